@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// --- Деактивация и Удаление Аккаунта ---
+
+// deactivationGracePeriod - сколько деактивированный аккаунт можно восстановить входом,
+// после этого purgeDeactivatedAccounts удаляет его окончательно.
+const deactivationGracePeriod = 30 * 24 * time.Hour
+
+// ErrAccountDeleted возвращается при входе в аккаунт, срок восстановления которого истек.
+var ErrAccountDeleted = errors.New("аккаунт удален")
+
+// deactivated сообщает, деактивирован ли аккаунт.
+func (u UserData) deactivated() bool {
+	return !u.DeactivatedAt.IsZero()
+}
+
+// purgeDue сообщает, истек ли к моменту now срок восстановления деактивированного аккаунта.
+func (u UserData) purgeDue(now time.Time) bool {
+	return u.deactivated() && !now.Before(u.DeactivatedAt.Add(deactivationGracePeriod))
+}
+
+// reactivateAccount снимает деактивацию при успешном входе. Вызывается после всех проверок
+// (пароль, 2FA, OIDC) непосредственно перед созданием сессии.
+func reactivateAccount(r *http.Request, user UserData) (UserData, error) {
+	if !user.deactivated() {
+		return user, nil
+	}
+	if user.purgeDue(time.Now()) {
+		return user, ErrAccountDeleted
+	}
+	user.DeactivatedAt = time.Time{}
+	if err := userStore.Update(user); err != nil {
+		return user, err
+	}
+	hub.showUser <- user.ID
+	audit(AuditEvent{Event: "account_reactivated", UserID: user.ID, IP: clientIP(r)})
+	return user, nil
+}
+
+// signOutEverywhere завершает все сессии и API-токены пользователя (с закрытием их соединений чата)
+// и гасит выданные ему одноразовые ссылки.
+func signOutEverywhere(userID string) error {
+	if _, err := revokeUserSessions(userID, ""); err != nil {
+		return err
+	}
+	tokens, err := apiTokenStore.ListByUser(userID)
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		ids = append(ids, token.ID)
+	}
+	if err := revokeAPITokens(ids...); err != nil {
+		return err
+	}
+	for _, purpose := range []string{passwordResetPurpose, emailChangeUndoPurpose} {
+		if err := oneTimeTokenStore.DeleteForUser(purpose, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteAccount безвозвратно удаляет пользователя: сессии, токены, файлы в папке загрузок,
+// архивы выгрузки, незавершенные загрузки, посты, сообщения в истории чата и саму запись.
+func deleteAccount(user UserData) error {
+	if err := signOutEverywhere(user.ID); err != nil {
+		return fmt.Errorf("отзыв сессий: %w", err)
+	}
+	hub.removeUser <- user.ID
+
+	if err := userStore.Delete(user.ID); err != nil && err != ErrUserNotFound {
+		return err
+	}
+	removeUserExports(user.ID)
+	if err := removeUserResumableUploads(user.ID); err != nil {
+		log.Printf("❌ Ошибка удаления незавершенных загрузок %s: %v", user.ID, err)
+	}
+	if err := removeUserPosts(user.ID); err != nil {
+		log.Printf("❌ Ошибка удаления постов %s: %v", user.ID, err)
+	}
+	// Файлы могут быть общими с другими пользователями: снимаем ссылки, удалит сборщик
+	releaseMedia(user.photoFiles()...)
+
+	log.Printf("🗑️ Аккаунт %s (@%s) удален", user.ID, user.Handle)
+	return nil
+}
+
+// userUploadFiles возвращает ключи файлов фото профиля пользователя в хранилище загрузок: текущее
+// фото с превью. Файлы называются по хешу содержимого и могут быть общими с другими пользователями,
+// поэтому владение определяется ссылками из профиля, а не именем файла (см. media.go).
+// Превью маленького фото совпадают между собой, каждый ключ возвращается один раз.
+func userUploadFiles(user UserData) []string {
+	var keys []string
+	seen := map[string]bool{}
+	for _, photoPath := range user.photoFiles() {
+		if key, ok := uploadKey(photoPath); ok && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// purgeDeactivatedAccounts периодически удаляет аккаунты, чей срок восстановления истек.
+func purgeDeactivatedAccounts(interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, err := purgeDueAccounts(time.Now()); err != nil {
+			log.Printf("❌ Ошибка чтения пользователей для очистки: %v", err)
+		}
+	}
+}
+
+// purgeDueAccounts удаляет аккаунты, чей срок восстановления истек к моменту now,
+// и возвращает их число.
+func purgeDueAccounts(now time.Time) (int, error) {
+	users, err := userStore.List()
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, user := range users {
+		if !user.purgeDue(now) {
+			continue
+		}
+		// Снимок List мог устареть: пока шла очистка, владелец мог войти и восстановить аккаунт
+		current, err := userStore.GetByID(user.ID)
+		if err != nil || !current.purgeDue(now) {
+			continue
+		}
+		if err := deleteAccount(current); err != nil {
+			log.Printf("❌ Ошибка удаления деактивированного аккаунта %s: %v", current.ID, err)
+			continue
+		}
+		audit(AuditEvent{Event: "account_purged", UserID: current.ID})
+		purged++
+	}
+	return purged, nil
+}
+
+// =======================================================================
+// Обработчики
+// =======================================================================
+
+// accountActionRequest - тело запросов деактивации и удаления.
+type accountActionRequest struct {
+	CurrentPassword string `json:"current_password"`
+	Confirm         string `json:"confirm"` // Для удаления - текущий хендл пользователя
+}
+
+// readAccountAction проверяет метод, разбирает тело и подтверждение личности.
+// При ошибке сам пишет ответ и возвращает ok == false.
+func readAccountAction(w http.ResponseWriter, r *http.Request) (UserData, accountActionRequest, bool) {
+	var body accountActionRequest
+	if r.Method != http.MethodPost {
+		http.Error(w, "Допустим только метод POST", http.StatusMethodNotAllowed)
+		return UserData{}, body, false
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Неверный формат JSON в теле запроса", http.StatusBadRequest)
+		return UserData{}, body, false
+	}
+
+	userData, err := userStore.GetByID(r.Context().Value(userContextKey).(string))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Пользователь не найден", "status": "error"})
+		return UserData{}, body, false
+	}
+	if !reauthenticated(r, userData, body.CurrentPassword) {
+		writeReauthRequired(w, userData, "Введите текущий пароль")
+		return UserData{}, body, false
+	}
+	return userData, body, true
+}
+
+// deactivateAccountHandler скрывает аккаунт: POST /user/deactivate {"current_password": "..."}
+// Профиль и сообщения скрываются, все сессии завершаются. Вход в течение
+// deactivationGracePeriod восстанавливает аккаунт вместе с историей чата, иначе он удаляется.
+func deactivateAccountHandler(w http.ResponseWriter, r *http.Request) {
+	userData, _, ok := readAccountAction(w, r)
+	if !ok {
+		return
+	}
+
+	userData.DeactivatedAt = time.Now()
+	if err := userStore.Update(userData); err != nil {
+		log.Printf("❌ Ошибка деактивации аккаунта %s: %v", userData.ID, err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if err := signOutEverywhere(userData.ID); err != nil {
+		log.Printf("❌ Ошибка завершения сессий %s: %v", userData.ID, err)
+	}
+	hub.hideUser <- userData.ID
+	clearSessionCookie(w)
+
+	purgeAt := userData.DeactivatedAt.Add(deactivationGracePeriod)
+	audit(AuditEvent{Event: "account_deactivated", UserID: userData.ID, IP: clientIP(r)})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message":  fmt.Sprintf("Аккаунт деактивирован. Войдите до %s, чтобы восстановить его.", purgeAt.Format("02.01.2006")),
+		"purge_at": purgeAt.Format(time.RFC3339),
+		"status":   "success",
+	})
+}
+
+// deleteAccountHandler удаляет аккаунт немедленно:
+// POST /user/delete {"current_password": "...", "confirm": "<хендл>"}
+func deleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	userData, body, ok := readAccountAction(w, r)
+	if !ok {
+		return
+	}
+	if normalizeHandle(body.Confirm) != userData.Handle {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Для подтверждения введите свой хендл", "status": "error"})
+		return
+	}
+
+	if err := deleteAccount(userData); err != nil {
+		log.Printf("❌ Ошибка удаления аккаунта %s: %v", userData.ID, err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	clearSessionCookie(w)
+	audit(AuditEvent{Event: "account_deleted", UserID: userData.ID, IP: clientIP(r)})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Аккаунт удален", "status": "success"})
+}
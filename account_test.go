@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// chatHistoryOf подключает к хабу наблюдателя и возвращает, сколько сообщений пользователя userID
+// он получил в истории.
+func chatHistoryOf(t *testing.T, userID string) int {
+	t.Helper()
+	observer := &Client{send: make(chan []byte, 1), user: UserData{ID: "observer-id"}}
+	hub.register <- observer
+	hub.allMessages() // Хаб обработал регистрацию и уже отправил историю
+	defer func() { hub.unregister <- observer }()
+
+	var history struct {
+		Data []Message `json:"data"`
+	}
+	select {
+	case raw := <-observer.send:
+		if err := json.Unmarshal(raw, &history); err != nil {
+			t.Fatalf("история: %v", err)
+		}
+	default:
+	}
+	n := 0
+	for _, msg := range history.Data {
+		if msg.UserID == userID {
+			n++
+		}
+	}
+	return n
+}
+
+func TestChatHistoryHiddenWhileDeactivated(t *testing.T) {
+	alice := &Client{send: make(chan []byte, 16), user: UserData{ID: "chat-alice-id", Username: "Alice", EmailVerified: true}}
+	hub.register <- alice
+	hub.incoming <- incomingMessage{client: alice, text: "привет"}
+
+	steps := []struct {
+		name string
+		send chan string
+		want int
+	}{
+		{"деактивация скрывает сообщения", hub.hideUser, 0},
+		{"восстановление возвращает их", hub.showUser, 1},
+		{"удаление стирает историю", hub.removeUser, 0},
+		{"после удаления восстанавливать нечего", hub.showUser, 0},
+	}
+	for _, step := range steps {
+		step.send <- alice.user.ID
+		if got := chatHistoryOf(t, alice.user.ID); got != step.want {
+			t.Errorf("%s: в истории %d сообщений, ожидалось %d", step.name, got, step.want)
+		}
+	}
+	if stored := hub.userMessages(alice.user.ID); len(stored) != 0 {
+		t.Errorf("после удаления в истории осталось %d сообщений", len(stored))
+	}
+}
+
+func TestPurgeDueAccounts(t *testing.T) {
+	useMemoryStores()
+	now := time.Now()
+	users := []struct {
+		user       UserData
+		wantPurged bool
+	}{
+		{UserData{ID: "active-id", Email: "active@example.com", Handle: "active"}, false},
+		{UserData{ID: "recent-id", Email: "recent@example.com", Handle: "recent", DeactivatedAt: now.Add(-time.Hour)}, false},
+		{UserData{ID: "due-id", Email: "due@example.com", Handle: "due", DeactivatedAt: now.Add(-deactivationGracePeriod - time.Hour)}, true},
+	}
+	for _, tc := range users {
+		if err := userStore.Create(tc.user); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+
+	if n, err := purgeDueAccounts(now); err != nil || n != 1 {
+		t.Errorf("purgeDueAccounts = %d, %v, ожидалось 1", n, err)
+	}
+	for _, tc := range users {
+		if _, err := userStore.GetByID(tc.user.ID); (err == ErrUserNotFound) != tc.wantPurged {
+			t.Errorf("%s: удален = %v, ожидалось %v", tc.user.ID, err == ErrUserNotFound, tc.wantPurged)
+		}
+	}
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// --- Персональные API-Токены ---
+//
+// Токены нужны скриптам и ботам: они передаются в заголовке Authorization: Bearer <token>
+// и действуют только на маршрутах, явно помеченных нужным правом (см. apiScope).
+
+const (
+	// apiTokenPrefix помогает узнать токен в логах и конфигах (и найти его сканерами секретов).
+	apiTokenPrefix = "cig_"
+	// apiTokenDefaultTTL и apiTokenMaxTTL - срок действия токена по умолчанию и максимальный.
+	apiTokenDefaultTTL = 90 * 24 * time.Hour
+	apiTokenMaxTTL     = 365 * 24 * time.Hour
+	// apiTokenMaxPerUser - сколько токенов может быть у одного пользователя.
+	apiTokenMaxPerUser = 20
+)
+
+// Права (scopes) API-токенов.
+const (
+	scopeProfileRead = "profile:read"
+	scopeChatWrite   = "chat:write"
+	scopeMediaUpload = "media:upload"
+)
+
+// apiScopes - все допустимые права с описанием для интерфейса.
+var apiScopes = map[string]string{
+	scopeProfileRead: "Чтение профиля",
+	scopeChatWrite:   "Сообщения в чате",
+	scopeMediaUpload: "Загрузка фото и посты",
+}
+
+// ErrAPITokenNotFound возвращается, если токен отсутствует, отозван или истек.
+var ErrAPITokenNotFound = errors.New("API-токен не найден")
+
+// APIToken - серверная запись персонального токена. Как и у сессий, хранится только
+// SHA-256 токена (ID), сам токен показывается пользователю один раз при создании.
+type APIToken struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"user_id"`
+	Name       string    `json:"name"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	LastUsedIP string    `json:"last_used_ip"`
+}
+
+// expired сообщает, истек ли токен к моменту now.
+func (t APIToken) expired(now time.Time) bool {
+	return !now.Before(t.ExpiresAt)
+}
+
+// hasScope сообщает, выдано ли токену право scope.
+func (t APIToken) hasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// APITokenStore описывает хранилище API-токенов.
+type APITokenStore interface {
+	// Create сохраняет новый токен.
+	Create(token APIToken) error
+	// Get возвращает токен по ID (хешу токена).
+	Get(id string) (APIToken, error)
+	// Update перезаписывает существующий токен (время последнего использования).
+	Update(token APIToken) error
+	// Delete отзывает токен.
+	Delete(id string) error
+	// ListByUser возвращает все токены пользователя.
+	ListByUser(userID string) ([]APIToken, error)
+	// DeleteExpired удаляет все токены, истекшие к моменту now.
+	DeleteExpired(now time.Time) (int, error)
+}
+
+// apiTokenStore - активное хранилище API-токенов, инициализируется в initStorage().
+var apiTokenStore APITokenStore
+
+// bearerToken возвращает токен из заголовка Authorization: Bearer (пустую строку, если его нет).
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// resolveAPIToken находит действующий токен и отмечает его использование.
+func resolveAPIToken(r *http.Request, token string) (APIToken, error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return APIToken{}, ErrAPITokenNotFound
+	}
+	apiToken, err := apiTokenStore.Get(hashToken(token))
+	if err != nil {
+		return APIToken{}, err
+	}
+
+	now := time.Now()
+	if apiToken.expired(now) {
+		return APIToken{}, ErrAPITokenNotFound
+	}
+
+	// Как и у сессий, пишем в базу не чаще раза в sessionTouchInterval
+	if now.Sub(apiToken.LastUsedAt) >= sessionTouchInterval {
+		apiToken.LastUsedAt = now
+		apiToken.LastUsedIP = clientIP(r)
+		if err := apiTokenStore.Update(apiToken); err != nil {
+			return APIToken{}, err
+		}
+	}
+	return apiToken, nil
+}
+
+// apiScope помечает маршрут правом, с которым на него пускают API-токены. Оборачивает authMiddleware:
+// без этой пометки authMiddleware отклоняет запросы с Bearer-токеном.
+func apiScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), apiScopeContextKey, scope)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// revokeAPITokens удаляет токены и закрывает открытые через них соединения чата.
+func revokeAPITokens(ids ...string) error {
+	for _, id := range ids {
+		if err := apiTokenStore.Delete(id); err != nil {
+			return err
+		}
+	}
+	if len(ids) > 0 {
+		hub.closeSessions <- ids
+	}
+	return nil
+}
+
+// purgeExpiredAPITokens периодически удаляет истекшие API-токены.
+func purgeExpiredAPITokens(interval time.Duration) {
+	for range time.Tick(interval) {
+		if n, err := apiTokenStore.DeleteExpired(time.Now()); err != nil {
+			log.Printf("❌ Ошибка очистки API-токенов: %v", err)
+		} else if n > 0 {
+			log.Printf("🧹 Удалено истекших API-токенов: %d", n)
+		}
+	}
+}
+
+// =======================================================================
+// Обработчики API токенов (/user/tokens)
+// =======================================================================
+
+// apiTokensHandler: GET /user/tokens - список токенов, POST /user/tokens - создание нового:
+// {"name": "...", "scopes": ["profile:read"], "expires_in_days": 30, "password": "..."}
+func apiTokensHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listAPITokens(w, r)
+	case http.MethodPost:
+		createAPIToken(w, r)
+	default:
+		http.Error(w, "Допустимы только методы GET и POST", http.StatusMethodNotAllowed)
+	}
+}
+
+func listAPITokens(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	userID := r.Context().Value(userContextKey).(string)
+
+	tokens, err := apiTokenStore.ListByUser(userID)
+	if err != nil {
+		log.Printf("❌ Ошибка получения API-токенов %s: %v", userID, err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.After(tokens[j].CreatedAt) })
+
+	now := time.Now()
+	list := make([]map[string]interface{}, 0, len(tokens))
+	for _, token := range tokens {
+		if token.expired(now) {
+			continue
+		}
+		item := map[string]interface{}{
+			"id":         token.ID,
+			"name":       token.Name,
+			"scopes":     token.Scopes,
+			"created_at": token.CreatedAt,
+			"expires_at": token.ExpiresAt,
+			"last_used":  nil,
+		}
+		if !token.LastUsedAt.IsZero() {
+			item["last_used"] = token.LastUsedAt
+			item["last_used_ip"] = token.LastUsedIP
+		}
+		list = append(list, item)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"tokens": list, "scopes": apiScopes, "status": "success"})
+}
+
+func createAPIToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	userID := r.Context().Value(userContextKey).(string)
+
+	var body struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+		Password      string   `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Неверный формат JSON в теле запроса", http.StatusBadRequest)
+		return
+	}
+
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" || len([]rune(body.Name)) > 64 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Название токена должно быть от 1 до 64 символов", "status": "error"})
+		return
+	}
+	if len(body.Scopes) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Выберите хотя бы одно право", "status": "error"})
+		return
+	}
+	scopes := make([]string, 0, len(body.Scopes))
+	seen := make(map[string]bool)
+	for _, scope := range body.Scopes {
+		if _, ok := apiScopes[scope]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": "Неизвестное право: " + scope, "status": "error"})
+			return
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	ttl := apiTokenDefaultTTL
+	if body.ExpiresInDays != 0 {
+		ttl = time.Duration(body.ExpiresInDays) * 24 * time.Hour
+		if ttl <= 0 || ttl > apiTokenMaxTTL {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": "Срок действия - от 1 до 365 дней", "status": "error"})
+			return
+		}
+	}
+
+	userData, err := userStore.GetByID(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Пользователь не найден", "status": "error"})
+		return
+	}
+	// Токен - долгоживущий доступ к аккаунту, поэтому выпуск требует подтверждения личности
+	if !reauthenticated(r, userData, body.Password) {
+		writeReauthRequired(w, userData, "Введите текущий пароль")
+		return
+	}
+
+	existing, err := apiTokenStore.ListByUser(userID)
+	if err != nil {
+		log.Printf("❌ Ошибка получения API-токенов %s: %v", userID, err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if len(existing) >= apiTokenMaxPerUser {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Слишком много токенов: отзовите ненужные", "status": "error"})
+		return
+	}
+
+	secret, err := generateSessionID()
+	if err != nil {
+		log.Printf("❌ Ошибка генерации API-токена: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	plain := apiTokenPrefix + secret
+	now := time.Now()
+	token := APIToken{
+		ID:        hashToken(plain),
+		UserID:    userID,
+		Name:      body.Name,
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	if err := apiTokenStore.Create(token); err != nil {
+		log.Printf("❌ Ошибка сохранения API-токена: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🔑 Пользователь %s создал API-токен %q (%s)", userID, token.Name, strings.Join(scopes, ", "))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":    "Токен создан. Скопируйте его сейчас - позже его нельзя будет посмотреть.",
+		"id":         token.ID,
+		"token":      plain,
+		"name":       token.Name,
+		"scopes":     token.Scopes,
+		"expires_at": token.ExpiresAt,
+		"status":     "success",
+	})
+}
+
+// revokeAPITokenHandler отзывает токен текущего пользователя: POST /user/tokens/revoke {"id": "..."}
+func revokeAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Допустим только метод POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Context().Value(userContextKey).(string)
+
+	var body struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Не указан ID токена", "status": "error"})
+		return
+	}
+
+	// Можно отзывать только свои токены
+	token, err := apiTokenStore.Get(body.ID)
+	if err != nil || token.UserID != userID {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Токен не найден", "status": "error"})
+		return
+	}
+
+	if err := revokeAPITokens(token.ID); err != nil {
+		log.Printf("❌ Ошибка отзыва API-токена: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🔒 Пользователь %s отозвал API-токен %q", userID, token.Name)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Токен отозван", "status": "success"})
+}
+
+// =======================================================================
+// Хранилище API-токенов в памяти
+// =======================================================================
+
+type memoryAPITokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]APIToken
+}
+
+func newMemoryAPITokenStore() *memoryAPITokenStore {
+	return &memoryAPITokenStore{tokens: make(map[string]APIToken)}
+}
+
+func (s *memoryAPITokenStore) Create(token APIToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[token.ID] = token
+	return nil
+}
+
+func (s *memoryAPITokenStore) Get(id string) (APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, exists := s.tokens[id]
+	if !exists {
+		return APIToken{}, ErrAPITokenNotFound
+	}
+	return token, nil
+}
+
+func (s *memoryAPITokenStore) Update(token APIToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.tokens[token.ID]; !exists {
+		return ErrAPITokenNotFound
+	}
+	s.tokens[token.ID] = token
+	return nil
+}
+
+func (s *memoryAPITokenStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, id)
+	return nil
+}
+
+func (s *memoryAPITokenStore) ListByUser(userID string) ([]APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]APIToken, 0)
+	for _, token := range s.tokens {
+		if token.UserID == userID {
+			list = append(list, token)
+		}
+	}
+	return list, nil
+}
+
+func (s *memoryAPITokenStore) DeleteExpired(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for id, token := range s.tokens {
+		if token.expired(now) {
+			delete(s.tokens, id)
+			count++
+		}
+	}
+	return count, nil
+}
+
+// =======================================================================
+// Хранилище API-токенов на диске (bbolt)
+// =======================================================================
+
+var apiTokensBucket = []byte("api_tokens")
+
+type boltAPITokenStore struct {
+	db *bolt.DB
+}
+
+func newBoltAPITokenStore(db *bolt.DB) (*boltAPITokenStore, error) {
+	if err := createBuckets(db, apiTokensBucket); err != nil {
+		return nil, err
+	}
+	return &boltAPITokenStore{db: db}, nil
+}
+
+func (s *boltAPITokenStore) Create(token APIToken) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx.Bucket(apiTokensBucket), token.ID, token)
+	})
+}
+
+func (s *boltAPITokenStore) Get(id string) (APIToken, error) {
+	var token APIToken
+	err := s.db.View(func(tx *bolt.Tx) error {
+		found, err := boltGet(tx.Bucket(apiTokensBucket), id, &token)
+		if err == nil && !found {
+			err = ErrAPITokenNotFound
+		}
+		return err
+	})
+	return token, err
+}
+
+func (s *boltAPITokenStore) Update(token APIToken) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(apiTokensBucket)
+		if b.Get([]byte(token.ID)) == nil {
+			return ErrAPITokenNotFound
+		}
+		return boltPut(b, token.ID, token)
+	})
+}
+
+func (s *boltAPITokenStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(apiTokensBucket).Delete([]byte(id))
+	})
+}
+
+func (s *boltAPITokenStore) ListByUser(userID string) ([]APIToken, error) {
+	list := make([]APIToken, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return forEachAPIToken(tx.Bucket(apiTokensBucket), func(token APIToken) error {
+			if token.UserID == userID {
+				list = append(list, token)
+			}
+			return nil
+		})
+	})
+	return list, err
+}
+
+func (s *boltAPITokenStore) DeleteExpired(now time.Time) (int, error) {
+	count := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(apiTokensBucket)
+		return forEachAPIToken(b, func(token APIToken) error {
+			if !token.expired(now) {
+				return nil
+			}
+			count++
+			return b.Delete([]byte(token.ID))
+		})
+	})
+	return count, err
+}
+
+// forEachAPIToken вызывает fn для каждого токена; токены читаются заранее, поэтому fn может их удалять.
+func forEachAPIToken(b *bolt.Bucket, fn func(APIToken) error) error {
+	var tokens []APIToken
+	err := b.ForEach(func(_, data []byte) error {
+		var token APIToken
+		if err := json.Unmarshal(data, &token); err != nil {
+			return err
+		}
+		tokens = append(tokens, token)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		if err := fn(token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
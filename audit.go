@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// --- Журнал Аудита ---
+
+// AuditEvent - запись журнала аудита о событии безопасности (блокировка входа и т.п.).
+type AuditEvent struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Key     string    `json:"key,omitempty"` // Ключ ограничителя: ip:..., account:...
+	UserID  string    `json:"user_id,omitempty"`
+	IP      string    `json:"ip,omitempty"`
+	Details string    `json:"details,omitempty"`
+}
+
+var (
+	auditMu   sync.Mutex
+	auditFile *os.File
+)
+
+// initAuditLog открывает файл журнала аудита (JSON Lines, только дозапись).
+func initAuditLog() {
+	if err := os.MkdirAll(filepath.Dir(auditLogPath), 0700); err != nil {
+		log.Fatalf("❌ Не удалось создать папку журнала аудита: %v", err)
+	}
+	f, err := os.OpenFile(auditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Fatalf("❌ Не удалось открыть журнал аудита: %v", err)
+	}
+	auditFile = f
+	log.Printf("📝 Журнал аудита: %s", auditLogPath)
+}
+
+// audit записывает событие в журнал аудита и дублирует его в лог сервера.
+func audit(event AuditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	log.Printf("🛡️ Аудит: %s %s %s", event.Event, event.Key, event.Details)
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("❌ Ошибка записи в журнал аудита: %v", err)
+		return
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditFile == nil {
+		return
+	}
+	if _, err := auditFile.Write(append(data, '\n')); err != nil {
+		log.Printf("❌ Ошибка записи в журнал аудита: %v", err)
+	}
+}
+
+// auditEventsForUser читает из журнала аудита все события пользователя (история входов и т.п.).
+func auditEventsForUser(userID string) ([]AuditEvent, error) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	events := make([]AuditEvent, 0)
+	f, err := os.Open(auditLogPath)
+	if os.IsNotExist(err) {
+		return events, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue // Поврежденная строка не должна ломать выгрузку
+		}
+		if event.UserID == userID {
+			events = append(events, event)
+		}
+	}
+	return events, scanner.Err()
+}
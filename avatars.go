@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"golang.org/x/image/draw"
+)
+
+// --- Превью Аватаров ---
+
+// avatarSizes - стороны квадратных превью фото профиля в пикселях.
+// Чат показывает аватары 32-56 px, профиль - 112 px, с запасом на экраны высокой плотности.
+var avatarSizes = []int{64, 150, 320}
+
+const (
+	// chatAvatarSize - превью для сообщений чата.
+	chatAvatarSize = 64
+	// defaultAvatarSize - превью, которое /user и /u/{handle} отдают без параметра size.
+	defaultAvatarSize = 320
+	// avatarJPEGQuality - качество превью. Превью всегда в JPEG: кодировщика WebP
+	// на чистом Go нет, а для маленьких картинок разница в размере невелика.
+	avatarJPEGQuality = 82
+)
+
+// photoURL возвращает путь к наименьшему превью не меньше size пикселей. Если такого нет
+// (size больше всех превью или фото загружено до их появления) - путь к оригиналу.
+func (u UserData) photoURL(size int) string {
+	best, bestSize := "", 0
+	for side, path := range u.PhotoVariants {
+		if side >= size && (bestSize == 0 || side < bestSize) {
+			best, bestSize = path, side
+		}
+	}
+	if best == "" {
+		return u.PhotoPath
+	}
+	return best
+}
+
+// photo возвращает текущее фото пользователя.
+func (u UserData) photo() profilePhoto {
+	return profilePhoto{Path: u.PhotoPath, Variants: u.PhotoVariants, TakenAt: u.PhotoTakenAt}
+}
+
+// photoFiles возвращает пути ко всем файлам текущего фото: оригиналу и превью.
+func (u UserData) photoFiles() []string {
+	return u.photo().files()
+}
+
+// setPhoto заменяет фото пользователя (оригинал, превью и метаданные).
+func (u *UserData) setPhoto(photo profilePhoto) {
+	u.PhotoPath = photo.Path
+	u.PhotoVariants = photo.Variants
+	u.PhotoTakenAt = photo.TakenAt
+}
+
+// requestedAvatarSize читает размер превью из параметра ?size=, по умолчанию defaultAvatarSize.
+func requestedAvatarSize(r *http.Request) int {
+	size, err := strconv.Atoi(r.URL.Query().Get("size"))
+	if err != nil || size < 1 {
+		return defaultAvatarSize
+	}
+	return size
+}
+
+// squareThumbnail вырезает из центра картинки квадрат и масштабирует его до size x size.
+// Маленькие картинки не увеличиваются. Прозрачные области заливаются белым (в JPEG нет альфа-канала).
+func squareThumbnail(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	side := min(bounds.Dx(), bounds.Dy())
+	crop := image.Rect(0, 0, side, side).Add(bounds.Min).Add(image.Pt((bounds.Dx()-side)/2, (bounds.Dy()-side)/2))
+
+	size = min(size, side)
+	thumb := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(thumb, thumb.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(thumb, thumb.Bounds(), img, crop, draw.Over, nil)
+	return thumb
+}
+
+// saveAvatarVariants сохраняет превью всех размеров. При ошибке ссылки на уже
+// сохраненные превью снимаются.
+func saveAvatarVariants(img image.Image) (map[int]string, error) {
+	variants := make(map[int]string, len(avatarSizes))
+	for _, size := range avatarSizes {
+		var out bytes.Buffer
+		if err := jpeg.Encode(&out, squareThumbnail(img, size), &jpeg.Options{Quality: avatarJPEGQuality}); err != nil {
+			releaseMedia(profilePhoto{Variants: variants}.files()...)
+			return nil, err
+		}
+		path, err := storeMedia(out.Bytes(), ".jpg")
+		if err != nil {
+			releaseMedia(profilePhoto{Variants: variants}.files()...)
+			return nil, err
+		}
+		variants[size] = path
+	}
+	return variants, nil
+}
+
+// processedUploadName - имена файлов, сохраненных через decodeUpload/encodeImage: SHA-256
+// содержимого или (до дедупликации) случайные 128 бит. Фото с другими именами загружены
+// до перекодирования и могут содержать EXIF и что угодно еще.
+var processedUploadName = regexp.MustCompile(`^/uploads/([0-9a-f]{64}|[0-9a-f]{32})\.(jpg|png)$`)
+
+// reprocessProfilePhotos прогоняет через обработку фото, загруженные до ее появления:
+// без превью всех размеров из avatarSizes или сохраненные как есть (с EXIF).
+// Запускается один раз при старте, в фоне.
+func reprocessProfilePhotos() {
+	users, err := userStore.List()
+	if err != nil {
+		log.Printf("❌ Ошибка чтения пользователей для обработки фото: %v", err)
+		return
+	}
+	processed := 0
+	for _, user := range users {
+		if _, uploaded := uploadKey(user.PhotoPath); !uploaded ||
+			(processedUploadName.MatchString(user.PhotoPath) && hasAllAvatarSizes(user)) {
+			continue
+		}
+		if err := reprocessProfilePhoto(user); err != nil {
+			log.Printf("⚠️ Не удалось обработать фото %s (%s): %v", user.ID, user.PhotoPath, err)
+			continue
+		}
+		processed++
+	}
+	if processed > 0 {
+		log.Printf("🖼️ Обработаны старые фото пользователей: %d", processed)
+	}
+}
+
+// hasAllAvatarSizes сообщает, есть ли у фото пользователя превью всех размеров из avatarSizes.
+func hasAllAvatarSizes(user UserData) bool {
+	for _, size := range avatarSizes {
+		if _, ok := user.PhotoVariants[size]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// reprocessProfilePhoto заново сохраняет текущее фото пользователя через saveProfilePhoto
+// и заменяет им старые файлы.
+func reprocessProfilePhoto(user UserData) error {
+	key, _ := uploadKey(user.PhotoPath)
+	original, _, err := blobStore.Get(key)
+	if err != nil {
+		return err
+	}
+	photo, err := saveProfilePhoto(original)
+	original.Close()
+	if err != nil {
+		return err
+	}
+
+	// Пока фото обрабатывалось, пользователь мог его сменить: перечитываем запись
+	current, err := userStore.GetByID(user.ID)
+	if err != nil || current.PhotoPath != user.PhotoPath {
+		releaseMedia(photo.files()...)
+		return err
+	}
+	oldFiles := current.photoFiles()
+	current.setPhoto(photo)
+	if err := userStore.Update(current); err != nil {
+		releaseMedia(photo.files()...)
+		return err
+	}
+	releaseMedia(oldFiles...)
+	hub.profileUpdate <- current.ID
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http/httptest"
+	"testing"
+)
+
+// stripes возвращает картинку width x height из трех равных полос: красной, зеленой и синей -
+// вертикальных для горизонтальной картинки и горизонтальных для вертикальной.
+func stripes(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	colors := []color.RGBA{{R: 255, A: 255}, {G: 255, A: 255}, {B: 255, A: 255}}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			stripe := x * 3 / width
+			if height > width {
+				stripe = y * 3 / height
+			}
+			img.SetRGBA(x, y, colors[stripe])
+		}
+	}
+	return img
+}
+
+// nearlyEqual сравнивает цвета с допуском на сглаживание и сжатие JPEG.
+func nearlyEqual(c color.Color, want color.RGBA) bool {
+	got := color.RGBAModel.Convert(c).(color.RGBA)
+	near := func(a, b uint8) bool { return int(a)-int(b) < 40 && int(b)-int(a) < 40 }
+	return near(got.R, want.R) && near(got.G, want.G) && near(got.B, want.B)
+}
+
+func TestSquareThumbnail(t *testing.T) {
+	green := color.RGBA{G: 255, A: 255}
+	// Та же картинка с координатами от (100, 50), как у вырезанной части другой картинки
+	shifted := stripes(900, 300).(*image.RGBA)
+	shifted.Rect = shifted.Rect.Add(image.Pt(100, 50))
+	tests := []struct {
+		name     string
+		img      image.Image
+		size     int
+		wantSide int
+	}{
+		{"горизонтальная", stripes(900, 300), 150, 150},
+		{"вертикальная", stripes(300, 900), 64, 64},
+		{"границы не от нуля", shifted, 320, 300},
+		{"меньше превью не увеличивается", stripes(180, 60), 320, 60},
+	}
+	for _, tc := range tests {
+		thumb := squareThumbnail(tc.img, tc.size)
+		bounds := thumb.Bounds()
+		if bounds.Dx() != tc.wantSide || bounds.Dy() != tc.wantSide {
+			t.Errorf("%s: размер %dx%d, ожидался %dx%d", tc.name, bounds.Dx(), bounds.Dy(), tc.wantSide, tc.wantSide)
+			continue
+		}
+		// Из центра вырезана средняя (зеленая) полоса
+		for _, pt := range []image.Point{{0, 0}, {bounds.Dx() - 1, bounds.Dy() - 1}, {bounds.Dx() / 2, bounds.Dy() / 2}} {
+			if c := thumb.At(bounds.Min.X+pt.X, bounds.Min.Y+pt.Y); !nearlyEqual(c, green) {
+				t.Errorf("%s: пиксель %v = %v, ожидалась середина картинки", tc.name, pt, c)
+			}
+		}
+	}
+
+	// Прозрачность заливается белым
+	transparent := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	if c := squareThumbnail(transparent, 64).At(5, 5); !nearlyEqual(c, color.RGBA{R: 255, G: 255, B: 255, A: 255}) {
+		t.Errorf("прозрачный пиксель превью: %v, ожидался белый", c)
+	}
+}
+
+func TestSaveAvatarVariants(t *testing.T) {
+	useTestMedia(t, newMemoryMediaStore())
+
+	variants, err := saveAvatarVariants(stripes(600, 200))
+	if err != nil {
+		t.Fatalf("saveAvatarVariants: %v", err)
+	}
+	wantSides := map[int]int{64: 64, 150: 150, 320: 200} // Картинка меньше 320 px не увеличивается
+	if len(variants) != len(wantSides) {
+		t.Fatalf("превью %v, ожидались размеры %v", variants, avatarSizes)
+	}
+	for size, side := range wantSides {
+		key, ok := uploadKey(variants[size])
+		if !ok {
+			t.Errorf("превью %d: путь %q", size, variants[size])
+			continue
+		}
+		body, info, err := blobStore.Get(key)
+		if err != nil {
+			t.Errorf("превью %d: %v", size, err)
+			continue
+		}
+		config, err := jpeg.DecodeConfig(body)
+		body.Close()
+		if err != nil || info.ContentType != "image/jpeg" || config.Width != side || config.Height != side {
+			t.Errorf("превью %d: %s %dx%d (%v), ожидался JPEG %dx%d", size, info.ContentType, config.Width, config.Height, err, side, side)
+		}
+	}
+}
+
+func TestPhotoURL(t *testing.T) {
+	user := UserData{PhotoPath: "/uploads/original.png", PhotoVariants: map[int]string{
+		64: "/uploads/64.jpg", 150: "/uploads/150.jpg", 320: "/uploads/320.jpg",
+	}}
+	tests := []struct {
+		name  string
+		query string
+		user  UserData
+		want  string
+	}{
+		{"без параметра - defaultAvatarSize", "", user, "/uploads/320.jpg"},
+		{"точный размер", "?size=150", user, "/uploads/150.jpg"},
+		{"ближайший больший", "?size=100", user, "/uploads/150.jpg"},
+		{"меньше всех превью", "?size=1", user, "/uploads/64.jpg"},
+		{"больше всех превью - оригинал", "?size=1000", user, "/uploads/original.png"},
+		{"ноль - defaultAvatarSize", "?size=0", user, "/uploads/320.jpg"},
+		{"не число - defaultAvatarSize", "?size=big", user, "/uploads/320.jpg"},
+		{"фото без превью", "?size=64", UserData{PhotoPath: "/uploads/old.png"}, "/uploads/old.png"},
+		{"без фото", "?size=64", UserData{}, ""},
+	}
+	for _, tc := range tests {
+		size := requestedAvatarSize(httptest.NewRequest("GET", "/user"+tc.query, nil))
+		if got := tc.user.photoURL(size); got != tc.want {
+			t.Errorf("%s: photoURL(%d) = %q, ожидался %q", tc.name, size, got, tc.want)
+		}
+	}
+	if got := user.photoURL(chatAvatarSize); got != "/uploads/64.jpg" {
+		t.Errorf("превью для чата: %q", got)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Хранилище Файлов (Blob Store) ---
+
+var (
+	// ErrBlobNotFound возвращается, если файла с таким ключом нет.
+	ErrBlobNotFound = errors.New("файл не найден")
+	// ErrInvalidBlobKey возвращается для ключей, которые могли бы выйти за пределы хранилища.
+	ErrInvalidBlobKey = errors.New("недопустимый ключ файла")
+	// ErrSignedURLUnsupported возвращается хранилищами без собственных внешних ссылок (локальный диск).
+	ErrSignedURLUnsupported = errors.New("хранилище не выдает подписанные ссылки")
+)
+
+// BlobInfo - сведения о сохраненном файле.
+type BlobInfo struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// BlobStore хранит загруженные файлы по плоским ключам (имя файла без каталогов).
+// Загрузки, удаление и раздача /uploads/ работают только через него, поэтому файлы
+// можно держать на диске одного сервера или в S3-совместимом хранилище (initBlobStore).
+type BlobStore interface {
+	// Put сохраняет файл размером size, перезаписывая существующий с тем же ключом.
+	Put(key string, r io.Reader, size int64, contentType string) error
+	// Get открывает файл на чтение. Если хранилище позволяет перемещаться по файлу,
+	// возвращенный поток реализует io.Seeker. Нет файла - ErrBlobNotFound.
+	Get(key string) (io.ReadCloser, BlobInfo, error)
+	// Delete удаляет файл. Отсутствие файла ошибкой не считается.
+	Delete(key string) error
+	// Stat возвращает сведения о файле. Нет файла - ErrBlobNotFound.
+	Stat(key string) (BlobInfo, error)
+	// SignedURL возвращает временную прямую ссылку на файл в хранилище
+	// или ErrSignedURLUnsupported, если хранилище их не выдает.
+	SignedURL(key string, ttl time.Duration) (string, error)
+	// List возвращает все файлы хранилища (ContentType не заполняется).
+	List() ([]BlobInfo, error)
+}
+
+// blobStore - активное хранилище загрузок, инициализируется в initBlobStore().
+var blobStore BlobStore
+
+// blobRedirectTTL - срок подписанных ссылок, на которые /uploads/ перенаправляет при BLOB_REDIRECT.
+const blobRedirectTTL = 15 * time.Minute
+
+// redirectUploads - отдавать ли /uploads/ редиректом на подписанную ссылку хранилища,
+// чтобы файлы шли клиентам напрямую, а не через сервер (BLOB_REDIRECT).
+var redirectUploads bool
+
+// initBlobStore создает хранилище загрузок согласно blobStoreKind.
+func initBlobStore() {
+	var err error
+	if redirectUploads, err = strconv.ParseBool(blobRedirect); err != nil {
+		log.Fatalf("❌ Неверное значение BLOB_REDIRECT: %q", blobRedirect)
+	}
+
+	switch blobStoreKind {
+	case "local":
+		if blobStore, err = newLocalBlobStore(uploadDir); err != nil {
+			log.Fatalf("❌ Не удалось создать директорию загрузок: %v", err)
+		}
+		if redirectUploads {
+			log.Printf("⚠️ BLOB_REDIRECT не действует для локального хранилища: файлы отдает сервер.")
+			redirectUploads = false
+		}
+		log.Printf("🗂️ Загрузки хранятся на диске: %s", uploadDir)
+	case "s3":
+		pathStyle, err := strconv.ParseBool(s3PathStyle)
+		if err != nil {
+			log.Fatalf("❌ Неверное значение S3_PATH_STYLE: %q", s3PathStyle)
+		}
+		store, err := newS3BlobStore(s3Config{
+			Endpoint:  s3Endpoint,
+			Region:    s3Region,
+			Bucket:    s3Bucket,
+			Prefix:    s3Prefix,
+			AccessKey: s3AccessKey,
+			SecretKey: s3SecretKey,
+			PathStyle: pathStyle,
+		})
+		if err != nil {
+			log.Fatalf("❌ Неверные настройки S3: %v", err)
+		}
+		blobStore = store
+		log.Printf("🗂️ Загрузки хранятся в S3: %s, бакет %s", s3Endpoint, s3Bucket)
+	default:
+		log.Fatalf("❌ Неизвестное хранилище BLOB_STORE=%q (local или s3)", blobStoreKind)
+	}
+}
+
+// validBlobKey проверяет, что ключ - простое имя файла: без каталогов и скрытых файлов.
+func validBlobKey(key string) bool {
+	return key != "" && !strings.ContainsAny(key, "/\\") && !strings.HasPrefix(key, ".")
+}
+
+// uploadKey возвращает ключ хранилища для URL загрузки (/uploads/{key}).
+func uploadKey(uploadURL string) (string, bool) {
+	key, found := strings.CutPrefix(uploadURL, "/uploads/")
+	return key, found && validBlobKey(key)
+}
+
+// =======================================================================
+// Локальный диск
+// =======================================================================
+
+// localBlobStore хранит файлы в папке на диске.
+type localBlobStore struct {
+	root string
+}
+
+func newLocalBlobStore(root string) (*localBlobStore, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &localBlobStore{root: root}, nil
+}
+
+func (s *localBlobStore) path(key string) (string, error) {
+	if !validBlobKey(key) {
+		return "", ErrInvalidBlobKey
+	}
+	return filepath.Join(s.root, key), nil
+}
+
+// Put пишет во временный файл и переименовывает его, чтобы читатели не видели файл наполовину.
+func (s *localBlobStore) Put(key string, r io.Reader, size int64, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.root, ".upload-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (s *localBlobStore) Get(key string) (io.ReadCloser, BlobInfo, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, BlobInfo{}, ErrBlobNotFound
+	} else if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	info, err := s.stat(key, f)
+	if err != nil {
+		f.Close()
+		return nil, BlobInfo{}, err
+	}
+	return f, info, nil
+}
+
+func (s *localBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *localBlobStore) Stat(key string) (BlobInfo, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return BlobInfo{}, ErrBlobNotFound
+	} else if err != nil {
+		return BlobInfo{}, err
+	}
+	defer f.Close()
+	return s.stat(key, f)
+}
+
+// stat собирает сведения об открытом файле. Тип на диске не хранится и определяется по содержимому.
+func (s *localBlobStore) stat(key string, f *os.File) (BlobInfo, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	if !fi.Mode().IsRegular() {
+		return BlobInfo{}, ErrBlobNotFound
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Key: key, Size: fi.Size(), ContentType: http.DetectContentType(head[:n]), ModTime: fi.ModTime()}, nil
+}
+
+// SignedURL: у локального диска нет внешнего адреса, файлы раздает uploadsHandler.
+func (s *localBlobStore) SignedURL(key string, ttl time.Duration) (string, error) {
+	return "", ErrSignedURLUnsupported
+}
+
+func (s *localBlobStore) List() ([]BlobInfo, error) {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+	blobs := make([]BlobInfo, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !validBlobKey(entry.Name()) {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			continue // Файл удалили между чтением папки и Stat
+		}
+		blobs = append(blobs, BlobInfo{Key: entry.Name(), Size: fi.Size(), ModTime: fi.ModTime()})
+	}
+	return blobs, nil
+}
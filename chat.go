@@ -12,14 +12,19 @@ import (
 
 // --- Настройки WebSocket ---
 var upgrader = websocket.Upgrader{
+	// Чужие страницы не должны открывать чат от имени наших пользователей (кука уходит с любого сайта)
 	CheckOrigin: func(r *http.Request) bool {
-		// В проде ограничь источники!
+		if !originAllowed(r) {
+			log.Printf("❌ WebSocket: отклонен источник %s", r.Header.Get("Origin"))
+			return false
+		}
 		return true
 	},
 }
 
 // Структура сообщения
 type Message struct {
+	UserID    string `json:"user_id"` // ID автора (имя и email могут меняться)
 	Username  string `json:"username"`
 	PhotoURL  string `json:"photo_url"`
 	Text      string `json:"text"`
@@ -33,27 +38,65 @@ type Client struct {
 	conn *websocket.Conn
 	send chan []byte
 	user UserData // Текущие данные пользователя (для отправки)
+	// sessionID - сессия (или API-токен), через которую открыто соединение (для удаленного выхода)
+	sessionID string
+}
+
+// incomingMessage - текст, полученный от клиента. Сообщение чата собирает хаб,
+// потому что только он владеет актуальными данными client.user.
+type incomingMessage struct {
+	client *Client
+	text   string
 }
 
 // Менеджер чата
 type ChatHub struct {
 	clients    map[*Client]bool
-	broadcast  chan []byte
+	incoming   chan incomingMessage
 	register   chan *Client
 	unregister chan *Client
 	// ✅ ДОБАВЛЕНО: Хранение истории сообщений в памяти
 	history []Message
 	// ✅ ДОБАВЛЕНО: Канал для обновления данных о пользователях
-	profileUpdate chan string // Канал для оповещения о смене Email
+	profileUpdate chan string // Канал для оповещения о смене профиля (передается ID пользователя)
+	// closeSessions получает ID отозванных сессий и API-токенов, чьи соединения нужно закрыть
+	closeSessions chan []string
+	// removeUser получает ID удаленного пользователя: его сообщения убираются из истории,
+	// соединения закрываются
+	removeUser chan string
+	// hideUser и showUser получают ID деактивированного и восстановленного пользователя:
+	// на время деактивации его соединения закрываются, а сообщения остаются в истории,
+	// но не показываются (hidden)
+	hideUser chan string
+	showUser chan string
+	hidden   map[string]bool
+	// historyRequests запрашивает из истории сообщения одного пользователя (для выгрузки данных)
+	// или все сообщения (для сборщика неиспользуемых файлов)
+	historyRequests chan historyRequest
+}
+
+// historyRequest - запрос сообщений пользователя userID (или всех при all) из истории;
+// ответ приходит в reply.
+type historyRequest struct {
+	userID string
+	all    bool
+	reply  chan []Message
 }
 
 var hub = ChatHub{
 	clients:       make(map[*Client]bool),
-	broadcast:     make(chan []byte),
+	incoming:      make(chan incomingMessage),
 	register:      make(chan *Client),
 	unregister:    make(chan *Client),
 	history:       make([]Message, 0), // Инициализация истории
 	profileUpdate: make(chan string),
+	closeSessions: make(chan []string),
+	removeUser:    make(chan string),
+	hideUser:      make(chan string),
+	showUser:      make(chan string),
+	hidden:        make(map[string]bool),
+
+	historyRequests: make(chan historyRequest),
 }
 
 // --- Запуск цикла хаба ---
@@ -62,13 +105,13 @@ func (h *ChatHub) run() {
 		select {
 		case client := <-h.register:
 			h.clients[client] = true
-			log.Printf("👤 %s подключился к чату (Email: %s)", client.user.Username, client.user.Email)
+			log.Printf("👤 %s подключился к чату (ID: %s)", client.user.Username, client.user.ID)
 
 			// ✅ ОТПРАВКА ИСТОРИИ НОВОМУ КЛИЕНТУ
-			if len(h.history) > 0 {
+			if visible := h.visibleHistory(); len(visible) > 0 {
 				historyMsg, _ := json.Marshal(map[string]interface{}{
 					"type": "history",
-					"data": h.history,
+					"data": visible,
 				})
 				client.send <- historyMsg
 			}
@@ -80,84 +123,194 @@ func (h *ChatHub) run() {
 				log.Printf("🚪 %s вышел из чата", client.user.Username)
 			}
 
-		case message := <-h.broadcast:
-			// ✅ СОХРАНЕНИЕ В ИСТОРИЮ
-			var msg Message
-			if err := json.Unmarshal(message, &msg); err == nil && msg.Type == "chat" {
-				h.history = append(h.history, msg)
-				// Ограничиваем историю, чтобы не занимать слишком много памяти
-				if len(h.history) > 100 {
-					h.history = h.history[1:]
-				}
+		case in := <-h.incoming:
+			client := in.client
+			if _, ok := h.clients[client]; !ok {
+				continue
 			}
 
-			// Рассылка всем клиентам
-			for client := range h.clients {
+			// Пока email не подтвержден, чат доступен только для чтения
+			if !client.user.EmailVerified {
+				notice, _ := json.Marshal(map[string]string{
+					"type":    "error",
+					"message": "Подтвердите email, чтобы отправлять сообщения",
+				})
 				select {
-				case client.send <- message:
+				case client.send <- notice:
 				default:
-					close(client.send)
+				}
+				continue
+			}
+
+			msg := Message{
+				UserID:    client.user.ID,
+				Username:  client.user.Username,
+				PhotoURL:  client.user.photoURL(chatAvatarSize),
+				Text:      in.text,
+				Timestamp: time.Now().Format("15:04"),
+				Type:      "chat", // ✅ ДОБАВЛЕНО: Тип сообщения
+			}
+
+			// ✅ СОХРАНЕНИЕ В ИСТОРИЮ
+			h.history = append(h.history, msg)
+			// Ограничиваем историю, чтобы не занимать слишком много памяти
+			if len(h.history) > 100 {
+				h.history = h.history[1:]
+			}
+
+			jsonMsg, _ := json.Marshal(msg)
+			h.sendAll(jsonMsg)
+
+		// Отзыв сессий: закрываем все соединения, открытые через них
+		case ids := <-h.closeSessions:
+			revoked := make(map[string]bool, len(ids))
+			for _, id := range ids {
+				revoked[id] = true
+			}
+			for client := range h.clients {
+				if revoked[client.sessionID] {
 					delete(h.clients, client)
+					close(client.send) // writePump завершится и закроет соединение
+					log.Printf("🔒 %s отключен от чата: сессия отозвана", client.user.Username)
+				}
+			}
+
+		// Пользователь удален: чистим историю и сообщаем клиентам, чьи сообщения убрать с экрана
+		case userID := <-h.removeUser:
+			kept := h.history[:0]
+			for _, msg := range h.history {
+				if msg.UserID != userID {
+					kept = append(kept, msg)
+				}
+			}
+			h.history = kept
+			delete(h.hidden, userID)
+			h.disconnectUser(userID)
+
+		// Пользователь деактивирован: история сохраняется, чтобы вернуться после восстановления
+		case userID := <-h.hideUser:
+			h.hidden[userID] = true
+			h.disconnectUser(userID)
+
+		// Аккаунт восстановлен: сообщения снова видны подключившимся клиентам
+		case userID := <-h.showUser:
+			delete(h.hidden, userID)
+
+		case req := <-h.historyRequests:
+			messages := make([]Message, 0)
+			for _, msg := range h.history {
+				if req.all || msg.UserID == req.userID {
+					messages = append(messages, msg)
 				}
 			}
+			req.reply <- messages
 
 		// ✅ ДОБАВЛЕНА ЛОГИКА ОБНОВЛЕНИЯ ПРОФИЛЯ
-		case oldEmail := <-h.profileUpdate:
-			mu.Lock()
-			newUserData, exists := users[oldEmail] // Пользователь был обновлен в handlers.go и теперь, возможно, имеет новый ключ
-			mu.Unlock()
-
-			if !exists {
-				// Если пользователь не найден по старому email, возможно, он теперь по новому.
-				// Проверяем всех клиентов, чтобы найти клиента с измененным профилем.
-				// (Этот блок может быть сложным, т.к. oldEmail может быть уже удален. Лучше искать по всем клиентам.)
-				// Оптимизация: Находим клиента по старому Email, обновляем его UserData и отправляем ему оповещение.
-
-				// Ищем клиента, который только что изменил профиль
-				for client := range h.clients {
-					// Мы ищем клиента, у которого в его структуре *Client остался старый Email
-					if client.user.Email == oldEmail {
-
-						// Находим обновленные данные (по новому или старому Email)
-						mu.Lock()
-						newUserData, exists := users[newUserData.Email] // newUserData.Email содержит актуальный Email
-						mu.Unlock()
-
-						if exists {
-							// Обновляем данные клиента в хабе
-							client.user = newUserData
-							log.Printf("🔄 Обновлены данные клиента %s в чате", client.user.Username)
-
-							// Отправляем всем сообщение об обновлении (например, для изменения имени в чате)
-							updateMsg, _ := json.Marshal(map[string]string{
-								"type":      "user_update",
-								"old_email": oldEmail,
-								"new_email": newUserData.Email,
-								"username":  newUserData.Username,
-								"photo_url": newUserData.PhotoPath,
-							})
-							h.broadcast <- updateMsg
-						}
-					}
+		case userID := <-h.profileUpdate:
+			// Пользователь уже обновлен в handlers.go, берем свежие данные по неизменному ID
+			newUserData, err := userStore.GetByID(userID)
+			if err != nil {
+				log.Printf("❌ Не удалось загрузить обновленный профиль %s: %v", userID, err)
+				continue
+			}
+
+			// Обновляем данные всех клиентов этого пользователя
+			updated := false
+			for client := range h.clients {
+				if client.user.ID == userID {
+					client.user = newUserData
+					updated = true
+					log.Printf("🔄 Обновлены данные клиента %s в чате", client.user.Username)
 				}
 			}
+
+			if updated {
+				// Отправляем всем сообщение об обновлении (например, для изменения имени в чате).
+				// Рассылаем напрямую: отправка в h.broadcast из этого же цикла заблокировала бы хаб.
+				updateMsg, _ := json.Marshal(map[string]string{
+					"type":      "user_update",
+					"user_id":   newUserData.ID,
+					"email":     newUserData.Email,
+					"username":  newUserData.Username,
+					"photo_url": newUserData.photoURL(chatAvatarSize),
+				})
+				h.sendAll(updateMsg)
+			}
+		}
+	}
+}
+
+// userMessages возвращает сообщения пользователя из истории чата. Вызывается вне цикла run().
+func (h *ChatHub) userMessages(userID string) []Message {
+	reply := make(chan []Message, 1)
+	h.historyRequests <- historyRequest{userID: userID, reply: reply}
+	return <-reply
+}
+
+// allMessages возвращает всю историю чата. Вызывается вне цикла run().
+func (h *ChatHub) allMessages() []Message {
+	reply := make(chan []Message, 1)
+	h.historyRequests <- historyRequest{all: true, reply: reply}
+	return <-reply
+}
+
+// visibleHistory возвращает историю без сообщений деактивированных пользователей.
+// Вызывается только из цикла run().
+func (h *ChatHub) visibleHistory() []Message {
+	if len(h.hidden) == 0 {
+		return h.history
+	}
+	visible := make([]Message, 0, len(h.history))
+	for _, msg := range h.history {
+		if !h.hidden[msg.UserID] {
+			visible = append(visible, msg)
+		}
+	}
+	return visible
+}
+
+// disconnectUser закрывает соединения пользователя и сообщает клиентам, чьи сообщения убрать
+// с экрана. Вызывается только из цикла run().
+func (h *ChatHub) disconnectUser(userID string) {
+	for client := range h.clients {
+		if client.user.ID == userID {
+			delete(h.clients, client)
+			close(client.send)
+		}
+	}
+	removedMsg, _ := json.Marshal(map[string]string{"type": "user_removed", "user_id": userID})
+	h.sendAll(removedMsg)
+}
+
+// sendAll рассылает сообщение всем клиентам, отключая тех, чей буфер переполнен.
+// Вызывается только из цикла run().
+func (h *ChatHub) sendAll(message []byte) {
+	for client := range h.clients {
+		select {
+		case client.send <- message:
+		default:
+			close(client.send)
+			delete(h.clients, client)
 		}
 	}
 }
 
 // --- WebSocket обработчик ---
 func chatHandler(w http.ResponseWriter, r *http.Request) {
-	email, ok := r.Context().Value(userContextKey).(string)
+	userID, ok := r.Context().Value(userContextKey).(string)
+	sessionID, _ := r.Context().Value(sessionContextKey).(string)
+	if tokenID, _ := r.Context().Value(apiTokenContextKey).(string); tokenID != "" {
+		// Соединение бота: закрывается при отзыве его API-токена
+		sessionID = tokenID
+	}
 	// ... (логика получения пользователя осталась прежней) ...
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	mu.Lock()
-	user, exists := users[email]
-	mu.Unlock()
-	if !exists {
+	user, err := userStore.GetByID(userID)
+	if err != nil {
 		http.Error(w, "User not found", http.StatusUnauthorized)
 		return
 	}
@@ -169,9 +322,10 @@ func chatHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	client := &Client{
-		conn: conn,
-		send: make(chan []byte, 256),
-		user: user,
+		conn:      conn,
+		send:      make(chan []byte, 256),
+		user:      user,
+		sessionID: sessionID,
 	}
 	hub.register <- client
 
@@ -200,16 +354,7 @@ func (c *Client) readPump() {
 			incoming = map[string]string{"text": string(msg)}
 		}
 
-		message := Message{
-			Username:  c.user.Username,
-			PhotoURL:  c.user.PhotoPath,
-			Text:      incoming["text"],
-			Timestamp: time.Now().Format("15:04"),
-			Type:      "chat", // ✅ ДОБАВЛЕНО: Тип сообщения
-		}
-
-		jsonMsg, _ := json.Marshal(message)
-		hub.broadcast <- jsonMsg
+		hub.incoming <- incomingMessage{client: c, text: incoming["text"]}
 	}
 }
 
@@ -228,6 +373,6 @@ func (c *Client) writePump() {
 // --- Регистрация маршрута ---
 func init() {
 	go hub.run()
-	http.HandleFunc("/ws", authMiddleware(chatHandler))
+	http.HandleFunc("/ws", apiScope(scopeChatWrite, authMiddleware(chatHandler)))
 	fmt.Println("💬 WebSocket чат доступен по адресу: ws://localhost:8080/ws")
 }
@@ -0,0 +1,293 @@
+// mock-oidc - тестовый провайдер OpenID Connect для локальной проверки входа через OIDC.
+//
+// Запуск:
+//
+//	go run ./cmd/mock-oidc -addr :9000
+//
+// и сервер приложения с переменными:
+//
+//	OIDC_PROVIDERS=mock OIDC_MOCK_ISSUER=http://localhost:9000 OIDC_MOCK_CLIENT_ID=clone-instagram \
+//	OIDC_MOCK_CLIENT_SECRET=secret OIDC_MOCK_NAME="Mock OIDC"
+//
+// Страница входа провайдера позволяет ввести любые sub, email и имя, а ?auto=1 в запросе
+// авторизации сразу выдает код (для скриптов).
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var (
+	addr         = flag.String("addr", ":9000", "адрес, на котором слушает провайдер")
+	issuer       = flag.String("issuer", "http://localhost:9000", "issuer (внешний адрес провайдера)")
+	clientID     = flag.String("client-id", "clone-instagram", "разрешенный client_id")
+	clientSecret = flag.String("client-secret", "secret", "client_secret (пустой - публичный клиент)")
+)
+
+// authCode - выданный код авторизации и все, что нужно для его обмена.
+type authCode struct {
+	RedirectURI   string
+	Challenge     string
+	Nonce         string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	AuthTime      time.Time // Когда "пользователь" прошел страницу входа
+	Expires       time.Time
+}
+
+var (
+	signingKey *rsa.PrivateKey
+	keyID      = "mock-key-1"
+
+	codesMu sync.Mutex
+	codes   = map[string]authCode{}
+)
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="ru"><head><meta charset="UTF-8"><title>Mock OIDC</title></head>
+<body style="font-family: sans-serif; max-width: 420px; margin: 40px auto;">
+<h2>Mock OIDC: вход</h2>
+<form method="POST">
+  {{range $k, $v := .Params}}<input type="hidden" name="{{$k}}" value="{{index $v 0}}">{{end}}
+  <p><label>sub<br><input name="sub" value="mock-user-1"></label></p>
+  <p><label>email<br><input name="email" value="mock@example.com"></label></p>
+  <p><label><input type="checkbox" name="email_verified" value="true" checked> email подтвержден</label></p>
+  <p><label>имя<br><input name="name" value="Mock User"></label></p>
+  <button type="submit">Войти</button>
+  <button type="submit" name="deny" value="1">Отказать</button>
+</form>
+</body></html>`))
+
+func main() {
+	flag.Parse()
+
+	var err error
+	if signingKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		log.Fatalf("❌ Не удалось создать ключ подписи: %v", err)
+	}
+
+	http.HandleFunc("/.well-known/openid-configuration", discoveryHandler)
+	http.HandleFunc("/authorize", authorizeHandler)
+	http.HandleFunc("/token", tokenHandler)
+	http.HandleFunc("/jwks", jwksHandler)
+
+	log.Printf("🧪 Mock OIDC: issuer %s, client_id %s", *issuer, *clientID)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                *issuer,
+		"authorization_endpoint":                *issuer + "/authorize",
+		"token_endpoint":                        *issuer + "/token",
+		"jwks_uri":                              *issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"scopes_supported":                      []string{"openid", "email", "profile"},
+	})
+}
+
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	pub := signingKey.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": keyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+// authorizeHandler показывает форму входа (GET) и выдает код (POST или GET с auto=1).
+func authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	params := r.Form
+
+	redirectURI := params.Get("redirect_uri")
+	if params.Get("client_id") != *clientID || redirectURI == "" {
+		http.Error(w, "неизвестный client_id или нет redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if params.Get("response_type") != "code" || params.Get("code_challenge_method") != "S256" || params.Get("code_challenge") == "" {
+		http.Error(w, "нужны response_type=code и PKCE S256", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodGet && params.Get("auto") != "1" {
+		// В скрытые поля формы переносим только параметры запроса авторизации
+		query := url.Values{}
+		for _, key := range []string{"client_id", "redirect_uri", "response_type", "scope", "state", "nonce", "code_challenge", "code_challenge_method", "prompt", "max_age"} {
+			if value := params.Get(key); value != "" {
+				query.Set(key, value)
+			}
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		loginPage.Execute(w, map[string]interface{}{"Params": query})
+		return
+	}
+
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "неверный redirect_uri", http.StatusBadRequest)
+		return
+	}
+	result := target.Query()
+	result.Set("state", params.Get("state"))
+
+	if params.Get("deny") == "1" {
+		result.Set("error", "access_denied")
+	} else {
+		code := randomString()
+		subject := params.Get("sub")
+		if subject == "" {
+			subject = "mock-user-1"
+		}
+		email := params.Get("email")
+		if email == "" && params.Get("auto") == "1" {
+			email = "mock@example.com"
+		}
+		codesMu.Lock()
+		codes[code] = authCode{
+			RedirectURI:   redirectURI,
+			Challenge:     params.Get("code_challenge"),
+			Nonce:         params.Get("nonce"),
+			Subject:       subject,
+			Email:         email,
+			EmailVerified: params.Get("email_verified") == "true" || params.Get("auto") == "1",
+			Name:          params.Get("name"),
+			AuthTime:      time.Now(), // Своей сессии у провайдера нет: каждый вход - заново
+			Expires:       time.Now().Add(time.Minute),
+		}
+		codesMu.Unlock()
+		result.Set("code", code)
+	}
+
+	target.RawQuery = result.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// tokenHandler обменивает код на ID-токен, проверяя клиента, redirect_uri и PKCE.
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "invalid_request"})
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	id, secret, hasBasic := r.BasicAuth()
+	if hasBasic {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if id != *clientID || secret != *clientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+
+	codesMu.Lock()
+	code, exists := codes[r.PostForm.Get("code")]
+	delete(codes, r.PostForm.Get("code"))
+	codesMu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case !exists || time.Now().After(code.Expires):
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "код недействителен"})
+		return
+	case code.RedirectURI != r.PostForm.Get("redirect_uri"):
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "redirect_uri не совпадает"})
+		return
+	case base64.RawURLEncoding.EncodeToString(verifier[:]) != code.Challenge:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "PKCE не пройден"})
+		return
+	}
+
+	now := time.Now()
+	idToken, err := signJWT(map[string]interface{}{
+		"iss":            *issuer,
+		"sub":            code.Subject,
+		"aud":            *clientID,
+		"iat":            now.Unix(),
+		"auth_time":      code.AuthTime.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"nonce":          code.Nonce,
+		"email":          code.Email,
+		"email_verified": code.EmailVerified,
+		"name":           code.Name,
+	})
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+// signJWT подписывает утверждения ключом провайдера (RS256).
+func signJWT(claims map[string]interface{}) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyID})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, signingKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,298 @@
+// mock-s3 - тестовое S3-совместимое хранилище в памяти для локальной проверки BLOB_STORE=s3.
+//
+// Запуск:
+//
+//	go run ./cmd/mock-s3 -addr :9001
+//
+// и сервер приложения с переменными:
+//
+//	BLOB_STORE=s3 S3_ENDPOINT=http://localhost:9001 S3_BUCKET=uploads \
+//	S3_ACCESS_KEY=mock-access S3_SECRET_KEY=mock-secret [BLOB_REDIRECT=true]
+//
+// Поддерживаются адреса вида /bucket/key (path-style), методы PUT, GET, HEAD и DELETE
+// и список объектов GET /bucket?list-type=2&prefix=... (ListObjectsV2, одной страницей).
+// Подпись AWS Signature Version 4 проверяется и в заголовке Authorization, и в подписанных
+// ссылках, поэтому ошибки подписи видны так же, как с настоящим S3 или MinIO.
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	addr      = flag.String("addr", ":9001", "адрес, на котором слушает хранилище")
+	accessKey = flag.String("access-key", "mock-access", "ключ доступа")
+	secretKey = flag.String("secret-key", "mock-secret", "секретный ключ")
+	region    = flag.String("region", "us-east-1", "регион")
+)
+
+const timeFormat = "20060102T150405Z"
+
+// object - сохраненный объект.
+type object struct {
+	Data        []byte
+	ContentType string
+	ModTime     time.Time
+}
+
+var (
+	objectsMu sync.Mutex
+	objects   = map[string]object{} // "bucket/key" -> объект
+)
+
+func main() {
+	flag.Parse()
+	http.HandleFunc("/", objectHandler)
+	log.Printf("🧪 Mock S3: %s, ключ %s, регион %s", *addr, *accessKey, *region)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: message})
+}
+
+// objectHandler обслуживает /bucket/key.
+func objectHandler(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	listing := key == "" && r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2"
+	if bucket == "" || (key == "" && !listing) {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", "ожидается адрес /bucket/key")
+		return
+	}
+
+	var body []byte
+	if r.Method == http.MethodPut {
+		var err error
+		if body, err = io.ReadAll(r.Body); err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+	}
+	if code, err := verifySignature(r, body); err != nil {
+		log.Printf("⛔ %s %s: %v", r.Method, r.URL.Path, err)
+		writeError(w, http.StatusForbidden, code, err.Error())
+		return
+	}
+
+	if listing {
+		listObjects(w, bucket, r.URL.Query().Get("prefix"))
+		return
+	}
+
+	name := bucket + "/" + key
+	switch r.Method {
+	case http.MethodPut:
+		objectsMu.Lock()
+		objects[name] = object{Data: body, ContentType: r.Header.Get("Content-Type"), ModTime: time.Now()}
+		objectsMu.Unlock()
+		log.Printf("📥 PUT %s (%d байт, %s)", name, len(body), r.Header.Get("Content-Type"))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet, http.MethodHead:
+		objectsMu.Lock()
+		obj, exists := objects[name]
+		objectsMu.Unlock()
+		if !exists {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "объект не найден")
+			return
+		}
+		sum := sha256.Sum256(obj.Data)
+		w.Header().Set("Content-Type", obj.ContentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.Data)))
+		w.Header().Set("Last-Modified", obj.ModTime.UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(obj.Data)
+		}
+	case http.MethodDelete:
+		objectsMu.Lock()
+		delete(objects, name)
+		objectsMu.Unlock()
+		log.Printf("🗑️ DELETE %s", name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
+
+// listObjects отвечает списком объектов бакета с префиксом prefix в формате ListObjectsV2.
+func listObjects(w http.ResponseWriter, bucket, prefix string) {
+	type content struct {
+		Key          string
+		Size         int
+		LastModified string
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []content
+	}{Name: bucket, Prefix: prefix}
+
+	objectsMu.Lock()
+	for name, obj := range objects {
+		key, found := strings.CutPrefix(name, bucket+"/")
+		if found && strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, content{Key: key, Size: len(obj.Data), LastModified: obj.ModTime.UTC().Format(time.RFC3339)})
+		}
+	}
+	objectsMu.Unlock()
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	result.KeyCount = len(result.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	xml.NewEncoder(w).Encode(result)
+}
+
+// verifySignature проверяет подпись SigV4 из заголовка Authorization или параметров подписанной ссылки.
+// Возвращает код ошибки S3 и описание.
+func verifySignature(r *http.Request, body []byte) (string, error) {
+	query := r.URL.Query()
+	var credential, signedHeaders, signature, amzDate, payloadHash string
+
+	if query.Get("X-Amz-Signature") != "" {
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		signature = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		payloadHash = "UNSIGNED-PAYLOAD"
+
+		signedAt, err := time.Parse(timeFormat, amzDate)
+		expires, err2 := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || err2 != nil {
+			return "AuthorizationQueryParametersError", fmt.Errorf("неверные X-Amz-Date или X-Amz-Expires")
+		}
+		if time.Now().After(signedAt.Add(time.Duration(expires) * time.Second)) {
+			return "AccessDenied", fmt.Errorf("срок действия ссылки истек")
+		}
+		query.Del("X-Amz-Signature")
+	} else {
+		auth, found := strings.CutPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+		if !found {
+			return "AccessDenied", fmt.Errorf("нет подписи AWS4-HMAC-SHA256")
+		}
+		for _, part := range strings.Split(auth, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			switch name {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				signature = value
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+		payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+
+		signedAt, err := time.Parse(timeFormat, amzDate)
+		if err != nil || time.Since(signedAt).Abs() > 15*time.Minute {
+			return "RequestTimeTooSkewed", fmt.Errorf("время запроса расходится с часами сервера")
+		}
+		if payloadHash != "UNSIGNED-PAYLOAD" {
+			sum := sha256.Sum256(body)
+			if hex.EncodeToString(sum[:]) != payloadHash {
+				return "XAmzContentSHA256Mismatch", fmt.Errorf("хеш тела не совпадает")
+			}
+		}
+	}
+
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[0] != *accessKey || parts[2] != *region || parts[3] != "s3" || parts[4] != "aws4_request" {
+		return "InvalidAccessKeyId", fmt.Errorf("неизвестный ключ или неверная область: %s", credential)
+	}
+	if !strings.HasPrefix(amzDate, parts[1]) {
+		return "SignatureDoesNotMatch", fmt.Errorf("дата подписи не совпадает с областью ключа")
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		escapePath(r.URL.Path),
+		canonicalQuery(query),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join(parts[1:], "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := []byte("AWS4" + *secretKey)
+	for _, part := range []string{parts[1], *region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	if !hmac.Equal([]byte(hex.EncodeToString(key)), []byte(signature)) {
+		return "SignatureDoesNotMatch", fmt.Errorf("подпись не совпадает, канонический запрос:\n%s", canonicalRequest)
+	}
+	return "", nil
+}
+
+// escape кодирует строку по правилам SigV4: все, кроме A-Z a-z 0-9 - _ . ~, в %XX.
+func escape(value string) string {
+	var b bytes.Buffer
+	for _, c := range []byte(value) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, escape(key)+"="+escape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// --- Конфигурация через переменные окружения ---
+
+// getEnv возвращает значение переменной окружения или значение по умолчанию.
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+var (
+	// storageKind выбирает реализацию хранилищ: "bolt" (на диске) или "memory".
+	storageKind = getEnv("STORAGE", "bolt")
+	// dbPath - путь к файлу встроенной базы данных bbolt.
+	dbPath = getEnv("DB_PATH", "data/clone_instagram.db")
+
+	// appBaseURL - внешний адрес сервера, используется в ссылках из писем.
+	appBaseURL = getEnv("APP_BASE_URL", "http://localhost:8080")
+	// appSecretPath - файл с секретом для подписи токенов (создается автоматически,
+	// если секрет не задан через APP_SECRET).
+	appSecretPath = getEnv("APP_SECRET_FILE", "data/app_secret")
+	// allowedOrigins - источники (через запятую), которым кроме самого сервера разрешено
+	// отправлять изменяющие запросы и открывать WebSocket чата.
+	allowedOrigins = getEnv("ALLOWED_ORIGINS", appBaseURL)
+	// exportDir - папка для архивов с выгрузкой персональных данных (удаляются через сутки).
+	exportDir = getEnv("EXPORT_DIR", "data/exports")
+	// resumableUploadDir - папка для частей незавершенных загрузок (/user/uploads).
+	resumableUploadDir = getEnv("RESUMABLE_UPLOAD_DIR", "data/resumable")
+	// auditLogPath - файл журнала аудита событий безопасности (JSON Lines).
+	auditLogPath = getEnv("AUDIT_LOG", "data/audit.log")
+
+	// Политика паролей: минимальная длина, число классов символов (1-4) и проверка по списку утекших.
+	passwordMinLength     = getEnv("PASSWORD_MIN_LENGTH", "10")
+	passwordMinClasses    = getEnv("PASSWORD_MIN_CLASSES", "2")
+	passwordCheckBreached = getEnv("PASSWORD_CHECK_BREACHED", "true")
+	// breachedPasswordsFile - дополнительный список SHA-1 утекших паролей (например, выгрузка HIBP).
+	breachedPasswordsFile = getEnv("BREACHED_PASSWORDS_FILE", "")
+
+	// passwordHasherKind - схема хеширования новых паролей: "bcrypt" или "argon2id".
+	// Хеши с другой схемой или параметрами пересчитываются при следующем входе.
+	passwordHasherKind = getEnv("PASSWORD_HASHER", "bcrypt")
+	// bcryptCost - стоимость bcrypt (подобрать под сервер: go run . -calibrate-hash 250ms).
+	bcryptCost = getEnv("BCRYPT_COST", "12")
+	// Параметры argon2id: число проходов, память в КиБ и число потоков.
+	argon2Time    = getEnv("ARGON2_TIME", "3")
+	argon2Memory  = getEnv("ARGON2_MEMORY", "65536")
+	argon2Threads = getEnv("ARGON2_THREADS", "2")
+
+	// blobStoreKind выбирает хранилище загруженных файлов: "local" (папка uploadDir) или "s3".
+	blobStoreKind = getEnv("BLOB_STORE", "local")
+	// uploadDir - папка загрузок для BLOB_STORE=local.
+	uploadDir = getEnv("UPLOAD_DIR", filepath.Join("static", "uploads"))
+	// blobRedirect - отдавать /uploads/ редиректом на подписанную ссылку S3 вместо проксирования.
+	blobRedirect = getEnv("BLOB_REDIRECT", "false")
+	// Параметры S3-совместимого хранилища для BLOB_STORE=s3. S3_PREFIX - префикс ключей в бакете,
+	// S3_PATH_STYLE - адреса вида endpoint/bucket/key (нужно для MinIO и заглушки cmd/mock-s3).
+	s3Endpoint  = getEnv("S3_ENDPOINT", "")
+	s3Region    = getEnv("S3_REGION", "us-east-1")
+	s3Bucket    = getEnv("S3_BUCKET", "")
+	s3Prefix    = getEnv("S3_PREFIX", "uploads/")
+	s3AccessKey = getEnv("S3_ACCESS_KEY", "")
+	s3SecretKey = getEnv("S3_SECRET_KEY", "")
+	s3PathStyle = getEnv("S3_PATH_STYLE", "true")
+
+	// storageQuotasSpec - лимиты хранилища по тарифам: "тариф=размер" через запятую,
+	// размер в B/KB/MB/GB/TB или unlimited. storageDefaultTier - тариф пользователей без назначенного.
+	storageQuotasSpec  = getEnv("STORAGE_QUOTAS", "free=100MB,pro=5GB")
+	storageDefaultTier = getEnv("STORAGE_DEFAULT_TIER", "free")
+
+	// photoKeepCaptureTime - сохранять ли в базе время съемки из EXIF загруженных фото
+	// (остальные метаданные, включая геопозицию, удаляются всегда).
+	photoKeepCaptureTime = getEnv("PHOTO_KEEP_CAPTURE_TIME", "true")
+
+	// mailerKind выбирает отправку писем: "outbox" (файлы и память, для локальной разработки) или "smtp".
+	mailerKind = getEnv("MAILER", "outbox")
+	// mailOutboxDir - папка, куда outbox складывает письма в формате .eml.
+	mailOutboxDir = getEnv("MAIL_OUTBOX_DIR", "data/outbox")
+	// Параметры SMTP-сервера для MAILER=smtp.
+	smtpHost     = getEnv("SMTP_HOST", "localhost")
+	smtpPort     = getEnv("SMTP_PORT", "587")
+	smtpUser     = getEnv("SMTP_USER", "")
+	smtpPassword = getEnv("SMTP_PASSWORD", "")
+	mailFrom     = getEnv("MAIL_FROM", "Clone Instagram <no-reply@localhost>")
+)
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// --- Защита от CSRF и Проверка Origin ---
+//
+// Используется схема double-submit cookie: сервер выдает случайный токен в куке csrf_token
+// (доступной JavaScript), а клиент повторяет его в заголовке X-CSRF-Token (или поле формы
+// csrf_token). Чужой сайт не может прочитать нашу куку, поэтому не может и подставить токен.
+
+const (
+	csrfCookieName = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+	csrfFormField  = "csrf_token"
+)
+
+// allowedOriginList - разобранный список ALLOWED_ORIGINS (схема://хост[:порт] в нижнем регистре).
+var allowedOriginList = parseOrigins(allowedOrigins)
+
+// parseOrigins разбирает список источников через запятую.
+func parseOrigins(list string) []string {
+	var origins []string
+	for _, origin := range strings.Split(list, ",") {
+		origin = strings.TrimRight(strings.ToLower(strings.TrimSpace(origin)), "/")
+		if origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// originAllowed проверяет заголовок Origin: разрешены запросы без Origin (не браузер),
+// с того же хоста, что и сам запрос, и из списка ALLOWED_ORIGINS.
+func originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	normalized := strings.ToLower(u.Scheme + "://" + u.Host)
+	for _, allowed := range allowedOriginList {
+		if allowed == "*" || allowed == normalized {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureCSRFCookie выдает браузеру CSRF-токен, если его еще нет.
+func ensureCSRFCookie(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(csrfCookieName); err == nil && cookie.Value != "" {
+		return
+	}
+	token, err := generateSessionID()
+	if err != nil {
+		log.Printf("❌ Ошибка генерации CSRF-токена: %v", err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: false, // Скрипт страницы должен прочитать токен, чтобы отправить его в заголовке
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// csrfCookieMiddleware выдает CSRF-токен вместе со страницами приложения.
+func csrfCookieMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ensureCSRFCookie(w, r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfMiddleware защищает изменяющие запросы: проверяет Origin и совпадение токена из куки
+// с токеном из заголовка или формы. Безопасные методы (GET, HEAD, OPTIONS) пропускаются.
+func csrfMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			ensureCSRFCookie(w, r)
+			next(w, r)
+			return
+		}
+
+		// Bearer-токен браузер сам не подставляет, поэтому такие запросы подделать нельзя
+		if tokenID, _ := r.Context().Value(apiTokenContextKey).(string); tokenID != "" {
+			next(w, r)
+			return
+		}
+
+		if !originAllowed(r) {
+			log.Printf("❌ CSRF: запрос %s %s с чужого источника %s", r.Method, r.URL.Path, r.Header.Get("Origin"))
+			csrfFailed(w)
+			return
+		}
+
+		cookie, err := r.Cookie(csrfCookieName)
+		if err != nil || cookie.Value == "" {
+			log.Printf("❌ CSRF: нет куки с токеном для %s %s", r.Method, r.URL.Path)
+			csrfFailed(w)
+			return
+		}
+		token := r.Header.Get(csrfHeaderName)
+		if token == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+			// Обычная HTML-форма без JavaScript передает токен полем. multipart-тела здесь
+			// не разбираем: их размер ограничивают сами обработчики.
+			token = r.PostFormValue(csrfFormField)
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) != 1 {
+			log.Printf("❌ CSRF: токен не совпадает для %s %s", r.Method, r.URL.Path)
+			csrfFailed(w)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// csrfFailed отвечает 403 на запрос без действительного CSRF-токена.
+func csrfFailed(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Недействительный CSRF-токен. Обновите страницу.", "status": "error"})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCSRFMiddleware(t *testing.T) {
+	const token = "csrf-token-value"
+	tests := []struct {
+		name        string
+		method      string
+		cookie      string
+		header      string
+		form        string // Тело application/x-www-form-urlencoded
+		origin      string
+		contentType string
+		apiToken    bool
+		wantPassed  bool
+	}{
+		{name: "GET без токена", method: http.MethodGet, wantPassed: true},
+		{name: "POST с совпадающим заголовком", method: http.MethodPost, cookie: token, header: token, wantPassed: true},
+		{name: "POST без куки", method: http.MethodPost, header: token},
+		{name: "POST без заголовка", method: http.MethodPost, cookie: token},
+		{name: "POST с чужим токеном", method: http.MethodPost, cookie: token, header: "other"},
+		{name: "POST из HTML-формы", method: http.MethodPost, cookie: token, form: "csrf_token=" + token,
+			contentType: "application/x-www-form-urlencoded", wantPassed: true},
+		{name: "токен в multipart не читается", method: http.MethodPost, cookie: token, form: "csrf_token=" + token,
+			contentType: "multipart/form-data; boundary=x"},
+		{name: "тот же хост", method: http.MethodPost, cookie: token, header: token, origin: "http://example.com", wantPassed: true},
+		{name: "разрешенный источник", method: http.MethodPost, cookie: token, header: token, origin: "http://localhost:8080", wantPassed: true},
+		{name: "чужой источник", method: http.MethodPost, cookie: token, header: token, origin: "https://evil.example"},
+		{name: "испорченный Origin", method: http.MethodPost, cookie: token, header: token, origin: "null"},
+		{name: "DELETE без токена", method: http.MethodDelete},
+		{name: "API-токен без CSRF", method: http.MethodPost, apiToken: true, wantPassed: true},
+	}
+
+	for _, tc := range tests {
+		req := httptest.NewRequest(tc.method, "http://example.com/user/update", strings.NewReader(tc.form))
+		if tc.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: tc.cookie})
+		}
+		if tc.header != "" {
+			req.Header.Set(csrfHeaderName, tc.header)
+		}
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		if tc.apiToken {
+			req = req.WithContext(context.WithValue(req.Context(), apiTokenContextKey, "token-id"))
+		}
+
+		passed := false
+		rec := httptest.NewRecorder()
+		csrfMiddleware(func(w http.ResponseWriter, r *http.Request) { passed = true })(rec, req)
+
+		if passed != tc.wantPassed {
+			t.Errorf("%s: пропущен = %v, ожидалось %v", tc.name, passed, tc.wantPassed)
+		}
+		if !tc.wantPassed && rec.Code != http.StatusForbidden {
+			t.Errorf("%s: статус %d, ожидался 403", tc.name, rec.Code)
+		}
+	}
+}
+
+func TestCSRFCookieIssuedOnSafeRequests(t *testing.T) {
+	rec := httptest.NewRecorder()
+	csrfMiddleware(func(w http.ResponseWriter, r *http.Request) {})(rec, httptest.NewRequest(http.MethodGet, "/user", nil))
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != csrfCookieName || cookies[0].Value == "" || cookies[0].HttpOnly {
+		t.Fatalf("ожидалась доступная скрипту кука %s, получено %v", csrfCookieName, cookies)
+	}
+
+	// Уже выданный токен не меняется
+	req := httptest.NewRequest(http.MethodGet, "/user", nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	csrfMiddleware(func(w http.ResponseWriter, r *http.Request) {})(rec, req)
+	if len(rec.Result().Cookies()) != 0 {
+		t.Errorf("токен выдан повторно: %v", rec.Result().Cookies())
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Метаданные Фотографий (EXIF) ---
+//
+// Загрузки всегда перекодируются, поэтому EXIF (геопозиция, модель камеры и т.п.) в сохраненные
+// файлы не попадает. Перед этим из него берется ориентация, чтобы фото с телефона не лежали
+// на боку, и, если разрешено, время съемки - единственное поле, которое сохраняется в базе.
+
+// keepCaptureTime - сохранять ли время съемки из EXIF (PHOTO_KEEP_CAPTURE_TIME).
+var keepCaptureTime = true
+
+// initPhotoMetadata читает настройки обработки метаданных.
+func initPhotoMetadata() {
+	var err error
+	if keepCaptureTime, err = strconv.ParseBool(photoKeepCaptureTime); err != nil {
+		log.Fatalf("❌ Неверное значение PHOTO_KEEP_CAPTURE_TIME: %q", photoKeepCaptureTime)
+	}
+}
+
+// Теги EXIF, которые читаются. Остальные отбрасываются вместе со всем блоком.
+const (
+	exifTagOrientation        = 0x0112
+	exifTagDateTime           = 0x0132
+	exifTagExifIFD            = 0x8769
+	exifTagDateTimeOriginal   = 0x9003
+	exifTagOffsetTimeOriginal = 0x9011
+)
+
+// exifData - то, что берется из EXIF загруженного фото.
+type exifData struct {
+	Orientation int       // 1-8, 0 - нет данных
+	TakenAt     time.Time // Время съемки, нулевое - нет данных
+}
+
+// readExif находит блок EXIF в файле формата format (jpeg, png или webp) и разбирает его.
+// Метаданные необязательны: поврежденный или отсутствующий блок дает пустой результат.
+func readExif(raw []byte, format string) exifData {
+	var tiff []byte
+	switch format {
+	case "jpeg":
+		tiff = jpegExif(raw)
+	case "png":
+		tiff = pngExif(raw)
+	case "webp":
+		tiff = webpExif(raw)
+	}
+	if tiff == nil {
+		return exifData{}
+	}
+	return parseTIFF(tiff)
+}
+
+// jpegExif возвращает содержимое сегмента APP1 "Exif" из JPEG.
+func jpegExif(raw []byte) []byte {
+	if len(raw) < 4 || raw[0] != 0xFF || raw[1] != 0xD8 {
+		return nil
+	}
+	for pos := 2; pos+4 <= len(raw); {
+		if raw[pos] != 0xFF {
+			return nil
+		}
+		marker := raw[pos+1]
+		if marker == 0xDA || marker == 0xD9 { // Дальше данные изображения, метаданных уже не будет
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(raw[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(raw) {
+			return nil
+		}
+		if segment := raw[pos+4 : end]; marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:]
+		}
+		pos = end
+	}
+	return nil
+}
+
+// pngExif возвращает содержимое чанка eXIf из PNG.
+func pngExif(raw []byte) []byte {
+	const signatureLength = 8
+	for pos := signatureLength; pos+8 <= len(raw); {
+		length := int(binary.BigEndian.Uint32(raw[pos:]))
+		end := pos + 8 + length + 4 // длина, тип, данные, CRC
+		if length < 0 || end > len(raw) {
+			return nil
+		}
+		if string(raw[pos+4:pos+8]) == "eXIf" {
+			return raw[pos+8 : pos+8+length]
+		}
+		pos = end
+	}
+	return nil
+}
+
+// webpExif возвращает содержимое чанка EXIF из контейнера RIFF WebP.
+func webpExif(raw []byte) []byte {
+	const headerLength = 12 // "RIFF", размер, "WEBP"
+	for pos := headerLength; pos+8 <= len(raw); {
+		length := int(binary.LittleEndian.Uint32(raw[pos+4:]))
+		end := pos + 8 + length
+		if length < 0 || end > len(raw) {
+			return nil
+		}
+		if string(raw[pos:pos+4]) == "EXIF" {
+			// Некоторые программы оставляют заголовок из JPEG
+			return bytes.TrimPrefix(raw[pos+8:end], []byte("Exif\x00\x00"))
+		}
+		pos = end + length%2 // Чанки выровнены по четной границе
+	}
+	return nil
+}
+
+// parseTIFF читает ориентацию и время съемки из блока EXIF (структура TIFF).
+func parseTIFF(tiff []byte) exifData {
+	var data exifData
+	if len(tiff) < 8 {
+		return data
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return data
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return data
+	}
+
+	ifd0 := readIFD(tiff, order, order.Uint32(tiff[4:]))
+	if value, ok := ifd0[exifTagOrientation]; ok {
+		if orientation := int(order.Uint16(value)); orientation >= 1 && orientation <= 8 {
+			data.Orientation = orientation
+		}
+	}
+
+	taken, offset := ifdString(tiff, order, ifd0[exifTagDateTime]), ""
+	if pointer, ok := ifd0[exifTagExifIFD]; ok {
+		exif := readIFD(tiff, order, order.Uint32(pointer))
+		if original := ifdString(tiff, order, exif[exifTagDateTimeOriginal]); original != "" {
+			taken = original
+			offset = ifdString(tiff, order, exif[exifTagOffsetTimeOriginal])
+		}
+	}
+	data.TakenAt = parseExifTime(taken, offset)
+	return data
+}
+
+// readIFD возвращает записи каталога TIFF по смещению offset: тег -> 4 байта поля значения.
+// Для значений длиннее 4 байт это смещение самих данных.
+func readIFD(tiff []byte, order binary.ByteOrder, offset uint32) map[uint16][]byte {
+	entries := map[uint16][]byte{}
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return entries
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		pos := int(offset) + 2 + 12*i
+		if pos+12 > len(tiff) {
+			break
+		}
+		entries[order.Uint16(tiff[pos:])] = tiff[pos+8 : pos+12]
+	}
+	return entries
+}
+
+// ifdString читает строку ASCII, на которую указывает поле значения записи каталога.
+func ifdString(tiff []byte, order binary.ByteOrder, value []byte) string {
+	if value == nil {
+		return ""
+	}
+	// Строки времени длиннее 4 байт, поэтому в поле значения всегда лежит смещение строки
+	start := uint64(order.Uint32(value))
+	if start >= uint64(len(tiff)) {
+		return ""
+	}
+	field := tiff[start:]
+	end := bytes.IndexByte(field, 0)
+	if end < 0 || end > 32 {
+		return ""
+	}
+	return strings.TrimSpace(string(field[:end]))
+}
+
+// parseExifTime разбирает время EXIF ("2006:01:02 15:04:05") со смещением вида "+03:00".
+// Без смещения часовой пояс неизвестен, и время сохраняется как UTC.
+func parseExifTime(value, offset string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	if offset != "" {
+		if t, err := time.Parse("2006:01:02 15:04:05-07:00", value+offset); err == nil {
+			return t
+		}
+	}
+	t, err := time.Parse("2006:01:02 15:04:05", value)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// applyOrientation поворачивает и отражает картинку так, как требует тег Orientation,
+// чтобы после удаления EXIF она отображалась так же, как у автора. Результат - копия картинки,
+// поэтому большие картинки сначала уменьшаются (uploadedImage.fitted).
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	src, ok := img.(*image.RGBA) // fitImage уже вернул RGBA - вторая копия не нужна
+	if !ok || bounds.Min != (image.Point{}) {
+		src = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	}
+
+	w, h := bounds.Dx(), bounds.Dy()
+	dstW, dstH := w, h
+	if orientation >= 5 { // Повороты на 90 градусов меняют стороны местами
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // Отражение по горизонтали
+				dx, dy = w-1-x, y
+			case 3: // Поворот на 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // Отражение по вертикали
+				dx, dy = x, h-1-y
+			case 5: // Отражение относительно главной диагонали
+				dx, dy = y, x
+			case 6: // Поворот на 90 по часовой
+				dx, dy = h-1-y, x
+			case 7: // Отражение относительно побочной диагонали
+				dx, dy = h-1-y, w-1-x
+			case 8: // Поворот на 90 против часовой
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):][:4], src.Pix[src.PixOffset(x, y):][:4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+	"time"
+)
+
+// tiffEntry - запись каталога для buildTIFF: число (SHORT или LONG) или строка ASCII.
+type tiffEntry struct {
+	tag   uint16
+	short uint16
+	long  uint32
+	ascii string
+}
+
+// buildTIFF собирает блок EXIF с каталогом IFD0 и, если exif не пуст, вложенным каталогом Exif IFD.
+func buildTIFF(order binary.ByteOrder, ifd0, exif []tiffEntry) []byte {
+	const ifdStart = 8
+	ifdSize := func(entries []tiffEntry) int { return 2 + 12*len(entries) + 4 }
+	exifStart := ifdStart + ifdSize(ifd0)
+	if len(exif) > 0 {
+		ifd0 = append(ifd0, tiffEntry{tag: exifTagExifIFD})
+		exifStart = ifdStart + ifdSize(ifd0)
+		ifd0[len(ifd0)-1].long = uint32(exifStart)
+	}
+	dataStart := exifStart + ifdSize(exif)
+
+	buf := make([]byte, dataStart)
+	if order == binary.LittleEndian {
+		copy(buf, "II")
+	} else {
+		copy(buf, "MM")
+	}
+	order.PutUint16(buf[2:], 42)
+	order.PutUint32(buf[4:], ifdStart)
+
+	writeIFD := func(start int, entries []tiffEntry) {
+		order.PutUint16(buf[start:], uint16(len(entries)))
+		for i, entry := range entries {
+			pos := start + 2 + 12*i
+			order.PutUint16(buf[pos:], entry.tag)
+			switch {
+			case entry.ascii != "":
+				order.PutUint16(buf[pos+2:], 2) // ASCII
+				order.PutUint32(buf[pos+4:], uint32(len(entry.ascii)+1))
+				order.PutUint32(buf[pos+8:], uint32(len(buf)))
+				buf = append(buf, entry.ascii+"\x00"...)
+			case entry.tag == exifTagExifIFD:
+				order.PutUint16(buf[pos+2:], 4) // LONG
+				order.PutUint32(buf[pos+4:], 1)
+				order.PutUint32(buf[pos+8:], entry.long)
+			default:
+				order.PutUint16(buf[pos+2:], 3) // SHORT
+				order.PutUint32(buf[pos+4:], 1)
+				order.PutUint16(buf[pos+8:], entry.short)
+			}
+		}
+	}
+	writeIFD(ifdStart, ifd0)
+	if len(exif) > 0 {
+		writeIFD(exifStart, exif)
+	}
+	return buf
+}
+
+func TestParseTIFF(t *testing.T) {
+	moscow := time.FixedZone("", 3*60*60)
+	tests := []struct {
+		name  string
+		order binary.ByteOrder
+		ifd0  []tiffEntry
+		exif  []tiffEntry
+		want  exifData
+	}{
+		{
+			name:  "ориентация, little endian",
+			order: binary.LittleEndian,
+			ifd0:  []tiffEntry{{tag: exifTagOrientation, short: 6}},
+			want:  exifData{Orientation: 6},
+		},
+		{
+			name:  "ориентация, big endian",
+			order: binary.BigEndian,
+			ifd0:  []tiffEntry{{tag: exifTagOrientation, short: 8}},
+			want:  exifData{Orientation: 8},
+		},
+		{
+			name:  "недопустимая ориентация",
+			order: binary.LittleEndian,
+			ifd0:  []tiffEntry{{tag: exifTagOrientation, short: 9}},
+			want:  exifData{},
+		},
+		{
+			name:  "время изменения без смещения - UTC",
+			order: binary.BigEndian,
+			ifd0:  []tiffEntry{{tag: exifTagDateTime, ascii: "2024:05:01 12:30:00"}},
+			want:  exifData{TakenAt: time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)},
+		},
+		{
+			name:  "время съемки со смещением важнее времени изменения",
+			order: binary.LittleEndian,
+			ifd0:  []tiffEntry{{tag: exifTagOrientation, short: 3}, {tag: exifTagDateTime, ascii: "2024:05:01 12:30:00"}},
+			exif: []tiffEntry{
+				{tag: exifTagDateTimeOriginal, ascii: "2023:12:31 23:59:58"},
+				{tag: exifTagOffsetTimeOriginal, ascii: "+03:00"},
+			},
+			want: exifData{Orientation: 3, TakenAt: time.Date(2023, 12, 31, 23, 59, 58, 0, moscow)},
+		},
+		{
+			name:  "испорченное время",
+			order: binary.BigEndian,
+			ifd0:  []tiffEntry{{tag: exifTagDateTime, ascii: "вчера"}},
+			want:  exifData{},
+		},
+	}
+	for _, tc := range tests {
+		got := parseTIFF(buildTIFF(tc.order, tc.ifd0, tc.exif))
+		if got.Orientation != tc.want.Orientation || !got.TakenAt.Equal(tc.want.TakenAt) {
+			t.Errorf("%s: parseTIFF = %+v, ожидалось %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseTIFFMalformed(t *testing.T) {
+	valid := buildTIFF(binary.LittleEndian, []tiffEntry{{tag: exifTagOrientation, short: 6}, {tag: exifTagDateTime, ascii: "2024:05:01 12:30:00"}}, nil)
+
+	badMagic := append([]byte{}, valid...)
+	binary.LittleEndian.PutUint16(badMagic[2:], 43)
+	farIFD := append([]byte{}, valid...)
+	binary.LittleEndian.PutUint32(farIFD[4:], 1<<30)
+	manyEntries := append([]byte{}, valid...)
+	binary.LittleEndian.PutUint16(manyEntries[8:], 1000)
+	farString := append([]byte{}, valid...)
+	binary.LittleEndian.PutUint32(farString[8+2+12+8:], 1<<30)
+
+	tests := []struct {
+		name string
+		tiff []byte
+		want int // Ожидаемая ориентация
+	}{
+		{"пусто", nil, 0},
+		{"короткий заголовок", []byte("II*\x00"), 0},
+		{"неизвестный порядок байт", append([]byte("XX"), valid[2:]...), 0},
+		{"неверное магическое число", badMagic, 0},
+		{"каталог за пределами блока", farIFD, 0},
+		{"записей больше, чем данных", manyEntries, 6},
+		{"строка за пределами блока", farString, 6},
+		{"обрезанный блок", valid[:len(valid)-10], 6},
+	}
+	for _, tc := range tests {
+		// Главное - не паниковать на чужих файлах
+		if got := parseTIFF(tc.tiff); got.Orientation != tc.want {
+			t.Errorf("%s: ориентация %d, ожидалась %d", tc.name, got.Orientation, tc.want)
+		}
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// Картинка 3x2, пиксели пронумерованы в красном канале:
+	//	1 2 3
+	//	4 5 6
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	pixel := func(n int) color.RGBA { return color.RGBA{R: uint8(n), A: 255} }
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			src.SetRGBA(x, y, pixel(1+y*3+x))
+		}
+	}
+
+	// Ожидаемые строки результата (номера пикселей исходника)
+	tests := []struct {
+		orientation int
+		want        [][]int
+	}{
+		{1, [][]int{{1, 2, 3}, {4, 5, 6}}},
+		{2, [][]int{{3, 2, 1}, {6, 5, 4}}},
+		{3, [][]int{{6, 5, 4}, {3, 2, 1}}},
+		{4, [][]int{{4, 5, 6}, {1, 2, 3}}},
+		{5, [][]int{{1, 4}, {2, 5}, {3, 6}}},
+		{6, [][]int{{4, 1}, {5, 2}, {6, 3}}},
+		{7, [][]int{{6, 3}, {5, 2}, {4, 1}}},
+		{8, [][]int{{3, 6}, {2, 5}, {1, 4}}},
+		{0, [][]int{{1, 2, 3}, {4, 5, 6}}},
+		{9, [][]int{{1, 2, 3}, {4, 5, 6}}},
+	}
+	for _, tc := range tests {
+		got := applyOrientation(src, tc.orientation)
+		bounds := got.Bounds()
+		if bounds.Dx() != len(tc.want[0]) || bounds.Dy() != len(tc.want) {
+			t.Errorf("ориентация %d: размер %dx%d, ожидался %dx%d", tc.orientation, bounds.Dx(), bounds.Dy(), len(tc.want[0]), len(tc.want))
+			continue
+		}
+		for y, row := range tc.want {
+			for x, n := range row {
+				if c := color.RGBAModel.Convert(got.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.RGBA); c != pixel(n) {
+					t.Errorf("ориентация %d: пиксель (%d,%d) = %d, ожидался %d", tc.orientation, x, y, c.R, n)
+				}
+			}
+		}
+	}
+}
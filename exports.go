@@ -0,0 +1,480 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// --- Выгрузка Персональных Данных ---
+
+const (
+	// exportLinkTTL - сколько действует ссылка на готовый архив (потом архив удаляется).
+	exportLinkTTL = 24 * time.Hour
+	// exportCooldown - как часто пользователь может заказывать новый архив (после неудавшейся сборки - сразу).
+	exportCooldown = time.Hour
+)
+
+// Состояния выгрузки.
+const (
+	exportPending = "pending"
+	exportReady   = "ready"
+	exportFailed  = "failed"
+)
+
+// DataExport - заказанный пользователем архив с его данными.
+// Ссылка на скачивание содержит случайный токен, хранится только его SHA-256 (TokenHash).
+type DataExport struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	ReadyAt   time.Time `json:"ready_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	TokenHash string    `json:"-"`
+}
+
+// path - файл архива на диске.
+func (e DataExport) path() string {
+	return filepath.Join(exportDir, e.ID+".zip")
+}
+
+// Выгрузки живут сутки, поэтому хранятся в памяти; архивы, оставшиеся после перезапуска,
+// удаляет initExports.
+var (
+	exportsMu sync.Mutex
+	exports   = map[string]DataExport{}
+)
+
+// initExports создает папку архивов и удаляет архивы, оставшиеся от прошлого запуска.
+func initExports() {
+	if err := os.MkdirAll(exportDir, 0700); err != nil {
+		log.Fatalf("❌ Не удалось создать папку выгрузок: %v", err)
+	}
+	leftovers, _ := filepath.Glob(filepath.Join(exportDir, "*.zip"))
+	for _, path := range leftovers {
+		os.Remove(path)
+	}
+}
+
+var (
+	// ErrExportPending возвращается при заказе выгрузки, пока предыдущая еще собирается.
+	ErrExportPending = errors.New("Архив уже готовится")
+	// ErrExportCooldown возвращается, если с заказа готового архива не прошел exportCooldown.
+	ErrExportCooldown = errors.New("Новый архив можно заказать позже")
+)
+
+// latestExport возвращает последнюю выгрузку пользователя.
+func latestExport(userID string) (DataExport, bool) {
+	exportsMu.Lock()
+	defer exportsMu.Unlock()
+	return latestExportLocked(userID)
+}
+
+// latestExportLocked - latestExport для вызова под exportsMu.
+func latestExportLocked(userID string) (DataExport, bool) {
+	var latest DataExport
+	found := false
+	for _, export := range exports {
+		if export.UserID == userID && (!found || export.CreatedAt.After(latest.CreatedAt)) {
+			latest, found = export, true
+		}
+	}
+	return latest, found
+}
+
+// reserveExport сохраняет новую выгрузку export (в состоянии pending), если пользователь может
+// ее заказать. Проверка и запись идут под одной блокировкой, поэтому из параллельных запросов
+// сборку запускает только один. При ErrExportCooldown возвращает, сколько осталось ждать.
+func reserveExport(export DataExport) (time.Duration, error) {
+	exportsMu.Lock()
+	defer exportsMu.Unlock()
+	if previous, found := latestExportLocked(export.UserID); found {
+		if previous.Status == exportPending {
+			return 0, ErrExportPending
+		}
+		// Неудавшуюся сборку (ошибка диска или хранилища) можно сразу повторить
+		if wait := previous.CreatedAt.Add(exportCooldown).Sub(export.CreatedAt); previous.Status == exportReady && wait > 0 {
+			return wait, ErrExportCooldown
+		}
+	}
+	exports[export.ID] = export
+	return 0, nil
+}
+
+// saveExport сохраняет состояние выгрузки.
+func saveExport(export DataExport) {
+	exportsMu.Lock()
+	defer exportsMu.Unlock()
+	exports[export.ID] = export
+}
+
+// removeExports удаляет выгрузки, для которых match возвращает true, вместе с архивами.
+func removeExports(match func(DataExport) bool) int {
+	exportsMu.Lock()
+	defer exportsMu.Unlock()
+	count := 0
+	for id, export := range exports {
+		if !match(export) {
+			continue
+		}
+		if err := os.Remove(export.path()); err != nil && !os.IsNotExist(err) {
+			log.Printf("❌ Ошибка удаления архива %s: %v", export.path(), err)
+		}
+		delete(exports, id)
+		count++
+	}
+	return count
+}
+
+// removeUserExports удаляет все выгрузки пользователя (при удалении аккаунта).
+func removeUserExports(userID string) {
+	removeExports(func(e DataExport) bool { return e.UserID == userID })
+}
+
+// purgeExpiredExports периодически удаляет истекшие архивы.
+func purgeExpiredExports(interval time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now()
+		n := removeExports(func(e DataExport) bool {
+			return e.Status == exportReady && !now.Before(e.ExpiresAt) ||
+				e.Status == exportFailed && !now.Before(e.CreatedAt.Add(exportCooldown))
+		})
+		if n > 0 {
+			log.Printf("🧹 Удалено истекших выгрузок: %d", n)
+		}
+	}
+}
+
+// =======================================================================
+// Сборка архива
+// =======================================================================
+
+// buildExport собирает архив в фоне, выдает ссылку и отправляет ее письмом.
+func buildExport(export DataExport, user UserData) {
+	err := writeExportArchive(export.path(), user)
+	if err != nil {
+		log.Printf("❌ Ошибка сборки выгрузки %s для %s: %v", export.ID, user.ID, err)
+		os.Remove(export.path())
+		export.Status = exportFailed
+		saveExport(export)
+		return
+	}
+
+	token, err := randomURLToken()
+	if err != nil {
+		log.Printf("❌ Ошибка генерации ссылки выгрузки: %v", err)
+		os.Remove(export.path())
+		export.Status = exportFailed
+		saveExport(export)
+		return
+	}
+	now := time.Now()
+	export.Status = exportReady
+	export.ReadyAt = now
+	export.ExpiresAt = now.Add(exportLinkTTL)
+	export.TokenHash = hashToken(token)
+	saveExport(export)
+
+	link := fmt.Sprintf("%s/user/export/download?token=%s", appBaseURL, url.QueryEscape(token))
+	sendMailAsync(MailMessage{
+		To:      user.Email,
+		Subject: "Архив ваших данных готов",
+		Body: fmt.Sprintf("Здравствуйте, %s!\n\n"+
+			"Архив с вашими данными готов. Скачать его можно по ссылке (нужно войти в аккаунт):\n%s\n\n"+
+			"Ссылка действует %d ч. Если вы не заказывали архив, смените пароль.\n",
+			user.Username, link, int(exportLinkTTL.Hours())),
+	})
+	audit(AuditEvent{Event: "data_export_ready", UserID: user.ID, Details: export.ID})
+	log.Printf("📦 Выгрузка %s для %s готова", export.ID, user.ID)
+}
+
+// writeExportArchive записывает ZIP с данными пользователя в path.
+func writeExportArchive(path string, user UserData) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	archive := zip.NewWriter(f)
+
+	addJSON := func(name string, value any) error {
+		w, err := createExportEntry(archive, name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(value)
+	}
+
+	// Профиль: без хешей пароля, кодов восстановления и секретов 2FA
+	identities := make([]map[string]interface{}, 0, len(user.Identities))
+	for _, identity := range user.Identities {
+		identities = append(identities, map[string]interface{}{
+			"provider":  identity.Provider,
+			"email":     identity.Email,
+			"linked_at": identity.LinkedAt,
+		})
+	}
+	profile := map[string]interface{}{
+		"id":                user.ID,
+		"email":             user.Email,
+		"email_verified":    user.EmailVerified,
+		"username":          user.Username,
+		"handle":            user.Handle,
+		"handle_changed_at": user.HandleChangedAt,
+		"photo_url":         user.PhotoPath,
+		"photo_variants":    user.PhotoVariants,
+		"photo_taken_at":    user.PhotoTakenAt,
+		"tier":              user.tier(),
+		"two_factor":        user.TOTPEnabled,
+		"has_password":      user.HashedPassword != "",
+		"identities":        identities,
+	}
+	if err := addJSON("profile.json", profile); err != nil {
+		return err
+	}
+
+	for _, key := range userUploadFiles(user) {
+		if err := addExportBlob(archive, "photos/"+key, key); err != nil {
+			return err
+		}
+	}
+
+	// Посты: картинки без превью, в posts.json - имя файла в архиве
+	posts, err := postStore.ListByAuthor(user.ID, "", 0)
+	if err != nil {
+		return err
+	}
+	postList := make([]map[string]interface{}, 0, len(posts))
+	archived := map[string]bool{} // Одна картинка в нескольких постах кладется один раз
+	for _, post := range posts {
+		entry := map[string]interface{}{
+			"id":         post.ID,
+			"caption":    post.Caption,
+			"width":      post.Width,
+			"height":     post.Height,
+			"taken_at":   post.TakenAt,
+			"created_at": post.CreatedAt,
+			"edited_at":  post.EditedAt,
+		}
+		if key, ok := uploadKey(post.ImagePath); ok {
+			entry["image"] = "posts/" + key
+			if !archived[key] {
+				archived[key] = true
+				if err := addExportBlob(archive, "posts/"+key, key); err != nil {
+					return err
+				}
+			}
+		}
+		postList = append(postList, entry)
+	}
+	if err := addJSON("posts.json", postList); err != nil {
+		return err
+	}
+
+	if err := addJSON("chat_messages.json", hub.userMessages(user.ID)); err != nil {
+		return err
+	}
+
+	sessions, err := sessionStore.ListByUser(user.ID)
+	if err != nil {
+		return err
+	}
+	sessionList := make([]map[string]interface{}, 0, len(sessions))
+	for _, session := range sessions {
+		sessionList = append(sessionList, map[string]interface{}{
+			"created_at": session.CreatedAt,
+			"last_seen":  session.LastSeen,
+			"expires_at": session.ExpiresAt,
+			"ip":         session.IP,
+			"user_agent": session.UserAgent,
+		})
+	}
+	if err := addJSON("sessions.json", sessionList); err != nil {
+		return err
+	}
+
+	history, err := auditEventsForUser(user.ID)
+	if err != nil {
+		return err
+	}
+	if err := addJSON("security_log.json", history); err != nil {
+		return err
+	}
+
+	tokens, err := apiTokenStore.ListByUser(user.ID)
+	if err != nil {
+		return err
+	}
+	tokenList := make([]map[string]interface{}, 0, len(tokens))
+	for _, token := range tokens {
+		tokenList = append(tokenList, map[string]interface{}{
+			"name":         token.Name,
+			"scopes":       token.Scopes,
+			"created_at":   token.CreatedAt,
+			"expires_at":   token.ExpiresAt,
+			"last_used_at": token.LastUsedAt,
+			"last_used_ip": token.LastUsedIP,
+		})
+	}
+	if err := addJSON("api_tokens.json", tokenList); err != nil {
+		return err
+	}
+
+	readme, err := createExportEntry(archive, "README.txt")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(readme, "Выгрузка данных аккаунта @%s от %s\n\n"+
+		"profile.json        - данные профиля\n"+
+		"photos/             - загруженные фотографии\n"+
+		"posts.json          - ваши посты с подписями\n"+
+		"posts/              - картинки постов\n"+
+		"chat_messages.json  - ваши сообщения в чате (сервер хранит только последние сообщения)\n"+
+		"sessions.json       - активные сессии (устройства)\n"+
+		"security_log.json   - история входов и событий безопасности\n"+
+		"api_tokens.json     - персональные API-токены (без самих токенов)\n",
+		user.Handle, time.Now().Format(time.RFC3339))
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// createExportEntry добавляет в архив сжатый файл с текущим временем изменения.
+func createExportEntry(archive *zip.Writer, name string) (io.Writer, error) {
+	return archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+}
+
+// addExportBlob копирует файл из хранилища загрузок в архив под именем name.
+func addExportBlob(archive *zip.Writer, name, key string) error {
+	src, _, err := blobStore.Get(key)
+	if errors.Is(err, ErrBlobNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := createExportEntry(archive, name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// =======================================================================
+// Обработчики
+// =======================================================================
+
+// dataExportHandler: GET /user/export - состояние последней выгрузки,
+// POST /user/export {"current_password": "..."} - заказать новую.
+func dataExportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	userID := r.Context().Value(userContextKey).(string)
+
+	switch r.Method {
+	case http.MethodGet:
+		var current interface{}
+		if export, found := latestExport(userID); found {
+			current = export
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"export": current, "status": "success"})
+
+	case http.MethodPost:
+		var body struct {
+			CurrentPassword string `json:"current_password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Неверный формат JSON в теле запроса", http.StatusBadRequest)
+			return
+		}
+		userData, err := userStore.GetByID(userID)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"message": "Пользователь не найден", "status": "error"})
+			return
+		}
+		if !reauthenticated(r, userData, body.CurrentPassword) {
+			writeReauthRequired(w, userData, "Введите текущий пароль")
+			return
+		}
+
+		id, err := generateUserID()
+		if err != nil {
+			log.Printf("❌ Ошибка генерации ID выгрузки: %v", err)
+			http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		export := DataExport{ID: id, UserID: userID, Status: exportPending, CreatedAt: time.Now()}
+		if wait, err := reserveExport(export); err == ErrExportPending {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"message": err.Error(), "status": "error"})
+			return
+		} else if err == ErrExportCooldown {
+			tooManyRequests(w, wait)
+			return
+		}
+		go buildExport(export, userData)
+
+		audit(AuditEvent{Event: "data_export_requested", UserID: userID, IP: clientIP(r), Details: export.ID})
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Архив готовится. Ссылка на скачивание придет на " + userData.Email,
+			"export":  export,
+			"status":  "success",
+		})
+
+	default:
+		http.Error(w, "Допустимы только методы GET и POST", http.StatusMethodNotAllowed)
+	}
+}
+
+// dataExportDownloadHandler отдает готовый архив: GET /user/export/download?token=...
+// Кроме токена из письма нужна сессия владельца архива.
+func dataExportDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Допустим только метод GET", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value(userContextKey).(string)
+	token := r.URL.Query().Get("token")
+
+	export, found := latestExport(userID)
+	if !found || token == "" || export.Status != exportReady || export.TokenHash != hashToken(token) ||
+		!time.Now().Before(export.ExpiresAt) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Ссылка недействительна или устарела", "status": "error"})
+		return
+	}
+
+	f, err := os.Open(export.path())
+	if err != nil {
+		log.Printf("❌ Архив %s недоступен: %v", export.ID, err)
+		http.Error(w, "Архив недоступен", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	name := "export_" + export.ReadyAt.Format("20060102") + ".zip"
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+	audit(AuditEvent{Event: "data_export_downloaded", UserID: userID, IP: clientIP(r), Details: export.ID})
+	http.ServeContent(w, r, name, export.ReadyAt, f)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useTestExports очищает выгрузки и кладет архивы во временную папку теста.
+func useTestExports(t *testing.T) {
+	t.Helper()
+	oldDir := exportDir
+	exportDir = t.TempDir()
+	exportsMu.Lock()
+	exports = map[string]DataExport{}
+	exportsMu.Unlock()
+	t.Cleanup(func() {
+		exportDir = oldDir
+		exportsMu.Lock()
+		exports = map[string]DataExport{}
+		exportsMu.Unlock()
+	})
+}
+
+func TestReserveExport(t *testing.T) {
+	useTestExports(t)
+	now := time.Now()
+
+	// Параллельные заказы: сборку запускает только один
+	var wg sync.WaitGroup
+	results := make(chan error, 10)
+	for i := 0; i < cap(results); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := reserveExport(DataExport{ID: fmt.Sprintf("export-%d", i), UserID: "alice-id", Status: exportPending, CreatedAt: now})
+			results <- err
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+	reserved := 0
+	for err := range results {
+		if err == nil {
+			reserved++
+		} else if err != ErrExportPending {
+			t.Errorf("параллельный заказ: %v", err)
+		}
+	}
+	if reserved != 1 {
+		t.Fatalf("зарезервировано выгрузок: %d, ожидалась одна", reserved)
+	}
+
+	current, _ := latestExport("alice-id")
+	steps := []struct {
+		name     string
+		status   string // Состояние текущей выгрузки перед заказом
+		at       time.Time
+		wantErr  error
+		wantWait time.Duration
+	}{
+		{"готовый архив - ждать exportCooldown", exportReady, now.Add(10 * time.Minute), ErrExportCooldown, exportCooldown - 10*time.Minute},
+		{"неудавшаяся сборка - сразу", exportFailed, now.Add(10 * time.Minute), nil, 0},
+		{"после exportCooldown", exportReady, now.Add(10*time.Minute + exportCooldown), nil, 0},
+	}
+	for i, step := range steps {
+		current.Status = step.status
+		saveExport(current)
+		next := DataExport{ID: fmt.Sprintf("next-%d", i), UserID: "alice-id", Status: exportPending, CreatedAt: step.at}
+		wait, err := reserveExport(next)
+		if err != step.wantErr || wait != step.wantWait {
+			t.Errorf("%s: reserveExport = %v, %v, ожидалось %v, %v", step.name, wait, err, step.wantErr, step.wantWait)
+		}
+		if err == nil {
+			current = next
+		}
+	}
+	if _, err := reserveExport(DataExport{ID: "bob-export", UserID: "bob-id", Status: exportPending, CreatedAt: now}); err != nil {
+		t.Errorf("выгрузка другого пользователя: %v", err)
+	}
+}
+
+func TestWriteExportArchive(t *testing.T) {
+	useMemoryStores()
+	useTestMedia(t, newMemoryMediaStore())
+	useTestExports(t)
+
+	photo := storeTestFile(t, 'p', 20)
+	postImage := storeTestFile(t, 'i', 30)
+	hashed := mustHash(t, testBcrypt, "correct horse battery staple")
+	alice := UserData{
+		ID: "export-alice-id", Email: "alice@example.com", EmailVerified: true, Handle: "alice", Username: "Alice",
+		HashedPassword: hashed, TOTPEnabled: true, TOTPSecret: "JBSWY3DPEHPK3PXP", RecoveryCodes: []string{"recovery-hash"},
+		PhotoPath: photo,
+	}
+	userStore.Create(alice)
+	postID, _ := newPostID(time.Now())
+	postStore.Create(Post{ID: postID, AuthorID: alice.ID, ImagePath: postImage, Caption: "закат"})
+	sessionStore.Create(Session{ID: "alice-session", UserID: alice.ID, IP: "198.51.100.7", CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)})
+
+	client := &Client{send: make(chan []byte, 16), user: alice}
+	hub.register <- client
+	hub.incoming <- incomingMessage{client: client, text: "сообщение для выгрузки"}
+	hub.allMessages() // Хаб обработал сообщение
+	t.Cleanup(func() { hub.removeUser <- alice.ID })
+
+	path := filepath.Join(exportDir, "archive.zip")
+	if err := writeExportArchive(path, alice); err != nil {
+		t.Fatalf("writeExportArchive: %v", err)
+	}
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatalf("архив не открывается: %v", err)
+	}
+	defer archive.Close()
+	entries := map[string]string{}
+	for _, f := range archive.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatalf("%s: %v", f.Name, err)
+		}
+		data, _ := io.ReadAll(r)
+		r.Close()
+		entries[f.Name] = string(data)
+	}
+
+	photoKey, _ := uploadKey(photo)
+	postKey, _ := uploadKey(postImage)
+	contains := []struct {
+		entry string
+		want  string
+	}{
+		{"profile.json", `"handle": "alice"`},
+		{"profile.json", `"two_factor": true`},
+		{"photos/" + photoKey, strings.Repeat("p", 20)},
+		{"posts.json", `"caption": "закат"`},
+		{"posts.json", `"image": "posts/` + postKey + `"`},
+		{"posts/" + postKey, strings.Repeat("i", 30)},
+		{"chat_messages.json", "сообщение для выгрузки"},
+		{"sessions.json", "198.51.100.7"},
+		{"security_log.json", "["},
+		{"api_tokens.json", "["},
+		{"README.txt", "@alice"},
+	}
+	for _, tc := range contains {
+		data, found := entries[tc.entry]
+		if !found {
+			t.Errorf("в архиве нет %s", tc.entry)
+		} else if !strings.Contains(data, tc.want) {
+			t.Errorf("%s не содержит %q:\n%s", tc.entry, tc.want, data)
+		}
+	}
+	// Секреты не попадают в архив ни в каком файле
+	for name, data := range entries {
+		for _, secret := range []string{hashed, alice.TOTPSecret, "recovery-hash", "alice-session"} {
+			if strings.Contains(data, secret) {
+				t.Errorf("%s содержит секрет %q", name, secret)
+			}
+		}
+	}
+}
+
+func TestDataExportDownload(t *testing.T) {
+	useTestExports(t)
+	now := time.Now()
+	ready := DataExport{ID: "alice-export", UserID: "alice-id", Status: exportReady, CreatedAt: now, ReadyAt: now,
+		ExpiresAt: now.Add(exportLinkTTL), TokenHash: hashToken("alice-token")}
+	if err := writeExportArchive(ready.path(), UserData{ID: "alice-id", Handle: "alice"}); err != nil {
+		t.Fatalf("writeExportArchive: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		export     DataExport
+		userID     string
+		token      string
+		wantStatus int
+	}{
+		{"владелец по ссылке из письма", ready, "alice-id", "alice-token", http.StatusOK},
+		{"без токена", ready, "alice-id", "", http.StatusNotFound},
+		{"чужой токен", ready, "alice-id", "bob-token", http.StatusNotFound},
+		{"ссылка из чужого письма", ready, "bob-id", "alice-token", http.StatusNotFound},
+		{"ссылка истекла", DataExport{ID: ready.ID, UserID: ready.UserID, Status: exportReady, ReadyAt: now,
+			ExpiresAt: now.Add(-time.Second), TokenHash: ready.TokenHash}, "alice-id", "alice-token", http.StatusNotFound},
+		{"архив еще собирается", DataExport{ID: ready.ID, UserID: ready.UserID, Status: exportPending,
+			TokenHash: ready.TokenHash, ExpiresAt: now.Add(time.Hour)}, "alice-id", "alice-token", http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		saveExport(tc.export)
+		req := httptest.NewRequest(http.MethodGet, "/user/export/download?token="+tc.token, nil)
+		req = req.WithContext(context.WithValue(req.Context(), userContextKey, tc.userID))
+		rec := httptest.NewRecorder()
+		dataExportDownloadHandler(rec, req)
+
+		if rec.Code != tc.wantStatus {
+			t.Errorf("%s: статус %d, ожидался %d", tc.name, rec.Code, tc.wantStatus)
+			continue
+		}
+		if tc.wantStatus == http.StatusOK && (rec.Header().Get("Content-Type") != "application/zip" || !strings.HasPrefix(rec.Body.String(), "PK")) {
+			t.Errorf("%s: отдан не архив: %q", tc.name, rec.Header().Get("Content-Type"))
+		}
+	}
+}
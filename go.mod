@@ -4,5 +4,10 @@ go 1.24.5
 
 require (
 	github.com/gorilla/websocket v1.5.3
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	go.etcd.io/bbolt v1.4.3
 	golang.org/x/crypto v0.43.0
+	golang.org/x/image v0.32.0
 )
+
+require golang.org/x/sys v0.37.0 // indirect
@@ -1,29 +1,36 @@
 package main
 
 import (
-	// Добавлен, если не было
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"os"
-	"path/filepath"
-	"time"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 const MAX_UPLOAD_SIZE = 10 << 20 // 10 MB
 
 // --- Вспомогательные функции ---
 
-func generateSessionID() string {
+// generateSessionID создает случайный токен сессии (256 бит), пригодный для куки.
+func generateSessionID() (string, error) {
 	b := make([]byte, 32)
-	rand.Read(b)
-	return base64.StdEncoding.EncodeToString(b)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// generateUserID создает неизменяемый идентификатор пользователя (128 бит в hex).
+func generateUserID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
 
 // --- Обработчики API ---
@@ -45,77 +52,144 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 
 	username := r.FormValue("username")
 	password := r.FormValue("password")
-	email := r.FormValue("email") // Используем email
+	email := normalizeEmail(r.FormValue("email")) // Используем email
+	handle := normalizeHandle(r.FormValue("handle"))
 
 	if username == "" || password == "" || email == "" {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{"message": "Все обязательные поля должны быть заполнены", "status": "error"})
 		return
 	}
+	// Ошибки формы собираем по полям, чтобы показать их все сразу
+	errs := fieldErrors{}
+	if err := validateEmail(email); err != nil {
+		errs["email"] = []string{err.Error()}
+	}
+	if handle != "" {
+		if err := validateHandle(handle); err != nil {
+			errs["handle"] = []string{err.Error()}
+		}
+	}
+	if problems := validatePassword(password, UserData{Username: username, Email: email, Handle: handle}); len(problems) > 0 {
+		errs["password"] = problems
+	}
+	if len(errs) > 0 {
+		writeFieldErrors(w, errs)
+		return
+	}
+
+	// Хендл необязателен: если его не указали, подбираем свободный по имени
+	if handle == "" {
+		generated, err := generateHandle(username, func(h string) bool {
+			available, err := userStore.HandleAvailable(h, "")
+			return err != nil || !available
+		})
+		if err != nil {
+			log.Printf("❌ Не удалось подобрать хендл для %s: %v", username, err)
+			http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		handle = generated
+	}
 
-	mu.Lock()
 	// КЛЮЧЕВОЕ ИЗМЕНЕНИЕ: Проверяем по email, так как он теперь ключ
-	if _, exists := users[email]; exists {
-		mu.Unlock()
+	if _, err := userStore.GetByEmail(email); err == nil {
 		w.WriteHeader(http.StatusConflict)
 		json.NewEncoder(w).Encode(map[string]string{"message": "Email уже используется", "status": "error"})
 		return
+	} else if err != ErrUserNotFound {
+		log.Printf("❌ Ошибка чтения хранилища пользователей: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
 	}
 
 	// 2. Обработка загруженного файла (логика не меняется)
-	var photoPath string
-	file, handler, err := r.FormFile("profile_photo")
+	var photo profilePhoto
+	file, _, err := r.FormFile("profile_photo")
 
 	if err == nil {
 		defer file.Close()
-
-		uploadDir := filepath.Join("static", "uploads")
-		// Генерируем уникальное имя файла
-		uniqueFileName := fmt.Sprintf("%s_%d%s", username, time.Now().Unix(), filepath.Ext(handler.Filename))
-		fullPath := filepath.Join(uploadDir, uniqueFileName)
-		photoPath = "/uploads/" + uniqueFileName
-
-		dst, createErr := os.Create(fullPath)
-		if createErr != nil {
-			log.Printf("❌ Ошибка создания файла на диске: %v. Продолжаем без фото.", createErr)
-		} else {
-			defer dst.Close()
-			if _, copyErr := io.Copy(dst, file); copyErr != nil {
-				log.Printf("❌ Ошибка копирования файла: %v. Продолжаем без фото.", copyErr)
-			} else {
-				log.Printf("✅ Файл успешно сохранен: %s", fullPath)
-			}
+		if photo, err = saveProfilePhoto(file); imageRejected(err) {
+			writeFieldErrors(w, fieldErrors{"profile_photo": {err.Error()}})
+			return
+		} else if err != nil {
+			log.Printf("❌ Ошибка сохранения файла: %v. Продолжаем без фото.", err)
+		}
+		// Новый пользователь получает тариф по умолчанию: даже первое фото не должно превышать его лимит
+		var quotaErr *QuotaExceededError
+		if err := checkStorageQuota(UserData{}, nil, photo.files()); errors.As(err, &quotaErr) {
+			releaseMedia(photo.files()...)
+			writeQuotaExceeded(w, "profile_photo", quotaErr)
+			return
+		} else if err != nil {
+			log.Printf("❌ Ошибка проверки квоты: %v. Продолжаем без фото.", err)
+			releaseMedia(photo.files()...)
+			photo = profilePhoto{}
 		}
-
 	} else if err != http.ErrMissingFile {
 		log.Printf("❌ Ошибка при получении файла: %v", err)
-		mu.Unlock()
 		http.Error(w, "Ошибка при обработке файла", http.StatusInternalServerError)
 		return
 	}
 
 	// 3. Хеширование и сохранение пользователя
-	hashedPasswordBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashedPassword, err := hashPassword(password)
 	if err != nil {
 		log.Printf("❌ Ошибка хеширования пароля: %v", err)
-		mu.Unlock()
+		releaseMedia(photo.files()...)
 		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
 		return
 	}
 
-	// КЛЮЧЕВОЕ ИЗМЕНЕНИЕ: Сохраняем данные по ключу email
-	users[email] = UserData{
+	userID, err := generateUserID()
+	if err != nil {
+		log.Printf("❌ Ошибка генерации ID пользователя: %v", err)
+		releaseMedia(photo.files()...)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	// Первичный ключ - сгенерированный ID, email остается уникальным атрибутом.
+	// Email пока не подтвержден: до перехода по ссылке из письма чат доступен только для чтения.
+	newUser := UserData{
+		ID:             userID,
 		Username:       username,
 		Email:          email,
-		HashedPassword: string(hashedPasswordBytes),
-		PhotoPath:      photoPath,
+		HashedPassword: hashedPassword,
+		PhotoPath:      photo.Path,
+		PhotoVariants:  photo.Variants,
+		PhotoTakenAt:   photo.TakenAt,
+		Handle:         handle,
+	}
+	err = userStore.Create(newUser)
+	if err != nil {
+		// Пользователь не создан: ссылки на уже сохраненное фото никому не принадлежат
+		releaseMedia(photo.files()...)
+	}
+	if err == ErrUserExists {
+		// Email успели занять параллельным запросом
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Email уже используется", "status": "error"})
+		return
+	} else if err == ErrHandleTaken {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Хендл уже занят", "status": "error"})
+		return
+	} else if err != nil {
+		log.Printf("❌ Ошибка сохранения пользователя: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
 	}
-	mu.Unlock()
 
-	log.Printf("✅ НОВЫЙ ПОЛЬЗОВАТЕЛЬ ДОБАВЛЕН: %s (Email: %s, Фото: %s)", username, email, photoPath)
+	log.Printf("✅ НОВЫЙ ПОЛЬЗОВАТЕЛЬ ДОБАВЛЕН: %s @%s (Email: %s, Фото: %s)", username, handle, email, photo.Path)
+
+	// 4. Отправляем письмо с подтверждением email
+	if err := sendVerificationEmail(newUser); err != nil {
+		log.Printf("❌ Ошибка отправки подтверждения на %s: %v", email, err)
+	}
 
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Регистрация прошла успешно! Теперь войдите.", "status": "success"})
+	json.NewEncoder(w).Encode(map[string]string{"message": "Регистрация прошла успешно! Подтвердите email по ссылке из письма и войдите.", "status": "success"})
 }
 
 // loginHandler обрабатывает вход пользователя, устанавливая сессионную куки.
@@ -139,36 +213,72 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	mu.Lock()
-	// КЛЮЧЕВОЕ ИЗМЕНЕНИЕ: Ищем пользователя по Email
-	userData, exists := users[creds.Email]
-	mu.Unlock()
+	// Неудачные попытки считаются и по IP, и по адресу (даже несуществующему),
+	// поэтому перебор паролей быстро упирается в паузы и блокировку
+	creds.Email = normalizeEmail(creds.Email)
+	failureKeys := []string{"ip:" + clientIP(r), "account:" + creds.Email}
+	if !checkFailures(w, loginFailures, failureKeys...) {
+		return
+	}
 
-	if !exists {
+	// КЛЮЧЕВОЕ ИЗМЕНЕНИЕ: Ищем пользователя по Email
+	userData, err := userStore.GetByEmail(creds.Email)
+	if err != nil {
+		recordFailures(r, loginFailures, failureKeys...)
 		w.WriteHeader(http.StatusUnauthorized)
 		json.NewEncoder(w).Encode(map[string]string{"message": "Неверный email или пароль", "status": "error"})
 		return
 	}
 
-	err := bcrypt.CompareHashAndPassword([]byte(userData.HashedPassword), []byte(creds.Password))
-	if err != nil {
+	passwordOK, rehash := verifyPassword(userData.HashedPassword, creds.Password)
+	if !passwordOK {
 		log.Printf("❌ Неудачная попытка входа для %s", creds.Email)
+		recordFailures(r, loginFailures, failureKeys...)
 		w.WriteHeader(http.StatusUnauthorized)
 		json.NewEncoder(w).Encode(map[string]string{"message": "Неверный email или пароль", "status": "error"})
 		return
 	}
+	resetFailures(loginFailures, failureKeys...)
+
+	// Пароль известен только сейчас: пересчитываем хеш, если его схема или параметры устарели
+	if rehash {
+		userData = upgradePasswordHash(userData, creds.Password)
+	}
+
+	// С включенной 2FA сессия создается только после ввода кода в /login/2fa
+	if userData.TOTPEnabled {
+		challenge, err := signToken(loginChallengePurpose, userData.ID, userData.Email, loginChallengeTTL)
+		if err != nil {
+			log.Printf("❌ Ошибка выпуска токена 2FA для %s: %v", userData.Email, err)
+			http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message":   "Введите код из приложения-аутентификатора",
+			"challenge": challenge,
+			"status":    "2fa_required",
+		})
+		return
+	}
+
+	// Вход в деактивированный аккаунт в течение срока восстановления возвращает его
+	if userData, err = reactivateAccount(r, userData); err == ErrAccountDeleted {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Аккаунт удален", "status": "error"})
+		return
+	} else if err != nil {
+		log.Printf("❌ Ошибка восстановления аккаунта %s: %v", userData.ID, err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
 
-	// КЛЮЧЕВОЕ ИЗМЕНЕНИЕ: Сохраняем email в куке
-	cookie := http.Cookie{
-		Name:     "session_username", // Название куки оставляем для совместимости (но теперь хранит email)
-		Value:    creds.Email,        // Храним Email
-		Expires:  time.Now().Add(24 * time.Hour),
-		HttpOnly: true,
-		Secure:   false,
-		SameSite: http.SameSiteLaxMode,
-		Path:     "/",
+	// Создаем серверную сессию: в куку попадает только случайный токен
+	if _, err := startSession(w, r, userData.ID); err != nil {
+		log.Printf("❌ Ошибка создания сессии для %s: %v", userData.Email, err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
 	}
-	http.SetCookie(w, &cookie)
 
 	log.Printf("✅ Успешный вход пользователя: %s. Установлена куки.", userData.Username)
 
@@ -178,47 +288,58 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 
 // userHandler возвращает данные профиля (доступен только после аутентификации).
 func userHandler(w http.ResponseWriter, r *http.Request) {
-	// КЛЮЧЕВОЕ ИЗМЕНЕНИЕ: Получаем email из контекста
-	email := r.Context().Value(userContextKey).(string)
-
-	mu.Lock()
-	// КЛЮЧЕВОЕ ИЗМЕНЕНИЕ: Ищем пользователя по email
-	userData, exists := users[email]
-	mu.Unlock()
+	// Получаем ID пользователя из контекста
+	userID := r.Context().Value(userContextKey).(string)
 
-	if !exists {
+	userData, err := userStore.GetByID(userID)
+	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{"message": "Пользователь не найден (по email)", "status": "error"})
+		json.NewEncoder(w).Encode(map[string]string{"message": "Пользователь не найден", "status": "error"})
 		return
 	}
 
+	identities := make([]map[string]interface{}, 0, len(userData.Identities))
+	for _, identity := range userData.Identities {
+		identities = append(identities, map[string]interface{}{
+			"provider":  identity.Provider,
+			"email":     identity.Email,
+			"linked_at": identity.LinkedAt,
+		})
+	}
+
 	// Отправляем данные, включая PhotoPath
-	response := map[string]string{
-		"username":  userData.Username,
-		"email":     userData.Email,
-		"photo_url": userData.PhotoPath,
-		"status":    "success",
+	response := map[string]interface{}{
+		"id":             userData.ID,
+		"handle":         userData.Handle,
+		"username":       userData.Username,
+		"email":          userData.Email,
+		"email_verified": userData.EmailVerified,
+		"photo_url":      userData.photoURL(requestedAvatarSize(r)),
+		"photo_variants": userData.PhotoVariants,
+		"two_factor":     userData.TOTPEnabled,
+		"has_password":   userData.HashedPassword != "",
+		"identities":     identities,
+		"status":         "success",
 	}
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
 }
 
-// logoutHandler сбрасывает сессионную куки (логика не меняется).
+// logoutHandler отзывает серверную сессию и сбрасывает куку.
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Допустим только метод POST", http.StatusMethodNotAllowed)
 		return
 	}
-	expiredCookie := http.Cookie{
-		Name:     "session_username",
-		Value:    "",
-		Expires:  time.Unix(0, 0),
-		HttpOnly: true,
-		Secure:   false,
-		SameSite: http.SameSiteLaxMode,
-		Path:     "/",
+	w.Header().Set("Content-Type", "application/json")
+
+	if cookie, err := r.Cookie(sessionCookieName); err == nil && cookie.Value != "" {
+		// Отзываем сессию и закрываем ее соединения чата
+		if err := revokeSessions(hashToken(cookie.Value)); err != nil {
+			log.Printf("❌ Ошибка отзыва сессии: %v", err)
+		}
 	}
-	http.SetCookie(w, &expiredCookie)
+	clearSessionCookie(w)
 
 	log.Printf("🚫 Пользователь вышел.")
 	w.WriteHeader(http.StatusOK)
@@ -236,8 +357,8 @@ func updateProfileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Header().Set("Content-Type", "application/json")
 
-	// 1. Получаем email текущего пользователя из контекста
-	oldEmail := r.Context().Value(userContextKey).(string)
+	// 1. Получаем ID текущего пользователя из контекста
+	userID := r.Context().Value(userContextKey).(string)
 
 	// 2. Парсинг формы (Максимальный размер запроса 10 MB)
 	if err := r.ParseMultipartForm(MAX_UPLOAD_SIZE); err != nil {
@@ -248,56 +369,72 @@ func updateProfileHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Получаем новые значения полей
 	newUsername := r.FormValue("username") // Имя и Фамилия, объединенные в JS
-	newEmail := r.FormValue("email")
+	newEmail := normalizeEmail(r.FormValue("email"))
 	newPassword := r.FormValue("new_password") // Пароль
+	currentPassword := r.FormValue("current_password")
 
 	if newUsername == "" || newEmail == "" {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{"message": "Имя и Email не могут быть пустыми", "status": "error"})
 		return
 	}
+	if err := validateEmail(newEmail); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": err.Error(), "status": "error"})
+		return
+	}
 
-	mu.Lock()
-	defer mu.Unlock()
+	// Новое фото проверяется по квоте и сохраняется в профиле под блокировкой файлов пользователя
+	lockUserStorage(userID)
+	defer unlockUserStorage(userID)
 
-	userData, exists := users[oldEmail]
-	if !exists {
+	userData, err := userStore.GetByID(userID)
+	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(map[string]string{"message": "Пользователь не найден", "status": "error"})
 		return
 	}
 
-	// 3. Обработка загруженного файла (если есть)
-	var newPhotoPath = userData.PhotoPath // Сохраняем старый путь по умолчанию
-	file, handler, err := r.FormFile("profile_photo")
-
-	if err == nil {
-		defer file.Close()
+	// Смена email и пароля требует текущего пароля (или открытого sudo-окна),
+	// чтобы украденная кука не давала захватить аккаунт
+	if (newEmail != userData.Email || newPassword != "") && !reauthenticated(r, userData, currentPassword) {
+		log.Printf("❌ Пользователь %s не подтвердил пароль для смены email/пароля", userID)
+		writeReauthRequired(w, userData, "Для смены email или пароля введите текущий пароль")
+		return
+	}
 
-		// Удаляем старое фото, если оно существует, для очистки диска
-		if userData.PhotoPath != "" && userData.PhotoPath != newPhotoPath {
-			oldFilePath := filepath.Join("static", userData.PhotoPath)
-			if oldFilePath[0] == '/' {
-				oldFilePath = oldFilePath[1:] // Убираем начальный слэш
-			}
-			os.Remove(oldFilePath)
+	if newPassword != "" {
+		if problems := validatePassword(newPassword, UserData{Username: newUsername, Email: newEmail, Handle: userData.Handle}); len(problems) > 0 {
+			writeFieldErrors(w, fieldErrors{"new_password": problems})
+			return
 		}
+	}
 
-		// Сохраняем новое фото
-		uploadDir := filepath.Join("static", "uploads")
-		uniqueFileName := fmt.Sprintf("%s_%d%s", newUsername, time.Now().Unix(), filepath.Ext(handler.Filename))
-		fullPath := filepath.Join(uploadDir, uniqueFileName)
-		newPhotoPath = "/uploads/" + uniqueFileName
+	// 3. Обработка загруженного файла (если есть)
+	var newPhoto = userData.photo() // Сохраняем старое фото по умолчанию
+	photoChanged := false
+	file, _, err := r.FormFile("profile_photo")
 
-		dst, createErr := os.Create(fullPath)
-		if createErr != nil {
-			log.Printf("❌ Ошибка создания нового файла: %v", createErr)
+	if err == nil {
+		defer file.Close()
+		savedPhoto, saveErr := saveProfilePhoto(file)
+		if imageRejected(saveErr) {
+			writeFieldErrors(w, fieldErrors{"profile_photo": {saveErr.Error()}})
+			return
+		} else if saveErr != nil {
+			log.Printf("❌ Ошибка сохранения нового файла: %v", saveErr)
 		} else {
-			defer dst.Close()
-			if _, copyErr := io.Copy(dst, file); copyErr != nil {
-				log.Printf("❌ Ошибка копирования нового файла: %v", copyErr)
+			var quotaErr *QuotaExceededError
+			if err := checkStorageQuota(userData, userData.photoFiles(), savedPhoto.files()); errors.As(err, &quotaErr) {
+				releaseMedia(savedPhoto.files()...)
+				writeQuotaExceeded(w, "profile_photo", quotaErr)
+				return
+			} else if err != nil {
+				log.Printf("❌ Ошибка проверки квоты: %v", err)
+				releaseMedia(savedPhoto.files()...)
 			} else {
-				log.Printf("✅ Новый файл успешно сохранен: %s", fullPath)
+				newPhoto = savedPhoto
+				photoChanged = true
 			}
 		}
 	} else if err != http.ErrMissingFile {
@@ -309,60 +446,58 @@ func updateProfileHandler(w http.ResponseWriter, r *http.Request) {
 	// 4. Обновление хеша пароля (если предоставлен)
 	hashedPassword := userData.HashedPassword
 	if newPassword != "" {
-		hashedPasswordBytes, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+		hashedPassword, err = hashPassword(newPassword)
 		if err != nil {
 			log.Printf("❌ Ошибка хеширования нового пароля: %v", err)
 			http.Error(w, "Внутренняя ошибка сервера при хешировании", http.StatusInternalServerError)
 			return
 		}
-		hashedPassword = string(hashedPasswordBytes)
 	}
 
-	// 5. Обновление структуры данных
-	updatedData := UserData{
-		Username:       newUsername,
-		Email:          newEmail,
-		HashedPassword: hashedPassword,
-		PhotoPath:      newPhotoPath,
+	// 5. Обновление структуры данных (ID и прочие поля сохраняются)
+	updatedData := userData
+	updatedData.Username = newUsername
+	updatedData.Email = newEmail
+	updatedData.HashedPassword = hashedPassword
+	updatedData.setPhoto(newPhoto)
+	if newEmail != userData.Email {
+		// Новый адрес нужно подтвердить заново
+		updatedData.EmailVerified = false
 	}
 
-	// 6. Обработка изменения Email (КЛЮЧЕВОЙ МОМЕНТ)
-	if oldEmail != newEmail {
-		// Проверяем, не занят ли новый email (другим пользователем)
-		if _, exists := users[newEmail]; exists {
-			w.WriteHeader(http.StatusConflict)
-			json.NewEncoder(w).Encode(map[string]string{"message": "Новый Email уже занят другим пользователем", "status": "error"})
-			return
-		}
+	// 6. Сохранение. Email - обычный атрибут: хранилище само проверит, что новый адрес свободен
+	err = userStore.Update(updatedData)
+	if err != nil && photoChanged {
+		releaseMedia(newPhoto.files()...)
+	}
+	if err == ErrUserExists {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Новый Email уже занят другим пользователем", "status": "error"})
+		return
+	} else if err != nil {
+		log.Printf("❌ Ошибка сохранения профиля: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
 
-		// Удаляем старую запись и создаем новую с новым email
-		delete(users, oldEmail)
-		users[newEmail] = updatedData
-		log.Printf("✅ Пользователь %s обновил Email с %s на %s", newUsername, oldEmail, newEmail)
-
-		// 7. Если Email изменился, необходимо обновить сессионную куку
-		cookie := http.Cookie{
-			Name:     "session_username",
-			Value:    newEmail,
-			Expires:  time.Now().Add(24 * time.Hour),
-			HttpOnly: true,
-			Secure:   false,
-			SameSite: http.SameSiteLaxMode,
-			Path:     "/",
+	if userData.Email != updatedData.Email {
+		log.Printf("✅ Пользователь %s обновил Email с %s на %s", updatedData.Username, userData.Email, updatedData.Email)
+		if err := sendVerificationEmail(updatedData); err != nil {
+			log.Printf("❌ Ошибка отправки подтверждения на %s: %v", updatedData.Email, err)
+		}
+		// Уведомляем старый адрес и даем ссылку для отмены
+		if err := sendEmailChangedNotice(userData, updatedData.Email); err != nil {
+			log.Printf("❌ Ошибка отправки уведомления на %s: %v", userData.Email, err)
 		}
-		http.SetCookie(w, &cookie)
-
-	} else {
-		// Email не изменился, просто обновляем текущую запись
-		users[oldEmail] = updatedData
 	}
-
+	if photoChanged {
+		// Старое фото больше не нужно профилю; файлы удалит сборщик, если на них никто не ссылается
+		releaseMedia(userData.photoFiles()...)
+	}
 	log.Printf("✅ Профиль пользователя %s успешно обновлен. (Email: %s)", updatedData.Username, updatedData.Email)
 
-	if oldEmail != updatedData.Email || oldEmail == updatedData.Email {
-		// Используем oldEmail, чтобы хаб мог найти клиента, у которого этот email в структуре
-		hub.profileUpdate <- oldEmail
-	}
+	// 7. Оповещаем чат: клиенты ищутся по неизменному ID
+	hub.profileUpdate <- updatedData.ID
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// --- Настройки Хендлов (@name) ---
+
+const (
+	handleMinLength = 3
+	handleMaxLength = 30
+	// handleChangeCooldown - как часто пользователь может менять свой хендл.
+	handleChangeCooldown = 7 * 24 * time.Hour
+	// handleReservationPeriod - сколько старый хендл закреплен за прежним владельцем после смены.
+	handleReservationPeriod = 14 * 24 * time.Hour
+)
+
+// ErrHandleTaken возвращается, если хендл занят другим пользователем или зарезервирован.
+var ErrHandleTaken = errors.New("хендл уже занят")
+
+// reservedHandles - служебные имена, которые нельзя занять (совпадают с маршрутами и ролями).
+var reservedHandles = map[string]bool{
+	"admin": true, "api": true, "u": true, "user": true, "users": true, "login": true,
+	"logout": true, "register": true, "uploads": true, "js": true, "ws": true,
+	"support": true, "help": true, "settings": true, "root": true, "system": true,
+}
+
+// handleEntry - запись индекса хендлов. Активный хендл имеет нулевой ReservedUntil,
+// старый хендл после смены хранится с датой окончания резерва.
+type handleEntry struct {
+	UserID        string    `json:"user_id"`
+	ReservedUntil time.Time `json:"reserved_until"`
+}
+
+// active сообщает, является ли хендл текущим хендлом пользователя.
+func (e handleEntry) active() bool {
+	return e.ReservedUntil.IsZero()
+}
+
+// blocks сообщает, мешает ли запись пользователю userID занять хендл в момент now.
+// Свой хендл (в т.ч. зарезервированный) всегда можно вернуть себе.
+func (e handleEntry) blocks(userID string, now time.Time) bool {
+	if e.UserID == userID {
+		return false
+	}
+	return e.active() || now.Before(e.ReservedUntil)
+}
+
+// --- Нормализация и проверка ---
+
+// normalizeHandle приводит хендл к каноническому виду: без "@", пробелов по краям и в нижнем регистре.
+func normalizeHandle(handle string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(handle), "@"))
+}
+
+// validateHandle проверяет уже нормализованный хендл и возвращает понятную пользователю ошибку.
+func validateHandle(handle string) error {
+	if len(handle) < handleMinLength || len(handle) > handleMaxLength {
+		return fmt.Errorf("Длина хендла должна быть от %d до %d символов", handleMinLength, handleMaxLength)
+	}
+	for _, c := range handle {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '.') {
+			return errors.New("Хендл может содержать только латинские буквы, цифры, точку и подчеркивание")
+		}
+	}
+	if strings.HasPrefix(handle, ".") || strings.HasSuffix(handle, ".") || strings.Contains(handle, "..") {
+		return errors.New("Хендл не может начинаться или заканчиваться точкой и содержать две точки подряд")
+	}
+	if reservedHandles[handle] {
+		return errors.New("Этот хендл зарезервирован системой")
+	}
+	return nil
+}
+
+// generateHandle подбирает свободный хендл на основе имени или email (для регистрации без хендла
+// и для пользователей, созданных до появления хендлов). taken проверяет занятость кандидата.
+func generateHandle(base string, taken func(string) bool) (string, error) {
+	var b strings.Builder
+	for _, c := range strings.ToLower(base) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+			b.WriteRune(c)
+		case c == '_' || c == '.' || c == ' ' || c == '-':
+			b.WriteRune('_')
+		}
+	}
+	candidate := strings.Trim(b.String(), "_")
+	if len(candidate) > handleMaxLength-5 {
+		candidate = candidate[:handleMaxLength-5]
+	}
+	if len(candidate) < handleMinLength {
+		candidate = "user"
+	}
+	if validateHandle(candidate) == nil && !taken(candidate) {
+		return candidate, nil
+	}
+
+	// Добавляем случайный числовой суффикс, пока не найдем свободный вариант
+	for i := 0; i < 20; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(10000))
+		if err != nil {
+			return "", err
+		}
+		withSuffix := fmt.Sprintf("%s_%04d", candidate, n.Int64())
+		if validateHandle(withSuffix) == nil && !taken(withSuffix) {
+			return withSuffix, nil
+		}
+	}
+	return "", ErrHandleTaken
+}
+
+// =======================================================================
+// Обработчики API хендлов
+// =======================================================================
+
+// handleAvailableHandler проверяет, можно ли занять хендл: GET /api/handles/available?h=name
+func handleAvailableHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Допустим только метод GET", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	handle := normalizeHandle(r.URL.Query().Get("h"))
+	if err := validateHandle(handle); err != nil {
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"handle": handle, "available": false, "message": err.Error(), "status": "success"})
+		return
+	}
+
+	// Авторизованный пользователь может вернуть себе собственный (зарезервированный) хендл
+	userID := ""
+	if session, err := resolveSession(w, r); err == nil {
+		userID = session.UserID
+	}
+
+	available, err := userStore.HandleAvailable(handle, userID)
+	if err != nil {
+		log.Printf("❌ Ошибка проверки хендла %s: %v", handle, err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{"handle": handle, "available": available, "status": "success"}
+	if !available {
+		response["message"] = "Хендл уже занят"
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// changeHandleHandler меняет хендл текущего пользователя с учетом кулдауна: POST /user/handle {"handle": "..."}
+func changeHandleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Допустим только метод POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Context().Value(userContextKey).(string)
+
+	var body struct {
+		Handle string `json:"handle"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Неверный формат JSON в теле запроса", http.StatusBadRequest)
+		return
+	}
+
+	handle := normalizeHandle(body.Handle)
+	if err := validateHandle(handle); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": err.Error(), "status": "error"})
+		return
+	}
+
+	userData, err := userStore.GetByID(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Пользователь не найден", "status": "error"})
+		return
+	}
+	if userData.Handle == handle {
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Хендл не изменился", "handle": handle, "status": "success"})
+		return
+	}
+
+	// Кулдаун: менять хендл можно не чаще раза в handleChangeCooldown
+	if next := userData.HandleChangedAt.Add(handleChangeCooldown); time.Now().Before(next) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message":        fmt.Sprintf("Хендл можно будет сменить после %s", next.Format("02.01.2006 15:04")),
+			"next_change_at": next.Format(time.RFC3339),
+			"status":         "error",
+		})
+		return
+	}
+
+	oldHandle := userData.Handle
+	userData.Handle = handle
+	userData.HandleChangedAt = time.Now()
+
+	// Хранилище проверит занятость и зарезервирует старый хендл за пользователем
+	if err := userStore.Update(userData); err == ErrHandleTaken {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Хендл уже занят", "status": "error"})
+		return
+	} else if err != nil {
+		log.Printf("❌ Ошибка смены хендла: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("✅ Пользователь %s сменил хендл @%s -> @%s", userID, oldHandle, handle)
+	hub.profileUpdate <- userID
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Хендл изменен", "handle": handle, "status": "success"})
+}
+
+// publicProfileHandler возвращает публичный профиль по хендлу: GET /u/{handle}
+func publicProfileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Допустим только метод GET", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	handle := normalizeHandle(strings.TrimPrefix(r.URL.Path, "/u/"))
+	userData, err := userStore.GetByHandle(handle)
+	if err != nil || userData.deactivated() {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Профиль не найден", "status": "error"})
+		return
+	}
+
+	// Только публичные поля: без email и хеша пароля
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":        userData.ID,
+		"handle":    userData.Handle,
+		"username":  userData.Username,
+		"photo_url": userData.photoURL(requestedAvatarSize(r)),
+		"status":    "success",
+	})
+}
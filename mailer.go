@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Отправка Писем ---
+
+// MailMessage - простое текстовое письмо.
+type MailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer отправляет письма пользователям. Реализация выбирается в initMailer().
+type Mailer interface {
+	Send(msg MailMessage) error
+}
+
+// mailer - активный отправитель писем.
+var mailer Mailer
+
+// initMailer создает отправителя писем согласно mailerKind.
+func initMailer() {
+	switch mailerKind {
+	case "smtp":
+		mailer = newSMTPMailer(smtpHost, smtpPort, smtpUser, smtpPassword, mailFrom)
+		log.Printf("📧 Письма отправляются через SMTP %s:%s", smtpHost, smtpPort)
+	default:
+		outbox, err := newOutboxMailer(mailOutboxDir)
+		if err != nil {
+			log.Fatalf("❌ Не удалось создать папку для писем: %v", err)
+		}
+		mailer = outbox
+		log.Printf("📧 Письма складываются в %s (MAILER=outbox)", mailOutboxDir)
+	}
+}
+
+// sendMailAsync отправляет письмо в фоне, чтобы медленный SMTP не задерживал ответ API.
+func sendMailAsync(msg MailMessage) {
+	go func() {
+		if err := mailer.Send(msg); err != nil {
+			log.Printf("❌ Не удалось отправить письмо %q на %s: %v", msg.Subject, msg.To, err)
+		}
+	}()
+}
+
+// formatMail собирает письмо в формате RFC 5322 (текст в UTF-8).
+func formatMail(from string, msg MailMessage) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// =======================================================================
+// SMTP
+// =======================================================================
+
+// smtpMailer отправляет письма через внешний SMTP-сервер (STARTTLS, если сервер его поддерживает).
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+func newSMTPMailer(host, port, user, password, from string) *smtpMailer {
+	var auth smtp.Auth
+	if user != "" {
+		auth = smtp.PlainAuth("", user, password, host)
+	}
+	return &smtpMailer{addr: host + ":" + port, auth: auth, from: from}
+}
+
+func (m *smtpMailer) Send(msg MailMessage) error {
+	sender, err := mail.ParseAddress(m.from)
+	if err != nil {
+		return fmt.Errorf("некорректный MAIL_FROM: %w", err)
+	}
+	return smtp.SendMail(m.addr, m.auth, sender.Address, []string{msg.To}, formatMail(m.from, msg))
+}
+
+// =======================================================================
+// Outbox (файлы + память) для локальной разработки
+// =======================================================================
+
+// outboxMailer не отправляет письма, а сохраняет их в памяти и (если задана папка) в файлы .eml.
+type outboxMailer struct {
+	dir      string
+	mu       sync.Mutex
+	messages []MailMessage
+}
+
+// newOutboxMailer создает outbox. Пустой dir - хранить письма только в памяти.
+func newOutboxMailer(dir string) (*outboxMailer, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &outboxMailer{dir: dir}, nil
+}
+
+func (m *outboxMailer) Send(msg MailMessage) error {
+	m.mu.Lock()
+	m.messages = append(m.messages, msg)
+	m.mu.Unlock()
+
+	log.Printf("📨 Письмо для %s: %s", msg.To, msg.Subject)
+	if m.dir == "" {
+		return nil
+	}
+	name := fmt.Sprintf("%d_%s.eml", time.Now().UnixNano(), strings.NewReplacer("@", "_at_", "/", "_").Replace(msg.To))
+	return os.WriteFile(filepath.Join(m.dir, name), formatMail(mailFrom, msg), 0644)
+}
+
+// Messages возвращает копию всех отправленных писем (для тестов и отладки).
+func (m *outboxMailer) Messages() []MailMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]MailMessage(nil), m.messages...)
+}
@@ -1,52 +1,135 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
-	"path/filepath"
+	"time"
 )
 
 func main() {
-	// --- Инициализация Файловой Системы ---
+	calibrateHash := flag.Duration("calibrate-hash", 0, "подобрать параметры хеширования паролей под это время на хеш (например 250ms) и выйти")
+	setTier := flag.String("set-tier", "", "назначить тариф хранилища пользователю (handle=tier, пустой тариф - по умолчанию) и выйти")
+	flag.Parse()
+	if *calibrateHash > 0 {
+		calibratePasswordHashers(*calibrateHash)
+		return
+	}
+
+	// --- Инициализация Хранилищ ---
 
-	// Указываем путь к папке загрузок (static/uploads)
-	uploadDir := filepath.Join("static", "uploads")
+	closeStorage := initStorage()
+	defer closeStorage()
+	initBlobStore()
+	initStorageQuotas()
 
-	// Проверяем и создаем директорию для загрузок, если она не существует
-	if _, err := os.Stat(uploadDir); os.IsNotExist(err) {
-		log.Printf("Создание директории загрузок: %s", uploadDir)
-		if err := os.MkdirAll(uploadDir, 0755); err != nil {
-			log.Fatalf("❌ Не удалось создать директорию загрузок: %v", err)
+	if *setTier != "" {
+		if err := setUserTier(*setTier); err != nil {
+			log.Fatalf("❌ Не удалось назначить тариф: %v", err)
 		}
+		return
 	}
 
+	initAppSecret()
+	initMailer()
+	initAuditLog()
+	initOIDC()
+	initPasswordPolicy()
+	initPasswordHasher()
+	initExports()
+	initResumableUploads()
+	initPhotoMetadata()
+
+	// Фоновая очистка истекших сессий, токенов и счетчиков ограничителей
+	go purgeExpiredSessions(time.Hour)
+	go purgeExpiredTokens(time.Hour)
+	go purgeExpiredAPITokens(time.Hour)
+	go purgeRateLimits(10 * time.Minute)
+	go purgeDeactivatedAccounts(time.Hour)
+	go purgeExpiredExports(time.Hour)
+	go sweepOrphanedMedia(time.Hour)
+	go purgeExpiredResumableUploads(time.Hour)
+
+	// Превью и очистка EXIF для фото, загруженных до появления обработки
+	go reprocessProfilePhotos()
+
 	// --- Обслуживание Статических Файлов ---
 
 	// 1. Главный маршрут (/)
 	// Обслуживаем содержимое папки static/templates по корневому пути (/).
-	http.Handle("/", http.FileServer(http.Dir("static/templates")))
+	// Вместе со страницами браузер получает CSRF-токен (куку csrf_token).
+	http.Handle("/", csrfCookieMiddleware(http.FileServer(http.Dir("static/templates"))))
 
 	// 2. JavaScript (/js/)
 	// Обслуживаем /js/ из папки static/js
 	http.Handle("/js/", http.StripPrefix("/js/", http.FileServer(http.Dir("static/js"))))
 
 	// 3. Загруженные файлы (/uploads/)
-	// Обслуживаем /uploads/ из папки static/uploads. Здесь хранятся фото профиля.
-	http.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir(uploadDir))))
+	// Обслуживаем /uploads/ из хранилища загрузок (BLOB_STORE: папка static/uploads или S3).
+	// Здесь хранятся фото профиля; uploadsHandler отдает их с безопасными заголовками и без листинга.
+	http.HandleFunc("/uploads/", uploadsHandler)
 
 	// --- Обработчики API и Маршрутизация ---
 
 	// Маршруты без защиты (открыты для всех)
-	http.HandleFunc("/register", registerHandler)
-	http.HandleFunc("/login", loginHandler)
-	http.HandleFunc("/logout", logoutHandler)
+	http.HandleFunc("/register", rateLimitMiddleware(registerRateLimiter, csrfMiddleware(registerHandler)))
+	http.HandleFunc("/login", rateLimitMiddleware(loginRateLimiter, csrfMiddleware(loginHandler)))
+	http.HandleFunc("/login/2fa", rateLimitMiddleware(loginRateLimiter, csrfMiddleware(loginTwoFactorHandler)))
+	http.HandleFunc("/logout", csrfMiddleware(logoutHandler))
+	http.HandleFunc("/api/handles/available", handleAvailableHandler)
+	http.HandleFunc("/u/", publicProfileHandler)
+	http.HandleFunc("/verify-email", verifyEmailHandler)
+	http.HandleFunc("/password/forgot", rateLimitMiddleware(passwordRateLimiter, csrfMiddleware(forgotPasswordHandler)))
+	http.HandleFunc("/password/reset", rateLimitMiddleware(passwordRateLimiter, csrfMiddleware(resetPasswordHandler)))
+	http.HandleFunc("/user/email/undo", rateLimitMiddleware(passwordRateLimiter, csrfMiddleware(undoEmailChangeHandler)))
+
+	// Вход через внешних провайдеров (OpenID Connect)
+	http.HandleFunc("/auth/oidc/providers", oidcProvidersHandler)
+	http.HandleFunc("/auth/oidc/", rateLimitMiddleware(loginRateLimiter, oidcHandler))
 
-	// Защищенные маршруты (требуют аутентификации через authMiddleware)
-	http.HandleFunc("/user", authMiddleware(userHandler))
+	// Защищенные маршруты (требуют аутентификации через authMiddleware).
+	// Изменяющие запросы дополнительно проходят csrfMiddleware, а apiScope открывает маршрут API-токенам.
+	http.HandleFunc("/user", apiScope(scopeProfileRead, authMiddleware(userHandler)))
 	// ✅ ДОБАВЛЕН НОВЫЙ МАРШРУТ ДЛЯ ОБНОВЛЕНИЯ ПРОФИЛЯ
-	http.HandleFunc("/user/update", authMiddleware(updateProfileHandler))
+	http.HandleFunc("/user/update", rateLimitMiddleware(passwordRateLimiter, authMiddleware(csrfMiddleware(updateProfileHandler))))
+	http.HandleFunc("/user/photo", apiScope(scopeMediaUpload, authMiddleware(csrfMiddleware(profilePhotoHandler))))
+	// Возобновляемая загрузка больших файлов по частям (протокол в духе tus, см. resumable.go)
+	http.HandleFunc("/user/uploads", apiScope(scopeMediaUpload, authMiddleware(csrfMiddleware(resumableUploadsHandler))))
+	http.HandleFunc("/user/uploads/", apiScope(scopeMediaUpload, authMiddleware(csrfMiddleware(resumableUploadHandler))))
+	http.HandleFunc("/user/storage", apiScope(scopeProfileRead, authMiddleware(storageUsageHandler)))
+	http.HandleFunc("/user/handle", authMiddleware(csrfMiddleware(changeHandleHandler)))
+	http.HandleFunc("/user/sudo", rateLimitMiddleware(passwordRateLimiter, authMiddleware(csrfMiddleware(sudoHandler))))
+	http.HandleFunc("/user/2fa/setup", authMiddleware(csrfMiddleware(twoFactorSetupHandler)))
+	http.HandleFunc("/user/2fa/qr", authMiddleware(twoFactorQRHandler))
+	http.HandleFunc("/user/2fa/enable", rateLimitMiddleware(passwordRateLimiter, authMiddleware(csrfMiddleware(twoFactorEnableHandler))))
+	http.HandleFunc("/user/2fa/disable", rateLimitMiddleware(passwordRateLimiter, authMiddleware(csrfMiddleware(twoFactorDisableHandler))))
+	http.HandleFunc("/user/2fa/recovery-codes", authMiddleware(csrfMiddleware(recoveryCodesHandler)))
+	http.HandleFunc("/verify-email/resend", authMiddleware(csrfMiddleware(resendVerificationHandler)))
+
+	// Управление активными сессиями (устройствами) пользователя
+	http.HandleFunc("/user/sessions", authMiddleware(sessionsHandler))
+	http.HandleFunc("/user/sessions/revoke", authMiddleware(csrfMiddleware(revokeSessionHandler)))
+	http.HandleFunc("/user/sessions/revoke_others", authMiddleware(csrfMiddleware(revokeOtherSessionsHandler)))
+
+	http.HandleFunc("/user/identities/unlink", authMiddleware(csrfMiddleware(unlinkIdentityHandler)))
+
+	// Посты: просмотр доступен всем, изменение - автору (права проверяются в postHandler)
+	http.HandleFunc("/api/posts", apiScope(scopeMediaUpload, authMiddleware(csrfMiddleware(createPostHandler))))
+	http.HandleFunc("/api/posts/", postHandler)
+	http.HandleFunc("/api/users/", userPostsHandler)
+
+	// Персональные API-токены (управляются только из браузерной сессии)
+	http.HandleFunc("/user/tokens", authMiddleware(csrfMiddleware(apiTokensHandler)))
+	http.HandleFunc("/user/tokens/revoke", authMiddleware(csrfMiddleware(revokeAPITokenHandler)))
+
+	// Выгрузка персональных данных (архив собирается в фоне, ссылка приходит письмом)
+	http.HandleFunc("/user/export", authMiddleware(csrfMiddleware(dataExportHandler)))
+	http.HandleFunc("/user/export/download", authMiddleware(dataExportDownloadHandler))
+
+	// Деактивация (с возможностью восстановить входом) и удаление аккаунта
+	http.HandleFunc("/user/deactivate", rateLimitMiddleware(passwordRateLimiter, authMiddleware(csrfMiddleware(deactivateAccountHandler))))
+	http.HandleFunc("/user/delete", rateLimitMiddleware(passwordRateLimiter, authMiddleware(csrfMiddleware(deleteAccountHandler))))
 
 	// --- Запуск Сервера ---
 
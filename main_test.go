@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// TestMain готовит окружение, как initStorage с STORAGE=memory: хранилища в памяти,
+// загрузки, части загрузок и письма во временной папке, тестовый секрет токенов.
+// Хаб чата запускается в init() из chat.go.
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+
+	dir, err := os.MkdirTemp("", "clone_instagram_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	resumableUploadDir = filepath.Join(dir, "resumable")
+	if err := os.MkdirAll(resumableUploadDir, 0700); err != nil {
+		log.Fatal(err)
+	}
+	if blobStore, err = newLocalBlobStore(filepath.Join(dir, "uploads")); err != nil {
+		log.Fatal(err)
+	}
+	if mailer, err = newOutboxMailer(filepath.Join(dir, "outbox")); err != nil {
+		log.Fatal(err)
+	}
+	appSecret = []byte("test-secret-test-secret-test-secret")
+	useMemoryStores()
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// useMemoryStores подменяет все хранилища пустыми хранилищами в памяти.
+func useMemoryStores() {
+	userStore = newMemoryUserStore()
+	sessionStore = newMemorySessionStore()
+	oneTimeTokenStore = newMemoryOneTimeTokenStore()
+	apiTokenStore = newMemoryAPITokenStore()
+	mediaStore = newMemoryMediaStore()
+	resumableUploadStore = newMemoryResumableUploadStore()
+	postStore = newMemoryPostStore()
+}
+
+// openTestDB открывает пустую базу bbolt во временной папке теста.
+func openTestDB(t *testing.T) *bolt.DB {
+	t.Helper()
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("открытие базы: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
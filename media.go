@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// --- Медиафайлы: Дедупликация и Сборка Мусора ---
+//
+// Файлы в хранилище загрузок называются по SHA-256 содержимого, поэтому одинаковые загрузки
+// (повторная отправка формы, одна картинка у нескольких пользователей) занимают один файл.
+// Владельцы (фото профиля, посты) учитываются счетчиком ссылок в MediaStore:
+// storeMedia добавляет ссылку, releaseMedia снимает. Сам файл не удаляется сразу - это делает
+// sweepOrphanedMedia, когда на него не ссылаются ни счетчик, ни пользователи, ни история чата.
+
+// mediaGracePeriod - сколько после загрузки или снятия последней ссылки файл не удаляется:
+// загрузка могла еще не попасть в профиль, а страницы со старой ссылкой - быть открыты.
+const mediaGracePeriod = time.Hour
+
+// ErrMediaNotFound возвращается, если учетной записи файла нет.
+var ErrMediaNotFound = errors.New("медиафайл не найден")
+
+// MediaBlob - учетная запись файла в хранилище загрузок.
+type MediaBlob struct {
+	Key        string    `json:"key"`
+	Size       int64     `json:"size"`
+	Refs       int       `json:"refs"`        // Сколько владельцев ссылается на файл
+	CreatedAt  time.Time `json:"created_at"`  // Когда файл загружен впервые
+	ReleasedAt time.Time `json:"released_at"` // Когда снята последняя ссылка (нулевое, пока Refs > 0)
+}
+
+// MediaStore хранит счетчики ссылок на файлы загрузок.
+type MediaStore interface {
+	// Acquire добавляет ссылку на файл key, создавая запись при первой.
+	// Возвращает true, если записи не было и файл нужно загрузить в хранилище.
+	Acquire(key string, size int64, now time.Time) (bool, error)
+	// Release снимает ссылку на файл. Файлы без записи (загруженные до учета) пропускаются.
+	Release(key string, now time.Time) error
+	// Get возвращает запись файла или ErrMediaNotFound.
+	Get(key string) (MediaBlob, error)
+	// DeleteUnreferenced удаляет запись, если ссылок на файл нет, и сообщает, удалена ли она.
+	// Отсутствие записи считается удалением.
+	DeleteUnreferenced(key string) (bool, error)
+	// List возвращает все записи.
+	List() ([]MediaBlob, error)
+}
+
+// mediaStore - активное хранилище счетчиков, инициализируется в initStorage().
+var mediaStore MediaStore
+
+// mediaMu упорядочивает загрузку новых файлов и удаление неиспользуемых:
+// иначе сборщик мог бы удалить файл, на который только что сослалась новая загрузка.
+var mediaMu sync.Mutex
+
+// storeMedia сохраняет файл с расширением ext под именем по хешу содержимого, добавляет
+// на него ссылку и возвращает URL (/uploads/...). Если такой файл уже есть, он не загружается заново,
+// а пропавший из хранилища файл с живой записью загружается снова.
+func storeMedia(data []byte, ext string) (string, error) {
+	sum := sha256.Sum256(data)
+	key := hex.EncodeToString(sum[:]) + ext
+
+	mediaMu.Lock()
+	defer mediaMu.Unlock()
+	created, err := mediaStore.Acquire(key, int64(len(data)), time.Now())
+	if err != nil {
+		return "", err
+	}
+	if !created {
+		// Запись есть, но сам файл мог пропасть из хранилища (удален вручную, правилом
+		// жизненного цикла S3): загружаем его заново, иначе ссылка навсегда вела бы на 404
+		_, err := blobStore.Stat(key)
+		if err == nil {
+			log.Printf("♻️ Файл %s уже есть в хранилище, добавлена ссылка", key)
+			return "/uploads/" + key, nil
+		}
+		if !errors.Is(err, ErrBlobNotFound) {
+			mediaStore.Release(key, time.Now())
+			return "", err
+		}
+		log.Printf("⚠️ Файл %s пропал из хранилища, загружаем заново", key)
+	}
+	if err := blobStore.Put(key, bytes.NewReader(data), int64(len(data)), mime.TypeByExtension(ext)); err != nil {
+		if err := mediaStore.Release(key, time.Now()); err == nil {
+			mediaStore.DeleteUnreferenced(key)
+		}
+		return "", err
+	}
+	log.Printf("✅ Файл успешно сохранен: %s", key)
+	return "/uploads/" + key, nil
+}
+
+// releaseMedia снимает ссылки на файлы по их URL (/uploads/...). Файлы удалит sweepOrphanedMedia.
+func releaseMedia(urls ...string) {
+	now := time.Now()
+	for _, url := range urls {
+		key, ok := uploadKey(url)
+		if !ok {
+			continue
+		}
+		if err := mediaStore.Release(key, now); err != nil {
+			log.Printf("❌ Ошибка снятия ссылки на файл %s: %v", key, err)
+		}
+	}
+}
+
+// referencedMedia собирает ключи файлов, на которые ссылаются пользователи (включая
+// деактивированных), их посты и сообщения в истории чата.
+func referencedMedia() (map[string]bool, error) {
+	referenced := map[string]bool{}
+	users, err := userStore.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		for _, url := range user.photoFiles() {
+			if key, ok := uploadKey(url); ok {
+				referenced[key] = true
+			}
+		}
+	}
+	posts, err := postStore.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, post := range posts {
+		for _, url := range post.files() {
+			if key, ok := uploadKey(url); ok {
+				referenced[key] = true
+			}
+		}
+	}
+	for _, msg := range hub.allMessages() {
+		if key, ok := uploadKey(msg.PhotoURL); ok {
+			referenced[key] = true
+		}
+	}
+	return referenced, nil
+}
+
+// sweepMedia удаляет файлы, на которые никто не ссылается дольше mediaGracePeriod,
+// и записи о файлах, которых уже нет в хранилище. Возвращает число удаленных файлов.
+func sweepMedia(now time.Time) (int, error) {
+	referenced, err := referencedMedia()
+	if err != nil {
+		return 0, err
+	}
+	records, err := mediaStore.List()
+	if err != nil {
+		return 0, err
+	}
+	byKey := make(map[string]MediaBlob, len(records))
+	for _, record := range records {
+		byKey[record.Key] = record
+	}
+	blobs, err := blobStore.List()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	stored := make(map[string]bool, len(blobs))
+	for _, blob := range blobs {
+		stored[blob.Key] = true
+		record, tracked := byKey[blob.Key]
+		if referenced[blob.Key] || (tracked && record.Refs > 0) {
+			continue
+		}
+		lastUsed := blob.ModTime
+		if record.ReleasedAt.After(lastUsed) {
+			lastUsed = record.ReleasedAt
+		}
+		if now.Sub(lastUsed) < mediaGracePeriod {
+			continue
+		}
+
+		deleted, err := deleteOrphanedMedia(blob.Key)
+		if err != nil {
+			log.Printf("❌ Ошибка удаления неиспользуемого файла %s: %v", blob.Key, err)
+			continue
+		}
+		if deleted {
+			removed++
+		}
+	}
+
+	// Записи без файлов (файл удален вручную или не загрузился) только мешают дедупликации
+	for _, record := range records {
+		if !stored[record.Key] && record.Refs == 0 {
+			if _, err := mediaStore.DeleteUnreferenced(record.Key); err != nil {
+				log.Printf("❌ Ошибка удаления записи о файле %s: %v", record.Key, err)
+			}
+		}
+	}
+	return removed, nil
+}
+
+// deleteOrphanedMedia удаляет файл, если за время сборки на него не появилось новых ссылок.
+func deleteOrphanedMedia(key string) (bool, error) {
+	mediaMu.Lock()
+	defer mediaMu.Unlock()
+	deleted, err := mediaStore.DeleteUnreferenced(key)
+	if err != nil || !deleted {
+		return false, err
+	}
+	return true, blobStore.Delete(key)
+}
+
+// sweepOrphanedMedia периодически удаляет неиспользуемые файлы загрузок.
+func sweepOrphanedMedia(interval time.Duration) {
+	for range time.Tick(interval) {
+		removed, err := sweepMedia(time.Now())
+		if err != nil {
+			log.Printf("❌ Ошибка сборки неиспользуемых файлов: %v", err)
+			continue
+		}
+		if removed > 0 {
+			log.Printf("🧹 Удалено неиспользуемых файлов: %d", removed)
+		}
+	}
+}
+
+// =======================================================================
+// Счетчики в памяти
+// =======================================================================
+
+type memoryMediaStore struct {
+	mu    sync.Mutex
+	blobs map[string]MediaBlob
+}
+
+func newMemoryMediaStore() *memoryMediaStore {
+	return &memoryMediaStore{blobs: make(map[string]MediaBlob)}
+}
+
+func (s *memoryMediaStore) Acquire(key string, size int64, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	blob, exists := s.blobs[key]
+	if !exists {
+		blob = MediaBlob{Key: key, Size: size, CreatedAt: now}
+	}
+	blob.Refs++
+	blob.ReleasedAt = time.Time{}
+	s.blobs[key] = blob
+	return !exists, nil
+}
+
+func (s *memoryMediaStore) Release(key string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	blob, exists := s.blobs[key]
+	if !exists || blob.Refs == 0 {
+		return nil
+	}
+	if blob.Refs--; blob.Refs == 0 {
+		blob.ReleasedAt = now
+	}
+	s.blobs[key] = blob
+	return nil
+}
+
+func (s *memoryMediaStore) Get(key string) (MediaBlob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	blob, exists := s.blobs[key]
+	if !exists {
+		return MediaBlob{}, ErrMediaNotFound
+	}
+	return blob, nil
+}
+
+func (s *memoryMediaStore) DeleteUnreferenced(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.blobs[key].Refs > 0 {
+		return false, nil
+	}
+	delete(s.blobs, key)
+	return true, nil
+}
+
+func (s *memoryMediaStore) List() ([]MediaBlob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]MediaBlob, 0, len(s.blobs))
+	for _, blob := range s.blobs {
+		list = append(list, blob)
+	}
+	return list, nil
+}
+
+// =======================================================================
+// Счетчики на диске (bbolt)
+// =======================================================================
+
+var mediaBucket = []byte("media")
+
+type boltMediaStore struct {
+	db *bolt.DB
+}
+
+func newBoltMediaStore(db *bolt.DB) (*boltMediaStore, error) {
+	if err := createBuckets(db, mediaBucket); err != nil {
+		return nil, err
+	}
+	return &boltMediaStore{db: db}, nil
+}
+
+func (s *boltMediaStore) Acquire(key string, size int64, now time.Time) (bool, error) {
+	created := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(mediaBucket)
+		var blob MediaBlob
+		found, err := boltGet(b, key, &blob)
+		if err != nil {
+			return err
+		}
+		if !found {
+			blob = MediaBlob{Key: key, Size: size, CreatedAt: now}
+			created = true
+		}
+		blob.Refs++
+		blob.ReleasedAt = time.Time{}
+		return boltPut(b, key, blob)
+	})
+	return created, err
+}
+
+func (s *boltMediaStore) Release(key string, now time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(mediaBucket)
+		var blob MediaBlob
+		found, err := boltGet(b, key, &blob)
+		if err != nil || !found || blob.Refs == 0 {
+			return err
+		}
+		if blob.Refs--; blob.Refs == 0 {
+			blob.ReleasedAt = now
+		}
+		return boltPut(b, key, blob)
+	})
+}
+
+func (s *boltMediaStore) Get(key string) (MediaBlob, error) {
+	var blob MediaBlob
+	err := s.db.View(func(tx *bolt.Tx) error {
+		found, err := boltGet(tx.Bucket(mediaBucket), key, &blob)
+		if err == nil && !found {
+			err = ErrMediaNotFound
+		}
+		return err
+	})
+	return blob, err
+}
+
+func (s *boltMediaStore) DeleteUnreferenced(key string) (bool, error) {
+	deleted := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(mediaBucket)
+		var blob MediaBlob
+		found, err := boltGet(b, key, &blob)
+		if err != nil || (found && blob.Refs > 0) {
+			return err
+		}
+		deleted = true
+		return b.Delete([]byte(key))
+	})
+	return deleted, err
+}
+
+func (s *boltMediaStore) List() ([]MediaBlob, error) {
+	list := make([]MediaBlob, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(mediaBucket).ForEach(func(_, data []byte) error {
+			var blob MediaBlob
+			if err := json.Unmarshal(data, &blob); err != nil {
+				return err
+			}
+			list = append(list, blob)
+			return nil
+		})
+	})
+	return list, err
+}
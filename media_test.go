@@ -0,0 +1,200 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// mediaStoreCases - реализации MediaStore, которые должны вести себя одинаково.
+func mediaStoreCases() map[string]func(t *testing.T) MediaStore {
+	return map[string]func(t *testing.T) MediaStore{
+		"memory": func(t *testing.T) MediaStore { return newMemoryMediaStore() },
+		"bolt": func(t *testing.T) MediaStore {
+			store, err := newBoltMediaStore(openTestDB(t))
+			if err != nil {
+				t.Fatalf("создание хранилища: %v", err)
+			}
+			return store
+		},
+	}
+}
+
+// useTestMedia подменяет хранилище загрузок пустой временной папкой, а счетчики - store.
+func useTestMedia(t *testing.T, store MediaStore) {
+	t.Helper()
+	blobs, err := newLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("хранилище загрузок: %v", err)
+	}
+	oldBlobs, oldMedia := blobStore, mediaStore
+	blobStore, mediaStore = blobs, store
+	t.Cleanup(func() { blobStore, mediaStore = oldBlobs, oldMedia })
+}
+
+func TestStoreMediaRefcounts(t *testing.T) {
+	for name, newStore := range mediaStoreCases() {
+		t.Run(name, func(t *testing.T) {
+			useTestMedia(t, newStore(t))
+
+			first, err := storeMedia([]byte("photo"), ".jpg")
+			if err != nil {
+				t.Fatalf("storeMedia: %v", err)
+			}
+			second, err := storeMedia([]byte("photo"), ".jpg")
+			if err != nil || second != first {
+				t.Fatalf("повторная загрузка: %q, %v, ожидался тот же URL %q", second, err, first)
+			}
+			other, _ := storeMedia([]byte("photo"), ".png")
+			if other == first {
+				t.Errorf("расширение не входит в имя файла: %q", other)
+			}
+			key, _ := uploadKey(first)
+			if len(strings.TrimSuffix(key, ".jpg")) != 64 {
+				t.Errorf("имя файла %q не по SHA-256", key)
+			}
+
+			steps := []struct {
+				name         string
+				release      []string
+				wantRefs     int
+				wantReleased bool
+			}{
+				{"две загрузки - две ссылки", nil, 2, false},
+				{"снята одна ссылка", []string{first}, 1, false},
+				{"чужие URL пропускаются", []string{"/static/default.png", "/uploads/../x"}, 1, false},
+				{"снята последняя ссылка", []string{first}, 0, true},
+				{"лишнее снятие не уходит в минус", []string{first}, 0, true},
+			}
+			for _, step := range steps {
+				releaseMedia(step.release...)
+				record, err := mediaStore.Get(key)
+				if err != nil {
+					t.Fatalf("%s: Get: %v", step.name, err)
+				}
+				if record.Refs != step.wantRefs || record.ReleasedAt.IsZero() == step.wantReleased || record.Size != int64(len("photo")) {
+					t.Errorf("%s: запись %+v, ожидалось ссылок %d", step.name, record, step.wantRefs)
+				}
+			}
+
+			// Новая ссылка возвращает файл в использование без повторной загрузки
+			if _, err := storeMedia([]byte("photo"), ".jpg"); err != nil {
+				t.Fatalf("storeMedia: %v", err)
+			}
+			if record, _ := mediaStore.Get(key); record.Refs != 1 || !record.ReleasedAt.IsZero() {
+				t.Errorf("после новой ссылки запись %+v", record)
+			}
+		})
+	}
+}
+
+func TestStoreMediaRestoresLostBlob(t *testing.T) {
+	for name, newStore := range mediaStoreCases() {
+		t.Run(name, func(t *testing.T) {
+			useTestMedia(t, newStore(t))
+
+			url, err := storeMedia([]byte("photo"), ".jpg")
+			if err != nil {
+				t.Fatalf("storeMedia: %v", err)
+			}
+			key, _ := uploadKey(url)
+			// Файл пропал из хранилища, а запись со ссылкой осталась
+			if err := blobStore.Delete(key); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+
+			again, err := storeMedia([]byte("photo"), ".jpg")
+			if err != nil || again != url {
+				t.Fatalf("повторная загрузка: %q, %v", again, err)
+			}
+			if info, err := blobStore.Stat(key); err != nil || info.Size != int64(len("photo")) {
+				t.Errorf("файл не восстановлен: %+v, %v", info, err)
+			}
+			if record, _ := mediaStore.Get(key); record.Refs != 2 {
+				t.Errorf("запись %+v, ожидалось 2 ссылки", record)
+			}
+		})
+	}
+}
+
+func TestSweepMedia(t *testing.T) {
+	for name, newStore := range mediaStoreCases() {
+		t.Run(name, func(t *testing.T) {
+			useMemoryStores()
+			useTestMedia(t, newStore(t))
+			now := time.Now()
+
+			put := func(key string) {
+				if err := blobStore.Put(key, strings.NewReader(key), int64(len(key)), "image/jpeg"); err != nil {
+					t.Fatalf("Put: %v", err)
+				}
+			}
+			keyOf := func(url string, err error) string {
+				if err != nil {
+					t.Fatalf("storeMedia: %v", err)
+				}
+				key, _ := uploadKey(url)
+				return key
+			}
+
+			held := keyOf(storeMedia([]byte("held"), ".jpg"))
+			released := keyOf(storeMedia([]byte("released"), ".jpg"))
+			releaseMedia("/uploads/" + released)
+			put("orphan.jpg") // Загружен до учета ссылок, никому не нужен
+			put("profile.jpg")
+			if err := userStore.Create(UserData{ID: "alice-id", Email: "alice@example.com", Handle: "alice",
+				PhotoPath: "/uploads/profile.jpg"}); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+			mediaStore.Acquire("missing.jpg", 1, now) // Запись без файла
+			mediaStore.Release("missing.jpg", now)
+			mediaStore.Acquire("missing-held.jpg", 1, now)
+
+			tests := []struct {
+				name        string
+				at          time.Time
+				wantRemoved int
+				wantBlobs   map[string]bool
+			}{
+				{
+					name:        "в пределах mediaGracePeriod ничего не удаляется",
+					at:          now,
+					wantRemoved: 0,
+					wantBlobs:   map[string]bool{held: true, released: true, "orphan.jpg": true, "profile.jpg": true},
+				},
+				{
+					name:        "после mediaGracePeriod удаляются только ненужные",
+					at:          now.Add(2 * mediaGracePeriod),
+					wantRemoved: 2,
+					wantBlobs:   map[string]bool{held: true, released: false, "orphan.jpg": false, "profile.jpg": true},
+				},
+			}
+			for _, tc := range tests {
+				removed, err := sweepMedia(tc.at)
+				if err != nil || removed != tc.wantRemoved {
+					t.Errorf("%s: sweepMedia = %d, %v, ожидалось %d", tc.name, removed, err, tc.wantRemoved)
+				}
+				for key, want := range tc.wantBlobs {
+					if _, err := blobStore.Stat(key); (err == nil) != want {
+						t.Errorf("%s: файл %s сохранен = %v, ожидалось %v", tc.name, key, err == nil, want)
+					}
+				}
+			}
+
+			records := []struct {
+				key  string
+				want error
+			}{
+				{held, nil},
+				{released, ErrMediaNotFound},
+				{"missing.jpg", ErrMediaNotFound},
+				{"missing-held.jpg", nil},
+			}
+			for _, tc := range records {
+				if _, err := mediaStore.Get(tc.key); err != tc.want {
+					t.Errorf("запись %s: Get = %v, ожидалось %v", tc.key, err, tc.want)
+				}
+			}
+		})
+	}
+}
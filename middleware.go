@@ -7,40 +7,80 @@ import (
 	"net/http"
 )
 
-// authMiddleware защищает маршруты, проверяя, установлена ли сессионная куки и существует ли пользователь по Email.
+// authMiddleware защищает маршруты: находит серверную сессию по куке и проверяет, что ее владелец существует.
+// Запросы с заголовком Authorization: Bearer аутентифицируются API-токеном (см. apiTokenAuth).
 func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("session_username")
+		if token := bearerToken(r); token != "" {
+			apiTokenAuth(w, r, token, next)
+			return
+		}
+
+		session, err := resolveSession(w, r)
 		if err != nil {
-			// Кука отсутствует или истекла
-			log.Printf("❌ Неудачная аутентификация: Кука 'session_username' отсутствует.")
+			// Кука отсутствует, сессия отозвана или истекла
+			log.Printf("❌ Неудачная аутентификация: действующая сессия не найдена.")
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusUnauthorized)
 			json.NewEncoder(w).Encode(map[string]string{"message": "Не авторизован", "status": "error"})
 			return
 		}
 
-		// КЛЮЧЕВОЕ ИЗМЕНЕНИЕ: Значение куки - это теперь email
-		email := cookie.Value
-
-		// Проверяем, существует ли пользователь с этим email в системе.
-		mu.Lock()
-		_, exists := users[email] // Ищем по email
-		mu.Unlock()
+		// ID владельца берем из сессии, а не из куки
+		userID := session.UserID
 
-		if !exists {
-			// Пользователь не найден в текущей "базе данных" (map users)
-			log.Printf("❌ Неудачная аутентификация: Пользователь с email %s не найден в базе данных.", email)
+		// Проверяем, существует ли пользователь с этим ID в системе и не деактивирован ли он.
+		if user, err := userStore.GetByID(userID); err != nil || user.deactivated() {
+			// Пользователь не найден в хранилище (или хранилище недоступно)
+			log.Printf("❌ Неудачная аутентификация: Пользователь %s не найден в базе данных.", userID)
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusUnauthorized)
 			json.NewEncoder(w).Encode(map[string]string{"message": "Пользователь не найден", "status": "error"})
 			return
 		}
 
-		// Аутентификация успешна. Передаем email в контексте.
-		log.Printf("✅ Успешная аутентификация по Email: %s", email)
-		// КЛЮЧЕВОЕ ИЗМЕНЕНИЕ: Сохраняем email в контексте
-		ctx := context.WithValue(r.Context(), userContextKey, email)
+		// Аутентификация успешна. Передаем ID пользователя и сессии в контексте.
+		log.Printf("✅ Успешная аутентификация пользователя %s", userID)
+		ctx := context.WithValue(r.Context(), userContextKey, userID)
+		ctx = context.WithValue(ctx, sessionContextKey, session.ID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 }
+
+// apiTokenAuth пускает запрос с API-токеном, если маршрут помечен правом (apiScope) и оно выдано токену.
+func apiTokenAuth(w http.ResponseWriter, r *http.Request, token string, next http.HandlerFunc) {
+	w.Header().Set("Content-Type", "application/json")
+
+	apiToken, err := resolveAPIToken(r, token)
+	if err != nil {
+		log.Printf("❌ Неудачная аутентификация: недействительный API-токен.")
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Недействительный API-токен", "status": "error"})
+		return
+	}
+	if user, err := userStore.GetByID(apiToken.UserID); err != nil || user.deactivated() {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Пользователь не найден", "status": "error"})
+		return
+	}
+
+	scope, _ := r.Context().Value(apiScopeContextKey).(string)
+	if scope == "" {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Этот маршрут недоступен для API-токенов", "status": "error"})
+		return
+	}
+	if !apiToken.hasScope(scope) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"message": "У токена нет права " + scope, "status": "error"})
+		return
+	}
+
+	// Сессии у такого запроса нет: в контексте пустой ID сессии и ID токена
+	ctx := context.WithValue(r.Context(), userContextKey, apiToken.UserID)
+	ctx = context.WithValue(ctx, sessionContextKey, "")
+	ctx = context.WithValue(ctx, apiTokenContextKey, apiToken.ID)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
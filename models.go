@@ -1,17 +1,59 @@
 package main
 
 import (
-	"sync"
+	"time"
 )
 
 // --- Структуры Данных ---
 
 // UserData хранит все данные о пользователе, включая хеш пароля и путь к фото.
 type UserData struct {
-	Email          string // Email теперь уникален и используется для входа
-	HashedPassword string
-	Username       string // Имя пользователя используется для отображения, но не для входа
-	PhotoPath      string // Путь к файлу фотографии (например, /uploads/user_12345.jpg)
+	ID             string   `json:"id"`             // Неизменяемый идентификатор (первичный ключ хранилища, сессий и чата)
+	Email          string   `json:"email"`          // Email уникален и используется для входа, но может меняться
+	EmailVerified  bool     `json:"email_verified"` // Подтвержден ли текущий email (без этого нельзя писать в чат)
+	HashedPassword string   `json:"hashed_password"`
+	RecoveryCodes  []string `json:"recovery_codes,omitempty"` // SHA-256 неиспользованных кодов восстановления 2FA
+	Username       string   `json:"username"`                 // Имя пользователя используется для отображения, но не для входа
+	PhotoPath      string   `json:"photo_path"`               // Путь к файлу фотографии (например, /uploads/user_12345.jpg)
+
+	PhotoVariants map[int]string `json:"photo_variants,omitempty"` // Квадратные превью фото: сторона в пикселях -> путь
+	PhotoTakenAt  time.Time      `json:"photo_taken_at"`           // Время съемки фото из EXIF (единственные сохраняемые метаданные)
+
+	Handle          string    `json:"handle"`            // Уникальный @хендл в нижнем регистре (для /u/{handle})
+	HandleChangedAt time.Time `json:"handle_changed_at"` // Время последней смены хендла (для кулдауна)
+
+	TOTPEnabled       bool   `json:"totp_enabled"`             // Включена ли двухфакторная аутентификация
+	TOTPSecret        string `json:"totp_secret,omitempty"`    // Подтвержденный секрет TOTP (base32)
+	TOTPPendingSecret string `json:"totp_pending,omitempty"`   // Секрет, выданный в /user/2fa/setup и еще не подтвержденный кодом
+	TOTPLastStep      int64  `json:"totp_last_step,omitempty"` // Последний принятый интервал (защита от повтора кода)
+
+	Identities []ExternalIdentity `json:"identities,omitempty"` // Привязанные внешние аккаунты (вход через OIDC)
+
+	Tier string `json:"tier,omitempty"` // Тариф с лимитом хранилища из STORAGE_QUOTAS (пустой - тариф по умолчанию)
+
+	DeactivatedAt time.Time `json:"deactivated_at"` // Когда аккаунт деактивирован (нулевое - активен)
+}
+
+// ExternalIdentity - внешний аккаунт (провайдер OpenID Connect), через который пользователь может войти.
+type ExternalIdentity struct {
+	Provider string    `json:"provider"` // Имя провайдера из OIDC_PROVIDERS
+	Subject  string    `json:"subject"`  // Неизменяемый идентификатор пользователя у провайдера (claim sub)
+	Email    string    `json:"email"`    // Email у провайдера на момент привязки (для отображения)
+	LinkedAt time.Time `json:"linked_at"`
+}
+
+// identityKey - ключ индекса внешних аккаунтов.
+func identityKey(provider, subject string) string {
+	return provider + ":" + subject
+}
+
+// identityKeys возвращает ключи всех привязанных внешних аккаунтов пользователя.
+func (u UserData) identityKeys() []string {
+	keys := make([]string, 0, len(u.Identities))
+	for _, identity := range u.Identities {
+		keys = append(keys, identityKey(identity.Provider, identity.Subject))
+	}
+	return keys
 }
 
 // UserCredentials используется для декодирования JSON-запросов.
@@ -22,19 +64,18 @@ type UserCredentials struct {
 	Email    string `json:"email"` // КЛЮЧЕВОЕ ИЗМЕНЕНИЕ ДЛЯ ВХОДА
 }
 
-// --- Глобальное Состояние (Имитация DB) ---
-
-var (
-	// users - это наша карта "базы данных" в памяти: [email]UserData
-	// КЛЮЧЕВОЕ ИЗМЕНЕНИЕ: используем email как ключ
-	users = make(map[string]UserData)
-	// mu - Mutex для защиты доступа к карте users от гонок данных.
-	mu sync.Mutex
-)
-
 // --- Контекст (для Middleware) ---
 
 // contextKey используется как тип ключа для избежания коллизий в контексте.
 type contextKey string
 
-const userContextKey contextKey = "email" // КЛЮЧЕВОЕ ИЗМЕНЕНИЕ: Теперь контекстный ключ хранит email
+const userContextKey contextKey = "user_id" // Контекстный ключ хранит ID пользователя
+
+// sessionContextKey хранит ID текущей серверной сессии.
+const sessionContextKey contextKey = "session"
+
+// apiTokenContextKey хранит ID API-токена, если запрос аутентифицирован Bearer-токеном, а не сессией.
+const apiTokenContextKey contextKey = "api_token"
+
+// apiScopeContextKey хранит право, с которым на маршрут пускают API-токены (см. apiScope).
+const apiScopeContextKey contextKey = "api_scope"
@@ -0,0 +1,890 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Вход через OpenID Connect ---
+//
+// Провайдеры настраиваются переменными окружения, например:
+//
+//	OIDC_PROVIDERS=google,mock
+//	OIDC_GOOGLE_ISSUER=https://accounts.google.com
+//	OIDC_GOOGLE_CLIENT_ID=...  OIDC_GOOGLE_CLIENT_SECRET=...  OIDC_GOOGLE_NAME=Google
+//
+// Поток: /auth/oidc/{provider}/login -> страница провайдера -> /auth/oidc/{provider}/callback.
+// Используются authorization code + PKCE (S256), state (против CSRF) и nonce (против подмены ID-токена).
+// С ?reauth=1 вошедший пользователь заново входит у провайдера (prompt=login, max_age=0) и получает
+// sudo-окно, как после ввода пароля: у аккаунтов, созданных через OIDC, пароля нет.
+// Для локальной проверки есть тестовый провайдер: go run ./cmd/mock-oidc.
+
+const (
+	// oidcStateCookie связывает callback с браузером, который начал вход.
+	oidcStateCookie = "oidc_state"
+	// oidcFlowTTL - сколько есть времени на вход у провайдера.
+	oidcFlowTTL = 10 * time.Minute
+	// oidcDiscoveryTTL и oidcJWKSTTL - сроки кеширования документа discovery и ключей провайдера.
+	oidcDiscoveryTTL = 24 * time.Hour
+	oidcJWKSTTL      = time.Hour
+	// oidcJWKSMinRefresh - не чаще этого перечитываем ключи, встретив незнакомый kid.
+	oidcJWKSMinRefresh = time.Minute
+	// oidcClockSkew - допустимое расхождение часов при проверке exp/iat.
+	oidcClockSkew = time.Minute
+)
+
+// errOIDCInvalidToken возвращается, если ID-токен не прошел проверку.
+var errOIDCInvalidToken = errors.New("недействительный ID-токен")
+
+// oidcHTTPClient - клиент для запросов к провайдерам (с таймаутом, чтобы зависший провайдер не держал запрос).
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcDiscovery - нужные нам поля документа /.well-known/openid-configuration.
+type oidcDiscovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	CodeChallengeMethods  []string `json:"code_challenge_methods_supported"`
+}
+
+// oidcProvider - настроенный провайдер с кешем discovery и ключей подписи.
+type oidcProvider struct {
+	Name         string
+	DisplayName  string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+
+	mu           sync.Mutex
+	discovery    *oidcDiscovery
+	discoveredAt time.Time
+	keys         map[string]crypto.PublicKey
+	keysFetched  time.Time
+}
+
+// oidcProviders - провайдеры по имени, заполняются в initOIDC().
+var oidcProviders = map[string]*oidcProvider{}
+
+// oidcProviderOrder - порядок провайдеров для кнопок входа.
+var oidcProviderOrder []string
+
+// initOIDC читает настройки провайдеров из окружения.
+func initOIDC() {
+	for _, name := range strings.Split(getEnv("OIDC_PROVIDERS", ""), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		provider := &oidcProvider{
+			Name:         name,
+			DisplayName:  getEnv(prefix+"NAME", name),
+			Issuer:       strings.TrimRight(getEnv(prefix+"ISSUER", ""), "/"),
+			ClientID:     getEnv(prefix+"CLIENT_ID", ""),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			Scopes:       strings.Fields(getEnv(prefix+"SCOPES", "openid email profile")),
+		}
+		if provider.Issuer == "" || provider.ClientID == "" {
+			log.Fatalf("❌ Для провайдера OIDC %s нужны %sISSUER и %sCLIENT_ID", name, prefix, prefix)
+		}
+		oidcProviders[name] = provider
+		oidcProviderOrder = append(oidcProviderOrder, name)
+		log.Printf("🔗 Вход через %s (%s)", provider.DisplayName, provider.Issuer)
+	}
+}
+
+// redirectURI - адрес callback, который нужно зарегистрировать у провайдера.
+func (p *oidcProvider) redirectURI() string {
+	return fmt.Sprintf("%s/auth/oidc/%s/callback", appBaseURL, p.Name)
+}
+
+// getJSON выполняет GET и декодирует JSON-ответ.
+func getJSON(target string, value any) error {
+	resp, err := oidcHTTPClient.Get(target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: статус %d", target, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(value)
+}
+
+// getDiscovery возвращает (кешированный) документ discovery провайдера.
+func (p *oidcProvider) getDiscovery() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil && time.Since(p.discoveredAt) < oidcDiscoveryTTL {
+		return p.discovery, nil
+	}
+
+	var doc oidcDiscovery
+	if err := getJSON(p.Issuer+"/.well-known/openid-configuration", &doc); err != nil {
+		return nil, err
+	}
+	// Документ должен описывать именно настроенного издателя (OpenID Connect Discovery, 4.3)
+	if strings.TrimRight(doc.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("issuer в discovery (%s) не совпадает с настроенным (%s)", doc.Issuer, p.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, errors.New("в документе discovery нет обязательных адресов")
+	}
+	p.discovery = &doc
+	p.discoveredAt = time.Now()
+	return p.discovery, nil
+}
+
+// jsonWebKey - открытый ключ из JWKS (поддерживаются RSA и EC P-256).
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey преобразует JWK в ключ crypto.
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("кривая %s не поддерживается", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("тип ключа %s не поддерживается", k.Kty)
+}
+
+// signingKey возвращает ключ подписи по kid. Ключи кешируются; незнакомый kid (ротация ключей
+// у провайдера) приводит к повторному чтению JWKS, но не чаще oidcJWKSMinRefresh.
+func (p *oidcProvider) signingKey(kid string) (crypto.PublicKey, error) {
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, known := p.keys[kid]
+	age := time.Since(p.keysFetched)
+	if known && age < oidcJWKSTTL {
+		return key, nil
+	}
+	if p.keys != nil && !known && age < oidcJWKSMinRefresh {
+		return nil, errOIDCInvalidToken
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(discovery.JWKSURI, &set); err != nil {
+		if known {
+			// Провайдер недоступен - продолжаем со старым ключом
+			return key, nil
+		}
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if pub, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = pub
+		}
+	}
+	p.keys = keys
+	p.keysFetched = time.Now()
+
+	if key, known = keys[kid]; !known {
+		return nil, errOIDCInvalidToken
+	}
+	return key, nil
+}
+
+// oidcClaims - проверенные утверждения ID-токена.
+type oidcClaims struct {
+	Issuer        string          `json:"iss"`
+	Subject       string          `json:"sub"`
+	Audience      json.RawMessage `json:"aud"` // Строка или массив строк
+	AuthorizedBy  string          `json:"azp"`
+	Expires       int64           `json:"exp"`
+	IssuedAt      int64           `json:"iat"`
+	Nonce         string          `json:"nonce"`
+	Email         string          `json:"email"`
+	EmailVerified any             `json:"email_verified"` // Некоторые провайдеры отдают строку "true"
+	Name          string          `json:"name"`
+	Username      string          `json:"preferred_username"`
+	AuthTime      int64           `json:"auth_time"` // Когда пользователь вводил учетные данные у провайдера
+}
+
+// emailVerified сообщает, подтвердил ли провайдер email.
+func (c oidcClaims) emailVerified() bool {
+	switch v := c.EmailVerified.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// audiences возвращает список получателей токена.
+func (c oidcClaims) audiences() []string {
+	var single string
+	if json.Unmarshal(c.Audience, &single) == nil {
+		return []string{single}
+	}
+	var list []string
+	json.Unmarshal(c.Audience, &list)
+	return list
+}
+
+// verifyIDToken проверяет подпись и утверждения ID-токена (OpenID Connect Core, 3.1.3.7).
+func (p *oidcProvider) verifyIDToken(raw, nonce string) (oidcClaims, error) {
+	var claims oidcClaims
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return claims, errOIDCInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJSON, &header) != nil {
+		return claims, errOIDCInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, errOIDCInvalidToken
+	}
+
+	key, err := p.signingKey(header.Kid)
+	if err != nil {
+		return claims, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	// Алгоритм определяется типом ключа провайдера, а не только заголовком: "none" и HS256 не принимаются
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) != nil {
+			return claims, errOIDCInvalidToken
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 {
+			return claims, errOIDCInvalidToken
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return claims, errOIDCInvalidToken
+		}
+	default:
+		return claims, errOIDCInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &claims) != nil {
+		return claims, errOIDCInvalidToken
+	}
+
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return claims, err
+	}
+	now := time.Now()
+	switch {
+	case strings.TrimRight(claims.Issuer, "/") != strings.TrimRight(discovery.Issuer, "/"):
+		return claims, fmt.Errorf("%w: чужой издатель %s", errOIDCInvalidToken, claims.Issuer)
+	case !containsString(claims.audiences(), p.ClientID):
+		return claims, fmt.Errorf("%w: токен выдан другому клиенту", errOIDCInvalidToken)
+	case len(claims.audiences()) > 1 && claims.AuthorizedBy != p.ClientID:
+		return claims, fmt.Errorf("%w: неверный azp", errOIDCInvalidToken)
+	case now.After(time.Unix(claims.Expires, 0).Add(oidcClockSkew)):
+		return claims, fmt.Errorf("%w: токен истек", errOIDCInvalidToken)
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(oidcClockSkew)):
+		return claims, fmt.Errorf("%w: токен из будущего", errOIDCInvalidToken)
+	case claims.Nonce == "" || claims.Nonce != nonce:
+		return claims, fmt.Errorf("%w: nonce не совпадает", errOIDCInvalidToken)
+	case claims.Subject == "":
+		return claims, fmt.Errorf("%w: нет sub", errOIDCInvalidToken)
+	}
+	return claims, nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// exchangeCode обменивает код авторизации на ID-токен.
+func (p *oidcProvider) exchangeCode(code, verifier string) (string, error) {
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURI())
+	form.Set("client_id", p.ClientID)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		// client_secret_basic - способ аутентификации клиента по умолчанию
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK || body.IDToken == "" {
+		return "", fmt.Errorf("обмен кода отклонен: %s %s", body.Error, body.ErrorDescription)
+	}
+	return body.IDToken, nil
+}
+
+// =======================================================================
+// Незавершенные входы (state -> параметры запроса)
+// =======================================================================
+
+// oidcFlow - параметры начатого входа, которые нужны для проверки callback.
+type oidcFlow struct {
+	Provider   string
+	Nonce      string
+	Verifier   string // PKCE code_verifier
+	LinkUserID string // Непустой - привязка внешнего аккаунта к вошедшему пользователю
+	// ReauthSessionID непустой - повторная аутентификация пользователя ReauthUserID для sudo-окна этой сессии
+	ReauthSessionID string
+	ReauthUserID    string
+	CreatedAt       time.Time
+}
+
+var (
+	oidcFlowsMu sync.Mutex
+	oidcFlows   = map[string]oidcFlow{}
+)
+
+// saveOIDCFlow запоминает вход по state и заодно удаляет устаревшие.
+func saveOIDCFlow(state string, flow oidcFlow) {
+	oidcFlowsMu.Lock()
+	defer oidcFlowsMu.Unlock()
+	for key, old := range oidcFlows {
+		if time.Since(old.CreatedAt) > oidcFlowTTL {
+			delete(oidcFlows, key)
+		}
+	}
+	oidcFlows[state] = flow
+}
+
+// takeOIDCFlow забирает вход по state (повторно использовать state нельзя).
+func takeOIDCFlow(state string) (oidcFlow, bool) {
+	oidcFlowsMu.Lock()
+	defer oidcFlowsMu.Unlock()
+	flow, exists := oidcFlows[state]
+	delete(oidcFlows, state)
+	if !exists || time.Since(flow.CreatedAt) > oidcFlowTTL {
+		return oidcFlow{}, false
+	}
+	return flow, true
+}
+
+// randomURLToken возвращает случайную строку для state, nonce и code_verifier.
+func randomURLToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// =======================================================================
+// Обработчики
+// =======================================================================
+
+// oidcProvidersHandler возвращает список провайдеров для кнопок входа: GET /auth/oidc/providers
+func oidcProvidersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	list := make([]map[string]string, 0, len(oidcProviderOrder))
+	for _, name := range oidcProviderOrder {
+		list = append(list, map[string]string{
+			"name":         name,
+			"display_name": oidcProviders[name].DisplayName,
+			"login_url":    "/auth/oidc/" + name + "/login",
+		})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"providers": list, "status": "success"})
+}
+
+// oidcHandler разбирает /auth/oidc/{provider}/login и /auth/oidc/{provider}/callback.
+func oidcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Допустим только метод GET", http.StatusMethodNotAllowed)
+		return
+	}
+	name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/auth/oidc/"), "/")
+	provider, exists := oidcProviders[name]
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch action {
+	case "login":
+		oidcLogin(w, r, provider)
+	case "callback":
+		oidcCallback(w, r, provider)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// oidcLogin перенаправляет на страницу входа провайдера. С ?link=1 внешний аккаунт
+// привязывается к уже вошедшему пользователю (в открытом sudo-окне), с ?reauth=1 - подтверждает его личность.
+func oidcLogin(w http.ResponseWriter, r *http.Request, provider *oidcProvider) {
+	discovery, err := provider.getDiscovery()
+	if err != nil {
+		log.Printf("❌ OIDC %s: ошибка discovery: %v", provider.Name, err)
+		oidcFail(w, r, "Провайдер входа недоступен")
+		return
+	}
+
+	flow := oidcFlow{Provider: provider.Name, CreatedAt: time.Now()}
+	if r.URL.Query().Get("link") == "1" {
+		session, err := resolveSession(w, r)
+		if err != nil {
+			oidcFail(w, r, "Войдите, чтобы привязать аккаунт")
+			return
+		}
+		// Привязка добавляет способ входа, поэтому одной сессии мало: нужно открытое sudo-окно
+		if !time.Now().Before(session.SudoUntil) {
+			http.Redirect(w, r, "/user_profile.html?reauth_error="+url.QueryEscape("Подтвердите личность и повторите привязку"), http.StatusFound)
+			return
+		}
+		flow.LinkUserID = session.UserID
+	}
+	if r.URL.Query().Get("reauth") == "1" {
+		session, err := resolveSession(w, r)
+		if err != nil {
+			oidcFail(w, r, "Войдите, чтобы подтвердить личность")
+			return
+		}
+		flow.ReauthSessionID, flow.ReauthUserID = session.ID, session.UserID
+	}
+
+	state, err := randomURLToken()
+	if err == nil {
+		flow.Nonce, err = randomURLToken()
+	}
+	if err == nil {
+		flow.Verifier, err = randomURLToken()
+	}
+	if err != nil {
+		log.Printf("❌ OIDC: ошибка генерации параметров: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	saveOIDCFlow(state, flow)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/auth/oidc/",
+		MaxAge:   int(oidcFlowTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode, // Кука должна прийти с переходом от провайдера
+	})
+
+	challenge := sha256.Sum256([]byte(flow.Verifier))
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", provider.ClientID)
+	params.Set("redirect_uri", provider.redirectURI())
+	params.Set("scope", strings.Join(provider.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", flow.Nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+	if flow.ReauthSessionID != "" {
+		// Провайдер должен заново спросить учетные данные, а не пропустить по своей сессии
+		params.Set("prompt", "login")
+		params.Set("max_age", "0")
+	}
+
+	target := discovery.AuthorizationEndpoint
+	if strings.Contains(target, "?") {
+		target += "&" + params.Encode()
+	} else {
+		target += "?" + params.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// oidcCallback завершает вход: проверяет state, обменивает код, проверяет ID-токен
+// и находит, привязывает или создает пользователя.
+func oidcCallback(w http.ResponseWriter, r *http.Request, provider *oidcProvider) {
+	query := r.URL.Query()
+	state := query.Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/auth/oidc/", MaxAge: -1})
+	if err != nil || state == "" || cookie.Value != state {
+		oidcFail(w, r, "Вход не был начат в этом браузере, попробуйте еще раз")
+		return
+	}
+	flow, ok := takeOIDCFlow(state)
+	if !ok || flow.Provider != provider.Name {
+		oidcFail(w, r, "Время входа истекло, попробуйте еще раз")
+		return
+	}
+	if errCode := query.Get("error"); errCode != "" {
+		log.Printf("⚠️ OIDC %s: провайдер вернул ошибку %s", provider.Name, errCode)
+		oidcFail(w, r, "Вход отменен")
+		return
+	}
+
+	rawIDToken, err := provider.exchangeCode(query.Get("code"), flow.Verifier)
+	if err != nil {
+		log.Printf("❌ OIDC %s: %v", provider.Name, err)
+		oidcFail(w, r, "Не удалось завершить вход")
+		return
+	}
+	claims, err := provider.verifyIDToken(rawIDToken, flow.Nonce)
+	if err != nil {
+		log.Printf("❌ OIDC %s: %v", provider.Name, err)
+		oidcFail(w, r, "Не удалось завершить вход")
+		return
+	}
+
+	identity := ExternalIdentity{
+		Provider: provider.Name,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+		LinkedAt: time.Now(),
+	}
+
+	if flow.ReauthSessionID != "" {
+		oidcReauth(w, r, provider, flow, claims)
+		return
+	}
+
+	// Привязка к вошедшему пользователю
+	if flow.LinkUserID != "" {
+		if err := linkIdentity(flow.LinkUserID, identity); err == ErrIdentityLinked {
+			oidcFail(w, r, "Этот аккаунт уже привязан к другому пользователю")
+			return
+		} else if err != nil {
+			log.Printf("❌ OIDC: ошибка привязки: %v", err)
+			oidcFail(w, r, "Не удалось привязать аккаунт")
+			return
+		}
+		log.Printf("🔗 Пользователь %s привязал аккаунт %s", flow.LinkUserID, provider.Name)
+		http.Redirect(w, r, "/user_profile.html?linked="+url.QueryEscape(provider.Name), http.StatusFound)
+		return
+	}
+
+	userData, err := userStore.GetByIdentity(provider.Name, claims.Subject)
+	if err == ErrUserNotFound {
+		userData, err = oidcUserForNewIdentity(identity, claims)
+	}
+	if err != nil {
+		var msg oidcUserError
+		if errors.As(err, &msg) {
+			oidcFail(w, r, string(msg))
+			return
+		}
+		log.Printf("❌ OIDC %s: %v", provider.Name, err)
+		oidcFail(w, r, "Не удалось завершить вход")
+		return
+	}
+
+	// Второй фактор обязателен и при входе через провайдера
+	if userData.TOTPEnabled {
+		challenge, err := signToken(loginChallengePurpose, userData.ID, userData.Email, loginChallengeTTL)
+		if err != nil {
+			log.Printf("❌ Ошибка выпуска токена 2FA для %s: %v", userData.Email, err)
+			http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/?challenge="+url.QueryEscape(challenge), http.StatusFound)
+		return
+	}
+
+	if userData, err = reactivateAccount(r, userData); err == ErrAccountDeleted {
+		oidcFail(w, r, "Аккаунт удален")
+		return
+	} else if err != nil {
+		log.Printf("❌ Ошибка восстановления аккаунта %s: %v", userData.ID, err)
+		oidcFail(w, r, "Не удалось завершить вход")
+		return
+	}
+
+	if _, err := startSession(w, r, userData.ID); err != nil {
+		log.Printf("❌ Ошибка создания сессии для %s: %v", userData.ID, err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("✅ Успешный вход пользователя %s через %s", userData.Username, provider.Name)
+	http.Redirect(w, r, "/user_profile.html", http.StatusFound)
+}
+
+// oidcReauth открывает sudo-окно сессии после повторного входа у провайдера. Внешний аккаунт
+// должен быть привязан к тому же пользователю, а auth_time - не раньше начала этого входа
+// (max_age=0 обязывает провайдера его вернуть, OpenID Connect Core, 3.1.2.1).
+func oidcReauth(w http.ResponseWriter, r *http.Request, provider *oidcProvider, flow oidcFlow, claims oidcClaims) {
+	fail := func(message string) {
+		http.Redirect(w, r, "/user_profile.html?reauth_error="+url.QueryEscape(message), http.StatusFound)
+	}
+
+	owner, err := userStore.GetByIdentity(provider.Name, claims.Subject)
+	if err != nil || owner.ID != flow.ReauthUserID {
+		log.Printf("❌ OIDC %s: повторный вход не тем аккаунтом для %s", provider.Name, flow.ReauthUserID)
+		fail("Войдите тем аккаунтом " + provider.DisplayName + ", который привязан к профилю")
+		return
+	}
+	if claims.AuthTime == 0 || time.Unix(claims.AuthTime, 0).Before(flow.CreatedAt.Add(-oidcClockSkew)) {
+		log.Printf("❌ OIDC %s: провайдер не запросил вход заново (auth_time %d)", provider.Name, claims.AuthTime)
+		fail("Провайдер не подтвердил повторный вход, попробуйте еще раз")
+		return
+	}
+
+	if _, err := openSudoWindow(flow.ReauthSessionID); err != nil {
+		log.Printf("❌ Ошибка открытия sudo-окна после OIDC для %s: %v", owner.ID, err)
+		fail("Сессия завершена, войдите заново")
+		return
+	}
+	log.Printf("🔐 Пользователь %s подтвердил личность через %s", owner.ID, provider.Name)
+	http.Redirect(w, r, "/user_profile.html?reauth="+url.QueryEscape(provider.Name), http.StatusFound)
+}
+
+// oidcUserError - ошибка входа, текст которой можно показать пользователю.
+type oidcUserError string
+
+func (e oidcUserError) Error() string { return string(e) }
+
+// oidcUserForNewIdentity обрабатывает первый вход с внешним аккаунтом: привязывает его к
+// пользователю с тем же подтвержденным email или создает нового пользователя.
+func oidcUserForNewIdentity(identity ExternalIdentity, claims oidcClaims) (UserData, error) {
+	email := normalizeEmail(claims.Email)
+	if email == "" || validateEmail(email) != nil {
+		return UserData{}, oidcUserError("Провайдер не сообщил email")
+	}
+
+	existing, err := userStore.GetByEmail(email)
+	if err == nil {
+		// Автоматически связываем, только если обе стороны подтвердили адрес: иначе тот, кто заранее
+		// зарегистрировал чужой email, получил бы доступ к аккаунту настоящего владельца
+		if !claims.emailVerified() || !existing.EmailVerified {
+			return UserData{}, oidcUserError("Аккаунт с этим email уже есть. Войдите с паролем и привяжите провайдера в профиле.")
+		}
+		if err := linkIdentity(existing.ID, identity); err != nil {
+			return UserData{}, err
+		}
+		log.Printf("🔗 Аккаунт %s привязан к %s по подтвержденному email", identity.Provider, existing.ID)
+		return userStore.GetByID(existing.ID)
+	} else if err != ErrUserNotFound {
+		return UserData{}, err
+	}
+
+	// Новый пользователь без пароля: войти можно через провайдера, а пароль - задать через сброс
+	id, err := generateUserID()
+	if err != nil {
+		return UserData{}, err
+	}
+	username := claims.Name
+	if username == "" {
+		username = claims.Username
+	}
+	if username == "" {
+		username, _, _ = strings.Cut(email, "@")
+	}
+	handle, err := generateHandle(username, func(h string) bool {
+		available, err := userStore.HandleAvailable(h, "")
+		return err != nil || !available
+	})
+	if err != nil {
+		return UserData{}, err
+	}
+
+	newUser := UserData{
+		ID:            id,
+		Email:         email,
+		EmailVerified: claims.emailVerified(),
+		Username:      username,
+		Handle:        handle,
+		Identities:    []ExternalIdentity{identity},
+	}
+	if err := userStore.Create(newUser); err != nil {
+		return UserData{}, err
+	}
+	if !newUser.EmailVerified {
+		if err := sendVerificationEmail(newUser); err != nil {
+			log.Printf("❌ Ошибка отправки подтверждения на %s: %v", newUser.Email, err)
+		}
+	}
+	log.Printf("✅ НОВЫЙ ПОЛЬЗОВАТЕЛЬ ЧЕРЕЗ %s: %s @%s (Email: %s)", strings.ToUpper(identity.Provider), username, handle, email)
+	return newUser, nil
+}
+
+// linkIdentity добавляет внешний аккаунт пользователю (повторная привязка того же аккаунта ничего не меняет).
+func linkIdentity(userID string, identity ExternalIdentity) error {
+	_, err := userStore.Modify(userID, func(user *UserData) error {
+		for _, linked := range user.Identities {
+			if linked.Provider == identity.Provider && linked.Subject == identity.Subject {
+				return nil
+			}
+		}
+		user.Identities = append(user.Identities, identity)
+		return nil
+	})
+	return err
+}
+
+// oidcFail возвращает пользователя на страницу входа с сообщением об ошибке.
+func oidcFail(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, "/?oidc_error="+url.QueryEscape(message), http.StatusFound)
+}
+
+var (
+	// errIdentityNotLinked возвращается при отвязке провайдера, который не привязан.
+	errIdentityNotLinked = errors.New("Аккаунт не привязан")
+	// errLastSignInMethod возвращается при отвязке последнего способа входа аккаунта без пароля.
+	errLastSignInMethod = errors.New("Сначала задайте пароль: иначе вы не сможете войти")
+)
+
+// unlinkIdentityHandler отвязывает внешний аккаунт: POST /user/identities/unlink {"provider": "...", "password": "..."}
+// Пароль не нужен в открытом sudo-окне.
+func unlinkIdentityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Допустим только метод POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Context().Value(userContextKey).(string)
+	var body struct {
+		Provider string `json:"provider"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Неверный формат JSON в теле запроса", http.StatusBadRequest)
+		return
+	}
+
+	userData, err := userStore.GetByID(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Пользователь не найден", "status": "error"})
+		return
+	}
+	if !reauthenticated(r, userData, body.Password) {
+		writeReauthRequired(w, userData, "Введите текущий пароль")
+		return
+	}
+
+	// Проверки повторяются на свежей записи: параллельный запрос мог сменить пароль или привязки
+	_, err = userStore.Modify(userID, func(user *UserData) error {
+		remaining := make([]ExternalIdentity, 0, len(user.Identities))
+		for _, identity := range user.Identities {
+			if identity.Provider != body.Provider {
+				remaining = append(remaining, identity)
+			}
+		}
+		if len(remaining) == len(user.Identities) {
+			return errIdentityNotLinked
+		}
+		// Нельзя остаться без способа входа
+		if user.HashedPassword == "" && len(remaining) == 0 {
+			return errLastSignInMethod
+		}
+		user.Identities = remaining
+		return nil
+	})
+	if err == errIdentityNotLinked {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": err.Error(), "status": "error"})
+		return
+	} else if err == errLastSignInMethod {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"message": err.Error(), "status": "error"})
+		return
+	} else if err != nil {
+		log.Printf("❌ Ошибка отвязки аккаунта: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🔓 Пользователь %s отвязал аккаунт %s", userID, body.Provider)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Аккаунт отвязан", "status": "success"})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnlinkIdentityRequiresReauth(t *testing.T) {
+	useMemoryStores()
+	hashed, err := hashPassword("correct horse battery staple")
+	if err != nil {
+		t.Fatalf("hashPassword: %v", err)
+	}
+	t.Cleanup(func() { reauthFailures.Reset("account:alice-id") })
+	now := time.Now()
+	sessions := []Session{
+		{ID: "plain-session", UserID: "alice-id"},
+		{ID: "sudo-session", UserID: "alice-id", SudoUntil: now.Add(sudoWindow)},
+	}
+	for _, session := range sessions {
+		session.CreatedAt, session.LastSeen, session.ExpiresAt = now, now, now.Add(sessionIdleTTL)
+		if err := sessionStore.Create(session); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		sessionID  string
+		password   string
+		wantStatus int
+	}{
+		{"только сессия", "plain-session", "", http.StatusForbidden},
+		{"неверный пароль", "plain-session", "wrong", http.StatusForbidden},
+		{"текущий пароль", "plain-session", "correct horse battery staple", http.StatusOK},
+		{"sudo-окно", "sudo-session", "", http.StatusOK},
+	}
+	for _, tc := range tests {
+		alice := UserData{ID: "alice-id", Email: "alice@example.com", Handle: "alice", HashedPassword: hashed,
+			Identities: []ExternalIdentity{{Provider: "google", Subject: "g-1"}}}
+		userStore = newMemoryUserStore()
+		if err := userStore.Create(alice); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+
+		body := strings.NewReader(`{"provider": "google", "password": "` + tc.password + `"}`)
+		req := httptest.NewRequest(http.MethodPost, "/user/identities/unlink", body)
+		ctx := context.WithValue(req.Context(), userContextKey, alice.ID)
+		req = req.WithContext(context.WithValue(ctx, sessionContextKey, tc.sessionID))
+		rec := httptest.NewRecorder()
+		unlinkIdentityHandler(rec, req)
+
+		if rec.Code != tc.wantStatus {
+			t.Errorf("%s: статус %d, ожидался %d (%s)", tc.name, rec.Code, tc.wantStatus, rec.Body)
+		}
+		stored, _ := userStore.GetByID(alice.ID)
+		if unlinked := len(stored.Identities) == 0; unlinked != (tc.wantStatus == http.StatusOK) {
+			t.Errorf("%s: аккаунт отвязан = %v", tc.name, unlinked)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// --- Одноразовые Токены ---
+
+// OneTimeToken - серверная запись одноразового токена (сброс пароля и т.п.).
+// Сам токен уходит пользователю в письме, а хранится только его SHA-256 (Hash),
+// поэтому по содержимому базы нельзя воспользоваться чужой ссылкой.
+type OneTimeToken struct {
+	Hash      string    `json:"hash"`
+	Purpose   string    `json:"purpose"`
+	UserID    string    `json:"user_id"`
+	Email     string    `json:"email"` // Адрес, на который отправлена ссылка
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// OneTimeTokenStore описывает хранилище одноразовых токенов.
+type OneTimeTokenStore interface {
+	// Create сохраняет новый токен.
+	Create(token OneTimeToken) error
+	// Consume атомарно находит и удаляет токен. Возвращает ErrInvalidToken,
+	// если токена нет, он другого назначения или истек.
+	Consume(purpose, hash string) (OneTimeToken, error)
+	// Get возвращает действующий токен, не погашая его (ErrInvalidToken, если его нет или он истек).
+	Get(purpose, hash string) (OneTimeToken, error)
+	// DeleteForUser удаляет все токены пользователя с указанным назначением.
+	DeleteForUser(purpose, userID string) error
+	// DeleteExpired удаляет все токены, истекшие к моменту now.
+	DeleteExpired(now time.Time) (int, error)
+}
+
+// oneTimeTokenStore - активное хранилище одноразовых токенов, инициализируется в initStorage().
+var oneTimeTokenStore OneTimeTokenStore
+
+// issueOneTimeToken создает случайный токен, сохраняет его хеш и возвращает сам токен для ссылки.
+func issueOneTimeToken(purpose string, user UserData, ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now()
+	err := oneTimeTokenStore.Create(OneTimeToken{
+		Hash:      hashToken(token),
+		Purpose:   purpose,
+		UserID:    user.ID,
+		Email:     user.Email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	})
+	return token, err
+}
+
+// consumeOneTimeToken погашает токен из ссылки.
+func consumeOneTimeToken(purpose, token string) (OneTimeToken, error) {
+	if token == "" {
+		return OneTimeToken{}, ErrInvalidToken
+	}
+	return oneTimeTokenStore.Consume(purpose, hashToken(token))
+}
+
+// lookupOneTimeToken проверяет токен из ссылки, не погашая его.
+func lookupOneTimeToken(purpose, token string) (OneTimeToken, error) {
+	if token == "" {
+		return OneTimeToken{}, ErrInvalidToken
+	}
+	return oneTimeTokenStore.Get(purpose, hashToken(token))
+}
+
+// purgeExpiredTokens периодически удаляет истекшие одноразовые токены.
+func purgeExpiredTokens(interval time.Duration) {
+	for range time.Tick(interval) {
+		if n, err := oneTimeTokenStore.DeleteExpired(time.Now()); err != nil {
+			log.Printf("❌ Ошибка очистки одноразовых токенов: %v", err)
+		} else if n > 0 {
+			log.Printf("🧹 Удалено истекших одноразовых токенов: %d", n)
+		}
+	}
+}
+
+// =======================================================================
+// Хранилище одноразовых токенов в памяти
+// =======================================================================
+
+type memoryOneTimeTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]OneTimeToken
+}
+
+func newMemoryOneTimeTokenStore() *memoryOneTimeTokenStore {
+	return &memoryOneTimeTokenStore{tokens: make(map[string]OneTimeToken)}
+}
+
+func (s *memoryOneTimeTokenStore) Create(token OneTimeToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[token.Hash] = token
+	return nil
+}
+
+func (s *memoryOneTimeTokenStore) Consume(purpose, hash string) (OneTimeToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, exists := s.tokens[hash]
+	if !exists || token.Purpose != purpose {
+		return OneTimeToken{}, ErrInvalidToken
+	}
+	delete(s.tokens, hash)
+	if !time.Now().Before(token.ExpiresAt) {
+		return OneTimeToken{}, ErrInvalidToken
+	}
+	return token, nil
+}
+
+func (s *memoryOneTimeTokenStore) Get(purpose, hash string) (OneTimeToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, exists := s.tokens[hash]
+	if !exists || token.Purpose != purpose || !time.Now().Before(token.ExpiresAt) {
+		return OneTimeToken{}, ErrInvalidToken
+	}
+	return token, nil
+}
+
+func (s *memoryOneTimeTokenStore) DeleteForUser(purpose, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, token := range s.tokens {
+		if token.Purpose == purpose && token.UserID == userID {
+			delete(s.tokens, hash)
+		}
+	}
+	return nil
+}
+
+func (s *memoryOneTimeTokenStore) DeleteExpired(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for hash, token := range s.tokens {
+		if !now.Before(token.ExpiresAt) {
+			delete(s.tokens, hash)
+			count++
+		}
+	}
+	return count, nil
+}
+
+// =======================================================================
+// Хранилище одноразовых токенов на диске (bbolt)
+// =======================================================================
+
+var oneTimeTokensBucket = []byte("one_time_tokens")
+
+type boltOneTimeTokenStore struct {
+	db *bolt.DB
+}
+
+func newBoltOneTimeTokenStore(db *bolt.DB) (*boltOneTimeTokenStore, error) {
+	if err := createBuckets(db, oneTimeTokensBucket); err != nil {
+		return nil, err
+	}
+	return &boltOneTimeTokenStore{db: db}, nil
+}
+
+func (s *boltOneTimeTokenStore) Create(token OneTimeToken) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx.Bucket(oneTimeTokensBucket), token.Hash, token)
+	})
+}
+
+func (s *boltOneTimeTokenStore) Consume(purpose, hash string) (OneTimeToken, error) {
+	var token OneTimeToken
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(oneTimeTokensBucket)
+		found, err := boltGet(b, hash, &token)
+		if err != nil {
+			return err
+		}
+		if !found || token.Purpose != purpose {
+			return ErrInvalidToken
+		}
+		return b.Delete([]byte(hash))
+	})
+	if err != nil {
+		return OneTimeToken{}, err
+	}
+	if !time.Now().Before(token.ExpiresAt) {
+		return OneTimeToken{}, ErrInvalidToken
+	}
+	return token, nil
+}
+
+func (s *boltOneTimeTokenStore) Get(purpose, hash string) (OneTimeToken, error) {
+	var token OneTimeToken
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		found, err = boltGet(tx.Bucket(oneTimeTokensBucket), hash, &token)
+		return err
+	})
+	if err != nil {
+		return OneTimeToken{}, err
+	}
+	if !found || token.Purpose != purpose || !time.Now().Before(token.ExpiresAt) {
+		return OneTimeToken{}, ErrInvalidToken
+	}
+	return token, nil
+}
+
+func (s *boltOneTimeTokenStore) DeleteForUser(purpose, userID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(oneTimeTokensBucket)
+		return forEachOneTimeToken(b, func(token OneTimeToken) error {
+			if token.Purpose != purpose || token.UserID != userID {
+				return nil
+			}
+			return b.Delete([]byte(token.Hash))
+		})
+	})
+}
+
+func (s *boltOneTimeTokenStore) DeleteExpired(now time.Time) (int, error) {
+	count := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(oneTimeTokensBucket)
+		return forEachOneTimeToken(b, func(token OneTimeToken) error {
+			if now.Before(token.ExpiresAt) {
+				return nil
+			}
+			count++
+			return b.Delete([]byte(token.Hash))
+		})
+	})
+	return count, err
+}
+
+// forEachOneTimeToken вызывает fn для каждого токена; токены читаются заранее, поэтому fn может их удалять.
+func forEachOneTimeToken(b *bolt.Bucket, fn func(OneTimeToken) error) error {
+	var tokens []OneTimeToken
+	err := b.ForEach(func(_, data []byte) error {
+		var token OneTimeToken
+		if err := json.Unmarshal(data, &token); err != nil {
+			return err
+		}
+		tokens = append(tokens, token)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		if err := fn(token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
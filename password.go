@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// --- Восстановление Пароля ---
+
+const (
+	// passwordResetPurpose - назначение одноразового токена сброса пароля.
+	passwordResetPurpose = "password_reset"
+	// passwordResetTTL - срок действия ссылки для сброса пароля.
+	passwordResetTTL = time.Hour
+)
+
+// forgotPasswordMessage - единый ответ /password/forgot, чтобы по нему нельзя было узнать,
+// зарегистрирован ли email.
+const forgotPasswordMessage = "Если такой email зарегистрирован, мы отправили на него ссылку для сброса пароля."
+
+// forgotPasswordHandler отправляет ссылку для сброса пароля: POST /password/forgot {"email": "..."}
+func forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Допустим только метод POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	var body struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Неверный формат JSON в теле запроса", http.StatusBadRequest)
+		return
+	}
+
+	// Ответ одинаковый в любом случае; письмо уходит только существующему пользователю
+	// и не чаще нескольких раз в час на один адрес
+	email := normalizeEmail(body.Email)
+	if ok, _ := forgotPasswordEmailLimiter.Allow("account:"+email, time.Now()); !ok {
+		log.Printf("⏳ Превышен лимит писем сброса пароля для %s", email)
+	} else if userData, err := userStore.GetByEmail(email); err == nil {
+		if err := sendPasswordResetEmail(userData); err != nil {
+			log.Printf("❌ Ошибка выпуска токена сброса пароля для %s: %v", userData.ID, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": forgotPasswordMessage, "status": "success"})
+}
+
+// sendPasswordResetEmail выпускает новый токен сброса (старые аннулируются) и отправляет ссылку.
+func sendPasswordResetEmail(user UserData) error {
+	if err := oneTimeTokenStore.DeleteForUser(passwordResetPurpose, user.ID); err != nil {
+		return err
+	}
+	token, err := issueOneTimeToken(passwordResetPurpose, user, passwordResetTTL)
+	if err != nil {
+		return err
+	}
+	link := fmt.Sprintf("%s/reset.html?token=%s", appBaseURL, url.QueryEscape(token))
+
+	sendMailAsync(MailMessage{
+		To:      user.Email,
+		Subject: "Сброс пароля",
+		Body: fmt.Sprintf("Здравствуйте, %s!\n\n"+
+			"Мы получили запрос на сброс пароля. Чтобы задать новый пароль, перейдите по ссылке:\n%s\n\n"+
+			"Ссылка одноразовая и действительна %d минут. Если вы не запрашивали сброс, просто проигнорируйте это письмо.\n",
+			user.Username, link, int(passwordResetTTL.Minutes())),
+	})
+	log.Printf("🔑 Отправлена ссылка для сброса пароля пользователю %s", user.ID)
+	return nil
+}
+
+// resetPasswordHandler задает новый пароль по токену из письма: POST /password/reset {"token": "...", "password": "..."}
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Допустим только метод POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	var body struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Неверный формат JSON в теле запроса", http.StatusBadRequest)
+		return
+	}
+	if body.Password == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Введите новый пароль", "status": "error"})
+		return
+	}
+
+	// Пароль проверяем до погашения токена, чтобы после отказа ссылкой можно было воспользоваться снова
+	pending, err := lookupOneTimeToken(passwordResetPurpose, body.Token)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Ссылка недействительна или устарела", "status": "error"})
+		return
+	}
+	userData, err := userStore.GetByID(pending.UserID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Ссылка недействительна или устарела", "status": "error"})
+		return
+	}
+	if problems := validatePassword(body.Password, userData); len(problems) > 0 {
+		writeFieldErrors(w, fieldErrors{"password": problems})
+		return
+	}
+
+	// Токен погашается сразу: повторно воспользоваться ссылкой нельзя
+	token, err := consumeOneTimeToken(passwordResetPurpose, body.Token)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Ссылка недействительна или устарела", "status": "error"})
+		return
+	}
+
+	hashedPassword, err := hashPassword(body.Password)
+	if err != nil {
+		log.Printf("❌ Ошибка хеширования пароля: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	// Запись перечитывается при сохранении, чтобы не затереть параллельную смену профиля
+	userData, err = userStore.Modify(userData.ID, func(user *UserData) error {
+		user.HashedPassword = hashedPassword
+		// Переход по ссылке из письма доказывает владение адресом
+		if token.Email == user.Email {
+			user.EmailVerified = true
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("❌ Ошибка сохранения нового пароля: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	// Завершаем все сессии (в т.ч. возможного злоумышленника) и гасим остальные ссылки сброса
+	revoked, err := revokeUserSessions(userData.ID, "")
+	if err != nil {
+		log.Printf("❌ Ошибка отзыва сессий после сброса пароля: %v", err)
+	}
+	if err := oneTimeTokenStore.DeleteForUser(passwordResetPurpose, userData.ID); err != nil {
+		log.Printf("❌ Ошибка удаления токенов сброса: %v", err)
+	}
+
+	log.Printf("✅ Пользователь %s сбросил пароль (завершено сессий: %d)", userData.ID, revoked)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Пароль изменен. Теперь войдите с новым паролем.", "status": "success"})
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// --- Хеширование Паролей ---
+
+// PasswordHasher хеширует пароли по одной схеме. Параметры (стоимость, память и т.п.)
+// записываются в сам хеш, поэтому старые хеши проверяются и после смены настроек.
+type PasswordHasher interface {
+	// Hash возвращает закодированный хеш пароля с текущими параметрами.
+	Hash(password string) (string, error)
+	// Verify сверяет пароль с хешем этой схемы.
+	Verify(encoded, password string) (bool, error)
+	// Matches сообщает, создан ли хеш этой схемой.
+	Matches(encoded string) bool
+	// NeedsRehash сообщает, отличаются ли параметры хеша этой схемы от текущих.
+	NeedsRehash(encoded string) bool
+}
+
+// ErrUnknownPasswordHash возвращается для хешей, которые не распознала ни одна схема.
+var ErrUnknownPasswordHash = errors.New("неизвестный формат хеша пароля")
+
+// errPasswordChanged возвращается upgradePasswordHash, если пароль сменился после проверки.
+var errPasswordChanged = errors.New("пароль изменен параллельным запросом")
+
+// passwordHasher - схема для новых хешей, выбирается в initPasswordHasher (PASSWORD_HASHER).
+var passwordHasher PasswordHasher = bcryptHasher{cost: 12}
+
+// hashPassword хеширует пароль текущей схемой.
+func hashPassword(password string) (string, error) {
+	return passwordHasher.Hash(password)
+}
+
+// verifyPassword сверяет пароль с хешем любой поддерживаемой схемы и сообщает,
+// нужно ли пересчитать хеш (схема или параметры устарели).
+func verifyPassword(encoded, password string) (ok, rehash bool) {
+	if encoded == "" || password == "" {
+		return false, false
+	}
+	for _, hasher := range []PasswordHasher{bcryptHasher{}, argon2idHasher{}} {
+		if !hasher.Matches(encoded) {
+			continue
+		}
+		ok, err := hasher.Verify(encoded, password)
+		if err != nil {
+			log.Printf("❌ Ошибка проверки хеша пароля: %v", err)
+			return false, false
+		}
+		return ok, ok && (!passwordHasher.Matches(encoded) || passwordHasher.NeedsRehash(encoded))
+	}
+	log.Printf("❌ %v", ErrUnknownPasswordHash)
+	return false, false
+}
+
+// upgradePasswordHash сохраняет новый хеш только что проверенного пароля текущей схемой.
+// Ошибки не мешают входу: хеш пересчитается при следующем.
+func upgradePasswordHash(user UserData, password string) UserData {
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Printf("❌ Не удалось пересчитать хеш пароля %s: %v", user.ID, err)
+		return user
+	}
+	// Пароль могли сменить параллельно: тогда новый хеш старого пароля не сохраняется
+	updated, err := userStore.Modify(user.ID, func(current *UserData) error {
+		if current.HashedPassword != user.HashedPassword {
+			return errPasswordChanged
+		}
+		current.HashedPassword = hash
+		return nil
+	})
+	if err != nil {
+		log.Printf("❌ Не удалось сохранить новый хеш пароля %s: %v", user.ID, err)
+		return user
+	}
+	log.Printf("🔑 Хеш пароля пользователя %s пересчитан: %s", user.ID, passwordHasher)
+	return updated
+}
+
+// initPasswordHasher выбирает схему и ее параметры по переменным окружения.
+func initPasswordHasher() {
+	hasher, err := newPasswordHasher(passwordHasherKind)
+	if err != nil {
+		log.Fatalf("❌ Неверные настройки хеширования паролей: %v", err)
+	}
+	passwordHasher = hasher
+	log.Printf("🔑 Хеширование паролей: %s", hasher)
+}
+
+// newPasswordHasher создает схему kind ("bcrypt" или "argon2id") с параметрами из окружения.
+func newPasswordHasher(kind string) (PasswordHasher, error) {
+	switch kind {
+	case "bcrypt":
+		cost, err := strconv.Atoi(bcryptCost)
+		if err != nil || cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("BCRYPT_COST должен быть числом от %d до %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		return bcryptHasher{cost: cost}, nil
+	case "argon2id":
+		timeCost, err1 := strconv.ParseUint(argon2Time, 10, 32)
+		memory, err2 := strconv.ParseUint(argon2Memory, 10, 32)
+		threads, err3 := strconv.ParseUint(argon2Threads, 10, 8)
+		if err := errors.Join(err1, err2, err3); err != nil || timeCost < 1 || memory < 8*threads || threads < 1 {
+			return nil, errors.New("ARGON2_TIME, ARGON2_MEMORY (КиБ) и ARGON2_THREADS должны быть положительными числами")
+		}
+		return argon2idHasher{time: uint32(timeCost), memory: uint32(memory), threads: uint8(threads)}, nil
+	default:
+		return nil, fmt.Errorf("неизвестная схема PASSWORD_HASHER=%q (bcrypt или argon2id)", kind)
+	}
+}
+
+// =======================================================================
+// bcrypt
+// =======================================================================
+
+// bcryptHasher - bcrypt с заданной стоимостью (2^cost раундов).
+type bcryptHasher struct {
+	cost int
+}
+
+func (h bcryptHasher) String() string {
+	return fmt.Sprintf("bcrypt (cost %d)", h.cost)
+}
+
+func (h bcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	return string(hash), err
+}
+
+func (h bcryptHasher) Verify(encoded, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h bcryptHasher) Matches(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (h bcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.cost
+}
+
+// =======================================================================
+// argon2id
+// =======================================================================
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// argon2idHasher - argon2id в формате PHC: $argon2id$v=19$m=<КиБ>,t=<проходы>,p=<потоки>$<соль>$<хеш>.
+type argon2idHasher struct {
+	time    uint32
+	memory  uint32 // КиБ
+	threads uint8
+}
+
+func (h argon2idHasher) String() string {
+	return fmt.Sprintf("argon2id (t=%d, m=%d КиБ, p=%d)", h.time, h.memory, h.threads)
+}
+
+func (h argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.time, h.memory, h.threads, argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.memory, h.time, h.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h argon2idHasher) Verify(encoded, password string) (bool, error) {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+	actual := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(actual, key) == 1, nil
+}
+
+func (h argon2idHasher) Matches(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (h argon2idHasher) NeedsRehash(encoded string) bool {
+	params, _, _, err := decodeArgon2id(encoded)
+	return err != nil || params != h
+}
+
+// decodeArgon2id разбирает хеш в формате PHC.
+func decodeArgon2id(encoded string) (params argon2idHasher, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("неподдерживаемая версия argon2: %s", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil ||
+		params.time < 1 || params.threads < 1 {
+		return params, nil, nil, fmt.Errorf("неверные параметры argon2: %s", parts[3])
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return params, nil, nil, err
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return params, nil, nil, fmt.Errorf("неверный хеш argon2: %s", parts[5])
+	}
+	return params, salt, key, nil
+}
+
+// =======================================================================
+// Подбор параметров под железо
+// =======================================================================
+
+// calibratePasswordHashers замеряет хеширование на этой машине и печатает минимальные параметры,
+// при которых один хеш занимает не меньше target. Запуск: go run . -calibrate-hash 250ms
+func calibratePasswordHashers(target time.Duration) {
+	measure := func(h PasswordHasher) time.Duration {
+		start := time.Now()
+		if _, err := h.Hash("calibration-password"); err != nil {
+			log.Fatalf("❌ Ошибка хеширования при замере: %v", err)
+		}
+		return time.Since(start)
+	}
+
+	fmt.Printf("Цель: не меньше %v на один хеш\n\n", target)
+
+	for cost := 8; cost <= bcrypt.MaxCost; cost++ {
+		took := measure(bcryptHasher{cost: cost})
+		fmt.Printf("  bcrypt cost %2d: %v\n", cost, took.Round(time.Millisecond))
+		if took >= target || cost == bcrypt.MaxCost {
+			fmt.Printf("PASSWORD_HASHER=bcrypt BCRYPT_COST=%d\n\n", cost)
+			break
+		}
+	}
+
+	base, err := newPasswordHasher("argon2id")
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	params := base.(argon2idHasher)
+	for params.time = 1; ; params.time++ {
+		took := measure(params)
+		fmt.Printf("  argon2id t=%d, m=%d КиБ, p=%d: %v\n", params.time, params.memory, params.threads, took.Round(time.Millisecond))
+		if took >= target || params.time == 10 {
+			if params.time == 1 && took > 2*target {
+				fmt.Println("  ⚠️ Даже один проход заметно дольше цели: уменьшите ARGON2_MEMORY.")
+			}
+			fmt.Printf("PASSWORD_HASHER=argon2id ARGON2_TIME=%d ARGON2_MEMORY=%d ARGON2_THREADS=%d\n",
+				params.time, params.memory, params.threads)
+			break
+		}
+	}
+}
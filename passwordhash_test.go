@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Дешевые параметры, чтобы тесты не тратили время на хеширование.
+var (
+	testBcrypt   = bcryptHasher{cost: 4}
+	testArgon2id = argon2idHasher{time: 1, memory: 64, threads: 1}
+)
+
+// useTestPasswordHasher делает hasher схемой новых хешей на время теста.
+func useTestPasswordHasher(t *testing.T, hasher PasswordHasher) {
+	t.Helper()
+	old := passwordHasher
+	passwordHasher = hasher
+	t.Cleanup(func() { passwordHasher = old })
+}
+
+// mustHash хеширует password схемой hasher.
+func mustHash(t *testing.T, hasher PasswordHasher, password string) string {
+	t.Helper()
+	encoded, err := hasher.Hash(password)
+	if err != nil {
+		t.Fatalf("%v: Hash: %v", hasher, err)
+	}
+	return encoded
+}
+
+func TestPasswordHashersRoundTrip(t *testing.T) {
+	tests := []struct {
+		hasher   PasswordHasher
+		other    PasswordHasher // Та же схема с другими параметрами
+		foreign  PasswordHasher // Другая схема
+		wantPref string
+	}{
+		{testBcrypt, bcryptHasher{cost: 5}, testArgon2id, "$2a$04$"},
+		{testArgon2id, argon2idHasher{time: 2, memory: 64, threads: 1}, testBcrypt, "$argon2id$v=19$m=64,t=1,p=1$"},
+	}
+	for _, tc := range tests {
+		encoded := mustHash(t, tc.hasher, "correct horse battery staple")
+		if !strings.HasPrefix(encoded, tc.wantPref) {
+			t.Errorf("%v: хеш %q, ожидался префикс %q", tc.hasher, encoded, tc.wantPref)
+		}
+		if again := mustHash(t, tc.hasher, "correct horse battery staple"); again == encoded {
+			t.Errorf("%v: два хеша одного пароля совпали, соль не случайна", tc.hasher)
+		}
+		if ok, err := tc.hasher.Verify(encoded, "correct horse battery staple"); !ok || err != nil {
+			t.Errorf("%v: верный пароль не подошел: %v", tc.hasher, err)
+		}
+		if ok, err := tc.hasher.Verify(encoded, "Correct horse battery staple"); ok || err != nil {
+			t.Errorf("%v: подошел неверный пароль (%v)", tc.hasher, err)
+		}
+		if !tc.hasher.Matches(encoded) || tc.foreign.Matches(encoded) {
+			t.Errorf("%v: Matches не различает схемы", tc.hasher)
+		}
+		if tc.hasher.NeedsRehash(encoded) || !tc.other.NeedsRehash(encoded) {
+			t.Errorf("%v: NeedsRehash не учитывает параметры", tc.hasher)
+		}
+	}
+}
+
+func TestVerifyPasswordRehash(t *testing.T) {
+	const password = "correct horse battery staple"
+	bcryptHash := mustHash(t, testBcrypt, password)
+	argonHash := mustHash(t, testArgon2id, password)
+
+	tests := []struct {
+		name       string
+		current    PasswordHasher
+		encoded    string
+		password   string
+		wantOK     bool
+		wantRehash bool
+	}{
+		{"bcrypt с текущей стоимостью", testBcrypt, bcryptHash, password, true, false},
+		{"bcrypt после повышения стоимости", bcryptHasher{cost: 5}, bcryptHash, password, true, true},
+		{"переход с bcrypt на argon2id", testArgon2id, bcryptHash, password, true, true},
+		{"argon2id с текущими параметрами", testArgon2id, argonHash, password, true, false},
+		{"argon2id после смены параметров", argon2idHasher{time: 1, memory: 128, threads: 1}, argonHash, password, true, true},
+		{"возврат с argon2id на bcrypt", testBcrypt, argonHash, password, true, true},
+		{"неверный пароль устаревшего хеша", testArgon2id, bcryptHash, "wrong", false, false},
+		{"пустой пароль", testBcrypt, bcryptHash, "", false, false},
+		{"нет хеша (вход только через OIDC)", testBcrypt, "", password, false, false},
+		{"неизвестная схема", testBcrypt, "$scrypt$whatever", password, false, false},
+		{"пароль в открытом виде", testBcrypt, password, password, false, false},
+	}
+	for _, tc := range tests {
+		useTestPasswordHasher(t, tc.current)
+		ok, rehash := verifyPassword(tc.encoded, tc.password)
+		if ok != tc.wantOK || rehash != tc.wantRehash {
+			t.Errorf("%s: verifyPassword = %v, %v, ожидалось %v, %v", tc.name, ok, rehash, tc.wantOK, tc.wantRehash)
+		}
+	}
+}
+
+func TestDecodeArgon2idMalformed(t *testing.T) {
+	valid := mustHash(t, testArgon2id, "password")
+	parts := strings.Split(valid, "$")
+	replace := func(i int, value string) string {
+		changed := append([]string{}, parts...)
+		changed[i] = value
+		return strings.Join(changed, "$")
+	}
+
+	if params, salt, key, err := decodeArgon2id(valid); err != nil || params != testArgon2id || len(salt) != argon2SaltLength || len(key) != argon2KeyLength {
+		t.Fatalf("decodeArgon2id(%q) = %v, %d байт соли, %d байт ключа, %v", valid, params, len(salt), len(key), err)
+	}
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{"пустая строка", ""},
+		{"не хватает частей", strings.Join(parts[:5], "$")},
+		{"лишняя часть", valid + "$extra"},
+		{"другой алгоритм", replace(1, "argon2i")},
+		{"другая версия", replace(2, "v=16")},
+		{"версия не числом", replace(2, "v=x")},
+		{"нет параметров", replace(3, "")},
+		{"ноль проходов", replace(3, "m=64,t=0,p=1")},
+		{"ноль потоков", replace(3, "m=64,t=1,p=0")},
+		{"соль не base64", replace(4, "!!!")},
+		{"ключ не base64", replace(5, "!!!")},
+		{"пустой ключ", replace(5, "")},
+	}
+	for _, tc := range tests {
+		if _, _, _, err := decodeArgon2id(tc.encoded); err == nil {
+			t.Errorf("%s: %q разобран без ошибки", tc.name, tc.encoded)
+		}
+		if ok, _ := verifyPassword(tc.encoded, "password"); ok {
+			t.Errorf("%s: пароль подошел к испорченному хешу", tc.name)
+		}
+	}
+}
+
+func TestLoginUpgradesPasswordHash(t *testing.T) {
+	useMemoryStores()
+	t.Cleanup(func() { loginFailures.Reset("ip:192.0.2.1"); loginFailures.Reset("account:alice@example.com") })
+	const password = "correct horse battery staple"
+	oldHash := mustHash(t, testBcrypt, password)
+	userStore.Create(UserData{ID: "alice-id", Email: "alice@example.com", Handle: "alice", HashedPassword: oldHash})
+	useTestPasswordHasher(t, testArgon2id)
+
+	login := func(password string) int {
+		body := strings.NewReader(`{"email": "Alice@example.com", "password": "` + password + `"}`)
+		rec := httptest.NewRecorder()
+		loginHandler(rec, httptest.NewRequest(http.MethodPost, "/login", body))
+		return rec.Code
+	}
+
+	if code := login("wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("вход с неверным паролем: %d", code)
+	}
+	if stored, _ := userStore.GetByID("alice-id"); stored.HashedPassword != oldHash {
+		t.Errorf("хеш изменен после неудачного входа")
+	}
+
+	if code := login(password); code != http.StatusOK {
+		t.Fatalf("вход: %d", code)
+	}
+	stored, _ := userStore.GetByID("alice-id")
+	if !testArgon2id.Matches(stored.HashedPassword) || testArgon2id.NeedsRehash(stored.HashedPassword) {
+		t.Fatalf("хеш не пересчитан текущей схемой: %q", stored.HashedPassword)
+	}
+	if ok, rehash := verifyPassword(stored.HashedPassword, password); !ok || rehash {
+		t.Errorf("новый хеш: verifyPassword = %v, %v", ok, rehash)
+	}
+
+	// Следующий вход хеш уже не трогает
+	if code := login(password); code != http.StatusOK {
+		t.Fatalf("повторный вход: %d", code)
+	}
+	if again, _ := userStore.GetByID("alice-id"); again.HashedPassword != stored.HashedPassword {
+		t.Errorf("актуальный хеш пересчитан повторно")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// --- Политика Паролей ---
+
+// passwordMaxBytes - предел bcrypt: более длинные пароли он не принимает.
+const passwordMaxBytes = 72
+
+// passwordPolicy - требования к новым паролям (настраиваются через окружение в initPasswordPolicy).
+var passwordPolicy = struct {
+	MinLength  int  // минимальная длина в символах
+	MinClasses int  // сколько классов символов (строчные, заглавные, цифры, прочие) должно встретиться
+	Breached   bool // проверять ли пароль по списку утекших
+}{MinLength: 10, MinClasses: 2, Breached: true}
+
+// breachedPasswords - SHA-1 утекших паролей, разложенные по 5-символьным префиксам, как в k-anonymity
+// API Have I Been Pwned: поиск идет по префиксу, затем по суффиксу в его диапазоне.
+var breachedPasswords = map[string]map[string]struct{}{}
+
+// commonPasswordHashes - встроенный список SHA-1 распространенных паролей (по одному хешу в строке).
+//
+//go:embed breached/common_sha1.txt
+var commonPasswordHashes string
+
+// initPasswordPolicy читает настройки политики и загружает списки утекших паролей: встроенный
+// и, если задан BREACHED_PASSWORDS_FILE, внешний (формат выгрузки HIBP: "SHA1:count" или просто "SHA1").
+func initPasswordPolicy() {
+	var err error
+	if passwordPolicy.MinLength, err = strconv.Atoi(passwordMinLength); err != nil || passwordPolicy.MinLength < 1 {
+		log.Fatalf("❌ Неверное значение PASSWORD_MIN_LENGTH: %q", passwordMinLength)
+	}
+	if passwordPolicy.MinClasses, err = strconv.Atoi(passwordMinClasses); err != nil || passwordPolicy.MinClasses < 1 || passwordPolicy.MinClasses > 4 {
+		log.Fatalf("❌ Неверное значение PASSWORD_MIN_CLASSES (допустимо 1-4): %q", passwordMinClasses)
+	}
+	if passwordPolicy.Breached, err = strconv.ParseBool(passwordCheckBreached); err != nil {
+		log.Fatalf("❌ Неверное значение PASSWORD_CHECK_BREACHED: %q", passwordCheckBreached)
+	}
+	if !passwordPolicy.Breached {
+		log.Printf("⚠️ Проверка паролей по списку утекших отключена.")
+		return
+	}
+
+	count, err := loadBreachedHashes(strings.NewReader(commonPasswordHashes))
+	if err != nil {
+		log.Fatalf("❌ Не удалось разобрать встроенный список паролей: %v", err)
+	}
+	if breachedPasswordsFile != "" {
+		f, err := os.Open(breachedPasswordsFile)
+		if err != nil {
+			log.Fatalf("❌ Не удалось открыть список утекших паролей: %v", err)
+		}
+		extra, err := loadBreachedHashes(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("❌ Ошибка чтения %s: %v", breachedPasswordsFile, err)
+		}
+		count += extra
+	}
+	log.Printf("🔒 Политика паролей: от %d символов, классов символов: %d, утекших хешей: %d",
+		passwordPolicy.MinLength, passwordPolicy.MinClasses, count)
+}
+
+// loadBreachedHashes добавляет хеши из r в breachedPasswords и возвращает их количество.
+func loadBreachedHashes(r io.Reader) (int, error) {
+	count := 0
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		hash, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if hash == "" || strings.HasPrefix(hash, "#") {
+			continue
+		}
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != 2*sha1.Size {
+			return count, fmt.Errorf("строка %d: ожидается SHA-1 в hex", line)
+		}
+		hash = strings.ToUpper(hash)
+		prefix, suffix := hash[:5], hash[5:]
+		if breachedPasswords[prefix] == nil {
+			breachedPasswords[prefix] = map[string]struct{}{}
+		}
+		breachedPasswords[prefix][suffix] = struct{}{}
+		count++
+	}
+	return count, scanner.Err()
+}
+
+// passwordBreached сообщает, встречается ли пароль в списке утекших.
+func passwordBreached(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	_, found := breachedPasswords[hash[:5]][hash[5:]]
+	return found
+}
+
+// validatePassword проверяет новый пароль пользователя user и возвращает понятные пользователю
+// нарушения политики (пустой список - пароль подходит). У user используются email, имя и хендл.
+func validatePassword(password string, user UserData) []string {
+	var problems []string
+	if utf8.RuneCountInString(password) < passwordPolicy.MinLength {
+		problems = append(problems, fmt.Sprintf("Пароль должен быть не короче %d символов", passwordPolicy.MinLength))
+	}
+	if len(password) > passwordMaxBytes {
+		problems = append(problems, fmt.Sprintf("Пароль не может быть длиннее %d байт", passwordMaxBytes))
+	}
+	if passwordClasses(password) < passwordPolicy.MinClasses {
+		problems = append(problems, fmt.Sprintf("Используйте хотя бы %d вида символов из: строчные буквы, заглавные буквы, цифры, другие символы",
+			passwordPolicy.MinClasses))
+	}
+
+	lowered := strings.ToLower(password)
+	localPart, _, _ := strings.Cut(strings.ToLower(user.Email), "@")
+	for _, personal := range []string{strings.ToLower(user.Email), localPart, strings.ToLower(user.Username), user.Handle} {
+		if personal != "" && lowered == personal {
+			problems = append(problems, "Пароль не должен совпадать с email, именем или хендлом")
+			break
+		}
+	}
+
+	if passwordPolicy.Breached && passwordBreached(password) {
+		problems = append(problems, "Этот пароль есть в списках утекших паролей, выберите другой")
+	}
+	return problems
+}
+
+// passwordClasses считает, сколько классов символов встречается в пароле.
+func passwordClasses(password string) int {
+	var lower, upper, digit, other bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	count := 0
+	for _, present := range []bool{lower, upper, digit, other} {
+		if present {
+			count++
+		}
+	}
+	return count
+}
+
+// --- Ошибки Полей Формы ---
+
+// fieldErrors - ошибки проверки по полям формы: имя поля -> список сообщений.
+type fieldErrors map[string][]string
+
+// writeFieldErrors отвечает 400 с общим сообщением (для старых клиентов) и ошибками по полям в "errors".
+func writeFieldErrors(w http.ResponseWriter, errs fieldErrors) {
+	fields := make([]string, 0, len(errs))
+	for field := range errs {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	var messages []string
+	for _, field := range fields {
+		messages = append(messages, errs[field]...)
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": strings.Join(messages, ". "),
+		"status":  "error",
+		"errors":  errs,
+	})
+}
@@ -0,0 +1,688 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/image/draw"
+)
+
+// --- Публикации ---
+//
+// Пост - одна картинка с подписью. Картинка проходит ту же обработку, что и фото профиля
+// (проверка, EXIF, перекодирование), уменьшается до postMaxSide и получает квадратное превью
+// для сетки профиля. Файлы учитываются в MediaStore и квоте автора.
+
+const (
+	// postMaxSide - наибольшая сторона сохраняемой картинки поста (как у Instagram).
+	postMaxSide = 1080
+	// postThumbnailSize - сторона квадратного превью в сетке профиля (три колонки на экранах высокой плотности).
+	postThumbnailSize = 320
+	// postCaptionMaxLength - наибольшая длина подписи в символах.
+	postCaptionMaxLength = 2200
+	// postPageDefault и postPageMax - размер страницы сетки по умолчанию и наибольший.
+	postPageDefault = 12
+	postPageMax     = 60
+)
+
+// ErrPostNotFound возвращается, если поста нет.
+var ErrPostNotFound = errors.New("пост не найден")
+
+// Post - публикация пользователя.
+type Post struct {
+	ID            string    `json:"id"` // Упорядочен по времени создания (см. newPostID)
+	AuthorID      string    `json:"author_id"`
+	ImagePath     string    `json:"image_path"`     // Картинка (не больше postMaxSide)
+	ThumbnailPath string    `json:"thumbnail_path"` // Квадратное превью для сетки
+	Width         int       `json:"width"`
+	Height        int       `json:"height"`
+	Caption       string    `json:"caption"`
+	TakenAt       time.Time `json:"taken_at"` // Время съемки из EXIF (нулевое, если нет)
+	CreatedAt     time.Time `json:"created_at"`
+	EditedAt      time.Time `json:"edited_at"` // Когда менялась подпись (нулевое - не менялась)
+}
+
+// files возвращает URL всех файлов поста.
+func (p Post) files() []string {
+	var files []string
+	for _, path := range []string{p.ImagePath, p.ThumbnailPath} {
+		if path != "" {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// public возвращает пост в виде для ответа API. Нулевые taken_at и edited_at отдаются как null.
+func (p Post) public() map[string]interface{} {
+	optionalTime := func(t time.Time) interface{} {
+		if t.IsZero() {
+			return nil
+		}
+		return t
+	}
+	return map[string]interface{}{
+		"id":            p.ID,
+		"author_id":     p.AuthorID,
+		"image_url":     p.ImagePath,
+		"thumbnail_url": p.ThumbnailPath,
+		"width":         p.Width,
+		"height":        p.Height,
+		"caption":       p.Caption,
+		"taken_at":      optionalTime(p.TakenAt),
+		"created_at":    p.CreatedAt,
+		"edited_at":     optionalTime(p.EditedAt),
+	}
+}
+
+// PostStore описывает хранилище постов.
+type PostStore interface {
+	// Create сохраняет новый пост.
+	Create(post Post) error
+	// Get возвращает пост по ID или ErrPostNotFound.
+	Get(id string) (Post, error)
+	// Update перезаписывает существующий пост (подпись).
+	Update(post Post) error
+	// Delete удаляет пост.
+	Delete(id string) error
+	// ListByAuthor возвращает посты автора от новых к старым, созданные раньше поста before
+	// (пустой - с самого нового). limit <= 0 - все.
+	ListByAuthor(authorID, before string, limit int) ([]Post, error)
+	// List возвращает все посты (для сборщика неиспользуемых файлов).
+	List() ([]Post, error)
+}
+
+// postStore - активное хранилище постов, инициализируется в initStorage().
+var postStore PostStore
+
+// newPostID создает ID поста: время создания в наносекундах и 64 случайных бита в hex.
+// Такие ID сортируются по времени, поэтому служат курсором страниц.
+func newPostID(now time.Time) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%016x", now.UnixNano()) + hex.EncodeToString(b), nil
+}
+
+// validPostID проверяет формат ID поста (32 символа hex).
+func validPostID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// normalizeCaption обрезает пробелы по краям и проверяет длину подписи.
+func normalizeCaption(caption string) (string, error) {
+	caption = strings.TrimSpace(caption)
+	if !utf8.ValidString(caption) {
+		return "", errors.New("Подпись должна быть в UTF-8")
+	}
+	if utf8.RuneCountInString(caption) > postCaptionMaxLength {
+		return "", fmt.Errorf("Подпись не должна быть длиннее %d символов", postCaptionMaxLength)
+	}
+	return caption, nil
+}
+
+// postImage - сохраненная картинка поста.
+type postImage struct {
+	Path, Thumbnail string
+	Width, Height   int
+	TakenAt         time.Time
+}
+
+// savePostImage проверяет и перекодирует картинку поста, уменьшает ее до postMaxSide
+// и сохраняет вместе с квадратным превью. Ошибки проверки распознаются через imageRejected.
+func savePostImage(file io.Reader) (postImage, error) {
+	upload, err := decodeUpload(file)
+	if err != nil {
+		return postImage{}, err
+	}
+	img := upload.fitted(postMaxSide)
+	data, ext, err := encodeImage(img, upload.Format)
+	if err != nil {
+		return postImage{}, err
+	}
+	path, err := storeMedia(data, ext)
+	if err != nil {
+		return postImage{}, err
+	}
+
+	var thumb bytes.Buffer
+	if err := jpeg.Encode(&thumb, squareThumbnail(img, postThumbnailSize), &jpeg.Options{Quality: avatarJPEGQuality}); err != nil {
+		releaseMedia(path)
+		return postImage{}, err
+	}
+	thumbnail, err := storeMedia(thumb.Bytes(), ".jpg")
+	if err != nil {
+		releaseMedia(path)
+		return postImage{}, err
+	}
+	return postImage{
+		Path:      path,
+		Thumbnail: thumbnail,
+		Width:     img.Bounds().Dx(),
+		Height:    img.Bounds().Dy(),
+		TakenAt:   upload.TakenAt,
+	}, nil
+}
+
+// fitImage уменьшает картинку так, чтобы большая сторона была не больше maxSide. Меньшие не меняются.
+func fitImage(img image.Image, maxSide int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= maxSide && h <= maxSide {
+		return img
+	}
+	if w >= h {
+		w, h = maxSide, max(h*maxSide/w, 1)
+	} else {
+		w, h = max(w*maxSide/h, 1), maxSide
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+// authorVisible сообщает, можно ли показывать посты автора: деактивированные и удаленные скрыты.
+func authorVisible(authorID string) bool {
+	author, err := userStore.GetByID(authorID)
+	return err == nil && !author.deactivated()
+}
+
+// removeUserPosts удаляет все посты пользователя и снимает ссылки на их файлы (при удалении аккаунта).
+func removeUserPosts(userID string) error {
+	posts, err := postStore.ListByAuthor(userID, "", 0)
+	if err != nil {
+		return err
+	}
+	for _, post := range posts {
+		if err := postStore.Delete(post.ID); err != nil {
+			return err
+		}
+		releaseMedia(post.files()...)
+	}
+	return nil
+}
+
+// =======================================================================
+// Обработчики (/api/posts, /api/users/{id}/posts)
+// =======================================================================
+
+// createPostHandler создает пост: POST /api/posts (multipart: image, caption).
+// Большие файлы загружаются по частям: /user/uploads с целью "post" (см. resumable.go).
+func createPostHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Допустим только метод POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_UPLOAD_SIZE)
+	if err := r.ParseMultipartForm(MAX_UPLOAD_SIZE); err != nil {
+		http.Error(w, fmt.Sprintf("Максимальный размер запроса %d MB", MAX_UPLOAD_SIZE/1048576), http.StatusBadRequest)
+		return
+	}
+	caption, err := normalizeCaption(r.FormValue("caption"))
+	if err != nil {
+		writeFieldErrors(w, fieldErrors{"caption": {err.Error()}})
+		return
+	}
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		writeFieldErrors(w, fieldErrors{"image": {"Выберите фото для публикации"}})
+		return
+	}
+	defer file.Close()
+
+	publishPost(w, r.Context().Value(userContextKey).(string), file, caption)
+}
+
+// publishPost сохраняет file картинкой нового поста пользователя userID и отвечает клиенту.
+// Общая часть POST /api/posts и завершения возобновляемой загрузки с целью "post".
+func publishPost(w http.ResponseWriter, userID string, file io.Reader, caption string) {
+	lockUserStorage(userID)
+	defer unlockUserStorage(userID)
+
+	userData, err := userStore.GetByID(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Пользователь не найден", "status": "error"})
+		return
+	}
+
+	saved, err := savePostImage(file)
+	if imageRejected(err) {
+		writeFieldErrors(w, fieldErrors{"image": {err.Error()}})
+		return
+	} else if err != nil {
+		log.Printf("❌ Ошибка сохранения картинки поста: %v", err)
+		http.Error(w, "Ошибка при обработке файла", http.StatusInternalServerError)
+		return
+	}
+	files := []string{saved.Path, saved.Thumbnail}
+
+	var quotaErr *QuotaExceededError
+	if err := checkStorageQuota(userData, nil, files); errors.As(err, &quotaErr) {
+		releaseMedia(files...)
+		writeQuotaExceeded(w, "image", quotaErr)
+		return
+	} else if err != nil {
+		releaseMedia(files...)
+		log.Printf("❌ Ошибка проверки квоты: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	id, err := newPostID(now)
+	if err != nil {
+		releaseMedia(files...)
+		log.Printf("❌ Ошибка генерации ID поста: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	post := Post{
+		ID:            id,
+		AuthorID:      userID,
+		ImagePath:     saved.Path,
+		ThumbnailPath: saved.Thumbnail,
+		Width:         saved.Width,
+		Height:        saved.Height,
+		Caption:       caption,
+		TakenAt:       saved.TakenAt,
+		CreatedAt:     now,
+	}
+	if err := postStore.Create(post); err != nil {
+		releaseMedia(files...)
+		log.Printf("❌ Ошибка сохранения поста: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("📸 Пользователь %s опубликовал пост %s", userID, post.ID)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Пост опубликован",
+		"post":    post.public(),
+		"status":  "success",
+	})
+}
+
+// postHandler: GET /api/posts/{id} - пост (доступен всем, как и профиль /u/{handle}),
+// PATCH - изменение подписи {"caption": "..."}, DELETE - удаление (только автор).
+func postHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		getPost(w, r)
+	case http.MethodPatch, http.MethodDelete:
+		apiScope(scopeMediaUpload, authMiddleware(csrfMiddleware(changePost)))(w, r)
+	default:
+		http.Error(w, "Допустимы только методы GET, PATCH и DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+// getPost возвращает пост: GET /api/posts/{id}
+func getPost(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	post, err := postStore.Get(strings.TrimPrefix(r.URL.Path, "/api/posts/"))
+	if err == nil && !authorVisible(post.AuthorID) {
+		err = ErrPostNotFound
+	}
+	if err == ErrPostNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Пост не найден", "status": "error"})
+		return
+	} else if err != nil {
+		log.Printf("❌ Ошибка чтения поста: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"post": post.public(), "status": "success"})
+}
+
+// changePost изменяет подпись (PATCH) или удаляет пост (DELETE): /api/posts/{id}
+func changePost(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	userID := r.Context().Value(userContextKey).(string)
+
+	// Чужие посты для изменения не существуют
+	post, err := postStore.Get(strings.TrimPrefix(r.URL.Path, "/api/posts/"))
+	if err == nil && post.AuthorID != userID {
+		err = ErrPostNotFound
+	}
+	if err == ErrPostNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Пост не найден", "status": "error"})
+		return
+	} else if err != nil {
+		log.Printf("❌ Ошибка чтения поста: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := postStore.Delete(post.ID); err != nil {
+			log.Printf("❌ Ошибка удаления поста %s: %v", post.ID, err)
+			http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		releaseMedia(post.files()...)
+		log.Printf("🗑️ Пользователь %s удалил пост %s", userID, post.ID)
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Пост удален", "status": "success"})
+		return
+	}
+
+	var body struct {
+		Caption *string `json:"caption"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Caption == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Не указана подпись", "status": "error"})
+		return
+	}
+	caption, err := normalizeCaption(*body.Caption)
+	if err != nil {
+		writeFieldErrors(w, fieldErrors{"caption": {err.Error()}})
+		return
+	}
+	if caption != post.Caption {
+		post.Caption = caption
+		post.EditedAt = time.Now()
+		if err := postStore.Update(post); err != nil {
+			log.Printf("❌ Ошибка сохранения поста %s: %v", post.ID, err)
+			http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Подпись сохранена",
+		"post":    post.public(),
+		"status":  "success",
+	})
+}
+
+// userPostsHandler возвращает сетку постов пользователя от новых к старым:
+// GET /api/users/{id}/posts?limit=12&cursor=... Ответ: {"posts": [...], "next_cursor": "..."};
+// пустой next_cursor - постов больше нет. Доступен всем, как и профиль /u/{handle}.
+func userPostsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Допустим только метод GET", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/users/"), "/")
+	if rest != "posts" {
+		http.NotFound(w, r)
+		return
+	}
+	if !authorVisible(userID) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Профиль не найден", "status": "error"})
+		return
+	}
+
+	limit := postPageDefault
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": "Неверный параметр limit", "status": "error"})
+			return
+		}
+		limit = min(parsed, postPageMax)
+	}
+	cursor := r.URL.Query().Get("cursor")
+	if cursor != "" && !validPostID(cursor) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Неверный параметр cursor", "status": "error"})
+		return
+	}
+
+	// Берем на один пост больше, чтобы узнать, есть ли следующая страница
+	posts, err := postStore.ListByAuthor(userID, cursor, limit+1)
+	if err != nil {
+		log.Printf("❌ Ошибка чтения постов %s: %v", userID, err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	nextCursor := ""
+	if len(posts) > limit {
+		posts = posts[:limit]
+		nextCursor = posts[limit-1].ID
+	}
+	grid := make([]map[string]interface{}, 0, len(posts))
+	for _, post := range posts {
+		grid = append(grid, post.public())
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"posts":       grid,
+		"next_cursor": nextCursor,
+		"status":      "success",
+	})
+}
+
+// =======================================================================
+// Хранилище постов в памяти
+// =======================================================================
+
+type memoryPostStore struct {
+	mu    sync.Mutex
+	posts map[string]Post
+}
+
+func newMemoryPostStore() *memoryPostStore {
+	return &memoryPostStore{posts: make(map[string]Post)}
+}
+
+func (s *memoryPostStore) Create(post Post) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.posts[post.ID] = post
+	return nil
+}
+
+func (s *memoryPostStore) Get(id string) (Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	post, exists := s.posts[id]
+	if !exists {
+		return Post{}, ErrPostNotFound
+	}
+	return post, nil
+}
+
+func (s *memoryPostStore) Update(post Post) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.posts[post.ID]; !exists {
+		return ErrPostNotFound
+	}
+	s.posts[post.ID] = post
+	return nil
+}
+
+func (s *memoryPostStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.posts, id)
+	return nil
+}
+
+func (s *memoryPostStore) ListByAuthor(authorID, before string, limit int) ([]Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Post, 0)
+	for _, post := range s.posts {
+		if post.AuthorID == authorID && (before == "" || post.ID < before) {
+			list = append(list, post)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID > list[j].ID })
+	if limit > 0 && len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
+
+func (s *memoryPostStore) List() ([]Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Post, 0, len(s.posts))
+	for _, post := range s.posts {
+		list = append(list, post)
+	}
+	return list, nil
+}
+
+// =======================================================================
+// Хранилище постов на диске (bbolt)
+// =======================================================================
+
+var (
+	// postsBucket: ID -> JSON Post
+	postsBucket = []byte("posts")
+	// postAuthorsBucket: "{authorID}/{postID}" -> пусто (индекс постов автора, упорядочен по времени)
+	postAuthorsBucket = []byte("post_authors")
+)
+
+type boltPostStore struct {
+	db *bolt.DB
+}
+
+func newBoltPostStore(db *bolt.DB) (*boltPostStore, error) {
+	if err := createBuckets(db, postsBucket, postAuthorsBucket); err != nil {
+		return nil, err
+	}
+	return &boltPostStore{db: db}, nil
+}
+
+func postAuthorKey(post Post) []byte {
+	return []byte(post.AuthorID + "/" + post.ID)
+}
+
+func (s *boltPostStore) Create(post Post) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := boltPut(tx.Bucket(postsBucket), post.ID, post); err != nil {
+			return err
+		}
+		return tx.Bucket(postAuthorsBucket).Put(postAuthorKey(post), []byte{})
+	})
+}
+
+func (s *boltPostStore) Get(id string) (Post, error) {
+	var post Post
+	err := s.db.View(func(tx *bolt.Tx) error {
+		found, err := boltGet(tx.Bucket(postsBucket), id, &post)
+		if err == nil && !found {
+			err = ErrPostNotFound
+		}
+		return err
+	})
+	return post, err
+}
+
+func (s *boltPostStore) Update(post Post) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(postsBucket)
+		if b.Get([]byte(post.ID)) == nil {
+			return ErrPostNotFound
+		}
+		return boltPut(b, post.ID, post)
+	})
+}
+
+func (s *boltPostStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(postsBucket)
+		var post Post
+		found, err := boltGet(b, id, &post)
+		if err != nil || !found {
+			return err
+		}
+		if err := tx.Bucket(postAuthorsBucket).Delete(postAuthorKey(post)); err != nil {
+			return err
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+// ListByAuthor идет по индексу автора с конца: ключи упорядочены по ID, а ID - по времени.
+func (s *boltPostStore) ListByAuthor(authorID, before string, limit int) ([]Post, error) {
+	list := make([]Post, 0)
+	prefix := []byte(authorID + "/")
+	err := s.db.View(func(tx *bolt.Tx) error {
+		posts := tx.Bucket(postsBucket)
+		c := tx.Bucket(postAuthorsBucket).Cursor()
+
+		// Встаем на первый ключ после нужного диапазона и шагаем назад
+		seek := []byte(authorID + "0") // '0' - следующий символ после '/'
+		if before != "" {
+			seek = append(prefix[:len(prefix):len(prefix)], before...)
+		}
+		k, _ := c.Seek(seek)
+		if k == nil {
+			k, _ = c.Last()
+		} else {
+			k, _ = c.Prev()
+		}
+
+		for ; k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Prev() {
+			if limit > 0 && len(list) >= limit {
+				break
+			}
+			var post Post
+			found, err := boltGet(posts, string(k[len(prefix):]), &post)
+			if err != nil {
+				return err
+			}
+			if found {
+				list = append(list, post)
+			}
+		}
+		return nil
+	})
+	return list, err
+}
+
+func (s *boltPostStore) List() ([]Post, error) {
+	list := make([]Post, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(postsBucket).ForEach(func(_, data []byte) error {
+			var post Post
+			if err := json.Unmarshal(data, &post); err != nil {
+				return err
+			}
+			list = append(list, post)
+			return nil
+		})
+	})
+	return list, err
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// postStoreCases - реализации PostStore, которые должны вести себя одинаково.
+func postStoreCases() map[string]func(t *testing.T) PostStore {
+	return map[string]func(t *testing.T) PostStore{
+		"memory": func(t *testing.T) PostStore { return newMemoryPostStore() },
+		"bolt": func(t *testing.T) PostStore {
+			store, err := newBoltPostStore(openTestDB(t))
+			if err != nil {
+				t.Fatalf("создание хранилища: %v", err)
+			}
+			return store
+		},
+	}
+}
+
+func TestPostStoreListByAuthor(t *testing.T) {
+	for name, newStore := range postStoreCases() {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+
+			// Посты трех авторов вперемешку; "al" - префикс "alice", индекс не должен их путать
+			authors := []string{"alice", "bob", "alice", "al", "alice", "bob", "alice", "alice"}
+			start := time.Unix(1700000000, 0)
+			ids := map[string][]string{} // ID постов по авторам от старых к новым
+			for i, author := range authors {
+				id, err := newPostID(start.Add(time.Duration(i) * time.Minute))
+				if err != nil {
+					t.Fatalf("newPostID: %v", err)
+				}
+				if err := store.Create(Post{ID: id, AuthorID: author}); err != nil {
+					t.Fatalf("Create: %v", err)
+				}
+				ids[author] = append(ids[author], id)
+			}
+			alice := ids["alice"]
+			// Курсор удаленного поста продолжает работать
+			deleted := alice[2]
+			if err := store.Delete(deleted); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			newest := []string{alice[4], alice[3], alice[1], alice[0]}
+
+			tests := []struct {
+				name   string
+				author string
+				before string
+				limit  int
+				want   []string
+			}{
+				{"первая страница", "alice", "", 2, newest[:2]},
+				{"вторая страница", "alice", newest[1], 2, newest[2:]},
+				{"после последнего поста", "alice", newest[3], 2, nil},
+				{"курсор удаленного поста", "alice", deleted, 10, newest[2:]},
+				{"без ограничения", "alice", "", 0, newest},
+				{"отрицательный limit - все", "alice", "", -1, newest},
+				{"автор-префикс", "al", "", 0, ids["al"]},
+				{"неизвестный автор", "carol", "", 10, nil},
+			}
+			for _, tc := range tests {
+				posts, err := store.ListByAuthor(tc.author, tc.before, tc.limit)
+				if err != nil {
+					t.Fatalf("%s: ListByAuthor: %v", tc.name, err)
+				}
+				if len(posts) != len(tc.want) {
+					t.Errorf("%s: получено %d постов, ожидалось %d", tc.name, len(posts), len(tc.want))
+					continue
+				}
+				for i, post := range posts {
+					if post.ID != tc.want[i] || post.AuthorID != tc.author {
+						t.Errorf("%s: пост %d = %s (%s), ожидался %s", tc.name, i, post.ID, post.AuthorID, tc.want[i])
+					}
+				}
+			}
+
+			// Постраничный обход собирает все посты ровно один раз
+			var seen []string
+			for before := ""; ; {
+				page, err := store.ListByAuthor("alice", before, 3)
+				if err != nil {
+					t.Fatalf("ListByAuthor: %v", err)
+				}
+				for _, post := range page {
+					seen = append(seen, post.ID)
+				}
+				if len(page) < 3 {
+					break
+				}
+				before = page[len(page)-1].ID
+			}
+			if len(seen) != len(newest) {
+				t.Errorf("обход страниц: %v, ожидалось %v", seen, newest)
+			}
+		})
+	}
+}
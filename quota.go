@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// --- Квоты Хранилища ---
+//
+// Каждому пользователю засчитывается суммарный размер файлов, на которые ссылаются его профиль
+// и посты (одинаковые файлы у разных пользователей засчитываются каждому). Лимит зависит от тарифа
+// (UserData.Tier): тарифы и их лимиты задаются в STORAGE_QUOTAS, тариф без записи в профиле -
+// STORAGE_DEFAULT_TIER. Оплаты пока нет, тариф назначается администратором при остановленном
+// сервере (базу bbolt открывает только один процесс): go run . -set-tier handle=pro
+
+// Категории файлов в разбивке использования.
+const (
+	usageProfilePhoto   = "profile_photo"   // Оригинал фото профиля
+	usageAvatarPreviews = "avatar_previews" // Квадратные превью фото профиля
+	usagePosts          = "posts"           // Картинки постов и их превью
+)
+
+// storageQuotas - лимит в байтах по имени тарифа, 0 - без ограничений. Заполняется в initStorageQuotas().
+var storageQuotas = map[string]int64{}
+
+// defaultTier - тариф пользователей, которым он не назначен явно.
+var defaultTier string
+
+// initStorageQuotas разбирает STORAGE_QUOTAS ("free=100MB,pro=5GB,staff=unlimited") и STORAGE_DEFAULT_TIER.
+func initStorageQuotas() {
+	for _, entry := range strings.Split(storageQuotasSpec, ",") {
+		name, limit, found := strings.Cut(strings.TrimSpace(entry), "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			log.Fatalf("❌ Неверная запись в STORAGE_QUOTAS: %q (ожидается тариф=размер)", entry)
+		}
+		bytes, err := parseByteSize(limit)
+		if err != nil {
+			log.Fatalf("❌ Неверный лимит тарифа %s в STORAGE_QUOTAS: %v", name, err)
+		}
+		storageQuotas[name] = bytes
+	}
+	defaultTier = storageDefaultTier
+	if _, exists := storageQuotas[defaultTier]; !exists {
+		log.Fatalf("❌ Тариф по умолчанию STORAGE_DEFAULT_TIER=%q не описан в STORAGE_QUOTAS", defaultTier)
+	}
+}
+
+// parseByteSize разбирает размер вида "512KB", "100MB", "5GB", число байт или "unlimited" (0).
+func parseByteSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if value == "UNLIMITED" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"TB", 1 << 40}, {"B", 1}} {
+		if number, found := strings.CutSuffix(value, unit.suffix); found {
+			value, multiplier = strings.TrimSpace(number), unit.size
+			break
+		}
+	}
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("не размер: %q", value)
+	}
+	return number * multiplier, nil
+}
+
+// formatByteSize возвращает размер в удобных единицах ("1.5 МБ").
+func formatByteSize(size int64) string {
+	units := []string{"Б", "КБ", "МБ", "ГБ", "ТБ"}
+	value, unit := float64(size), 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", size, units[0])
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// tier возвращает тариф пользователя с учетом тарифа по умолчанию. Тариф, удаленный
+// из STORAGE_QUOTAS, тоже считается тарифом по умолчанию.
+func (u UserData) tier() string {
+	if _, exists := storageQuotas[u.Tier]; u.Tier == "" || !exists {
+		return defaultTier
+	}
+	return u.Tier
+}
+
+// userMedia возвращает файлы (URL /uploads/...) пользователя по категориям использования.
+func userMedia(user UserData) (map[string][]string, error) {
+	media := map[string][]string{}
+	if user.PhotoPath != "" {
+		media[usageProfilePhoto] = []string{user.PhotoPath}
+	}
+	for _, path := range user.PhotoVariants {
+		media[usageAvatarPreviews] = append(media[usageAvatarPreviews], path)
+	}
+	if user.ID == "" {
+		return media, nil // Регистрация: постов еще нет
+	}
+	posts, err := postStore.ListByAuthor(user.ID, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, post := range posts {
+		media[usagePosts] = append(media[usagePosts], post.files()...)
+	}
+	return media, nil
+}
+
+// mediaSize возвращает размер файла по ключу: из учета медиафайлов, а для файлов,
+// загруженных до него, - из хранилища. Пропавший файл места не занимает.
+func mediaSize(key string) (int64, error) {
+	if blob, err := mediaStore.Get(key); err == nil {
+		return blob.Size, nil
+	} else if err != ErrMediaNotFound {
+		return 0, err
+	}
+	info, err := blobStore.Stat(key)
+	if errors.Is(err, ErrBlobNotFound) {
+		return 0, nil
+	}
+	return info.Size, err
+}
+
+// StorageUsage - использование хранилища пользователем.
+type StorageUsage struct {
+	Tier      string           `json:"tier"`
+	Limit     int64            `json:"limit_bytes"` // 0 - без ограничений
+	Used      int64            `json:"used_bytes"`
+	Breakdown map[string]int64 `json:"breakdown"` // Категория -> байты
+}
+
+// Available возвращает, сколько байт еще можно загрузить (-1 - без ограничений).
+func (u StorageUsage) Available() int64 {
+	if u.Limit == 0 {
+		return -1
+	}
+	return max(u.Limit-u.Used, 0)
+}
+
+// storageUsage считает использование хранилища пользователем. Файл, на который профиль
+// ссылается несколько раз (например, совпавшие превью маленького фото), засчитывается один раз.
+func storageUsage(user UserData) (StorageUsage, error) {
+	usage, _, err := measureStorage(user)
+	return usage, err
+}
+
+// storedFile - файл пользователя в подсчете использования.
+type storedFile struct {
+	size int64
+	refs int // Сколько раз на файл ссылаются профиль и посты пользователя
+}
+
+// measureStorage считает использование, как storageUsage, и возвращает учтенные файлы по ключам,
+// чтобы checkStorageQuota не читала посты и размеры файлов второй раз.
+func measureStorage(user UserData) (StorageUsage, map[string]storedFile, error) {
+	tier := user.tier()
+	usage := StorageUsage{Tier: tier, Limit: storageQuotas[tier], Breakdown: map[string]int64{}}
+	files := map[string]storedFile{}
+
+	// Категории в постоянном порядке, чтобы общий файл всегда засчитывался одной и той же
+	media, err := userMedia(user)
+	if err != nil {
+		return StorageUsage{}, nil, err
+	}
+	categories := make([]string, 0, len(media))
+	for category := range media {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	for _, category := range categories {
+		for _, url := range media[category] {
+			key, ok := uploadKey(url)
+			if !ok {
+				continue
+			}
+			if file, counted := files[key]; counted {
+				file.refs++
+				files[key] = file
+				continue
+			}
+			size, err := mediaSize(key)
+			if err != nil {
+				return StorageUsage{}, nil, err
+			}
+			files[key] = storedFile{size: size, refs: 1}
+			usage.Breakdown[category] += size
+			usage.Used += size
+		}
+	}
+	return usage, files, nil
+}
+
+// QuotaExceededError возвращается, если после загрузки пользователь превысил бы лимит тарифа.
+type QuotaExceededError struct {
+	Usage     StorageUsage // Использование до загрузки
+	Requested int64        // Сколько добавила бы загрузка
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("Недостаточно места: загрузка займет %s, свободно %s из %s (тариф %s)",
+		formatByteSize(e.Requested), formatByteSize(e.Usage.Available()), formatByteSize(e.Usage.Limit), e.Usage.Tier)
+}
+
+// userStorageLocks - блокировки пользователей на время от проверки квоты до сохранения новых файлов
+// в профиле или посте: иначе параллельные загрузки проверили бы квоту по одному и тому же
+// использованию и вместе превысили лимит. Счетчик - сколько запросов держат или ждут блокировку.
+var (
+	userStorageLocksMu sync.Mutex
+	userStorageLocks   = map[string]*userStorageLock{}
+)
+
+type userStorageLock struct {
+	sync.Mutex
+	holders int
+}
+
+// lockUserStorage ждет и захватывает блокировку файлов пользователя userID.
+func lockUserStorage(userID string) {
+	userStorageLocksMu.Lock()
+	lock, exists := userStorageLocks[userID]
+	if !exists {
+		lock = &userStorageLock{}
+		userStorageLocks[userID] = lock
+	}
+	lock.holders++
+	userStorageLocksMu.Unlock()
+	lock.Lock()
+}
+
+func unlockUserStorage(userID string) {
+	userStorageLocksMu.Lock()
+	defer userStorageLocksMu.Unlock()
+	lock := userStorageLocks[userID]
+	lock.Unlock()
+	if lock.holders--; lock.holders == 0 {
+		delete(userStorageLocks, userID)
+	}
+}
+
+// checkStorageQuota проверяет, уложится ли пользователь в лимит, если его файлы removed
+// заменить на added (URL /uploads/...). Уже сохраненные added после отказа нужно освободить
+// через releaseMedia. Ошибка превышения - *QuotaExceededError. Проверка и сохранение результата
+// должны идти под lockUserStorage, а user - быть прочитан уже под ней.
+func checkStorageQuota(user UserData, removed, added []string) error {
+	usage, files, err := measureStorage(user)
+	if err != nil || usage.Limit == 0 {
+		return err
+	}
+
+	// Итоговый набор файлов: текущие без removed плюс added, каждый файл один раз. Файл из removed
+	// освобождает место, только если на него больше не ссылается ничто другое (например, пост
+	// с той же картинкой, что и фото профиля).
+	projected := usage.Used
+	for _, url := range removed {
+		key, ok := uploadKey(url)
+		file, exists := files[key]
+		if !ok || !exists || file.refs == 0 {
+			continue
+		}
+		if file.refs--; file.refs == 0 {
+			projected -= file.size
+		}
+		files[key] = file
+	}
+	var requested int64
+	for _, url := range added {
+		key, ok := uploadKey(url)
+		if !ok {
+			continue
+		}
+		file, exists := files[key]
+		if file.refs > 0 {
+			continue
+		}
+		if !exists {
+			if file.size, err = mediaSize(key); err != nil {
+				return err
+			}
+		}
+		file.refs = 1
+		files[key] = file
+		requested += file.size
+	}
+	projected += requested
+
+	if projected > usage.Limit && projected > usage.Used {
+		// Замена, которая не увеличивает занятое место, разрешена даже сверх лимита (после его снижения)
+		return &QuotaExceededError{Usage: usage, Requested: requested}
+	}
+	return nil
+}
+
+// writeQuotaExceeded отвечает 413 с сообщением об ошибке поля field и текущим использованием.
+func writeQuotaExceeded(w http.ResponseWriter, field string, err *QuotaExceededError) {
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": err.Error(),
+		"status":  "error",
+		"code":    "quota_exceeded",
+		"errors":  fieldErrors{field: {err.Error()}},
+		"usage":   err.Usage,
+	})
+}
+
+// storageUsageHandler возвращает использование хранилища: GET /user/storage
+func storageUsageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Допустим только метод GET", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	userData, err := userStore.GetByID(r.Context().Value(userContextKey).(string))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Пользователь не найден", "status": "error"})
+		return
+	}
+	usage, err := storageUsage(userData)
+	if err != nil {
+		log.Printf("❌ Ошибка подсчета места пользователя %s: %v", userData.ID, err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":          "success",
+		"tier":            usage.Tier,
+		"limit_bytes":     usage.Limit,
+		"used_bytes":      usage.Used,
+		"available_bytes": usage.Available(),
+		"breakdown":       usage.Breakdown,
+	})
+}
+
+// setUserTier назначает тариф пользователю по хендлу (флаг -set-tier handle=tier).
+// Пустой тариф возвращает пользователя на тариф по умолчанию.
+func setUserTier(assignment string) error {
+	handle, tier, found := strings.Cut(assignment, "=")
+	if !found {
+		return fmt.Errorf("ожидается handle=tier, получено %q", assignment)
+	}
+	if _, exists := storageQuotas[tier]; tier != "" && !exists {
+		return fmt.Errorf("тариф %q не описан в STORAGE_QUOTAS", tier)
+	}
+	user, err := userStore.GetByHandle(normalizeHandle(handle))
+	if err != nil {
+		return fmt.Errorf("пользователь @%s: %w", handle, err)
+	}
+	user.Tier = tier
+	if err := userStore.Update(user); err != nil {
+		return err
+	}
+	log.Printf("✅ Пользователю @%s назначен тариф %s", user.Handle, user.tier())
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// useTestQuotas подменяет тарифы на время теста.
+func useTestQuotas(t *testing.T, quotas map[string]int64, tier string) {
+	t.Helper()
+	oldQuotas, oldTier := storageQuotas, defaultTier
+	storageQuotas, defaultTier = quotas, tier
+	t.Cleanup(func() { storageQuotas, defaultTier = oldQuotas, oldTier })
+}
+
+// storeTestFile сохраняет файл из size байт (содержимое различается по fill) и возвращает его URL.
+func storeTestFile(t *testing.T, fill byte, size int) string {
+	t.Helper()
+	url, err := storeMedia(bytes.Repeat([]byte{fill}, size), ".png")
+	if err != nil {
+		t.Fatalf("storeMedia: %v", err)
+	}
+	return url
+}
+
+func TestCheckStorageQuota(t *testing.T) {
+	useMemoryStores()
+	useTestMedia(t, newMemoryMediaStore())
+	useTestQuotas(t, map[string]int64{"free": 100, "pro": 1000, "staff": 0}, "free")
+
+	photo := storeTestFile(t, 'p', 60)
+	shared := storeTestFile(t, 's', 60)
+	small := storeTestFile(t, 'm', 40)
+	medium := storeTestFile(t, 'd', 50)
+	large := storeTestFile(t, 'l', 70)
+	tiny := storeTestFile(t, 't', 30)
+
+	postID, _ := newPostID(time.Now())
+	if err := postStore.Create(Post{ID: postID, AuthorID: "poster-id", ImagePath: shared}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		user    UserData
+		removed []string
+		added   []string
+		wantErr bool
+	}{
+		{"регистрация в пределах лимита", UserData{}, nil, []string{photo}, false},
+		{"регистрация сверх лимита", UserData{}, nil, []string{photo, medium}, true},
+		{"тариф pro", UserData{Tier: "pro", PhotoPath: photo}, nil, []string{medium}, false},
+		{"тариф free", UserData{PhotoPath: photo}, nil, []string{medium}, true},
+		{"тариф без ограничений", UserData{Tier: "staff", PhotoPath: photo}, nil, []string{medium, large}, false},
+		{"удаленный тариф - как тариф по умолчанию", UserData{Tier: "gold", PhotoPath: photo}, nil, []string{medium}, true},
+		{"уже засчитанный файл не занимает места", UserData{PhotoPath: photo}, nil, []string{photo}, false},
+		{"замена освобождает место", UserData{PhotoPath: photo}, []string{photo}, []string{large}, false},
+		{"замена после снижения лимита без роста", UserData{PhotoPath: large, PhotoVariants: map[int]string{64: photo}}, []string{large}, []string{small}, false},
+		{"замена после снижения лимита с ростом", UserData{PhotoPath: large, PhotoVariants: map[int]string{64: photo}}, []string{photo}, []string{medium, small}, true},
+		// Фото профиля совпадает с картинкой поста: замена фото не освобождает общий файл
+		{"замена общего с постом файла", UserData{ID: "poster-id", PhotoPath: shared}, []string{shared}, []string{medium}, true},
+		{"замена необщего файла при общем посте", UserData{ID: "poster-id", PhotoPath: small}, []string{small}, []string{tiny}, false},
+	}
+	for _, tc := range tests {
+		err := checkStorageQuota(tc.user, tc.removed, tc.added)
+		var quotaErr *QuotaExceededError
+		if exceeded := errors.As(err, &quotaErr); exceeded != tc.wantErr || (err != nil && !exceeded) {
+			t.Errorf("%s: checkStorageQuota = %v, ожидалось превышение %v", tc.name, err, tc.wantErr)
+		}
+	}
+
+	usage, err := storageUsage(UserData{ID: "poster-id", PhotoPath: shared, PhotoVariants: map[int]string{64: shared, 150: small}})
+	if err != nil || usage.Used != 100 || usage.Breakdown[usageAvatarPreviews]+usage.Breakdown[usagePosts]+usage.Breakdown[usageProfilePhoto] != 100 {
+		t.Errorf("общий файл засчитан не один раз: %+v, %v", usage, err)
+	}
+}
+
+func TestWriteQuotaExceeded(t *testing.T) {
+	rec := httptest.NewRecorder()
+	usage := StorageUsage{Tier: "free", Limit: 100, Used: 80, Breakdown: map[string]int64{usagePosts: 80}}
+	writeQuotaExceeded(rec, "image", &QuotaExceededError{Usage: usage, Requested: 50})
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("статус %d, ожидался 413", rec.Code)
+	}
+	var resp struct {
+		Status  string              `json:"status"`
+		Code    string              `json:"code"`
+		Message string              `json:"message"`
+		Errors  map[string][]string `json:"errors"`
+		Usage   StorageUsage        `json:"usage"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("ответ не JSON: %v", err)
+	}
+	if resp.Status != "error" || resp.Code != "quota_exceeded" || resp.Message == "" {
+		t.Errorf("ответ %+v", resp)
+	}
+	if len(resp.Errors["image"]) != 1 || resp.Errors["image"][0] != resp.Message {
+		t.Errorf("ошибки полей %v", resp.Errors)
+	}
+	if resp.Usage.Tier != "free" || resp.Usage.Limit != 100 || resp.Usage.Used != 80 || resp.Usage.Breakdown[usagePosts] != 80 {
+		t.Errorf("использование %+v", resp.Usage)
+	}
+}
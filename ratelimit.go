@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --- Ограничение Частоты Запросов и Блокировка Входа ---
+//
+// Два механизма:
+//   - rateLimiter (token bucket) ограничивает частоту запросов к чувствительным маршрутам по IP;
+//   - failureTracker считает неудачные попытки (по IP и по аккаунту), после нескольких ошибок
+//     требует паузу, растущую вдвое с каждой новой ошибкой, а затем временно блокирует ключ.
+//
+// Состояние хранится в памяти процесса: после перезапуска счетчики обнуляются.
+
+// rateLimiter - набор token bucket'ов по ключу: в каждом до burst токенов, пополнение rate токенов в секунду.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// newRateLimiter создает ограничитель: не больше count запросов за период per (с запасом burst).
+func newRateLimiter(count int, per time.Duration, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(count) / per.Seconds(),
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow забирает токен для ключа. Если токенов нет, возвращает false и время до появления следующего.
+func (l *rateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// prune удаляет полностью восстановившиеся bucket'ы, чтобы карта не росла бесконечно.
+func (l *rateLimiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// failureTracker считает неудачные попытки по ключу с прогрессивной задержкой и блокировкой.
+type failureTracker struct {
+	mu      sync.Mutex
+	name    string // Название для журнала аудита (login, 2fa, reauth)
+	entries map[string]*failureEntry
+
+	freeAttempts int           // Сколько ошибок подряд допускается без задержки
+	baseDelay    time.Duration // Задержка после первой "платной" ошибки, далее удваивается
+	maxDelay     time.Duration
+	lockoutAfter int           // После стольких ошибок ключ блокируется
+	lockoutFor   time.Duration // Длительность блокировки
+	forgetAfter  time.Duration // Через сколько без ошибок счетчик обнуляется
+}
+
+type failureEntry struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+	locked       bool // Ключ уже блокировался (а не просто получал прогрессивную задержку)
+}
+
+// Check возвращает, сколько еще нужно ждать до следующей попытки (0 - можно пробовать).
+func (t *failureTracker) Check(key string, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, exists := t.entries[key]
+	if !exists || !now.Before(e.blockedUntil) {
+		return 0
+	}
+	return e.blockedUntil.Sub(now)
+}
+
+// Fail учитывает неудачную попытку и возвращает назначенную паузу (0, если попытки еще бесплатны).
+// Блокировка записывается в журнал аудита.
+func (t *failureTracker) Fail(key string, now time.Time, r *http.Request) time.Duration {
+	t.mu.Lock()
+	e, exists := t.entries[key]
+	if !exists || now.Sub(e.lastFailure) > t.forgetAfter {
+		e = &failureEntry{}
+		t.entries[key] = e
+	}
+	e.failures++
+	e.lastFailure = now
+
+	var wait time.Duration
+	lockedNow := false
+	switch {
+	case e.failures >= t.lockoutAfter:
+		// Каждая ошибка после истечения блокировки снова блокирует ключ
+		wait = t.lockoutFor
+		lockedNow = !e.locked || !now.Before(e.blockedUntil)
+		e.locked = true
+	case e.failures > t.freeAttempts:
+		wait = t.baseDelay << (e.failures - t.freeAttempts - 1)
+		if wait > t.maxDelay {
+			wait = t.maxDelay
+		}
+	}
+	e.blockedUntil = now.Add(wait)
+	failures := e.failures
+	t.mu.Unlock()
+
+	if lockedNow {
+		audit(AuditEvent{
+			Time:    now,
+			Event:   t.name + "_lockout",
+			Key:     key,
+			IP:      clientIP(r),
+			Details: fmt.Sprintf("%d неудачных попыток, блокировка на %s", failures, t.lockoutFor),
+		})
+	}
+	return wait
+}
+
+// Reset сбрасывает счетчик после успешной попытки.
+func (t *failureTracker) Reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, key)
+}
+
+// prune удаляет давно не обновлявшиеся записи.
+func (t *failureTracker) prune(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, e := range t.entries {
+		if !now.Before(e.blockedUntil) && now.Sub(e.lastFailure) > t.forgetAfter {
+			delete(t.entries, key)
+		}
+	}
+}
+
+func newFailureTracker(name string, freeAttempts, lockoutAfter int, lockoutFor time.Duration) *failureTracker {
+	return &failureTracker{
+		name:         name,
+		entries:      make(map[string]*failureEntry),
+		freeAttempts: freeAttempts,
+		baseDelay:    time.Second,
+		maxDelay:     time.Minute,
+		lockoutAfter: lockoutAfter,
+		lockoutFor:   lockoutFor,
+		forgetAfter:  time.Hour,
+	}
+}
+
+var (
+	// Частота запросов с одного IP
+	loginRateLimiter    = newRateLimiter(20, time.Minute, 10)
+	registerRateLimiter = newRateLimiter(10, time.Hour, 5)
+	passwordRateLimiter = newRateLimiter(10, time.Minute, 5)
+	// forgotPasswordEmailLimiter не дает засыпать один адрес письмами сброса пароля.
+	forgotPasswordEmailLimiter = newRateLimiter(3, time.Hour, 3)
+
+	// loginFailures - неверные пароли при входе; ключи "ip:..." и "account:<email>".
+	loginFailures = newFailureTracker("login", 3, 10, 15*time.Minute)
+	// twoFactorFailures - неверные коды 2FA; ключ "account:<id>". Кодов всего 10^6, поэтому строже.
+	twoFactorFailures = newFailureTracker("2fa", 3, 5, 15*time.Minute)
+	// reauthFailures - неверный текущий пароль при подтверждении личности; ключ "account:<id>".
+	reauthFailures = newFailureTracker("reauth", 3, 10, 15*time.Minute)
+)
+
+// purgeRateLimits периодически удаляет устаревшие записи ограничителей.
+func purgeRateLimits(interval time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now()
+		for _, l := range []*rateLimiter{loginRateLimiter, registerRateLimiter, passwordRateLimiter, forgotPasswordEmailLimiter} {
+			l.prune(now)
+		}
+		for _, t := range []*failureTracker{loginFailures, twoFactorFailures, reauthFailures} {
+			t.prune(now)
+		}
+	}
+}
+
+// tooManyRequests отвечает 429 с заголовком Retry-After (в целых секундах, с округлением вверх).
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":     fmt.Sprintf("Слишком много попыток. Повторите через %d сек.", seconds),
+		"retry_after": seconds,
+		"status":      "error",
+	})
+}
+
+// checkFailures проверяет паузы по всем ключам; при необходимости сам отвечает 429 и возвращает false.
+func checkFailures(w http.ResponseWriter, t *failureTracker, keys ...string) bool {
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range keys {
+		if d := t.Check(key, now); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		tooManyRequests(w, wait)
+		return false
+	}
+	return true
+}
+
+// recordFailures учитывает неудачную попытку по всем ключам.
+func recordFailures(r *http.Request, t *failureTracker, keys ...string) {
+	now := time.Now()
+	for _, key := range keys {
+		t.Fail(key, now, r)
+	}
+}
+
+// resetFailures сбрасывает счетчики по всем ключам.
+func resetFailures(t *failureTracker, keys ...string) {
+	for _, key := range keys {
+		t.Reset(key)
+	}
+}
+
+// rateLimitMiddleware ограничивает частоту запросов к обработчику с одного IP.
+func rateLimitMiddleware(l *rateLimiter, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := l.Allow("ip:"+clientIP(r), time.Now()); !ok {
+			tooManyRequests(w, wait)
+			return
+		}
+		next(w, r)
+	}
+}
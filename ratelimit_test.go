@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter := newRateLimiter(60, time.Minute, 3) // Токен в секунду, запас 3
+	start := time.Unix(1700000000, 0)
+
+	steps := []struct {
+		name     string
+		key      string
+		at       time.Duration // Смещение от start
+		wantOK   bool
+		wantWait time.Duration
+	}{
+		{"запас 1", "ip:a", 0, true, 0},
+		{"запас 2", "ip:a", 0, true, 0},
+		{"запас 3", "ip:a", 0, true, 0},
+		{"запас исчерпан", "ip:a", 0, false, time.Second},
+		{"другой ключ независим", "ip:b", 0, true, 0},
+		{"половина токена", "ip:a", 500 * time.Millisecond, false, 500 * time.Millisecond},
+		{"токен восстановился", "ip:a", time.Second, true, 0},
+		{"запас не растет выше burst", "ip:a", time.Hour, true, 0},
+		{"после паузы снова запас", "ip:a", time.Hour, true, 0},
+		{"после паузы снова запас 3", "ip:a", time.Hour, true, 0},
+		{"и снова исчерпан", "ip:a", time.Hour, false, time.Second},
+	}
+	for _, step := range steps {
+		ok, wait := limiter.Allow(step.key, start.Add(step.at))
+		if ok != step.wantOK || wait != step.wantWait {
+			t.Errorf("%s: Allow = %v, %v, ожидалось %v, %v", step.name, ok, wait, step.wantOK, step.wantWait)
+		}
+	}
+
+	limiter.prune(start.Add(2 * time.Hour))
+	if len(limiter.buckets) != 0 {
+		t.Errorf("prune оставил %d восстановившихся bucket'ов", len(limiter.buckets))
+	}
+}
+
+func TestFailureTracker(t *testing.T) {
+	tracker := newFailureTracker("test", 2, 5, 15*time.Minute)
+	req := httptest.NewRequest(http.MethodPost, "/login", nil)
+	now := time.Unix(1700000000, 0)
+
+	// Первые freeAttempts ошибок бесплатны, дальше пауза удваивается, затем блокировка
+	wantWaits := []time.Duration{0, 0, time.Second, 2 * time.Second, 15 * time.Minute, 15 * time.Minute}
+	for i, want := range wantWaits {
+		if wait := tracker.Fail("account:a", now, req); wait != want {
+			t.Errorf("ошибка %d: пауза %v, ожидалась %v", i+1, wait, want)
+		}
+	}
+
+	checks := []struct {
+		name string
+		key  string
+		at   time.Duration
+		want time.Duration
+	}{
+		{"ключ заблокирован", "account:a", 0, 15 * time.Minute},
+		{"блокировка идет", "account:a", 5 * time.Minute, 10 * time.Minute},
+		{"блокировка прошла", "account:a", 15 * time.Minute, 0},
+		{"другой ключ свободен", "account:b", 0, 0},
+	}
+	for _, tc := range checks {
+		if got := tracker.Check(tc.key, now.Add(tc.at)); got != tc.want {
+			t.Errorf("%s: Check = %v, ожидалось %v", tc.name, got, tc.want)
+		}
+	}
+
+	// Успешная попытка сбрасывает счетчик
+	tracker.Reset("account:a")
+	if wait := tracker.Fail("account:a", now, req); wait != 0 {
+		t.Errorf("после Reset пауза %v", wait)
+	}
+
+	// Давняя ошибка забывается
+	tracker.Fail("account:c", now, req)
+	tracker.Fail("account:c", now, req)
+	if wait := tracker.Fail("account:c", now.Add(2*time.Hour), req); wait != 0 {
+		t.Errorf("через forgetAfter пауза %v, ожидался сброс счетчика", wait)
+	}
+}
+
+func TestFailureTrackerMaxDelay(t *testing.T) {
+	tracker := newFailureTracker("test", 0, 100, time.Hour)
+	req := httptest.NewRequest(http.MethodPost, "/login", nil)
+	now := time.Unix(1700000000, 0)
+	var wait time.Duration
+	for i := 0; i < 20; i++ {
+		wait = tracker.Fail("ip:a", now, req)
+	}
+	if wait != tracker.maxDelay {
+		t.Errorf("пауза %v, ожидалось не больше maxDelay %v", wait, tracker.maxDelay)
+	}
+}
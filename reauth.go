@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// --- Повторная Аутентификация ("sudo") ---
+
+const (
+	// sudoWindow - сколько после ввода пароля можно менять email и пароль без повторного ввода.
+	sudoWindow = 10 * time.Minute
+	// emailChangeUndoPurpose - назначение одноразового токена отмены смены email.
+	emailChangeUndoPurpose = "email_change_undo"
+	// emailChangeUndoTTL - сколько действует ссылка отмены, отправленная на старый адрес.
+	emailChangeUndoTTL = 7 * 24 * time.Hour
+)
+
+// checkPassword сверяет пароль с хешем пользователя.
+func checkPassword(user UserData, password string) bool {
+	ok, _ := verifyPassword(user.HashedPassword, password)
+	return ok
+}
+
+// reauthenticated сообщает, подтвердил ли пользователь личность для чувствительного действия:
+// ввел текущий пароль в запросе или находится в открытом sudo-окне своей сессии.
+// Неверные пароли учитываются в reauthFailures; во время паузы пароль не проверяется.
+func reauthenticated(r *http.Request, user UserData, currentPassword string) bool {
+	failureKey := "account:" + user.ID
+	if currentPassword != "" && reauthFailures.Check(failureKey, time.Now()) == 0 {
+		if checkPassword(user, currentPassword) {
+			reauthFailures.Reset(failureKey)
+			return true
+		}
+		recordFailures(r, reauthFailures, failureKey)
+	}
+	sessionID, _ := r.Context().Value(sessionContextKey).(string)
+	session, err := sessionStore.Get(sessionID)
+	return err == nil && time.Now().Before(session.SudoUntil)
+}
+
+// writeReauthRequired отвечает 403 с "reauth": "required". Пользователю без пароля (вход только
+// через OIDC) ввести нечего: ему отвечаем с "code": "no_password" и ссылками "reauth_urls" на
+// повторный вход у привязанных провайдеров, после которого открывается sudo-окно (см. oidcReauth).
+func writeReauthRequired(w http.ResponseWriter, user UserData, message string) {
+	response := map[string]interface{}{"message": message, "status": "error", "reauth": "required"}
+	if user.HashedPassword == "" {
+		var names, urls []string
+		for _, identity := range user.Identities {
+			if provider, exists := oidcProviders[identity.Provider]; exists {
+				names = append(names, provider.DisplayName)
+				urls = append(urls, "/auth/oidc/"+provider.Name+"/login?reauth=1")
+			}
+		}
+		if len(urls) > 0 {
+			response["message"] = "У аккаунта нет пароля: подтвердите вход через " + strings.Join(names, " или ")
+			response["reauth_urls"] = urls
+		} else {
+			response["message"] = "У аккаунта нет пароля: задайте его по ссылке «Забыли пароль?» на странице входа"
+		}
+		response["code"] = "no_password"
+	}
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(response)
+}
+
+// openSudoWindow открывает sudo-окно сессии sessionID на sudoWindow.
+func openSudoWindow(sessionID string) (Session, error) {
+	session, err := sessionStore.Get(sessionID)
+	if err != nil {
+		return Session{}, err
+	}
+	session.SudoUntil = time.Now().Add(sudoWindow)
+	return session, sessionStore.Update(session)
+}
+
+// sendEmailChangedNotice сообщает на старый адрес о смене email и дает ссылку для отмены.
+func sendEmailChangedNotice(oldUser UserData, newEmail string) error {
+	// Токен запоминает старый адрес (oldUser.Email), на который вернется аккаунт
+	token, err := issueOneTimeToken(emailChangeUndoPurpose, oldUser, emailChangeUndoTTL)
+	if err != nil {
+		return err
+	}
+	link := fmt.Sprintf("%s/undo-email.html?token=%s", appBaseURL, url.QueryEscape(token))
+
+	sendMailAsync(MailMessage{
+		To:      oldUser.Email,
+		Subject: "Email вашего аккаунта изменен",
+		Body: fmt.Sprintf("Здравствуйте, %s!\n\n"+
+			"Адрес вашего аккаунта изменен с %s на %s.\n\n"+
+			"Если это были не вы, отмените изменение по ссылке (действует %d дней):\n%s\n\n"+
+			"После отмены все сессии будут завершены, а на этот адрес придет ссылка для смены пароля.\n",
+			oldUser.Username, oldUser.Email, newEmail, int(emailChangeUndoTTL.Hours()/24), link),
+	})
+	return nil
+}
+
+// =======================================================================
+// Обработчики API
+// =======================================================================
+
+// sudoHandler открывает sudo-окно для текущей сессии: POST /user/sudo {"password": "..."}
+func sudoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Допустим только метод POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Context().Value(userContextKey).(string)
+	sessionID := r.Context().Value(sessionContextKey).(string)
+
+	var body struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Неверный формат JSON в теле запроса", http.StatusBadRequest)
+		return
+	}
+
+	failureKey := "account:" + userID
+	if !checkFailures(w, reauthFailures, failureKey) {
+		return
+	}
+
+	userData, err := userStore.GetByID(userID)
+	if err == nil && userData.HashedPassword == "" {
+		writeReauthRequired(w, userData, "Неверный пароль")
+		return
+	}
+	if err != nil || !checkPassword(userData, body.Password) {
+		log.Printf("❌ Неудачное подтверждение пароля для %s", userID)
+		recordFailures(r, reauthFailures, failureKey)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Неверный пароль", "status": "error"})
+		return
+	}
+
+	reauthFailures.Reset(failureKey)
+
+	session, err := openSudoWindow(sessionID)
+	if err == ErrSessionNotFound {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Не авторизован", "status": "error"})
+		return
+	} else if err != nil {
+		log.Printf("❌ Ошибка сохранения sudo-окна: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message":    "Пароль подтвержден",
+		"sudo_until": session.SudoUntil.Format(time.RFC3339),
+		"status":     "success",
+	})
+}
+
+// undoEmailChangeHandler возвращает аккаунту прежний email по ссылке из уведомления, сбрасывает
+// пароль и 2FA, завершает все сессии и API-токены и отправляет ссылку для нового пароля:
+// POST /user/email/undo {"token": "..."} со страницы подтверждения undo-email.html.
+// GET только перенаправляет на эту страницу: почтовые сканеры открывают ссылки из писем сами,
+// и сброс не должен срабатывать без нажатия кнопки владельцем.
+func undoEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		// Ссылки вида /user/email/undo?token=... из уже отправленных писем
+		http.Redirect(w, r, "/undo-email.html?token="+url.QueryEscape(r.URL.Query().Get("token")), http.StatusFound)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Допустимы только методы GET и POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Неверный формат JSON в теле запроса", http.StatusBadRequest)
+		return
+	}
+
+	// Токен гасится только после сохранения: если прежний адрес занят, ссылка остается рабочей
+	token, err := lookupOneTimeToken(emailChangeUndoPurpose, body.Token)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Ссылка недействительна или устарела", "status": "error"})
+		return
+	}
+
+	// Владелец старого адреса подтвердил его переходом по ссылке. Считаем аккаунт захваченным:
+	// все, что мог оставить себе злоумышленник (пароль, 2FA, внешние аккаунты, привязанные
+	// после смены email), сбрасываем, а пароль владелец задаст заново по ссылке сброса
+	var changedTo string
+	userData, err := userStore.Modify(token.UserID, func(user *UserData) error {
+		changedTo = user.Email
+		user.Email = normalizeEmail(token.Email) // Ссылки могли быть выданы до нормализации регистра
+		user.EmailVerified = true
+		user.HashedPassword = ""
+		user.TOTPEnabled = false
+		user.TOTPSecret = ""
+		user.TOTPPendingSecret = ""
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = nil
+		identities := user.Identities[:0:0]
+		for _, identity := range user.Identities {
+			if identity.LinkedAt.Before(token.CreatedAt) {
+				identities = append(identities, identity)
+			}
+		}
+		user.Identities = identities
+		return nil
+	})
+	if err == ErrUserNotFound {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Ссылка недействительна или устарела", "status": "error"})
+		return
+	} else if err == ErrUserExists {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Прежний email уже занят другим аккаунтом. Ссылка остается действительной: освободите адрес и повторите отмену.",
+			"status":  "error",
+		})
+		return
+	} else if err != nil {
+		log.Printf("❌ Ошибка отмены смены email: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	// Параллельный запрос с той же ссылкой уже погасил ее и завершит отмену сам
+	if _, err := consumeOneTimeToken(emailChangeUndoPurpose, body.Token); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Ссылка недействительна или устарела", "status": "error"})
+		return
+	}
+
+	// Завершаем сессии и API-токены и гасим ссылки сброса и отмены, выданные злоумышленнику,
+	// и только после этого отправляем владельцу новую ссылку сброса пароля
+	if err := signOutEverywhere(userData.ID); err != nil {
+		log.Printf("❌ Ошибка отзыва сессий после отмены смены email: %v", err)
+	}
+	if err := sendPasswordResetEmail(userData); err != nil {
+		log.Printf("❌ Ошибка отправки ссылки сброса пароля: %v", err)
+	}
+	hub.profileUpdate <- userData.ID
+
+	log.Printf("↩️ Пользователь %s отменил смену email (%s -> %s)", userData.ID, token.Email, changedTo)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Смена email отменена. Все сессии и API-токены завершены, пароль и 2FA сброшены: задайте новый пароль по ссылке, отправленной на прежний адрес.",
+		"status":  "success",
+	})
+}
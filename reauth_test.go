@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUndoEmailChangeRequiresPost(t *testing.T) {
+	useMemoryStores()
+	alice := UserData{ID: "alice-id", Email: "mallory@example.com", Handle: "alice", HashedPassword: "hash", TOTPEnabled: true}
+	if err := userStore.Create(alice); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	token, err := issueOneTimeToken(emailChangeUndoPurpose, UserData{ID: alice.ID, Email: "alice@example.com"}, time.Hour)
+	if err != nil {
+		t.Fatalf("issueOneTimeToken: %v", err)
+	}
+
+	// Переход по ссылке (или ее предпросмотр сканером) только открывает страницу подтверждения
+	rec := httptest.NewRecorder()
+	undoEmailChangeHandler(rec, httptest.NewRequest(http.MethodGet, "/user/email/undo?token="+url.QueryEscape(token), nil))
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/undo-email.html?token="+url.QueryEscape(token) {
+		t.Errorf("GET: статус %d, Location %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if stored, _ := userStore.GetByID(alice.ID); stored.Email != alice.Email || stored.HashedPassword == "" {
+		t.Fatalf("GET изменил аккаунт: %+v", stored)
+	}
+
+	steps := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{"подтверждение", `{"token": "` + token + `"}`, http.StatusOK},
+		{"повторное подтверждение", `{"token": "` + token + `"}`, http.StatusBadRequest},
+	}
+	for _, step := range steps {
+		rec := httptest.NewRecorder()
+		undoEmailChangeHandler(rec, httptest.NewRequest(http.MethodPost, "/user/email/undo", strings.NewReader(step.body)))
+		if rec.Code != step.wantStatus {
+			t.Errorf("%s: статус %d, ожидался %d (%s)", step.name, rec.Code, step.wantStatus, rec.Body)
+		}
+	}
+	stored, _ := userStore.GetByID(alice.ID)
+	if stored.Email != "alice@example.com" || stored.HashedPassword != "" || stored.TOTPEnabled {
+		t.Errorf("после отмены: email %q, пароль сброшен = %v, 2FA = %v", stored.Email, stored.HashedPassword == "", stored.TOTPEnabled)
+	}
+}
+
+func TestUndoEmailChangeKeepsTokenWhenEmailTaken(t *testing.T) {
+	useMemoryStores()
+	alice := UserData{ID: "alice-id", Email: "mallory@example.com", Handle: "alice", HashedPassword: "hash"}
+	squatter := UserData{ID: "squatter-id", Email: "alice@example.com", Handle: "squatter"}
+	for _, user := range []UserData{alice, squatter} {
+		if err := userStore.Create(user); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+	token, err := issueOneTimeToken(emailChangeUndoPurpose, UserData{ID: alice.ID, Email: "alice@example.com"}, time.Hour)
+	if err != nil {
+		t.Fatalf("issueOneTimeToken: %v", err)
+	}
+	undo := func() int {
+		rec := httptest.NewRecorder()
+		undoEmailChangeHandler(rec, httptest.NewRequest(http.MethodPost, "/user/email/undo", strings.NewReader(`{"token": "`+token+`"}`)))
+		return rec.Code
+	}
+
+	if code := undo(); code != http.StatusConflict {
+		t.Fatalf("прежний адрес занят: статус %d, ожидался 409", code)
+	}
+	if stored, _ := userStore.GetByID(alice.ID); stored.Email != alice.Email || stored.HashedPassword == "" {
+		t.Fatalf("неудавшаяся отмена изменила аккаунт: %+v", stored)
+	}
+
+	// Адрес освободился: та же ссылка срабатывает
+	if err := userStore.Delete(squatter.ID); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if code := undo(); code != http.StatusOK {
+		t.Fatalf("повтор после освобождения адреса: статус %d", code)
+	}
+	if stored, _ := userStore.GetByID(alice.ID); stored.Email != "alice@example.com" || stored.HashedPassword != "" {
+		t.Errorf("после отмены: %+v", stored)
+	}
+	if code := undo(); code != http.StatusBadRequest {
+		t.Errorf("ссылка не погашена после отмены: статус %d", code)
+	}
+}
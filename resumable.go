@@ -0,0 +1,762 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// --- Возобновляемые Загрузки ---
+//
+// Большие файлы с мобильных сетей загружаются по частям по протоколу в духе tus 1.0
+// (https://tus.io/protocols/resumable-upload), который понимают готовые клиенты:
+//
+//	POST   /user/uploads               Upload-Length, [Upload-Checksum], [Upload-Metadata] -> 201, Location
+//	HEAD   /user/uploads/{id}          -> Upload-Offset (сколько уже получено), Upload-Length
+//	PATCH  /user/uploads/{id}          Upload-Offset, тело application/offset+octet-stream -> 204
+//	DELETE /user/uploads/{id}          отмена загрузки
+//	POST   /user/uploads/{id}/finalize {"target": "profile_photo", "checksum": "..."} -> как /user/photo
+//	                                   {"target": "post", "caption": "...", "checksum": "..."} -> как /api/posts
+//
+// После обрыва клиент спрашивает HEAD и продолжает PATCH с полученного смещения. В отличие от tus,
+// Upload-Checksum ("sha256 <base64>") относится ко всему файлу и проверяется при завершении;
+// его можно передать и в запросе finalize. Полученные части лежат в RESUMABLE_UPLOAD_DIR,
+// а файл попадает в обычную обработку загрузок только после проверки контрольной суммы.
+// Брошенные загрузки удаляются через resumableUploadTTL после последней полученной части.
+
+const (
+	// tusVersion - поддерживаемая версия протокола tus.
+	tusVersion = "1.0.0"
+	// resumableUploadTTL - сколько незавершенная загрузка ждет следующую часть.
+	resumableUploadTTL = 24 * time.Hour
+	// resumableMaxPerUser - сколько незавершенных загрузок может быть у одного пользователя.
+	resumableMaxPerUser = 5
+	// statusChecksumMismatch - код ответа tus на несовпадение контрольной суммы.
+	statusChecksumMismatch = 460
+)
+
+// Цели завершенной загрузки: куда отправляется файл после проверки.
+const (
+	uploadTargetProfilePhoto = "profile_photo"
+	uploadTargetPost         = "post"
+)
+
+// ErrResumableUploadNotFound возвращается, если загрузки нет (или она принадлежит другому пользователю).
+var ErrResumableUploadNotFound = errors.New("загрузка не найдена")
+
+// ResumableUpload - незавершенная загрузка по частям.
+type ResumableUpload struct {
+	ID        string            `json:"id"`
+	UserID    string            `json:"user_id"`
+	Length    int64             `json:"length"`             // Заявленный размер файла
+	Offset    int64             `json:"offset"`             // Сколько байт уже получено
+	Checksum  string            `json:"checksum,omitempty"` // SHA-256 всего файла в hex (из Upload-Checksum)
+	Metadata  map[string]string `json:"metadata,omitempty"` // Upload-Metadata клиента (имя файла и т.п.)
+	CreatedAt time.Time         `json:"created_at"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+// path - файл с полученными частями.
+func (u ResumableUpload) path() string {
+	return filepath.Join(resumableUploadDir, u.ID+".part")
+}
+
+// expired сообщает, истекла ли загрузка к моменту now.
+func (u ResumableUpload) expired(now time.Time) bool {
+	return !now.Before(u.ExpiresAt)
+}
+
+// ResumableUploadStore описывает хранилище незавершенных загрузок.
+type ResumableUploadStore interface {
+	// Create сохраняет новую загрузку.
+	Create(upload ResumableUpload) error
+	// Get возвращает загрузку по ID или ErrResumableUploadNotFound.
+	Get(id string) (ResumableUpload, error)
+	// Update перезаписывает существующую загрузку (смещение и срок).
+	Update(upload ResumableUpload) error
+	// Delete удаляет загрузку.
+	Delete(id string) error
+	// ListByUser возвращает все загрузки пользователя.
+	ListByUser(userID string) ([]ResumableUpload, error)
+	// ListExpired возвращает загрузки, истекшие к моменту now (файлы частей удаляет вызывающий).
+	ListExpired(now time.Time) ([]ResumableUpload, error)
+}
+
+// resumableUploadStore - активное хранилище загрузок, инициализируется в initStorage().
+var resumableUploadStore ResumableUploadStore
+
+// resumableBusy - загрузки, в которые прямо сейчас пишет PATCH: параллельная запись
+// в один файл испортила бы смещение.
+var (
+	resumableBusyMu sync.Mutex
+	resumableBusy   = map[string]bool{}
+)
+
+// lockResumableUpload помечает загрузку занятой. Возвращает false, если она уже занята.
+func lockResumableUpload(id string) bool {
+	resumableBusyMu.Lock()
+	defer resumableBusyMu.Unlock()
+	if resumableBusy[id] {
+		return false
+	}
+	resumableBusy[id] = true
+	return true
+}
+
+func unlockResumableUpload(id string) {
+	resumableBusyMu.Lock()
+	defer resumableBusyMu.Unlock()
+	delete(resumableBusy, id)
+}
+
+// initResumableUploads создает папку для частей загрузок.
+func initResumableUploads() {
+	if err := os.MkdirAll(resumableUploadDir, 0700); err != nil {
+		log.Fatalf("❌ Не удалось создать папку возобновляемых загрузок: %v", err)
+	}
+}
+
+// removeResumableUpload удаляет загрузку вместе с полученными частями.
+func removeResumableUpload(upload ResumableUpload) error {
+	if err := os.Remove(upload.path()); err != nil && !os.IsNotExist(err) {
+		log.Printf("❌ Ошибка удаления файла загрузки %s: %v", upload.path(), err)
+	}
+	return resumableUploadStore.Delete(upload.ID)
+}
+
+// removeUserResumableUploads удаляет все незавершенные загрузки пользователя (при удалении аккаунта).
+func removeUserResumableUploads(userID string) error {
+	uploads, err := resumableUploadStore.ListByUser(userID)
+	if err != nil {
+		return err
+	}
+	for _, upload := range uploads {
+		if err := removeResumableUpload(upload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeExpiredResumableUploads периодически удаляет брошенные загрузки и файлы частей без записи
+// (например, оставшиеся после перезапуска с STORAGE=memory).
+func purgeExpiredResumableUploads(interval time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now()
+		expired, err := resumableUploadStore.ListExpired(now)
+		if err != nil {
+			log.Printf("❌ Ошибка чтения загрузок для очистки: %v", err)
+			continue
+		}
+		for _, upload := range expired {
+			if err := removeResumableUpload(upload); err != nil {
+				log.Printf("❌ Ошибка удаления загрузки %s: %v", upload.ID, err)
+			}
+		}
+
+		leftovers, _ := filepath.Glob(filepath.Join(resumableUploadDir, "*.part"))
+		for _, path := range leftovers {
+			id := strings.TrimSuffix(filepath.Base(path), ".part")
+			info, err := os.Stat(path)
+			if err != nil || now.Sub(info.ModTime()) < resumableUploadTTL {
+				continue
+			}
+			if _, err := resumableUploadStore.Get(id); err == ErrResumableUploadNotFound {
+				os.Remove(path)
+			}
+		}
+
+		if len(expired) > 0 {
+			log.Printf("🧹 Удалено брошенных загрузок: %d", len(expired))
+		}
+	}
+}
+
+// parseUploadChecksum разбирает "sha256 <base64>" и возвращает SHA-256 в hex.
+func parseUploadChecksum(value string) (string, error) {
+	algorithm, encoded, found := strings.Cut(strings.TrimSpace(value), " ")
+	if !found || !strings.EqualFold(algorithm, "sha256") {
+		return "", errors.New("Поддерживается только контрольная сумма вида \"sha256 <base64>\"")
+	}
+	sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(sum) != sha256.Size {
+		return "", errors.New("Неверная контрольная сумма SHA-256")
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+// parseUploadMetadata разбирает Upload-Metadata: пары "ключ base64" через запятую.
+func parseUploadMetadata(value string) (map[string]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if key == "" || err != nil {
+			return nil, fmt.Errorf("неверная запись Upload-Metadata: %q", pair)
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata, nil
+}
+
+// formatUploadMetadata собирает Upload-Metadata обратно для ответа на HEAD.
+func formatUploadMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for key, value := range metadata {
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(value)))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// newResumableUploadID создает непредсказуемый ID загрузки (128 бит в hex).
+func newResumableUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// setTusHeaders добавляет общие заголовки протокола и запрещает кэшировать ответы.
+func setTusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// setUploadProgressHeaders сообщает клиенту состояние загрузки.
+func setUploadProgressHeaders(w http.ResponseWriter, upload ResumableUpload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+}
+
+// writeUploadError отвечает JSON с сообщением об ошибке.
+func writeUploadError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": message, "status": "error"})
+}
+
+// =======================================================================
+// Обработчики (/user/uploads)
+// =======================================================================
+
+// resumableUploadsHandler: OPTIONS /user/uploads - возможности сервера, POST - создание загрузки.
+func resumableUploadsHandler(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	if version := r.Header.Get("Tus-Resumable"); version != "" && version != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeUploadError(w, http.StatusPreconditionFailed, "Неподдерживаемая версия протокола tus")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,expiration,termination")
+		w.Header().Set("Tus-Max-Size", strconv.Itoa(maxImageFileSize))
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPost:
+		createResumableUpload(w, r)
+	default:
+		http.Error(w, "Допустимы только методы POST и OPTIONS", http.StatusMethodNotAllowed)
+	}
+}
+
+// createResumableUpload заводит загрузку: POST /user/uploads
+func createResumableUpload(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userContextKey).(string)
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		writeUploadError(w, http.StatusBadRequest, "Не указан размер файла (Upload-Length)")
+		return
+	}
+	if length > maxImageFileSize {
+		writeUploadError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Максимальный размер файла %d MB", maxImageFileSize>>20))
+		return
+	}
+	var checksum string
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		if checksum, err = parseUploadChecksum(header); err != nil {
+			writeUploadError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeUploadError(w, http.StatusBadRequest, "Неверный заголовок Upload-Metadata")
+		return
+	}
+
+	userData, err := userStore.GetByID(userID)
+	if err != nil {
+		writeUploadError(w, http.StatusNotFound, "Пользователь не найден")
+		return
+	}
+	// Заранее отказываем в загрузке, которая точно не поместится в квоту. После обработки
+	// файл станет другим по размеру, поэтому окончательная проверка - при завершении.
+	usage, err := storageUsage(userData)
+	if err != nil {
+		log.Printf("❌ Ошибка подсчета места пользователя %s: %v", userID, err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if usage.Limit > 0 && length > usage.Available() {
+		w.Header().Set("Content-Type", "application/json")
+		writeQuotaExceeded(w, "upload", &QuotaExceededError{Usage: usage, Requested: length})
+		return
+	}
+
+	existing, err := resumableUploadStore.ListByUser(userID)
+	if err != nil {
+		log.Printf("❌ Ошибка чтения загрузок: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if len(existing) >= resumableMaxPerUser {
+		writeUploadError(w, http.StatusTooManyRequests, fmt.Sprintf("Можно вести не больше %d загрузок одновременно. Завершите или отмените старые.", resumableMaxPerUser))
+		return
+	}
+
+	id, err := newResumableUploadID()
+	if err != nil {
+		log.Printf("❌ Ошибка генерации ID загрузки: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	upload := ResumableUpload{
+		ID:        id,
+		UserID:    userID,
+		Length:    length,
+		Checksum:  checksum,
+		Metadata:  metadata,
+		CreatedAt: now,
+		ExpiresAt: now.Add(resumableUploadTTL),
+	}
+	file, err := os.OpenFile(upload.path(), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("❌ Ошибка создания файла загрузки: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	file.Close()
+	if err := resumableUploadStore.Create(upload); err != nil {
+		os.Remove(upload.path())
+		log.Printf("❌ Ошибка сохранения загрузки: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("📤 Пользователь %s начал загрузку %s (%d байт)", userID, id, length)
+	location := "/user/uploads/" + id
+	w.Header().Set("Location", location)
+	setUploadProgressHeaders(w, upload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":         id,
+		"location":   location,
+		"offset":     upload.Offset,
+		"length":     upload.Length,
+		"expires_at": upload.ExpiresAt,
+		"status":     "success",
+	})
+}
+
+// resumableUploadHandler обслуживает загрузку /user/uploads/{id} (HEAD, PATCH, DELETE)
+// и ее завершение /user/uploads/{id}/finalize (POST).
+func resumableUploadHandler(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	if version := r.Header.Get("Tus-Resumable"); version != "" && version != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeUploadError(w, http.StatusPreconditionFailed, "Неподдерживаемая версия протокола tus")
+		return
+	}
+
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/user/uploads/"), "/")
+	userID := r.Context().Value(userContextKey).(string)
+	upload, err := resumableUploadStore.Get(id)
+	if err == nil && (upload.UserID != userID || upload.expired(time.Now())) {
+		err = ErrResumableUploadNotFound
+	}
+	if err == ErrResumableUploadNotFound {
+		writeUploadError(w, http.StatusNotFound, "Загрузка не найдена или истекла")
+		return
+	} else if err != nil {
+		log.Printf("❌ Ошибка чтения загрузки %s: %v", id, err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodHead:
+		setUploadProgressHeaders(w, upload)
+		if len(upload.Metadata) > 0 {
+			w.Header().Set("Upload-Metadata", formatUploadMetadata(upload.Metadata))
+		}
+		w.WriteHeader(http.StatusOK)
+	case action == "" && r.Method == http.MethodPatch:
+		patchResumableUpload(w, r, upload)
+	case action == "" && r.Method == http.MethodDelete:
+		if !lockResumableUpload(upload.ID) {
+			writeUploadError(w, http.StatusConflict, "Загрузка занята другим запросом")
+			return
+		}
+		defer unlockResumableUpload(upload.ID)
+		if err := removeResumableUpload(upload); err != nil {
+			log.Printf("❌ Ошибка удаления загрузки %s: %v", upload.ID, err)
+			http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case action == "finalize" && r.Method == http.MethodPost:
+		finalizeResumableUpload(w, r, upload)
+	default:
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+	}
+}
+
+// patchResumableUpload дописывает часть файла: PATCH /user/uploads/{id}
+// Часть, полученная до обрыва соединения, сохраняется - клиент продолжит с нового смещения.
+func patchResumableUpload(w http.ResponseWriter, r *http.Request, upload ResumableUpload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeUploadError(w, http.StatusUnsupportedMediaType, "Ожидается Content-Type: application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeUploadError(w, http.StatusBadRequest, "Не указано смещение (Upload-Offset)")
+		return
+	}
+	if !lockResumableUpload(upload.ID) {
+		writeUploadError(w, http.StatusConflict, "Загрузка занята другим запросом")
+		return
+	}
+	defer unlockResumableUpload(upload.ID)
+
+	// Смещение могло измениться, пока ждали блокировку
+	if upload, err = resumableUploadStore.Get(upload.ID); err != nil {
+		writeUploadError(w, http.StatusNotFound, "Загрузка не найдена или истекла")
+		return
+	}
+	if offset != upload.Offset {
+		setUploadProgressHeaders(w, upload)
+		writeUploadError(w, http.StatusConflict, fmt.Sprintf("Смещение не совпадает: получено %d байт", upload.Offset))
+		return
+	}
+	remaining := upload.Length - upload.Offset
+	if r.ContentLength > remaining {
+		writeUploadError(w, http.StatusRequestEntityTooLarge, "Часть выходит за заявленный размер файла")
+		return
+	}
+
+	file, err := os.OpenFile(upload.path(), os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("❌ Ошибка открытия файла загрузки %s: %v", upload.ID, err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	// Если прошлый PATCH записал данные, но не успел сохранить смещение, они отбрасываются
+	if err := file.Truncate(upload.Offset); err == nil {
+		_, err = file.Seek(upload.Offset, io.SeekStart)
+	}
+	if err != nil {
+		log.Printf("❌ Ошибка подготовки файла загрузки %s: %v", upload.ID, err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	written, copyErr := io.Copy(file, io.LimitReader(r.Body, remaining))
+	if written > 0 {
+		upload.Offset += written
+		upload.ExpiresAt = time.Now().Add(resumableUploadTTL)
+		if err := resumableUploadStore.Update(upload); err != nil {
+			log.Printf("❌ Ошибка сохранения смещения загрузки %s: %v", upload.ID, err)
+			http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+	}
+	if copyErr != nil {
+		// Соединение оборвалось: полученное сохранено, клиент узнает смещение через HEAD
+		log.Printf("⚠️ Загрузка %s прервана на %d из %d байт: %v", upload.ID, upload.Offset, upload.Length, copyErr)
+		setUploadProgressHeaders(w, upload)
+		writeUploadError(w, http.StatusBadRequest, "Часть получена не полностью")
+		return
+	}
+
+	setUploadProgressHeaders(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finalizeResumableUpload проверяет полностью полученный файл и отправляет его в обработку:
+// POST /user/uploads/{id}/finalize {"target": "profile_photo", "checksum": "sha256 <base64>"}
+// Для цели post передается и подпись "caption". Ответ - как у обработчика цели (для profile_photo -
+// как у /user/photo, для post - как у POST /api/posts). После завершения
+// загрузка удаляется, даже если файл не прошел проверку изображения.
+func finalizeResumableUpload(w http.ResponseWriter, r *http.Request, upload ResumableUpload) {
+	var body struct {
+		Target   string `json:"target"`
+		Checksum string `json:"checksum"`
+		Caption  string `json:"caption"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeUploadError(w, http.StatusBadRequest, "Неверный формат JSON в теле запроса")
+		return
+	}
+	switch body.Target {
+	case uploadTargetProfilePhoto:
+	case uploadTargetPost:
+		// Подпись проверяется до завершения, чтобы из-за опечатки не загружать файл заново
+		caption, err := normalizeCaption(body.Caption)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			writeFieldErrors(w, fieldErrors{"caption": {err.Error()}})
+			return
+		}
+		body.Caption = caption
+	default:
+		writeUploadError(w, http.StatusBadRequest, "Неизвестная цель загрузки")
+		return
+	}
+	if body.Checksum != "" {
+		checksum, err := parseUploadChecksum(body.Checksum)
+		if err != nil {
+			writeUploadError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if upload.Checksum != "" && checksum != upload.Checksum {
+			writeUploadError(w, http.StatusBadRequest, "Контрольная сумма не совпадает с указанной при создании загрузки")
+			return
+		}
+		upload.Checksum = checksum
+	}
+	if upload.Checksum == "" {
+		writeUploadError(w, http.StatusBadRequest, "Не передана контрольная сумма файла (Upload-Checksum или checksum)")
+		return
+	}
+
+	if !lockResumableUpload(upload.ID) {
+		writeUploadError(w, http.StatusConflict, "Загрузка занята другим запросом")
+		return
+	}
+	defer unlockResumableUpload(upload.ID)
+	current, err := resumableUploadStore.Get(upload.ID)
+	if err != nil {
+		writeUploadError(w, http.StatusNotFound, "Загрузка не найдена или истекла")
+		return
+	}
+	upload.Offset = current.Offset
+	if upload.Offset != upload.Length {
+		setUploadProgressHeaders(w, upload)
+		writeUploadError(w, http.StatusConflict, fmt.Sprintf("Файл получен не полностью: %d из %d байт", upload.Offset, upload.Length))
+		return
+	}
+
+	file, err := os.Open(upload.path())
+	if err != nil {
+		log.Printf("❌ Ошибка открытия файла загрузки %s: %v", upload.ID, err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		file.Close()
+		if err := removeResumableUpload(upload); err != nil {
+			log.Printf("❌ Ошибка удаления загрузки %s: %v", upload.ID, err)
+		}
+	}()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.LimitReader(file, upload.Length)); err != nil {
+		log.Printf("❌ Ошибка чтения файла загрузки %s: %v", upload.ID, err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(hash.Sum(nil))), []byte(upload.Checksum)) != 1 {
+		log.Printf("❌ Контрольная сумма загрузки %s не совпала", upload.ID)
+		writeUploadError(w, statusChecksumMismatch, "Контрольная сумма не совпала: файл поврежден при передаче, загрузите его заново")
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		log.Printf("❌ Ошибка чтения файла загрузки %s: %v", upload.ID, err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("📤 Загрузка %s завершена (%d байт), цель %s", upload.ID, upload.Length, body.Target)
+	w.Header().Set("Content-Type", "application/json")
+	if body.Target == uploadTargetPost {
+		publishPost(w, upload.UserID, file, body.Caption)
+		return
+	}
+	replaceProfilePhoto(w, r, upload.UserID, file)
+}
+
+// =======================================================================
+// Хранилище загрузок в памяти
+// =======================================================================
+
+type memoryResumableUploadStore struct {
+	mu      sync.Mutex
+	uploads map[string]ResumableUpload
+}
+
+func newMemoryResumableUploadStore() *memoryResumableUploadStore {
+	return &memoryResumableUploadStore{uploads: make(map[string]ResumableUpload)}
+}
+
+func (s *memoryResumableUploadStore) Create(upload ResumableUpload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uploads[upload.ID] = upload
+	return nil
+}
+
+func (s *memoryResumableUploadStore) Get(id string) (ResumableUpload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	upload, exists := s.uploads[id]
+	if !exists {
+		return ResumableUpload{}, ErrResumableUploadNotFound
+	}
+	return upload, nil
+}
+
+func (s *memoryResumableUploadStore) Update(upload ResumableUpload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.uploads[upload.ID]; !exists {
+		return ErrResumableUploadNotFound
+	}
+	s.uploads[upload.ID] = upload
+	return nil
+}
+
+func (s *memoryResumableUploadStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.uploads, id)
+	return nil
+}
+
+func (s *memoryResumableUploadStore) ListByUser(userID string) ([]ResumableUpload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]ResumableUpload, 0)
+	for _, upload := range s.uploads {
+		if upload.UserID == userID {
+			list = append(list, upload)
+		}
+	}
+	return list, nil
+}
+
+func (s *memoryResumableUploadStore) ListExpired(now time.Time) ([]ResumableUpload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]ResumableUpload, 0)
+	for _, upload := range s.uploads {
+		if upload.expired(now) {
+			list = append(list, upload)
+		}
+	}
+	return list, nil
+}
+
+// =======================================================================
+// Хранилище загрузок на диске (bbolt)
+// =======================================================================
+
+var resumableUploadsBucket = []byte("resumable_uploads")
+
+type boltResumableUploadStore struct {
+	db *bolt.DB
+}
+
+func newBoltResumableUploadStore(db *bolt.DB) (*boltResumableUploadStore, error) {
+	if err := createBuckets(db, resumableUploadsBucket); err != nil {
+		return nil, err
+	}
+	return &boltResumableUploadStore{db: db}, nil
+}
+
+func (s *boltResumableUploadStore) Create(upload ResumableUpload) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx.Bucket(resumableUploadsBucket), upload.ID, upload)
+	})
+}
+
+func (s *boltResumableUploadStore) Get(id string) (ResumableUpload, error) {
+	var upload ResumableUpload
+	err := s.db.View(func(tx *bolt.Tx) error {
+		found, err := boltGet(tx.Bucket(resumableUploadsBucket), id, &upload)
+		if err == nil && !found {
+			err = ErrResumableUploadNotFound
+		}
+		return err
+	})
+	return upload, err
+}
+
+func (s *boltResumableUploadStore) Update(upload ResumableUpload) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(resumableUploadsBucket)
+		if b.Get([]byte(upload.ID)) == nil {
+			return ErrResumableUploadNotFound
+		}
+		return boltPut(b, upload.ID, upload)
+	})
+}
+
+func (s *boltResumableUploadStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(resumableUploadsBucket).Delete([]byte(id))
+	})
+}
+
+func (s *boltResumableUploadStore) ListByUser(userID string) ([]ResumableUpload, error) {
+	return s.list(func(upload ResumableUpload) bool { return upload.UserID == userID })
+}
+
+func (s *boltResumableUploadStore) ListExpired(now time.Time) ([]ResumableUpload, error) {
+	return s.list(func(upload ResumableUpload) bool { return upload.expired(now) })
+}
+
+// list возвращает загрузки, для которых match возвращает true.
+func (s *boltResumableUploadStore) list(match func(ResumableUpload) bool) ([]ResumableUpload, error) {
+	list := make([]ResumableUpload, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(resumableUploadsBucket).ForEach(func(_, data []byte) error {
+			var upload ResumableUpload
+			if err := json.Unmarshal(data, &upload); err != nil {
+				return err
+			}
+			if match(upload) {
+				list = append(list, upload)
+			}
+			return nil
+		})
+	})
+	return list, err
+}
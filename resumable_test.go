@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestParseUploadChecksum(t *testing.T) {
+	sum := sha256.Sum256([]byte("data"))
+	encoded := base64.StdEncoding.EncodeToString(sum[:])
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"sha256", "sha256 " + encoded, hex.EncodeToString(sum[:]), false},
+		{"регистр алгоритма и пробелы", "  SHA256   " + encoded + " ", hex.EncodeToString(sum[:]), false},
+		{"другой алгоритм", "md5 " + encoded, "", true},
+		{"без алгоритма", encoded, "", true},
+		{"не base64", "sha256 !!!", "", true},
+		{"короткая сумма", "sha256 " + base64.StdEncoding.EncodeToString(sum[:16]), "", true},
+		{"пусто", "", "", true},
+	}
+	for _, tc := range tests {
+		got, err := parseUploadChecksum(tc.value)
+		if got != tc.want || (err != nil) != tc.wantErr {
+			t.Errorf("%s: parseUploadChecksum = %q, %v", tc.name, got, err)
+		}
+	}
+}
+
+func TestParseUploadMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"пусто", "  ", nil, false},
+		{"несколько пар", "filename cGhvdG8uanBn, filetype aW1hZ2UvanBlZw==", map[string]string{"filename": "photo.jpg", "filetype": "image/jpeg"}, false},
+		{"ключ без значения", "is_confidential", map[string]string{"is_confidential": ""}, false},
+		{"не base64", "filename ###", nil, true},
+		{"пустая пара", "filename cGhvdG8=,", nil, true},
+	}
+	for _, tc := range tests {
+		got, err := parseUploadMetadata(tc.value)
+		if (err != nil) != tc.wantErr || len(got) != len(tc.want) {
+			t.Errorf("%s: parseUploadMetadata = %v, %v", tc.name, got, err)
+			continue
+		}
+		for key, value := range tc.want {
+			if got[key] != value {
+				t.Errorf("%s: %s = %q, ожидалось %q", tc.name, key, got[key], value)
+			}
+		}
+	}
+}
+
+// tusRequest выполняет запрос к обработчикам загрузок от имени пользователя userID.
+func tusRequest(userID, method, path string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	req = req.WithContext(context.WithValue(req.Context(), userContextKey, userID))
+	rec := httptest.NewRecorder()
+	if path == "/user/uploads" {
+		resumableUploadsHandler(rec, req)
+	} else {
+		resumableUploadHandler(rec, req)
+	}
+	return rec
+}
+
+// createTestUpload начинает загрузку length байт и возвращает ее адрес.
+func createTestUpload(t *testing.T, userID string, length int, checksum string) string {
+	t.Helper()
+	headers := map[string]string{"Upload-Length": strconv.Itoa(length), "Tus-Resumable": tusVersion}
+	if checksum != "" {
+		headers["Upload-Checksum"] = checksum
+	}
+	rec := tusRequest(userID, http.MethodPost, "/user/uploads", nil, headers)
+	if rec.Code != http.StatusCreated || rec.Header().Get("Location") == "" {
+		t.Fatalf("создание загрузки: %d %s", rec.Code, rec.Body)
+	}
+	return rec.Header().Get("Location")
+}
+
+// patchTestUpload отправляет часть data со смещения offset.
+func patchTestUpload(userID, location string, offset int, data []byte) *httptest.ResponseRecorder {
+	return tusRequest(userID, http.MethodPatch, location, data, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.Itoa(offset),
+	})
+}
+
+// uploadChecksum возвращает заголовок Upload-Checksum для data.
+func uploadChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256 " + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestResumableUploadOffsets(t *testing.T) {
+	useMemoryStores()
+	userStore.Create(UserData{ID: "alice-id", Email: "alice@example.com", Handle: "alice"})
+	location := createTestUpload(t, "alice-id", 10, "")
+
+	steps := []struct {
+		name        string
+		contentType string
+		offset      string
+		body        string
+		wantStatus  int
+		wantOffset  string
+	}{
+		{"неверный Content-Type", "application/octet-stream", "0", "hello", http.StatusUnsupportedMediaType, ""},
+		{"нет смещения", "application/offset+octet-stream", "", "hello", http.StatusBadRequest, ""},
+		{"первая часть", "application/offset+octet-stream", "0", "hello", http.StatusNoContent, "5"},
+		{"повтор первой части", "application/offset+octet-stream", "0", "hello", http.StatusConflict, "5"},
+		{"смещение впереди полученного", "application/offset+octet-stream", "7", "lo", http.StatusConflict, "5"},
+		{"часть больше остатка", "application/offset+octet-stream", "5", "world!", http.StatusRequestEntityTooLarge, ""},
+		{"вторая часть", "application/offset+octet-stream", "5", "world", http.StatusNoContent, "10"},
+	}
+	for _, step := range steps {
+		headers := map[string]string{"Content-Type": step.contentType}
+		if step.offset != "" {
+			headers["Upload-Offset"] = step.offset
+		}
+		rec := tusRequest("alice-id", http.MethodPatch, location, []byte(step.body), headers)
+		if rec.Code != step.wantStatus || rec.Header().Get("Upload-Offset") != step.wantOffset {
+			t.Errorf("%s: статус %d, Upload-Offset %q, ожидалось %d и %q", step.name, rec.Code, rec.Header().Get("Upload-Offset"), step.wantStatus, step.wantOffset)
+		}
+	}
+
+	rec := tusRequest("alice-id", http.MethodHead, location, nil, nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("Upload-Offset") != "10" || rec.Header().Get("Upload-Length") != "10" {
+		t.Errorf("HEAD: %d, Upload-Offset %q", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+	if rec := tusRequest("bob-id", http.MethodHead, location, nil, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("HEAD чужой загрузки: %d, ожидался 404", rec.Code)
+	}
+}
+
+func TestFinalizeResumableUpload(t *testing.T) {
+	useMemoryStores()
+	useTestMedia(t, newMemoryMediaStore())
+	userStore.Create(UserData{ID: "alice-id", Email: "alice@example.com", Handle: "alice"})
+
+	img := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7)
+	}
+	img.Set(0, 0, color.White)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("png.Encode: %v", err)
+	}
+	data := buf.Bytes()
+	corrupted := append([]byte{}, data...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	other := uploadChecksum([]byte("other"))
+
+	tests := []struct {
+		name           string
+		createChecksum string // Upload-Checksum при создании
+		sent           []byte // Что дошло до сервера
+		finalize       string // checksum в теле finalize
+		wantStatus     int
+		wantRemoved    bool // Загрузка удаляется после проверки суммы
+	}{
+		{"файл получен не полностью", uploadChecksum(data), data[:len(data)/2], "", http.StatusConflict, false},
+		{"нет контрольной суммы", "", data, "", http.StatusBadRequest, false},
+		{"сумма не совпадает с заявленной при создании", uploadChecksum(data), data, other, http.StatusBadRequest, false},
+		{"файл поврежден при передаче", uploadChecksum(data), corrupted, "", statusChecksumMismatch, true},
+		{"сумма из тела finalize", "", data, uploadChecksum(data), http.StatusCreated, true},
+		{"сумма из заголовка при создании", uploadChecksum(data), data, "", http.StatusCreated, true},
+	}
+	for _, tc := range tests {
+		location := createTestUpload(t, "alice-id", len(data), tc.createChecksum)
+		if rec := patchTestUpload("alice-id", location, 0, tc.sent); rec.Code != http.StatusNoContent {
+			t.Fatalf("%s: PATCH %d %s", tc.name, rec.Code, rec.Body)
+		}
+
+		body, _ := json.Marshal(map[string]string{"target": uploadTargetPost, "checksum": tc.finalize, "caption": "закат"})
+		rec := tusRequest("alice-id", http.MethodPost, location+"/finalize", body, nil)
+		if rec.Code != tc.wantStatus {
+			t.Errorf("%s: статус %d, ожидался %d: %s", tc.name, rec.Code, tc.wantStatus, rec.Body)
+		}
+		head := tusRequest("alice-id", http.MethodHead, location, nil, nil)
+		if removed := head.Code == http.StatusNotFound; removed != tc.wantRemoved {
+			t.Errorf("%s: загрузка удалена = %v, ожидалось %v", tc.name, removed, tc.wantRemoved)
+		}
+	}
+
+	posts, err := postStore.ListByAuthor("alice-id", "", 0)
+	if err != nil || len(posts) != 2 || posts[0].Caption != "закат" {
+		t.Errorf("опубликованные посты: %+v, %v", posts, err)
+	}
+	// Незавершенные загрузки остаются вместе с файлами в resumableUploadDir
+	uploads, _ := resumableUploadStore.ListByUser("alice-id")
+	if len(uploads) != 3 {
+		t.Errorf("незавершенных загрузок %d, ожидалось 3", len(uploads))
+	}
+	for _, upload := range uploads {
+		if _, err := os.Stat(upload.path()); err != nil {
+			t.Errorf("загрузка %s без файла: %v", upload.ID, err)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- S3-совместимое Хранилище ---
+//
+// Минимальный клиент S3 (AWS, MinIO, Ceph и т.п.): PUT, GET, HEAD и DELETE объекта и
+// подписанные ссылки на чтение. Запросы подписываются AWS Signature Version 4.
+// Для локальной проверки есть заглушка: go run ./cmd/mock-s3
+
+// s3Config - параметры подключения к S3.
+type s3Config struct {
+	Endpoint  string // Адрес сервиса, например https://s3.eu-central-1.amazonaws.com или http://localhost:9001
+	Region    string
+	Bucket    string
+	Prefix    string // Префикс ключей внутри бакета, например "uploads/"
+	AccessKey string
+	SecretKey string
+	PathStyle bool // Адрес вида endpoint/bucket/key (MinIO) вместо bucket.endpoint/key
+}
+
+// s3BlobStore реализует BlobStore поверх S3 API.
+type s3BlobStore struct {
+	config   s3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func newS3BlobStore(config s3Config) (*s3BlobStore, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("S3_ENDPOINT должен быть адресом http(s): %q", config.Endpoint)
+	}
+	if config.Bucket == "" || config.AccessKey == "" || config.SecretKey == "" || config.Region == "" {
+		return nil, errors.New("нужны S3_BUCKET, S3_REGION, S3_ACCESS_KEY и S3_SECRET_KEY")
+	}
+	return &s3BlobStore{config: config, endpoint: endpoint, client: &http.Client{Timeout: time.Minute}}, nil
+}
+
+// objectURL возвращает адрес объекта с ключом key.
+func (s *s3BlobStore) objectURL(key string) *url.URL {
+	return s.bucketURL("/" + s.config.Prefix + key)
+}
+
+// bucketURL возвращает адрес пути objectPath внутри бакета ("/" - сам бакет).
+func (s *s3BlobStore) bucketURL(objectPath string) *url.URL {
+	u := *s.endpoint
+	if s.config.PathStyle {
+		objectPath = "/" + s.config.Bucket + objectPath
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(s.endpoint.Path, "/") + objectPath
+	u.RawPath = s3EscapePath(u.Path)
+	return &u
+}
+
+// do выполняет подписанный запрос к объекту key.
+func (s *s3BlobStore) do(method, key string, body io.Reader, size int64, contentType string) (*http.Response, error) {
+	if !validBlobKey(key) {
+		return nil, ErrInvalidBlobKey
+	}
+	req, err := http.NewRequest(method, s.objectURL(key).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+func (s *s3BlobStore) Put(key string, r io.Reader, size int64, contentType string) error {
+	resp, err := s.do(http.MethodPut, key, r, size, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return s3ResponseError(resp, key)
+}
+
+func (s *s3BlobStore) Get(key string) (io.ReadCloser, BlobInfo, error) {
+	resp, err := s.do(http.MethodGet, key, nil, 0, "")
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	if err := s3ResponseError(resp, key); err != nil {
+		resp.Body.Close()
+		return nil, BlobInfo{}, err
+	}
+	return resp.Body, s3BlobInfo(key, resp), nil
+}
+
+func (s *s3BlobStore) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, 0, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := s3ResponseError(resp, key); err != nil && !errors.Is(err, ErrBlobNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (s *s3BlobStore) Stat(key string) (BlobInfo, error) {
+	resp, err := s.do(http.MethodHead, key, nil, 0, "")
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	defer resp.Body.Close()
+	if err := s3ResponseError(resp, key); err != nil {
+		return BlobInfo{}, err
+	}
+	return s3BlobInfo(key, resp), nil
+}
+
+// SignedURL возвращает подписанную ссылку на чтение объекта (presigned GET), действующую ttl.
+func (s *s3BlobStore) SignedURL(key string, ttl time.Duration) (string, error) {
+	if !validBlobKey(key) {
+		return "", ErrInvalidBlobKey
+	}
+	now := time.Now().UTC()
+	u := s.objectURL(key)
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.config.AccessKey+"/"+s.credentialScope(now))
+	query.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(ttl.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	u.RawQuery = s3CanonicalQuery(query)
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		s3EscapePath(u.Path),
+		u.RawQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	u.RawQuery += "&X-Amz-Signature=" + s.signature(now, canonicalRequest)
+	return u.String(), nil
+}
+
+// List перебирает объекты с префиксом хранилища запросами ListObjectsV2 (по 1000 за страницу).
+// Объекты во вложенных "папках" префикса не считаются загрузками и пропускаются.
+func (s *s3BlobStore) List() ([]BlobInfo, error) {
+	var blobs []BlobInfo
+	continuation := ""
+	for {
+		u := s.bucketURL("/")
+		query := url.Values{"list-type": {"2"}, "prefix": {s.config.Prefix}}
+		if continuation != "" {
+			query.Set("continuation-token", continuation)
+		}
+		u.RawQuery = s3CanonicalQuery(query)
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		s.sign(req, time.Now().UTC())
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		var page struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = s3ResponseError(resp, s.config.Prefix)
+		if err == nil {
+			err = xml.NewDecoder(resp.Body).Decode(&page)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range page.Contents {
+			key := strings.TrimPrefix(item.Key, s.config.Prefix)
+			if validBlobKey(key) {
+				blobs = append(blobs, BlobInfo{Key: key, Size: item.Size, ModTime: item.LastModified})
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return blobs, nil
+		}
+		continuation = page.NextContinuationToken
+	}
+}
+
+// s3BlobInfo собирает BlobInfo из заголовков ответа GET или HEAD.
+func s3BlobInfo(key string, resp *http.Response) BlobInfo {
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return BlobInfo{Key: key, Size: resp.ContentLength, ContentType: resp.Header.Get("Content-Type"), ModTime: modTime}
+}
+
+// s3ResponseError превращает неуспешный ответ S3 в ошибку (404 - ErrBlobNotFound).
+func s3ResponseError(resp *http.Response, key string) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrBlobNotFound
+	}
+	var body struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body)
+	return fmt.Errorf("S3 %s %s: %s %s %s", resp.Request.Method, key, resp.Status, body.Code, body.Message)
+}
+
+// =======================================================================
+// AWS Signature Version 4
+// =======================================================================
+
+const s3TimeFormat = "20060102T150405Z"
+
+// sign подписывает запрос заголовком Authorization. Тело не хешируется (UNSIGNED-PAYLOAD),
+// чтобы загрузки можно было передавать потоком.
+func (s *s3BlobStore) sign(req *http.Request, now time.Time) {
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if req.Header.Get("Content-Type") != "" {
+		signedHeaders = append([]string{"content-type"}, signedHeaders...)
+	}
+	var canonicalHeaders strings.Builder
+	for _, name := range signedHeaders {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKey, s.credentialScope(now), strings.Join(signedHeaders, ";"), s.signature(now, canonicalRequest)))
+}
+
+// credentialScope - область действия ключа: дата/регион/s3/aws4_request.
+func (s *s3BlobStore) credentialScope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.config.Region + "/s3/aws4_request"
+}
+
+// signature вычисляет подпись канонического запроса ключом, производным от секрета, даты и региона.
+func (s *s3BlobStore) signature(now time.Time, canonicalRequest string) string {
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format(s3TimeFormat) + "\n" + s.credentialScope(now) + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + s.config.SecretKey)
+	for _, part := range []string{now.Format("20060102"), s.config.Region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	return hex.EncodeToString(key)
+}
+
+// s3Escape кодирует строку по правилам SigV4: все, кроме A-Z a-z 0-9 - _ . ~, в %XX.
+func s3Escape(value string) string {
+	var b strings.Builder
+	for _, c := range []byte(value) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3EscapePath кодирует путь, сохраняя разделители "/".
+func s3EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// s3CanonicalQuery сортирует и кодирует параметры запроса по правилам SigV4.
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3Escape(key)+"="+s3Escape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
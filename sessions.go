@@ -0,0 +1,529 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// --- Настройки Сессий ---
+
+const (
+	// sessionCookieName - имя куки, в которой браузер хранит непрозрачный токен сессии.
+	sessionCookieName = "session_id"
+	// sessionIdleTTL - срок жизни сессии без активности (продлевается при каждом запросе).
+	sessionIdleTTL = 24 * time.Hour
+	// sessionMaxLifetime - абсолютный срок жизни сессии, после которого нужен повторный вход.
+	sessionMaxLifetime = 30 * 24 * time.Hour
+	// sessionTouchInterval - как часто записывать продление сессии в хранилище.
+	sessionTouchInterval = time.Minute
+)
+
+// ErrSessionNotFound возвращается, если сессия отсутствует, отозвана или истекла.
+var ErrSessionNotFound = errors.New("сессия не найдена")
+
+// Session - серверная запись о входе пользователя.
+// В куке хранится только случайный токен, а в хранилище - его SHA-256 (поле ID),
+// поэтому утечка базы не позволяет подделать чужую куку.
+type Session struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	// SudoUntil - до какого момента сессии разрешены чувствительные изменения без ввода пароля
+	SudoUntil time.Time `json:"sudo_until"`
+}
+
+// expired сообщает, истекла ли сессия к моменту now.
+func (s Session) expired(now time.Time) bool {
+	return !now.Before(s.ExpiresAt) || !now.Before(s.CreatedAt.Add(sessionMaxLifetime))
+}
+
+// SessionStore описывает хранилище сессий.
+type SessionStore interface {
+	// Create сохраняет новую сессию.
+	Create(session Session) error
+	// Get возвращает сессию по ID (хешу токена).
+	Get(id string) (Session, error)
+	// Update перезаписывает существующую сессию (продление).
+	Update(session Session) error
+	// Delete отзывает сессию.
+	Delete(id string) error
+	// ListByUser возвращает все сессии пользователя.
+	ListByUser(userID string) ([]Session, error)
+	// DeleteExpired удаляет все сессии, истекшие к моменту now.
+	DeleteExpired(now time.Time) (int, error)
+}
+
+// sessionStore - активное хранилище сессий, инициализируется в initStorage().
+var sessionStore SessionStore
+
+// --- Вспомогательные функции ---
+
+// hashToken возвращает ключ, под которым секретный токен (сессии, ссылки из письма) хранится на сервере.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// clientIP возвращает IP-адрес клиента без порта.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// setSessionCookie отправляет браузеру куку сессии с указанным сроком действия.
+func setSessionCookie(w http.ResponseWriter, token string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   false,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/",
+	})
+}
+
+// clearSessionCookie удаляет куку сессии в браузере.
+func clearSessionCookie(w http.ResponseWriter) {
+	setSessionCookie(w, "", time.Unix(0, 0))
+}
+
+// startSession создает сессию для пользователя и устанавливает куку.
+func startSession(w http.ResponseWriter, r *http.Request, userID string) (Session, error) {
+	token, err := generateSessionID()
+	if err != nil {
+		return Session{}, err
+	}
+
+	now := time.Now()
+	session := Session{
+		ID:        hashToken(token),
+		UserID:    userID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(sessionIdleTTL),
+		LastSeen:  now,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+	if err := sessionStore.Create(session); err != nil {
+		return Session{}, err
+	}
+
+	setSessionCookie(w, token, session.ExpiresAt)
+	audit(AuditEvent{Event: "login", UserID: userID, IP: session.IP, Details: describeDevice(session.UserAgent)})
+	return session, nil
+}
+
+// resolveSession находит действующую сессию по куке запроса и продлевает ее (скользящий срок).
+func resolveSession(w http.ResponseWriter, r *http.Request) (Session, error) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return Session{}, ErrSessionNotFound
+	}
+
+	session, err := sessionStore.Get(hashToken(cookie.Value))
+	if err != nil {
+		return Session{}, err
+	}
+
+	now := time.Now()
+	if session.expired(now) {
+		sessionStore.Delete(session.ID)
+		return Session{}, ErrSessionNotFound
+	}
+
+	// Продлеваем сессию не чаще раза в sessionTouchInterval, чтобы не писать в базу на каждый запрос
+	if now.Sub(session.LastSeen) >= sessionTouchInterval {
+		session.LastSeen = now
+		session.ExpiresAt = now.Add(sessionIdleTTL)
+		session.IP = clientIP(r)
+		session.UserAgent = r.UserAgent()
+		if err := sessionStore.Update(session); err != nil {
+			return Session{}, err
+		}
+		setSessionCookie(w, cookie.Value, session.ExpiresAt)
+	}
+	return session, nil
+}
+
+// purgeExpiredSessions периодически удаляет истекшие сессии из хранилища.
+func purgeExpiredSessions(interval time.Duration) {
+	for range time.Tick(interval) {
+		if n, err := sessionStore.DeleteExpired(time.Now()); err != nil {
+			log.Printf("❌ Ошибка очистки сессий: %v", err)
+		} else if n > 0 {
+			log.Printf("🧹 Удалено истекших сессий: %d", n)
+		}
+	}
+}
+
+// revokeSessions удаляет сессии из хранилища и закрывает их открытые соединения чата.
+func revokeSessions(ids ...string) error {
+	for _, id := range ids {
+		if err := sessionStore.Delete(id); err != nil {
+			return err
+		}
+	}
+	if len(ids) > 0 {
+		hub.closeSessions <- ids
+	}
+	return nil
+}
+
+// revokeUserSessions завершает все сессии пользователя, кроме exceptID (пустой - завершить все).
+func revokeUserSessions(userID, exceptID string) (int, error) {
+	sessions, err := sessionStore.ListByUser(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	var ids []string
+	for _, session := range sessions {
+		if session.ID != exceptID {
+			ids = append(ids, session.ID)
+		}
+	}
+	return len(ids), revokeSessions(ids...)
+}
+
+// describeDevice строит короткое описание устройства по User-Agent ("Chrome, Windows").
+func describeDevice(userAgent string) string {
+	browser := "Неизвестный браузер"
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(userAgent, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	case userAgent != "":
+		// Скрипты и утилиты (curl/8.0) - берем имя до первого слэша
+		browser = strings.SplitN(userAgent, "/", 2)[0]
+	}
+
+	system := ""
+	switch {
+	case strings.Contains(userAgent, "Android"):
+		system = "Android"
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		system = "iOS"
+	case strings.Contains(userAgent, "Windows"):
+		system = "Windows"
+	case strings.Contains(userAgent, "Mac OS X"):
+		system = "macOS"
+	case strings.Contains(userAgent, "Linux"):
+		system = "Linux"
+	}
+
+	if system == "" {
+		return browser
+	}
+	return browser + ", " + system
+}
+
+// =======================================================================
+// Обработчики API сессий (/user/sessions)
+// =======================================================================
+
+// sessionsHandler возвращает список активных сессий текущего пользователя.
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Допустим только метод GET", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Context().Value(userContextKey).(string)
+	currentID := r.Context().Value(sessionContextKey).(string)
+
+	sessions, err := sessionStore.ListByUser(userID)
+	if err != nil {
+		log.Printf("❌ Ошибка получения сессий %s: %v", userID, err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	// Сначала последние активные
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastSeen.After(sessions[j].LastSeen) })
+
+	now := time.Now()
+	list := make([]map[string]interface{}, 0, len(sessions))
+	for _, session := range sessions {
+		if session.expired(now) {
+			continue
+		}
+		list = append(list, map[string]interface{}{
+			"id":         session.ID,
+			"device":     describeDevice(session.UserAgent),
+			"user_agent": session.UserAgent,
+			"ip":         session.IP,
+			"created_at": session.CreatedAt,
+			"last_seen":  session.LastSeen,
+			"current":    session.ID == currentID,
+		})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"sessions": list, "status": "success"})
+}
+
+// revokeSessionHandler завершает одну сессию текущего пользователя по ее ID.
+func revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Допустим только метод POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Context().Value(userContextKey).(string)
+	currentID := r.Context().Value(sessionContextKey).(string)
+
+	var body struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Не указан ID сессии", "status": "error"})
+		return
+	}
+
+	// Можно отзывать только свои сессии
+	session, err := sessionStore.Get(body.ID)
+	if err != nil || session.UserID != userID {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Сессия не найдена", "status": "error"})
+		return
+	}
+
+	if err := revokeSessions(session.ID); err != nil {
+		log.Printf("❌ Ошибка отзыва сессии: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if session.ID == currentID {
+		clearSessionCookie(w)
+	}
+
+	log.Printf("🔒 Пользователь %s завершил сессию (%s, %s)", userID, describeDevice(session.UserAgent), session.IP)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Сессия завершена", "status": "success"})
+}
+
+// revokeOtherSessionsHandler завершает все сессии пользователя, кроме текущей.
+func revokeOtherSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Допустим только метод POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Context().Value(userContextKey).(string)
+	currentID := r.Context().Value(sessionContextKey).(string)
+
+	revoked, err := revokeUserSessions(userID, currentID)
+	if err != nil {
+		log.Printf("❌ Ошибка отзыва сессий: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🔒 Пользователь %s завершил все остальные сессии (%d)", userID, revoked)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Остальные сессии завершены", "revoked": revoked, "status": "success"})
+}
+
+// =======================================================================
+// Хранилище сессий в памяти
+// =======================================================================
+
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: make(map[string]Session)}
+}
+
+func (s *memorySessionStore) Create(session Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.ID] = session
+	return nil
+}
+
+func (s *memorySessionStore) Get(id string) (Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, exists := s.sessions[id]
+	if !exists {
+		return Session{}, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+func (s *memorySessionStore) Update(session Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.sessions[session.ID]; !exists {
+		return ErrSessionNotFound
+	}
+	s.sessions[session.ID] = session
+	return nil
+}
+
+func (s *memorySessionStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *memorySessionStore) ListByUser(userID string) ([]Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Session, 0)
+	for _, session := range s.sessions {
+		if session.UserID == userID {
+			list = append(list, session)
+		}
+	}
+	return list, nil
+}
+
+func (s *memorySessionStore) DeleteExpired(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for id, session := range s.sessions {
+		if session.expired(now) {
+			delete(s.sessions, id)
+			count++
+		}
+	}
+	return count, nil
+}
+
+// =======================================================================
+// Хранилище сессий на диске (bbolt)
+// =======================================================================
+
+var sessionsBucket = []byte("sessions")
+
+type boltSessionStore struct {
+	db *bolt.DB
+}
+
+func newBoltSessionStore(db *bolt.DB) (*boltSessionStore, error) {
+	if err := createBuckets(db, sessionsBucket); err != nil {
+		return nil, err
+	}
+	return &boltSessionStore{db: db}, nil
+}
+
+func (s *boltSessionStore) Create(session Session) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx.Bucket(sessionsBucket), session.ID, session)
+	})
+}
+
+func (s *boltSessionStore) Get(id string) (Session, error) {
+	var session Session
+	err := s.db.View(func(tx *bolt.Tx) error {
+		found, err := boltGet(tx.Bucket(sessionsBucket), id, &session)
+		if err == nil && !found {
+			err = ErrSessionNotFound
+		}
+		return err
+	})
+	return session, err
+}
+
+func (s *boltSessionStore) Update(session Session) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(sessionsBucket)
+		if b.Get([]byte(session.ID)) == nil {
+			return ErrSessionNotFound
+		}
+		return boltPut(b, session.ID, session)
+	})
+}
+
+func (s *boltSessionStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Delete([]byte(id))
+	})
+}
+
+func (s *boltSessionStore) ListByUser(userID string) ([]Session, error) {
+	list := make([]Session, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return forEachSession(tx.Bucket(sessionsBucket), func(session Session) error {
+			if session.UserID == userID {
+				list = append(list, session)
+			}
+			return nil
+		})
+	})
+	return list, err
+}
+
+func (s *boltSessionStore) DeleteExpired(now time.Time) (int, error) {
+	count := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(sessionsBucket)
+		return forEachSession(b, func(session Session) error {
+			if !session.expired(now) {
+				return nil
+			}
+			count++
+			return b.Delete([]byte(session.ID))
+		})
+	})
+	return count, err
+}
+
+// forEachSession вызывает fn для каждой сессии в бакете. Сессии сначала читаются целиком,
+// поэтому внутри fn можно изменять и удалять ключи бакета.
+func forEachSession(b *bolt.Bucket, fn func(Session) error) error {
+	var sessions []Session
+	err := b.ForEach(func(_, data []byte) error {
+		var session Session
+		if err := json.Unmarshal(data, &session); err != nil {
+			return err
+		}
+		sessions = append(sessions, session)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if err := fn(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sessionStoreCases - реализации SessionStore, которые должны вести себя одинаково.
+func sessionStoreCases() map[string]func(t *testing.T) SessionStore {
+	return map[string]func(t *testing.T) SessionStore{
+		"memory": func(t *testing.T) SessionStore { return newMemorySessionStore() },
+		"bolt": func(t *testing.T) SessionStore {
+			store, err := newBoltSessionStore(openTestDB(t))
+			if err != nil {
+				t.Fatalf("создание хранилища: %v", err)
+			}
+			return store
+		},
+	}
+}
+
+// requestWithSession - запрос с кукой сессии token.
+func requestWithSession(token string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/user", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: token})
+	return req
+}
+
+func TestResolveSessionSlidingExpiry(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		session     Session
+		wantErr     error
+		wantExtends bool // Срок продлен и кука выдана заново
+	}{
+		{
+			name:    "недавний запрос не пишет в хранилище",
+			session: Session{CreatedAt: now.Add(-time.Hour), LastSeen: now.Add(-10 * time.Second), ExpiresAt: now.Add(time.Hour)},
+		},
+		{
+			name:        "после sessionTouchInterval срок сдвигается",
+			session:     Session{CreatedAt: now.Add(-time.Hour), LastSeen: now.Add(-2 * sessionTouchInterval), ExpiresAt: now.Add(time.Hour)},
+			wantExtends: true,
+		},
+		{
+			name:    "простой дольше sessionIdleTTL",
+			session: Session{CreatedAt: now.Add(-2 * sessionIdleTTL), LastSeen: now.Add(-sessionIdleTTL - time.Minute), ExpiresAt: now.Add(-time.Minute)},
+			wantErr: ErrSessionNotFound,
+		},
+		{
+			name:    "абсолютный срок sessionMaxLifetime",
+			session: Session{CreatedAt: now.Add(-sessionMaxLifetime - time.Minute), LastSeen: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour)},
+			wantErr: ErrSessionNotFound,
+		},
+	}
+
+	for name, newStore := range sessionStoreCases() {
+		t.Run(name, func(t *testing.T) {
+			sessionStore = newStore(t)
+			for i, tc := range tests {
+				token := fmt.Sprintf("token-%d", i)
+				tc.session.ID = hashToken(token)
+				tc.session.UserID = "alice-id"
+				if err := sessionStore.Create(tc.session); err != nil {
+					t.Fatalf("Create: %v", err)
+				}
+
+				rec := httptest.NewRecorder()
+				session, err := resolveSession(rec, requestWithSession(token))
+				if err != tc.wantErr {
+					t.Errorf("%s: ошибка %v, ожидалась %v", tc.name, err, tc.wantErr)
+					continue
+				}
+				stored, storedErr := sessionStore.Get(tc.session.ID)
+				if tc.wantErr != nil {
+					if storedErr != ErrSessionNotFound {
+						t.Errorf("%s: истекшая сессия осталась в хранилище (%v)", tc.name, storedErr)
+					}
+					continue
+				}
+
+				extended := session.ExpiresAt.After(tc.session.ExpiresAt)
+				if extended != tc.wantExtends {
+					t.Errorf("%s: срок продлен = %v, ожидалось %v", tc.name, extended, tc.wantExtends)
+				}
+				if !stored.ExpiresAt.Equal(session.ExpiresAt) {
+					t.Errorf("%s: в хранилище срок %v, в ответе %v", tc.name, stored.ExpiresAt, session.ExpiresAt)
+				}
+				if gotCookie := len(rec.Result().Cookies()) > 0; gotCookie != tc.wantExtends {
+					t.Errorf("%s: кука выдана = %v, ожидалось %v", tc.name, gotCookie, tc.wantExtends)
+				}
+			}
+		})
+	}
+
+	t.Run("без куки", func(t *testing.T) {
+		if _, err := resolveSession(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/user", nil)); err != ErrSessionNotFound {
+			t.Errorf("ошибка %v, ожидалась %v", err, ErrSessionNotFound)
+		}
+	})
+}
+
+func TestRevokeUserSessions(t *testing.T) {
+	for name, newStore := range sessionStoreCases() {
+		t.Run(name, func(t *testing.T) {
+			sessionStore = newStore(t)
+			now := time.Now()
+			sessions := []Session{
+				{ID: hashToken("alice-1"), UserID: "alice-id"},
+				{ID: hashToken("alice-2"), UserID: "alice-id"},
+				{ID: hashToken("alice-3"), UserID: "alice-id"},
+				{ID: hashToken("bob-1"), UserID: "bob-id"},
+			}
+			for _, session := range sessions {
+				session.CreatedAt, session.LastSeen, session.ExpiresAt = now, now, now.Add(sessionIdleTTL)
+				if err := sessionStore.Create(session); err != nil {
+					t.Fatalf("Create: %v", err)
+				}
+			}
+
+			// Завершение остальных сессий не трогает текущую и чужие
+			n, err := revokeUserSessions("alice-id", hashToken("alice-1"))
+			if err != nil || n != 2 {
+				t.Fatalf("revokeUserSessions = %d, %v, ожидалось 2", n, err)
+			}
+			tests := []struct {
+				token string
+				alive bool
+			}{
+				{"alice-1", true},
+				{"alice-2", false},
+				{"alice-3", false},
+				{"bob-1", true},
+			}
+			for _, tc := range tests {
+				_, err := resolveSession(httptest.NewRecorder(), requestWithSession(tc.token))
+				if alive := err == nil; alive != tc.alive {
+					t.Errorf("сессия %s активна = %v, ожидалось %v (%v)", tc.token, alive, tc.alive, err)
+				}
+			}
+
+			// Пустой exceptID завершает все
+			if n, err := revokeUserSessions("alice-id", ""); err != nil || n != 1 {
+				t.Errorf("revokeUserSessions без исключения = %d, %v, ожидалось 1", n, err)
+			}
+			if list, err := sessionStore.ListByUser("alice-id"); err != nil || len(list) != 0 {
+				t.Errorf("после отзыва осталось %d сессий (%v)", len(list), err)
+			}
+		})
+	}
+}
+
+func TestSessionStoreDeleteExpired(t *testing.T) {
+	for name, newStore := range sessionStoreCases() {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			now := time.Now()
+			store.Create(Session{ID: "live", UserID: "u", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+			store.Create(Session{ID: "idle", UserID: "u", CreatedAt: now, ExpiresAt: now.Add(-time.Second)})
+			store.Create(Session{ID: "old", UserID: "u", CreatedAt: now.Add(-sessionMaxLifetime), ExpiresAt: now.Add(time.Hour)})
+
+			if n, err := store.DeleteExpired(now); err != nil || n != 2 {
+				t.Errorf("DeleteExpired = %d, %v, ожидалось 2", n, err)
+			}
+			if _, err := store.Get("live"); err != nil {
+				t.Errorf("действующая сессия удалена: %v", err)
+			}
+		})
+	}
+}
+
+// sessionRequest - запрос к обработчикам сессий от имени userID в сессии sessionID.
+func sessionRequest(method, path, body, userID, sessionID string) *http.Request {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	ctx := context.WithValue(req.Context(), userContextKey, userID)
+	return req.WithContext(context.WithValue(ctx, sessionContextKey, sessionID))
+}
+
+// createTestSessions создает действующие сессии с заданными ID и владельцами.
+func createTestSessions(t *testing.T, owners map[string]string) {
+	t.Helper()
+	now := time.Now()
+	for id, userID := range owners {
+		session := Session{ID: id, UserID: userID, CreatedAt: now, LastSeen: now, ExpiresAt: now.Add(sessionIdleTTL)}
+		if err := sessionStore.Create(session); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+}
+
+// chatClosed сообщает, закрыл ли хаб канал отправки клиента (прочитав уже отправленное).
+func chatClosed(client *Client) bool {
+	for {
+		select {
+		case _, ok := <-client.send:
+			if !ok {
+				return true
+			}
+		default:
+			return false
+		}
+	}
+}
+
+func TestSessionsHandlerListsOwnSessions(t *testing.T) {
+	useMemoryStores()
+	createTestSessions(t, map[string]string{"alice-1": "alice-id", "alice-2": "alice-id", "bob-1": "bob-id"})
+	now := time.Now()
+	sessionStore.Create(Session{ID: "alice-expired", UserID: "alice-id", CreatedAt: now, ExpiresAt: now.Add(-time.Second)})
+
+	rec := httptest.NewRecorder()
+	sessionsHandler(rec, sessionRequest(http.MethodGet, "/user/sessions", "", "alice-id", "alice-2"))
+	var resp struct {
+		Sessions []struct {
+			ID      string `json:"id"`
+			Current bool   `json:"current"`
+		} `json:"sessions"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("статус %d, %v", rec.Code, err)
+	}
+	listed := map[string]bool{}
+	for _, session := range resp.Sessions {
+		listed[session.ID] = session.Current
+	}
+	if len(listed) != 2 || listed["alice-1"] || !listed["alice-2"] {
+		t.Errorf("сессии в списке (ID -> текущая): %v, ожидались alice-1 и текущая alice-2", listed)
+	}
+}
+
+func TestRevokeSessionHandler(t *testing.T) {
+	useMemoryStores()
+	createTestSessions(t, map[string]string{"alice-1": "alice-id", "alice-2": "alice-id", "bob-1": "bob-id"})
+
+	tests := []struct {
+		name        string
+		id          string
+		wantStatus  int
+		wantCleared bool // Отозвана текущая сессия - кука удаляется
+	}{
+		{"без ID", "", http.StatusBadRequest, false},
+		{"чужая сессия", "bob-1", http.StatusNotFound, false},
+		{"несуществующая сессия", "missing", http.StatusNotFound, false},
+		{"другая своя сессия", "alice-2", http.StatusOK, false},
+		{"уже отозванная", "alice-2", http.StatusNotFound, false},
+		{"текущая сессия", "alice-1", http.StatusOK, true},
+	}
+	for _, tc := range tests {
+		rec := httptest.NewRecorder()
+		revokeSessionHandler(rec, sessionRequest(http.MethodPost, "/user/sessions/revoke", `{"id": "`+tc.id+`"}`, "alice-id", "alice-1"))
+		if rec.Code != tc.wantStatus {
+			t.Errorf("%s: статус %d, ожидался %d", tc.name, rec.Code, tc.wantStatus)
+		}
+		if cleared := strings.Contains(rec.Header().Get("Set-Cookie"), sessionCookieName+"=;"); cleared != tc.wantCleared {
+			t.Errorf("%s: кука удалена = %v", tc.name, cleared)
+		}
+	}
+	if _, err := sessionStore.Get("bob-1"); err != nil {
+		t.Errorf("чужая сессия отозвана: %v", err)
+	}
+}
+
+func TestRevokeOtherSessionsHandler(t *testing.T) {
+	useMemoryStores()
+	createTestSessions(t, map[string]string{"alice-1": "alice-id", "alice-2": "alice-id", "alice-3": "alice-id", "bob-1": "bob-id"})
+
+	// По соединению с чатом на каждую сессию
+	clients := map[string]*Client{}
+	for _, id := range []string{"alice-1", "alice-2", "bob-1"} {
+		clients[id] = &Client{send: make(chan []byte, 16), user: UserData{ID: strings.Split(id, "-")[0] + "-id"}, sessionID: id}
+		hub.register <- clients[id]
+	}
+	t.Cleanup(func() {
+		hub.unregister <- clients["alice-1"]
+		hub.unregister <- clients["bob-1"]
+	})
+
+	rec := httptest.NewRecorder()
+	revokeOtherSessionsHandler(rec, sessionRequest(http.MethodPost, "/user/sessions/revoke_others", "", "alice-id", "alice-1"))
+	var resp struct {
+		Revoked int `json:"revoked"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || rec.Code != http.StatusOK || resp.Revoked != 2 {
+		t.Fatalf("статус %d, отозвано %d (%v), ожидалось 2", rec.Code, resp.Revoked, err)
+	}
+	hub.allMessages() // Хаб обработал закрытие соединений
+
+	tests := []struct {
+		id          string
+		wantSession bool
+		wantClosed  bool
+	}{
+		{"alice-1", true, false},
+		{"alice-2", false, true},
+		{"alice-3", false, false},
+		{"bob-1", true, false},
+	}
+	for _, tc := range tests {
+		if _, err := sessionStore.Get(tc.id); (err == nil) != tc.wantSession {
+			t.Errorf("%s: сессия активна = %v, ожидалось %v", tc.id, err == nil, tc.wantSession)
+		}
+		if client, connected := clients[tc.id]; connected && chatClosed(client) != tc.wantClosed {
+			t.Errorf("%s: соединение с чатом закрыто = %v, ожидалось %v", tc.id, !tc.wantClosed, tc.wantClosed)
+		}
+	}
+}
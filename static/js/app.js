@@ -8,6 +8,38 @@ document.addEventListener('DOMContentLoaded', () => {
     // Вспомогательная функция для безопасного получения элемента
     const getElement = (id) => document.getElementById(id);
 
+    // Заголовки с CSRF-токеном: сервер выдает его в куке csrf_token и ждет обратно
+    // в X-CSRF-Token у всех изменяющих запросов
+    const csrfHeaders = (headers = {}) => {
+        const match = document.cookie.match(/(?:^|;\s*)csrf_token=([^;]+)/);
+        return match ? { ...headers, 'X-CSRF-Token': decodeURIComponent(match[1]) } : headers;
+    };
+
+    // У аккаунта без пароля (вход через OIDC) сервер вместо пароля предлагает заново войти
+    // у провайдера (reauth_urls): после возврата на профиль действие можно повторить
+    const offerOIDCReauth = (result) => {
+        if (result && result.reauth_urls && result.reauth_urls.length && confirm(`${result.message}. Перейти?`)) {
+            window.location.href = result.reauth_urls[0];
+            return true;
+        }
+        return false;
+    };
+
+    // Ошибки проверки по полям ({"errors": {"password": [...]}}) выводим под соответствующими полями формы
+    const showFieldErrors = (form, errors) => {
+        form.querySelectorAll('.field-error').forEach((el) => el.remove());
+        Object.entries(errors || {}).forEach(([field, messages]) => {
+            const input = form.querySelector(`[name="${field}"]`);
+            if (!input) return;
+            const hint = document.createElement('small');
+            hint.className = 'field-error';
+            hint.style.color = 'red';
+            hint.style.display = 'block';
+            hint.textContent = messages.join('. ');
+            input.insertAdjacentElement('afterend', hint);
+        });
+    };
+
     // ------------------------------------
     // 1. Обработка регистрации (Без изменений)
     // ------------------------------------
@@ -28,10 +60,12 @@ document.addEventListener('DOMContentLoaded', () => {
             try {
                 const response = await fetch('/register', {
                     method: 'POST',
+                    headers: csrfHeaders(),
                     body: formData
                 });
 
                 const result = await response.json();
+                showFieldErrors(registerForm, result.errors);
 
                 if (response.ok) {
                     registerMessageElement.textContent = result.message;
@@ -69,27 +103,79 @@ document.addEventListener('DOMContentLoaded', () => {
     if (loginForm) {
         console.log('🔗 Форма входа найдена. Подключение...');
 
+        // Токен второго шага: выдается сервером, если у пользователя включена 2FA
+        let loginChallenge = null;
+        const totpInput = getElement('totpCode');
+
+        const showTotpStep = (message) => {
+            if (totpInput) {
+                totpInput.style.display = '';
+                totpInput.required = true;
+                totpInput.focus();
+            }
+            if (loginMessageElement) {
+                loginMessageElement.textContent = message;
+                loginMessageElement.style.color = 'black';
+            }
+        };
+
+        // Возврат от внешнего провайдера: ошибка входа или запрос кода 2FA
+        const params = new URLSearchParams(window.location.search);
+        if (params.get('oidc_error') && loginMessageElement) {
+            loginMessageElement.textContent = `Ошибка: ${params.get('oidc_error')}`;
+            loginMessageElement.style.color = 'red';
+        }
+        if (params.get('challenge')) {
+            loginChallenge = params.get('challenge');
+            showTotpStep('Введите код из приложения-аутентификатора');
+        }
+
+        // Кнопки входа через внешних провайдеров (OpenID Connect)
+        const oidcContainer = getElement('oidcProviders');
+        if (oidcContainer) {
+            fetch('/auth/oidc/providers')
+                .then((response) => response.json())
+                .then((result) => {
+                    (result.providers || []).forEach((provider) => {
+                        const link = document.createElement('a');
+                        link.href = provider.login_url;
+                        link.textContent = `Войти через ${provider.display_name}`;
+                        link.style.display = 'block';
+                        link.style.marginTop = '8px';
+                        oidcContainer.appendChild(link);
+                    });
+                })
+                .catch((error) => console.warn('⚠️ Не удалось загрузить провайдеров входа:', error));
+        }
+
         loginForm.addEventListener('submit', async (e) => {
             e.preventDefault();
 
-            // Сбор email и password
-            const data = {
-                email: getElement('emailInput')?.value,
-                password: getElement('password')?.value
-            };
+            // Первый шаг - email и пароль, второй (при включенной 2FA) - код
+            const url = loginChallenge ? '/login/2fa' : '/login';
+            const data = loginChallenge
+                ? { challenge: loginChallenge, code: totpInput?.value }
+                : { email: getElement('emailInput')?.value, password: getElement('password')?.value };
 
             if (loginMessageElement) loginMessageElement.textContent = '';
             
             try {
-                const response = await fetch('/login', {
+                const response = await fetch(url, {
                     method: 'POST',
-                    headers: { 'Content-Type': 'application/json' },
+                    headers: csrfHeaders({ 'Content-Type': 'application/json' }),
                     body: JSON.stringify(data)
                 });
 
                 const result = await response.json();
 
+                if (response.ok && result.status === '2fa_required') {
+                    loginChallenge = result.challenge;
+                    showTotpStep(result.message);
+                    return;
+                }
+
                 if (response.ok) {
+                    loginChallenge = null;
                     if (loginMessageElement) {
                          loginMessageElement.textContent = result.message;
                          loginMessageElement.style.color = 'green';
@@ -104,6 +190,15 @@ document.addEventListener('DOMContentLoaded', () => {
                     
                 } else {
                     console.warn('⚠️ Ошибка входа:', result.message);
+                    // Истекший токен второго шага - начинаем вход заново
+                    if (loginChallenge && result.restart === 'login') {
+                        loginChallenge = null;
+                        if (totpInput) {
+                            totpInput.style.display = 'none';
+                            totpInput.required = false;
+                            totpInput.value = '';
+                        }
+                    }
                     if (loginMessageElement) {
                         loginMessageElement.textContent = `Ошибка: ${result.message || 'Неверные данные'}`;
                         loginMessageElement.style.color = 'red';
@@ -119,6 +214,96 @@ document.addEventListener('DOMContentLoaded', () => {
         });
     }
 
+    // ------------------------------------
+    // 2.1. Восстановление пароля (reset.html)
+    // ------------------------------------
+    const forgotForm = getElement('forgotForm');
+    const resetForm = getElement('resetForm');
+    const resetMessageElement = getElement('resetMessage');
+
+    const showResetMessage = (text, color) => {
+        if (resetMessageElement) {
+            resetMessageElement.textContent = text;
+            resetMessageElement.style.color = color;
+        }
+    };
+
+    if (forgotForm && resetForm) {
+        // Токен приходит в ссылке из письма: /reset.html?token=...
+        const resetToken = new URLSearchParams(window.location.search).get('token');
+        if (resetToken) {
+            forgotForm.style.display = 'none';
+            resetForm.style.display = '';
+        }
+
+        forgotForm.addEventListener('submit', async (e) => {
+            e.preventDefault();
+            try {
+                const response = await fetch('/password/forgot', {
+                    method: 'POST',
+                    headers: csrfHeaders({ 'Content-Type': 'application/json' }),
+                    body: JSON.stringify({ email: getElement('forgotEmail').value })
+                });
+                const result = await response.json();
+                showResetMessage(result.message, response.ok ? 'green' : 'red');
+            } catch (error) {
+                console.error('❌ Ошибка сети при запросе сброса пароля:', error);
+                showResetMessage('Произошла ошибка сети. Сервер недоступен.', 'red');
+            }
+        });
+
+        resetForm.addEventListener('submit', async (e) => {
+            e.preventDefault();
+            try {
+                const response = await fetch('/password/reset', {
+                    method: 'POST',
+                    headers: csrfHeaders({ 'Content-Type': 'application/json' }),
+                    body: JSON.stringify({ token: resetToken, password: getElement('resetPassword').value })
+                });
+                const result = await response.json();
+                showFieldErrors(resetForm, result.errors);
+                showResetMessage(result.message, response.ok ? 'green' : 'red');
+                if (response.ok) {
+                    resetForm.reset();
+                    setTimeout(() => { window.location.href = LOGIN_PAGE; }, REDIRECT_DELAY);
+                }
+            } catch (error) {
+                console.error('❌ Ошибка сети при сбросе пароля:', error);
+                showResetMessage('Произошла ошибка сети. Сервер недоступен.', 'red');
+            }
+        });
+    }
+
+    // ------------------------------------
+    // 2.2. Отмена смены email (undo-email.html)
+    // ------------------------------------
+    const undoEmailForm = getElement('undoEmailForm');
+    const undoEmailMessageElement = getElement('undoEmailMessage');
+
+    if (undoEmailForm) {
+        // Токен приходит в ссылке из уведомления на прежний адрес: /undo-email.html?token=...
+        const undoToken = new URLSearchParams(window.location.search).get('token');
+
+        undoEmailForm.addEventListener('submit', async (e) => {
+            e.preventDefault();
+            try {
+                const response = await fetch('/user/email/undo', {
+                    method: 'POST',
+                    headers: csrfHeaders({ 'Content-Type': 'application/json' }),
+                    body: JSON.stringify({ token: undoToken })
+                });
+                const result = await response.json();
+                undoEmailMessageElement.textContent = result.message;
+                undoEmailMessageElement.style.color = response.ok ? 'green' : 'red';
+                if (response.ok) undoEmailForm.style.display = 'none';
+            } catch (error) {
+                console.error('❌ Ошибка сети при отмене смены email:', error);
+                undoEmailMessageElement.textContent = 'Произошла ошибка сети. Сервер недоступен.';
+                undoEmailMessageElement.style.color = 'red';
+            }
+        });
+    }
+
     // ------------------------------------
     // 3. Загрузка данных профиля и обработка выхода
     // ------------------------------------
@@ -133,6 +318,7 @@ document.addEventListener('DOMContentLoaded', () => {
     const lastNameInput = getElement('lastName');
     const emailInput = getElement('email');
     const newPasswordInput = getElement('newPassword');
+    const currentPasswordInput = getElement('currentPassword'); // Нужен для смены email/пароля
     const userAvatarMain = getElement('userAvatarMain'); // Аватар в главной секции
     const photoUploadInput = getElement('photoUpload'); // Input для файла
     const displayUsernameMain = getElement('displayUsernameMain'); // Этих элементов нет в новой HTML, но оставляем на всякий случай
@@ -141,6 +327,7 @@ document.addEventListener('DOMContentLoaded', () => {
 
     // Проверяем, что мы на странице профиля
     if (displayUsernameElement) {
+        let currentUserId = null; // ID из /user, нужен для сетки постов
         // ✅ Функция для загрузки и обновления всех элементов
         async function loadUserProfile() {
             try {
@@ -168,8 +355,18 @@ document.addEventListener('DOMContentLoaded', () => {
                     if (emailInput) emailInput.value = result.email;
                     
                     // Обновляем аватары
-                    if (userAvatarElement && result.photo_url) userAvatarElement.src = result.photo_url;
-                    if (userAvatarMain && result.photo_url) userAvatarMain.src = result.photo_url;
+                    // Превью под размер аватара (56 и 112 px), для старых фото без превью - оригинал
+                    const variants = result.photo_variants || {};
+                    const smallAvatar = variants['64'] || result.photo_url;
+                    const mainAvatar = variants['320'] || result.photo_url;
+                    if (userAvatarElement && smallAvatar) userAvatarElement.src = smallAvatar;
+                    if (userAvatarMain && mainAvatar) userAvatarMain.src = mainAvatar;
+
+                    // Сетку постов загружаем один раз: после сохранения настроек она не меняется
+                    if (!currentUserId) {
+                        currentUserId = result.id;
+                        loadPosts(true);
+                    }
 
 
                     console.log(`👋 Пользователь авторизован: ${result.username}, Email: ${result.email}, Фото: ${result.photo_url || 'Нет'}`);
@@ -185,6 +382,16 @@ document.addEventListener('DOMContentLoaded', () => {
         
         loadUserProfile();
 
+        // Возврат после повторного входа у провайдера (?reauth=... или ?reauth_error=...)
+        const reauthParams = new URLSearchParams(window.location.search);
+        if (profileMessageElement && (reauthParams.get('reauth') || reauthParams.get('reauth_error'))) {
+            const ok = !!reauthParams.get('reauth');
+            profileMessageElement.textContent = ok
+                ? 'Личность подтверждена: в течение 10 минут можно менять email, пароль и другие настройки аккаунта'
+                : `Ошибка: ${reauthParams.get('reauth_error')}`;
+            profileMessageElement.style.color = ok ? 'green' : 'red';
+        }
+
         // =======================================================================
         // ✅ 4. ПРЕДВАРИТЕЛЬНЫЙ ПРОСМОТР ФОТО
         // =======================================================================
@@ -239,6 +446,11 @@ document.addEventListener('DOMContentLoaded', () => {
                     formData.append('new_password', newPasswordInput.value);
                 }
 
+                // Текущий пароль подтверждает смену email или пароля
+                if (currentPasswordInput && currentPasswordInput.value) {
+                    formData.append('current_password', currentPasswordInput.value);
+                }
+
                 // Добавляем файл фото, если он выбран
                 const photoFile = getElement('photoUpload').files[0];
                 if (photoFile) {
@@ -254,10 +466,12 @@ document.addEventListener('DOMContentLoaded', () => {
                     const response = await fetch('/user/update', {
                         method: 'POST',
                         // НЕ устанавливаем Content-Type, чтобы браузер использовал multipart/form-data
+                        headers: csrfHeaders(),
                         body: formData 
                     });
 
                     const result = await response.json();
+                    showFieldErrors(profileSettingsForm, result.errors);
 
                     if (response.ok) {
                         if (profileMessageElement) {
@@ -265,6 +479,7 @@ document.addEventListener('DOMContentLoaded', () => {
                              profileMessageElement.style.color = 'green';
                         }
                         newPasswordInput.value = ''; // Очищаем поле пароля
+                        if (currentPasswordInput) currentPasswordInput.value = '';
 
                         // Если email изменился, перезагружаем страницу, чтобы обновить куку и данные
                         if (result.new_email && result.new_email !== emailInput.value) {
@@ -276,6 +491,7 @@ document.addEventListener('DOMContentLoaded', () => {
                         }
                     } else {
                         console.error('❌ Ошибка сохранения:', result.message);
+                        offerOIDCReauth(result);
                         if (profileMessageElement) {
                              profileMessageElement.textContent = `Ошибка: ${result.message || 'Не удалось сохранить настройки'}`;
                              profileMessageElement.style.color = 'red';
@@ -292,11 +508,212 @@ document.addEventListener('DOMContentLoaded', () => {
         }
 
 
+        // =======================================================================
+        // Публикации: сетка постов постранично, создание, изменение подписи и удаление
+        // =======================================================================
+        const newPostForm = getElement('newPostForm');
+        const postsGrid = getElement('postsGrid');
+        const postsEmpty = getElement('postsEmpty');
+        const postsMessage = getElement('postsMessage');
+        const loadMorePostsBtn = getElement('loadMorePostsBtn');
+        let postsCursor = '';
+
+        const showPostsMessage = (text, ok) => {
+            if (!postsMessage) return;
+            postsMessage.textContent = text || '';
+            postsMessage.style.color = ok ? 'green' : 'red';
+        };
+
+        const postTile = (post) => {
+            const tile = document.createElement('div');
+            tile.className = 'relative group';
+            tile.dataset.postId = post.id;
+
+            const img = document.createElement('img');
+            img.src = post.thumbnail_url;
+            img.alt = post.caption;
+            img.title = post.caption + (post.edited_at ? ' (изменено)' : '');
+            img.className = 'w-full aspect-square object-cover';
+            img.addEventListener('click', () => window.open(post.image_url, '_blank'));
+            tile.appendChild(img);
+
+            const actions = document.createElement('div');
+            actions.className = 'absolute top-1 right-1 hidden group-hover:flex gap-1';
+            const editBtn = document.createElement('button');
+            editBtn.type = 'button';
+            editBtn.className = 'bg-white/80 rounded px-2 text-sm';
+            editBtn.innerHTML = '<i class="fas fa-pen"></i>';
+            editBtn.addEventListener('click', () => editPost(post, img));
+            const deleteBtn = document.createElement('button');
+            deleteBtn.type = 'button';
+            deleteBtn.className = 'bg-white/80 rounded px-2 text-sm text-red-600';
+            deleteBtn.innerHTML = '<i class="fas fa-trash"></i>';
+            deleteBtn.addEventListener('click', () => deletePost(post, tile));
+            actions.append(editBtn, deleteBtn);
+            tile.appendChild(actions);
+            return tile;
+        };
+
+        const updatePostsEmpty = () => {
+            if (postsEmpty) postsEmpty.classList.toggle('hidden', postsGrid.children.length > 0);
+        };
+
+        // reset - загрузить сетку заново с первой страницы
+        async function loadPosts(reset) {
+            if (!postsGrid || !currentUserId) return;
+            if (reset) postsCursor = '';
+            try {
+                const params = new URLSearchParams({ limit: '12' });
+                if (postsCursor) params.set('cursor', postsCursor);
+                const response = await fetch(`/api/users/${encodeURIComponent(currentUserId)}/posts?${params}`);
+                const result = await response.json();
+                if (!response.ok) {
+                    showPostsMessage(result.message, false);
+                    return;
+                }
+                if (reset) postsGrid.innerHTML = '';
+                result.posts.forEach((post) => postsGrid.appendChild(postTile(post)));
+                postsCursor = result.next_cursor;
+                if (loadMorePostsBtn) loadMorePostsBtn.classList.toggle('hidden', !postsCursor);
+                updatePostsEmpty();
+            } catch (error) {
+                console.error('❌ Ошибка загрузки постов:', error);
+            }
+        }
+
+        async function editPost(post, img) {
+            const caption = prompt('Подпись к посту:', post.caption);
+            if (caption === null) return;
+            try {
+                const response = await fetch(`/api/posts/${post.id}`, {
+                    method: 'PATCH',
+                    headers: csrfHeaders({ 'Content-Type': 'application/json' }),
+                    body: JSON.stringify({ caption })
+                });
+                const result = await response.json();
+                showPostsMessage(result.message, response.ok);
+                if (response.ok) {
+                    Object.assign(post, result.post);
+                    img.alt = post.caption;
+                    img.title = post.caption + ' (изменено)';
+                }
+            } catch (error) {
+                console.error('❌ Ошибка сети при изменении поста:', error);
+            }
+        }
+
+        async function deletePost(post, tile) {
+            if (!confirm('Удалить пост?')) return;
+            try {
+                const response = await fetch(`/api/posts/${post.id}`, { method: 'DELETE', headers: csrfHeaders() });
+                const result = await response.json();
+                showPostsMessage(result.message, response.ok);
+                if (response.ok) {
+                    tile.remove();
+                    updatePostsEmpty();
+                }
+            } catch (error) {
+                console.error('❌ Ошибка сети при удалении поста:', error);
+            }
+        }
+
+        if (newPostForm) {
+            newPostForm.addEventListener('submit', async (e) => {
+                e.preventDefault();
+                showPostsMessage('Публикация...', true);
+                try {
+                    const response = await fetch('/api/posts', {
+                        method: 'POST',
+                        headers: csrfHeaders(),
+                        body: new FormData(newPostForm)
+                    });
+                    const result = await response.json();
+                    showFieldErrors(newPostForm, result.errors);
+                    showPostsMessage(result.message, response.ok);
+                    if (response.ok) {
+                        newPostForm.reset();
+                        postsGrid.prepend(postTile(result.post));
+                        updatePostsEmpty();
+                    }
+                } catch (error) {
+                    console.error('❌ Ошибка сети при публикации:', error);
+                    showPostsMessage('Произошла ошибка сети. Сервер недоступен.', false);
+                }
+            });
+        }
+
+        if (loadMorePostsBtn) {
+            loadMorePostsBtn.addEventListener('click', () => loadPosts(false));
+        }
+
         // Обработка выхода (Без изменений)
+        // Деактивация и удаление аккаунта: оба действия требуют текущего пароля
+        const accountAction = async (url, body) => {
+            try {
+                const response = await fetch(url, {
+                    method: 'POST',
+                    headers: csrfHeaders({ 'Content-Type': 'application/json' }),
+                    body: JSON.stringify({ current_password: currentPasswordInput ? currentPasswordInput.value : '', ...body })
+                });
+                const result = await response.json();
+                if (profileMessageElement) {
+                    profileMessageElement.textContent = result.message;
+                    profileMessageElement.style.color = response.ok ? 'green' : 'red';
+                }
+                offerOIDCReauth(result);
+                if (response.ok) {
+                    setTimeout(() => { window.location.href = LOGIN_PAGE; }, REDIRECT_DELAY * 3);
+                }
+            } catch (error) {
+                console.error('❌ Ошибка сети:', error);
+            }
+        };
+
+        // Выгрузка данных: архив собирается на сервере, ссылка на скачивание приходит письмом
+        const exportDataBtn = getElement('exportDataBtn');
+        if (exportDataBtn) {
+            exportDataBtn.addEventListener('click', async () => {
+                try {
+                    const response = await fetch('/user/export', {
+                        method: 'POST',
+                        headers: csrfHeaders({ 'Content-Type': 'application/json' }),
+                        body: JSON.stringify({ current_password: currentPasswordInput ? currentPasswordInput.value : '' })
+                    });
+                    const result = await response.json();
+                    if (profileMessageElement) {
+                        profileMessageElement.textContent = result.message;
+                        profileMessageElement.style.color = response.ok ? 'green' : 'red';
+                    }
+                    offerOIDCReauth(result);
+                } catch (error) {
+                    console.error('❌ Ошибка сети при заказе выгрузки:', error);
+                }
+            });
+        }
+
+        const deactivateAccountBtn = getElement('deactivateAccountBtn');
+        if (deactivateAccountBtn) {
+            deactivateAccountBtn.addEventListener('click', () => {
+                if (confirm('Деактивировать аккаунт? Его можно будет восстановить, войдя в течение 30 дней.')) {
+                    accountAction('/user/deactivate', {});
+                }
+            });
+        }
+
+        const deleteAccountBtn = getElement('deleteAccountBtn');
+        if (deleteAccountBtn) {
+            deleteAccountBtn.addEventListener('click', () => {
+                const handle = prompt('Удаление необратимо. Введите свой хендл для подтверждения:');
+                if (handle) {
+                    accountAction('/user/delete', { confirm: handle });
+                }
+            });
+        }
+
         if (logoutBtn) {
             logoutBtn.addEventListener('click', async () => {
                 try {
-                    const response = await fetch('/logout', { method: 'POST' });
+                    const response = await fetch('/logout', { method: 'POST', headers: csrfHeaders() });
                     
                     if (response.ok) {
                         console.log('🚪 Выход успешен. Перенаправление на вход.');
@@ -7,7 +7,14 @@ const sendBtn = document.getElementById("sendBtn");
 ws.onmessage = (event) => {
     const msg = JSON.parse(event.data);
 
+    // Пользователь удалил или деактивировал аккаунт: убираем его сообщения
+    if (msg.type === "user_removed") {
+        chatBox.querySelectorAll(`[data-user-id="${msg.user_id}"]`).forEach((el) => el.remove());
+        return;
+    }
+
     const el = document.createElement("div");
+    el.dataset.userId = msg.user_id;
     el.classList.add("flex", "items-center", "gap-2", "mb-2");
     el.innerHTML = `
         <img src="${msg.photo_url}" alt="avatar" class="w-8 h-8 rounded-full">
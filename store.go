@@ -0,0 +1,768 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// --- Ошибки Хранилища ---
+
+var (
+	// ErrUserNotFound возвращается, если пользователь с указанным ключом отсутствует.
+	ErrUserNotFound = errors.New("пользователь не найден")
+	// ErrUserExists возвращается при попытке занять уже используемый email.
+	ErrUserExists = errors.New("пользователь уже существует")
+	// ErrIdentityLinked возвращается, если внешний аккаунт уже привязан к другому пользователю.
+	ErrIdentityLinked = errors.New("внешний аккаунт уже привязан к другому пользователю")
+)
+
+// --- Интерфейс Репозитория ---
+
+// UserStore описывает хранилище пользователей. Обработчики и чат работают только через него,
+// поэтому реализацию (диск или память) можно подменить в initStorage().
+// Первичный ключ - неизменяемый UserData.ID, email - изменяемый уникальный атрибут.
+type UserStore interface {
+	// Create добавляет нового пользователя. Возвращает ErrUserExists, если email занят,
+	// и ErrHandleTaken, если занят хендл.
+	Create(user UserData) error
+	// GetByID ищет пользователя по ID.
+	GetByID(id string) (UserData, error)
+	// GetByEmail ищет пользователя по email.
+	GetByEmail(email string) (UserData, error)
+	// GetByHandle ищет пользователя по текущему (не зарезервированному) хендлу.
+	GetByHandle(handle string) (UserData, error)
+	// GetByIdentity ищет пользователя по привязанному внешнему аккаунту (провайдер OIDC и sub).
+	GetByIdentity(provider, subject string) (UserData, error)
+	// HandleAvailable сообщает, может ли пользователь userID занять хендл
+	// (пустой userID - проверка для нового пользователя).
+	HandleAvailable(handle, userID string) (bool, error)
+	// Update перезаписывает данные пользователя (поиск по user.ID). Если email изменился,
+	// проверяет, что новый адрес свободен, иначе возвращает ErrUserExists. Если изменился хендл,
+	// проверяет его занятость (ErrHandleTaken) и резервирует старый хендл за пользователем.
+	// Новые внешние аккаунты не должны быть привязаны к другим пользователям (ErrIdentityLinked).
+	Update(user UserData) error
+	// Modify атомарно читает пользователя по ID, применяет к нему fn и сохраняет результат с теми же
+	// проверками, что и Update. Если fn вернула ошибку, ничего не сохраняется и ошибка возвращается.
+	// Нужен там, где решение зависит от текущего состояния (одноразовые коды 2FA), и для смены
+	// учетных данных: запись целиком через Update затерла бы параллельное изменение профиля.
+	Modify(id string, fn func(user *UserData) error) (UserData, error)
+	// Delete удаляет пользователя по ID вместе с его хендлами, в том числе зарезервированными.
+	Delete(id string) error
+	// List возвращает всех пользователей, отсортированных по email.
+	List() ([]UserData, error)
+}
+
+// userStore - активное хранилище пользователей, инициализируется в initStorage().
+var userStore UserStore
+
+// --- Инициализация ---
+
+// initStorage создает все хранилища согласно storageKind и возвращает функцию для их закрытия.
+func initStorage() func() {
+	if storageKind == "memory" {
+		log.Printf("⚠️ Используется хранилище в памяти: данные пропадут после перезапуска.")
+		userStore = newMemoryUserStore()
+		sessionStore = newMemorySessionStore()
+		oneTimeTokenStore = newMemoryOneTimeTokenStore()
+		apiTokenStore = newMemoryAPITokenStore()
+		mediaStore = newMemoryMediaStore()
+		resumableUploadStore = newMemoryResumableUploadStore()
+		postStore = newMemoryPostStore()
+		return func() {}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
+		log.Fatalf("❌ Не удалось создать директорию базы данных: %v", err)
+	}
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		log.Fatalf("❌ Не удалось открыть базу данных %s: %v", dbPath, err)
+	}
+
+	if userStore, err = newBoltUserStore(db); err != nil {
+		log.Fatalf("❌ Не удалось инициализировать хранилище пользователей: %v", err)
+	}
+	if sessionStore, err = newBoltSessionStore(db); err != nil {
+		log.Fatalf("❌ Не удалось инициализировать хранилище сессий: %v", err)
+	}
+	if oneTimeTokenStore, err = newBoltOneTimeTokenStore(db); err != nil {
+		log.Fatalf("❌ Не удалось инициализировать хранилище одноразовых токенов: %v", err)
+	}
+	if apiTokenStore, err = newBoltAPITokenStore(db); err != nil {
+		log.Fatalf("❌ Не удалось инициализировать хранилище API-токенов: %v", err)
+	}
+	if mediaStore, err = newBoltMediaStore(db); err != nil {
+		log.Fatalf("❌ Не удалось инициализировать учет медиафайлов: %v", err)
+	}
+	if resumableUploadStore, err = newBoltResumableUploadStore(db); err != nil {
+		log.Fatalf("❌ Не удалось инициализировать хранилище загрузок: %v", err)
+	}
+	if postStore, err = newBoltPostStore(db); err != nil {
+		log.Fatalf("❌ Не удалось инициализировать хранилище постов: %v", err)
+	}
+
+	log.Printf("💾 База данных: %s", dbPath)
+	return func() { db.Close() }
+}
+
+// =======================================================================
+// Хранилище в памяти (для тестов и локальной отладки)
+// =======================================================================
+
+// memoryUserStore хранит пользователей в карте [id]UserData с индексами [email]id, [handle]handleEntry
+// и [provider:sub]id.
+type memoryUserStore struct {
+	mu         sync.Mutex
+	users      map[string]UserData
+	byEmail    map[string]string
+	handles    map[string]handleEntry
+	identities map[string]string
+}
+
+// newMemoryUserStore создает пустое хранилище в памяти.
+func newMemoryUserStore() *memoryUserStore {
+	return &memoryUserStore{
+		users:      make(map[string]UserData),
+		byEmail:    make(map[string]string),
+		handles:    make(map[string]handleEntry),
+		identities: make(map[string]string),
+	}
+}
+
+func (s *memoryUserStore) Create(user UserData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.byEmail[user.Email]; exists {
+		return ErrUserExists
+	}
+	if _, exists := s.users[user.ID]; exists {
+		return ErrUserExists
+	}
+	if entry, exists := s.handles[user.Handle]; exists && entry.blocks(user.ID, time.Now()) {
+		return ErrHandleTaken
+	}
+	for _, key := range user.identityKeys() {
+		if _, linked := s.identities[key]; linked {
+			return ErrIdentityLinked
+		}
+	}
+	s.users[user.ID] = user
+	s.byEmail[user.Email] = user.ID
+	s.handles[user.Handle] = handleEntry{UserID: user.ID}
+	for _, key := range user.identityKeys() {
+		s.identities[key] = user.ID
+	}
+	return nil
+}
+
+func (s *memoryUserStore) GetByIdentity(provider, subject string) (UserData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, exists := s.identities[identityKey(provider, subject)]
+	if !exists {
+		return UserData{}, ErrUserNotFound
+	}
+	return s.users[id], nil
+}
+
+func (s *memoryUserStore) GetByHandle(handle string) (UserData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, exists := s.handles[handle]
+	if !exists || !entry.active() {
+		return UserData{}, ErrUserNotFound
+	}
+	return s.users[entry.UserID], nil
+}
+
+func (s *memoryUserStore) HandleAvailable(handle, userID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, exists := s.handles[handle]
+	return !exists || !entry.blocks(userID, time.Now()), nil
+}
+
+func (s *memoryUserStore) GetByID(id string) (UserData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, exists := s.users[id]
+	if !exists {
+		return UserData{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (s *memoryUserStore) GetByEmail(email string) (UserData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, exists := s.byEmail[email]
+	if !exists {
+		return UserData{}, ErrUserNotFound
+	}
+	return s.users[id], nil
+}
+
+func (s *memoryUserStore) Update(user UserData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.update(user)
+}
+
+func (s *memoryUserStore) Modify(id string, fn func(user *UserData) error) (UserData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, exists := s.users[id]
+	if !exists {
+		return UserData{}, ErrUserNotFound
+	}
+	if err := fn(&user); err != nil {
+		return UserData{}, err
+	}
+	if err := s.update(user); err != nil {
+		return UserData{}, err
+	}
+	return user, nil
+}
+
+// update сохраняет пользователя с обновлением индексов. Вызывается под s.mu.
+func (s *memoryUserStore) update(user UserData) error {
+	old, exists := s.users[user.ID]
+	if !exists {
+		return ErrUserNotFound
+	}
+	if old.Email != user.Email {
+		if _, taken := s.byEmail[user.Email]; taken {
+			return ErrUserExists
+		}
+	}
+	if old.Handle != user.Handle {
+		if entry, exists := s.handles[user.Handle]; exists && entry.blocks(user.ID, time.Now()) {
+			return ErrHandleTaken
+		}
+	}
+	for _, key := range user.identityKeys() {
+		if id, linked := s.identities[key]; linked && id != user.ID {
+			return ErrIdentityLinked
+		}
+	}
+
+	if old.Email != user.Email {
+		delete(s.byEmail, old.Email)
+		s.byEmail[user.Email] = user.ID
+	}
+	if old.Handle != user.Handle {
+		s.handles[old.Handle] = handleEntry{UserID: user.ID, ReservedUntil: time.Now().Add(handleReservationPeriod)}
+		s.handles[user.Handle] = handleEntry{UserID: user.ID}
+	}
+	for _, key := range old.identityKeys() {
+		delete(s.identities, key)
+	}
+	for _, key := range user.identityKeys() {
+		s.identities[key] = user.ID
+	}
+	s.users[user.ID] = user
+	return nil
+}
+
+func (s *memoryUserStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, exists := s.users[id]
+	if !exists {
+		return ErrUserNotFound
+	}
+	delete(s.users, id)
+	delete(s.byEmail, user.Email)
+	// Вместе с текущим хендлом освобождаются и зарезервированные за пользователем
+	for handle, entry := range s.handles {
+		if entry.UserID == id {
+			delete(s.handles, handle)
+		}
+	}
+	for _, key := range user.identityKeys() {
+		delete(s.identities, key)
+	}
+	return nil
+}
+
+func (s *memoryUserStore) List() ([]UserData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]UserData, 0, len(s.users))
+	for _, user := range s.users {
+		list = append(list, user)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Email < list[j].Email })
+	return list, nil
+}
+
+// =======================================================================
+// Хранилище на диске (bbolt)
+// =======================================================================
+
+// createBuckets создает отсутствующие бакеты в базе.
+func createBuckets(db *bolt.DB, names ...[]byte) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, name := range names {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// boltPut сериализует значение в JSON и записывает его по ключу.
+func boltPut(b *bolt.Bucket, key string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
+
+// boltGet читает JSON по ключу. Возвращает false, если ключ отсутствует.
+func boltGet(b *bolt.Bucket, key string, value any) (bool, error) {
+	data := b.Get([]byte(key))
+	if data == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, value)
+}
+
+var (
+	// usersBucket: ID -> JSON UserData
+	usersBucket = []byte("users")
+	// userEmailsBucket: email -> ID (уникальный индекс)
+	userEmailsBucket = []byte("user_emails")
+	// userHandlesBucket: хендл -> JSON handleEntry (текущие и зарезервированные хендлы)
+	userHandlesBucket = []byte("user_handles")
+	// userIdentitiesBucket: provider:sub -> ID (привязанные внешние аккаунты)
+	userIdentitiesBucket = []byte("user_identities")
+)
+
+// boltUserStore хранит пользователей во встроенной базе bbolt.
+type boltUserStore struct {
+	db *bolt.DB
+}
+
+// newBoltUserStore создает (при необходимости) бакеты пользователей в открытой базе
+// и переносит записи старого формата: ключ - email вместо ID, отсутствие хендла.
+func newBoltUserStore(db *bolt.DB) (*boltUserStore, error) {
+	if err := createBuckets(db, usersBucket, userEmailsBucket, userHandlesBucket, userIdentitiesBucket); err != nil {
+		return nil, err
+	}
+	if err := db.Update(migrateUsersToIDs); err != nil {
+		return nil, err
+	}
+	if err := db.Update(migrateUserHandles); err != nil {
+		return nil, err
+	}
+	if err := db.Update(migrateUserEmailCase); err != nil {
+		return nil, err
+	}
+	return &boltUserStore{db: db}, nil
+}
+
+// migrateUsersToIDs выдает ID пользователям, сохраненным до появления ID, и строит индекс email.
+func migrateUsersToIDs(tx *bolt.Tx) error {
+	b := tx.Bucket(usersBucket)
+	emails := tx.Bucket(userEmailsBucket)
+
+	var legacy []UserData
+	err := b.ForEach(func(key, data []byte) error {
+		var user UserData
+		if err := json.Unmarshal(data, &user); err != nil {
+			return err
+		}
+		if user.ID == "" {
+			legacy = append(legacy, user)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, user := range legacy {
+		id, err := generateUserID()
+		if err != nil {
+			return err
+		}
+		if err := b.Delete([]byte(user.Email)); err != nil {
+			return err
+		}
+		user.ID = id
+		if err := boltPut(b, user.ID, user); err != nil {
+			return err
+		}
+		if err := emails.Put([]byte(user.Email), []byte(user.ID)); err != nil {
+			return err
+		}
+		log.Printf("🔁 Пользователю %s присвоен ID %s", user.Email, user.ID)
+	}
+	return nil
+}
+
+// migrateUserHandles выдает хендлы пользователям, созданным до их появления.
+func migrateUserHandles(tx *bolt.Tx) error {
+	b := tx.Bucket(usersBucket)
+	handles := tx.Bucket(userHandlesBucket)
+
+	var missing []UserData
+	err := b.ForEach(func(_, data []byte) error {
+		var user UserData
+		if err := json.Unmarshal(data, &user); err != nil {
+			return err
+		}
+		if user.Handle == "" {
+			missing = append(missing, user)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	taken := func(handle string) bool { return handles.Get([]byte(handle)) != nil }
+	for _, user := range missing {
+		handle, err := generateHandle(user.Username, taken)
+		if err != nil {
+			return err
+		}
+		user.Handle = handle
+		if err := boltPut(handles, handle, handleEntry{UserID: user.ID}); err != nil {
+			return err
+		}
+		if err := boltPut(b, user.ID, user); err != nil {
+			return err
+		}
+		log.Printf("🔁 Пользователю %s присвоен хендл @%s", user.Email, handle)
+	}
+	return nil
+}
+
+// migrateUserEmailCase приводит email пользователей и индекс email к нижнему регистру (normalizeEmail).
+// Если два аккаунта отличаются только регистром адреса, после миграции один из них стал бы
+// недоступен для входа, а объединять аккаунты автоматически нельзя. Поэтому миграция ничего не
+// меняет и возвращает ошибку со списком таких аккаунтов: сервер не запустится, пока администратор
+// не сменит email одного аккаунта из каждой пары (например, запустив предыдущую версию и войдя в него
+// по адресу с прежним регистром) или не удалит лишний аккаунт.
+func migrateUserEmailCase(tx *bolt.Tx) error {
+	b := tx.Bucket(usersBucket)
+	emails := tx.Bucket(userEmailsBucket)
+
+	var mixed []UserData
+	owners := map[string][]string{} // Нормализованный email -> исходные адреса с ID владельцев
+	err := b.ForEach(func(_, data []byte) error {
+		var user UserData
+		if err := json.Unmarshal(data, &user); err != nil {
+			return err
+		}
+		email := normalizeEmail(user.Email)
+		owners[email] = append(owners[email], fmt.Sprintf("%s (%s)", user.Email, user.ID))
+		if user.Email != email {
+			mixed = append(mixed, user)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var conflicts []string
+	for _, user := range mixed {
+		if list := owners[normalizeEmail(user.Email)]; len(list) > 1 {
+			conflicts = append(conflicts, strings.Join(list, " и "))
+			delete(owners, normalizeEmail(user.Email)) // Каждую группу - один раз
+		}
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return fmt.Errorf("email аккаунтов совпадают без учета регистра: %s; смените email одного из них "+
+			"или удалите лишний аккаунт и перезапустите сервер", strings.Join(conflicts, "; "))
+	}
+
+	for _, user := range mixed {
+		email := normalizeEmail(user.Email)
+		if err := emails.Delete([]byte(user.Email)); err != nil {
+			return err
+		}
+		if err := emails.Put([]byte(email), []byte(user.ID)); err != nil {
+			return err
+		}
+		user.Email = email
+		if err := boltPut(b, user.ID, user); err != nil {
+			return err
+		}
+		log.Printf("🔁 Email пользователя %s приведен к нижнему регистру", user.ID)
+	}
+	return nil
+}
+
+// handleBlocked проверяет в транзакции, мешает ли существующая запись пользователю занять хендл.
+func handleBlocked(handles *bolt.Bucket, handle, userID string) (bool, error) {
+	var entry handleEntry
+	found, err := boltGet(handles, handle, &entry)
+	if err != nil || !found {
+		return false, err
+	}
+	return entry.blocks(userID, time.Now()), nil
+}
+
+// getUser читает пользователя из бакета по ID.
+func getUser(b *bolt.Bucket, id string) (UserData, error) {
+	var user UserData
+	found, err := boltGet(b, id, &user)
+	if err == nil && !found {
+		err = ErrUserNotFound
+	}
+	return user, err
+}
+
+func (s *boltUserStore) Create(user UserData) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usersBucket)
+		emails := tx.Bucket(userEmailsBucket)
+		handles := tx.Bucket(userHandlesBucket)
+		if emails.Get([]byte(user.Email)) != nil || b.Get([]byte(user.ID)) != nil {
+			return ErrUserExists
+		}
+		if blocked, err := handleBlocked(handles, user.Handle, user.ID); err != nil {
+			return err
+		} else if blocked {
+			return ErrHandleTaken
+		}
+		if err := linkIdentities(tx.Bucket(userIdentitiesBucket), UserData{}, user); err != nil {
+			return err
+		}
+		if err := emails.Put([]byte(user.Email), []byte(user.ID)); err != nil {
+			return err
+		}
+		if err := boltPut(handles, user.Handle, handleEntry{UserID: user.ID}); err != nil {
+			return err
+		}
+		return boltPut(b, user.ID, user)
+	})
+}
+
+// linkIdentities приводит индекс внешних аккаунтов в соответствие с user (old - прежняя версия записи).
+func linkIdentities(identities *bolt.Bucket, old, user UserData) error {
+	for _, key := range user.identityKeys() {
+		if id := identities.Get([]byte(key)); id != nil && string(id) != user.ID {
+			return ErrIdentityLinked
+		}
+	}
+	for _, key := range old.identityKeys() {
+		if err := identities.Delete([]byte(key)); err != nil {
+			return err
+		}
+	}
+	for _, key := range user.identityKeys() {
+		if err := identities.Put([]byte(key), []byte(user.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *boltUserStore) GetByIdentity(provider, subject string) (UserData, error) {
+	var user UserData
+	err := s.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(userIdentitiesBucket).Get([]byte(identityKey(provider, subject)))
+		if id == nil {
+			return ErrUserNotFound
+		}
+		var err error
+		user, err = getUser(tx.Bucket(usersBucket), string(id))
+		return err
+	})
+	return user, err
+}
+
+func (s *boltUserStore) GetByHandle(handle string) (UserData, error) {
+	var user UserData
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var entry handleEntry
+		found, err := boltGet(tx.Bucket(userHandlesBucket), handle, &entry)
+		if err != nil {
+			return err
+		}
+		if !found || !entry.active() {
+			return ErrUserNotFound
+		}
+		user, err = getUser(tx.Bucket(usersBucket), entry.UserID)
+		return err
+	})
+	return user, err
+}
+
+func (s *boltUserStore) HandleAvailable(handle, userID string) (bool, error) {
+	var blocked bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		blocked, err = handleBlocked(tx.Bucket(userHandlesBucket), handle, userID)
+		return err
+	})
+	return !blocked, err
+}
+
+func (s *boltUserStore) GetByID(id string) (UserData, error) {
+	var user UserData
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		user, err = getUser(tx.Bucket(usersBucket), id)
+		return err
+	})
+	return user, err
+}
+
+func (s *boltUserStore) GetByEmail(email string) (UserData, error) {
+	var user UserData
+	err := s.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(userEmailsBucket).Get([]byte(email))
+		if id == nil {
+			return ErrUserNotFound
+		}
+		var err error
+		user, err = getUser(tx.Bucket(usersBucket), string(id))
+		return err
+	})
+	return user, err
+}
+
+func (s *boltUserStore) Update(user UserData) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return updateUser(tx, user)
+	})
+}
+
+func (s *boltUserStore) Modify(id string, fn func(user *UserData) error) (UserData, error) {
+	var user UserData
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if user, err = getUser(tx.Bucket(usersBucket), id); err != nil {
+			return err
+		}
+		if err := fn(&user); err != nil {
+			return err
+		}
+		return updateUser(tx, user)
+	})
+	if err != nil {
+		return UserData{}, err
+	}
+	return user, nil
+}
+
+// updateUser сохраняет пользователя в транзакции с проверками и обновлением индексов (см. UserStore.Update).
+func updateUser(tx *bolt.Tx, user UserData) error {
+	b := tx.Bucket(usersBucket)
+	emails := tx.Bucket(userEmailsBucket)
+	old, err := getUser(b, user.ID)
+	if err != nil {
+		return err
+	}
+	if old.Email != user.Email {
+		if emails.Get([]byte(user.Email)) != nil {
+			return ErrUserExists
+		}
+		if err := emails.Delete([]byte(old.Email)); err != nil {
+			return err
+		}
+		if err := emails.Put([]byte(user.Email), []byte(user.ID)); err != nil {
+			return err
+		}
+	}
+	if old.Handle != user.Handle {
+		handles := tx.Bucket(userHandlesBucket)
+		if blocked, err := handleBlocked(handles, user.Handle, user.ID); err != nil {
+			return err
+		} else if blocked {
+			return ErrHandleTaken
+		}
+		// Старый хендл остается за пользователем на время резерва
+		reserved := handleEntry{UserID: user.ID, ReservedUntil: time.Now().Add(handleReservationPeriod)}
+		if err := boltPut(handles, old.Handle, reserved); err != nil {
+			return err
+		}
+		if err := boltPut(handles, user.Handle, handleEntry{UserID: user.ID}); err != nil {
+			return err
+		}
+	}
+	if err := linkIdentities(tx.Bucket(userIdentitiesBucket), old, user); err != nil {
+		return err
+	}
+	return boltPut(b, user.ID, user)
+}
+
+func (s *boltUserStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usersBucket)
+		user, err := getUser(b, id)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(userEmailsBucket).Delete([]byte(user.Email)); err != nil {
+			return err
+		}
+		if err := deleteUserHandles(tx.Bucket(userHandlesBucket), id); err != nil {
+			return err
+		}
+		if err := linkIdentities(tx.Bucket(userIdentitiesBucket), user, UserData{ID: id}); err != nil {
+			return err
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+// deleteUserHandles удаляет из индекса текущий и зарезервированные хендлы пользователя userID.
+func deleteUserHandles(handles *bolt.Bucket, userID string) error {
+	var owned [][]byte
+	err := handles.ForEach(func(handle, data []byte) error {
+		var entry handleEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+		if entry.UserID == userID {
+			owned = append(owned, append([]byte(nil), handle...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, handle := range owned {
+		if err := handles.Delete(handle); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *boltUserStore) List() ([]UserData, error) {
+	list := make([]UserData, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usersBucket)
+		// Обходим индекс email, чтобы порядок совпадал с memoryUserStore
+		return tx.Bucket(userEmailsBucket).ForEach(func(_, id []byte) error {
+			user, err := getUser(b, string(id))
+			if err != nil {
+				return err
+			}
+			list = append(list, user)
+			return nil
+		})
+	})
+	return list, err
+}
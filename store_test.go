@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// userStoreCases - реализации UserStore, которые должны вести себя одинаково.
+func userStoreCases() map[string]func(t *testing.T) UserStore {
+	return map[string]func(t *testing.T) UserStore{
+		"memory": func(t *testing.T) UserStore { return newMemoryUserStore() },
+		"bolt": func(t *testing.T) UserStore {
+			store, err := newBoltUserStore(openTestDB(t))
+			if err != nil {
+				t.Fatalf("создание хранилища: %v", err)
+			}
+			return store
+		},
+	}
+}
+
+func TestUserStoreIndexes(t *testing.T) {
+	for name, newStore := range userStoreCases() {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			alice := UserData{ID: "alice-id", Email: "alice@example.com", Handle: "alice",
+				Identities: []ExternalIdentity{{Provider: "google", Subject: "g-1"}}}
+			if err := store.Create(alice); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+
+			conflicts := []struct {
+				name string
+				user UserData
+				want error
+			}{
+				{"тот же email", UserData{ID: "bob-id", Email: "alice@example.com", Handle: "bob"}, ErrUserExists},
+				{"тот же ID", UserData{ID: "alice-id", Email: "other@example.com", Handle: "other"}, ErrUserExists},
+				{"тот же хендл", UserData{ID: "bob-id", Email: "bob@example.com", Handle: "alice"}, ErrHandleTaken},
+				{"тот же внешний аккаунт", UserData{ID: "bob-id", Email: "bob@example.com", Handle: "bob",
+					Identities: []ExternalIdentity{{Provider: "google", Subject: "g-1"}}}, ErrIdentityLinked},
+			}
+			for _, tc := range conflicts {
+				if err := store.Create(tc.user); err != tc.want {
+					t.Errorf("Create (%s) = %v, ожидалось %v", tc.name, err, tc.want)
+				}
+			}
+
+			lookups := []struct {
+				name string
+				get  func() (UserData, error)
+			}{
+				{"GetByID", func() (UserData, error) { return store.GetByID("alice-id") }},
+				{"GetByEmail", func() (UserData, error) { return store.GetByEmail("alice@example.com") }},
+				{"GetByHandle", func() (UserData, error) { return store.GetByHandle("alice") }},
+				{"GetByIdentity", func() (UserData, error) { return store.GetByIdentity("google", "g-1") }},
+			}
+			for _, tc := range lookups {
+				if user, err := tc.get(); err != nil || user.ID != "alice-id" {
+					t.Errorf("%s = %q, %v", tc.name, user.ID, err)
+				}
+			}
+
+			// Смена email и внешнего аккаунта переносит индексы
+			alice.Email = "alice@new.example.com"
+			alice.Identities = []ExternalIdentity{{Provider: "github", Subject: "gh-1"}}
+			if err := store.Update(alice); err != nil {
+				t.Fatalf("Update: %v", err)
+			}
+			if _, err := store.GetByEmail("alice@example.com"); err != ErrUserNotFound {
+				t.Errorf("старый email находится: %v", err)
+			}
+			if _, err := store.GetByIdentity("google", "g-1"); err != ErrUserNotFound {
+				t.Errorf("отвязанный аккаунт находится: %v", err)
+			}
+			if user, err := store.GetByIdentity("github", "gh-1"); err != nil || user.ID != "alice-id" {
+				t.Errorf("GetByIdentity после Update = %q, %v", user.ID, err)
+			}
+
+			// Освободившийся email может занять другой пользователь, занятый - нет
+			bob := UserData{ID: "bob-id", Email: "alice@example.com", Handle: "bob"}
+			if err := store.Create(bob); err != nil {
+				t.Fatalf("Create на освободившийся email: %v", err)
+			}
+			bob.Email = "alice@new.example.com"
+			if err := store.Update(bob); err != ErrUserExists {
+				t.Errorf("Update на занятый email = %v, ожидалось %v", err, ErrUserExists)
+			}
+			bob.Email = "bob@example.com"
+			bob.Identities = []ExternalIdentity{{Provider: "github", Subject: "gh-1"}}
+			if err := store.Update(bob); err != ErrIdentityLinked {
+				t.Errorf("Update с чужим внешним аккаунтом = %v, ожидалось %v", err, ErrIdentityLinked)
+			}
+
+			users, err := store.List()
+			if err != nil || len(users) != 2 || users[0].Email != "alice@example.com" {
+				t.Errorf("List = %v, %v (ожидались 2 пользователя по email)", users, err)
+			}
+
+			if err := store.Delete("alice-id"); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if _, err := store.GetByID("alice-id"); err != ErrUserNotFound {
+				t.Errorf("GetByID после Delete: %v", err)
+			}
+			if _, err := store.GetByEmail("alice@new.example.com"); err != ErrUserNotFound {
+				t.Errorf("GetByEmail после Delete: %v", err)
+			}
+			if _, err := store.GetByIdentity("github", "gh-1"); err != ErrUserNotFound {
+				t.Errorf("GetByIdentity после Delete: %v", err)
+			}
+			if err := store.Delete("alice-id"); err != ErrUserNotFound {
+				t.Errorf("повторный Delete = %v, ожидалось %v", err, ErrUserNotFound)
+			}
+		})
+	}
+}
+
+func TestUserStoreHandleReservation(t *testing.T) {
+	for name, newStore := range userStoreCases() {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			alice := UserData{ID: "alice-id", Email: "alice@example.com", Handle: "alice"}
+			if err := store.Create(alice); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+			alice.Handle = "alice2"
+			if err := store.Update(alice); err != nil {
+				t.Fatalf("смена хендла: %v", err)
+			}
+
+			// Старый хендл зарезервирован за владельцем: по нему не ищут, другим он не доступен
+			if _, err := store.GetByHandle("alice"); err != ErrUserNotFound {
+				t.Errorf("GetByHandle по зарезервированному хендлу: %v", err)
+			}
+			availability := []struct {
+				handle, userID string
+				want           bool
+			}{
+				{"alice", "", false},
+				{"alice", "bob-id", false},
+				{"alice", "alice-id", true},
+				{"alice2", "bob-id", false},
+				{"free", "bob-id", true},
+			}
+			for _, tc := range availability {
+				if got, err := store.HandleAvailable(tc.handle, tc.userID); err != nil || got != tc.want {
+					t.Errorf("HandleAvailable(%q, %q) = %v, %v, ожидалось %v", tc.handle, tc.userID, got, err, tc.want)
+				}
+			}
+			if err := store.Create(UserData{ID: "bob-id", Email: "bob@example.com", Handle: "alice"}); err != ErrHandleTaken {
+				t.Errorf("Create с зарезервированным хендлом = %v, ожидалось %v", err, ErrHandleTaken)
+			}
+
+			// Владелец может вернуть себе старый хендл
+			alice.Handle = "alice"
+			if err := store.Update(alice); err != nil {
+				t.Fatalf("возврат хендла: %v", err)
+			}
+			if user, err := store.GetByHandle("alice"); err != nil || user.ID != "alice-id" {
+				t.Errorf("GetByHandle после возврата = %q, %v", user.ID, err)
+			}
+
+			// Удаление освобождает и текущий, и зарезервированные хендлы
+			if err := store.Delete("alice-id"); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			for _, handle := range []string{"alice", "alice2"} {
+				if got, err := store.HandleAvailable(handle, "bob-id"); err != nil || !got {
+					t.Errorf("HandleAvailable(%q) после Delete = %v, %v", handle, got, err)
+				}
+			}
+		})
+	}
+}
+
+func TestUserStoreModify(t *testing.T) {
+	for name, newStore := range userStoreCases() {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			if err := store.Create(UserData{ID: "alice-id", Email: "alice@example.com", Handle: "alice"}); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+
+			updated, err := store.Modify("alice-id", func(user *UserData) error {
+				user.Username = "Alice"
+				return nil
+			})
+			if err != nil || updated.Username != "Alice" {
+				t.Fatalf("Modify = %+v, %v", updated, err)
+			}
+
+			// Ошибка fn отменяет изменение
+			_, err = store.Modify("alice-id", func(user *UserData) error {
+				user.Username = "Mallory"
+				return errSecondFactorInvalid
+			})
+			if err != errSecondFactorInvalid {
+				t.Errorf("Modify с ошибкой fn = %v", err)
+			}
+			if user, _ := store.GetByID("alice-id"); user.Username != "Alice" {
+				t.Errorf("после ошибки fn сохранено имя %q", user.Username)
+			}
+			if _, err := store.Modify("missing", func(*UserData) error { return nil }); err != ErrUserNotFound {
+				t.Errorf("Modify несуществующего = %v", err)
+			}
+		})
+	}
+}
+
+func TestHandleEntryBlocks(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		entry  handleEntry
+		userID string
+		want   bool
+	}{
+		{"чужой текущий хендл", handleEntry{UserID: "a"}, "b", true},
+		{"свой текущий хендл", handleEntry{UserID: "a"}, "a", false},
+		{"чужой резерв действует", handleEntry{UserID: "a", ReservedUntil: now.Add(time.Hour)}, "b", true},
+		{"чужой резерв истек", handleEntry{UserID: "a", ReservedUntil: now.Add(-time.Second)}, "b", false},
+		{"свой резерв", handleEntry{UserID: "a", ReservedUntil: now.Add(time.Hour)}, "a", false},
+		{"новый пользователь", handleEntry{UserID: "a", ReservedUntil: now.Add(time.Hour)}, "", true},
+	}
+	for _, tc := range tests {
+		if got := tc.entry.blocks(tc.userID, now); got != tc.want {
+			t.Errorf("%s: blocks = %v, ожидалось %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestChangeHandleCooldown(t *testing.T) {
+	useMemoryStores()
+	tests := []struct {
+		name      string
+		changedAt time.Time
+		want      int
+	}{
+		{"недавняя смена", time.Now().Add(-time.Hour), http.StatusTooManyRequests},
+		{"кулдаун прошел", time.Now().Add(-handleChangeCooldown - time.Minute), http.StatusOK},
+		{"хендл не менялся", time.Time{}, http.StatusOK},
+	}
+	for i, tc := range tests {
+		id := fmt.Sprintf("user-%d", i)
+		user := UserData{ID: id, Email: id + "@example.com", Handle: fmt.Sprintf("user_%d", i), HandleChangedAt: tc.changedAt}
+		if err := userStore.Create(user); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+
+		body := strings.NewReader(fmt.Sprintf(`{"handle": "renamed_%d"}`, i))
+		req := httptest.NewRequest(http.MethodPost, "/user/handle", body)
+		req = req.WithContext(context.WithValue(req.Context(), userContextKey, id))
+		rec := httptest.NewRecorder()
+		changeHandleHandler(rec, req)
+
+		if rec.Code != tc.want {
+			t.Errorf("%s: статус %d, ожидался %d (%s)", tc.name, rec.Code, tc.want, rec.Body)
+		}
+	}
+}
+
+func TestMigrateUserEmailCase(t *testing.T) {
+	tests := []struct {
+		name      string
+		users     []UserData
+		wantErr   bool
+		wantEmail map[string]string // ID -> email после миграции
+	}{
+		{
+			name: "адреса без конфликтов",
+			users: []UserData{
+				{ID: "alice-id", Email: "Alice@Example.com", Handle: "alice"},
+				{ID: "bob-id", Email: "bob@example.com", Handle: "bob"},
+			},
+			wantEmail: map[string]string{"alice-id": "alice@example.com", "bob-id": "bob@example.com"},
+		},
+		{
+			name: "адреса совпадают без учета регистра",
+			users: []UserData{
+				{ID: "alice-id", Email: "alice@example.com", Handle: "alice"},
+				{ID: "alice2-id", Email: "Alice@example.com", Handle: "alice2"},
+				{ID: "bob-id", Email: "Bob@example.com", Handle: "bob"},
+			},
+			wantErr:   true,
+			wantEmail: map[string]string{"alice2-id": "Alice@example.com", "bob-id": "Bob@example.com"},
+		},
+	}
+	for _, tc := range tests {
+		db := openTestDB(t)
+		store, err := newBoltUserStore(db)
+		if err != nil {
+			t.Fatalf("%s: newBoltUserStore: %v", tc.name, err)
+		}
+		for _, user := range tc.users {
+			if err := store.Create(user); err != nil {
+				t.Fatalf("%s: Create: %v", tc.name, err)
+			}
+		}
+
+		// Повторное открытие запускает миграцию; при конфликте база остается нетронутой
+		_, err = newBoltUserStore(db)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: миграция = %v, ожидалась ошибка: %v", tc.name, err, tc.wantErr)
+		}
+		if err != nil && (!strings.Contains(err.Error(), "alice2-id") || strings.Contains(err.Error(), "bob-id")) {
+			t.Errorf("%s: в ошибке нет конфликтующих аккаунтов: %v", tc.name, err)
+		}
+		for id, want := range tc.wantEmail {
+			if user, err := store.GetByID(id); err != nil || user.Email != want {
+				t.Errorf("%s: email %s = %q, %v, ожидалось %q", tc.name, id, user.Email, err, want)
+			}
+		}
+	}
+}
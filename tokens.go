@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// --- Подписанные Токены ---
+
+// ErrInvalidToken возвращается для поддельных, испорченных, чужих или просроченных токенов.
+var ErrInvalidToken = errors.New("недействительный или просроченный токен")
+
+// appSecret - ключ HMAC для подписи токенов, загружается в initAppSecret().
+var appSecret []byte
+
+// signedToken - содержимое подписанного токена. Purpose не дает использовать токен
+// одного назначения (например, подтверждение email) в другом месте.
+type signedToken struct {
+	Purpose string `json:"p"`
+	UserID  string `json:"sub"`
+	Email   string `json:"email,omitempty"`
+	Expires int64  `json:"exp"`
+}
+
+// initAppSecret берет секрет из APP_SECRET или из файла appSecretPath, создавая его при первом запуске,
+// чтобы выданные ссылки оставались действительными после перезапуска сервера.
+func initAppSecret() {
+	if secret := getEnv("APP_SECRET", ""); secret != "" {
+		appSecret = []byte(secret)
+		return
+	}
+
+	if data, err := os.ReadFile(appSecretPath); err == nil {
+		if appSecret, err = hex.DecodeString(strings.TrimSpace(string(data))); err == nil && len(appSecret) >= 32 {
+			return
+		}
+		log.Fatalf("❌ Файл секрета %s поврежден", appSecretPath)
+	}
+
+	appSecret = make([]byte, 32)
+	if _, err := rand.Read(appSecret); err != nil {
+		log.Fatalf("❌ Не удалось сгенерировать секрет: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(appSecretPath), 0755); err != nil {
+		log.Fatalf("❌ Не удалось создать директорию для секрета: %v", err)
+	}
+	if err := os.WriteFile(appSecretPath, []byte(hex.EncodeToString(appSecret)), 0600); err != nil {
+		log.Fatalf("❌ Не удалось сохранить секрет: %v", err)
+	}
+	log.Printf("🔑 Создан новый секрет для подписи токенов: %s", appSecretPath)
+}
+
+// tokenMAC вычисляет подпись содержимого токена.
+func tokenMAC(payload []byte) []byte {
+	mac := hmac.New(sha256.New, appSecret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// signToken выпускает токен вида base64(payload).base64(hmac) со сроком действия ttl.
+func signToken(purpose, userID, email string, ttl time.Duration) (string, error) {
+	payload, err := json.Marshal(signedToken{
+		Purpose: purpose,
+		UserID:  userID,
+		Email:   email,
+		Expires: time.Now().Add(ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(tokenMAC(payload)), nil
+}
+
+// verifyToken проверяет подпись, назначение и срок действия токена.
+func verifyToken(purpose, token string) (signedToken, error) {
+	var claims signedToken
+
+	encodedPayload, encodedMAC, ok := strings.Cut(token, ".")
+	if !ok {
+		return claims, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return claims, ErrInvalidToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(encodedMAC)
+	if err != nil || !hmac.Equal(mac, tokenMAC(payload)) {
+		return claims, ErrInvalidToken
+	}
+
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, ErrInvalidToken
+	}
+	if claims.Purpose != purpose || time.Now().Unix() >= claims.Expires {
+		return claims, ErrInvalidToken
+	}
+	return claims, nil
+}
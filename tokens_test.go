@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerifyToken(t *testing.T) {
+	valid, err := signToken("verify_email", "alice-id", "alice@example.com", time.Hour)
+	if err != nil {
+		t.Fatalf("signToken: %v", err)
+	}
+	expired, _ := signToken("verify_email", "alice-id", "alice@example.com", -time.Second)
+	payload, mac, _ := strings.Cut(valid, ".")
+	forgedPayload := base64.RawURLEncoding.EncodeToString([]byte(`{"p":"verify_email","sub":"mallory-id","exp":9999999999}`))
+
+	tests := []struct {
+		name    string
+		purpose string
+		token   string
+		wantErr bool
+	}{
+		{"действующий", "verify_email", valid, false},
+		{"другое назначение", "password_reset", valid, true},
+		{"просроченный", "verify_email", expired, true},
+		{"подмененное содержимое", "verify_email", forgedPayload + "." + mac, true},
+		{"испорченная подпись", "verify_email", payload + "." + mac[:len(mac)-2] + "AA", true},
+		{"без подписи", "verify_email", payload, true},
+		{"не base64", "verify_email", "!!!.???", true},
+		{"пустой", "verify_email", "", true},
+	}
+	for _, tc := range tests {
+		claims, err := verifyToken(tc.purpose, tc.token)
+		if tc.wantErr {
+			if err != ErrInvalidToken {
+				t.Errorf("%s: ошибка %v, ожидалась %v", tc.name, err, ErrInvalidToken)
+			}
+			continue
+		}
+		if err != nil || claims.UserID != "alice-id" || claims.Email != "alice@example.com" {
+			t.Errorf("%s: %+v, %v", tc.name, claims, err)
+		}
+	}
+
+	// Токен, подписанный другим секретом, недействителен
+	secret := appSecret
+	appSecret = []byte("another-secret-another-secret-000")
+	_, err = verifyToken("verify_email", valid)
+	appSecret = secret
+	if err != ErrInvalidToken {
+		t.Errorf("токен с чужим секретом: %v", err)
+	}
+}
+
+// oneTimeTokenStoreCases - реализации OneTimeTokenStore, которые должны вести себя одинаково.
+func oneTimeTokenStoreCases() map[string]func(t *testing.T) OneTimeTokenStore {
+	return map[string]func(t *testing.T) OneTimeTokenStore{
+		"memory": func(t *testing.T) OneTimeTokenStore { return newMemoryOneTimeTokenStore() },
+		"bolt": func(t *testing.T) OneTimeTokenStore {
+			store, err := newBoltOneTimeTokenStore(openTestDB(t))
+			if err != nil {
+				t.Fatalf("создание хранилища: %v", err)
+			}
+			return store
+		},
+	}
+}
+
+func TestOneTimeTokens(t *testing.T) {
+	alice := UserData{ID: "alice-id", Email: "alice@example.com"}
+	for name, newStore := range oneTimeTokenStoreCases() {
+		t.Run(name, func(t *testing.T) {
+			oneTimeTokenStore = newStore(t)
+
+			token, err := issueOneTimeToken(passwordResetPurpose, alice, time.Hour)
+			if err != nil {
+				t.Fatalf("issueOneTimeToken: %v", err)
+			}
+			expired, _ := issueOneTimeToken(passwordResetPurpose, alice, -time.Second)
+			revoked, _ := issueOneTimeToken(passwordResetPurpose, alice, time.Hour)
+			otherPurpose, _ := issueOneTimeToken(emailChangeUndoPurpose, alice, time.Hour)
+
+			if _, err := lookupOneTimeToken(passwordResetPurpose, token); err != nil {
+				t.Errorf("lookupOneTimeToken: %v", err)
+			}
+			if err := oneTimeTokenStore.DeleteForUser(passwordResetPurpose, "alice-id"); err != nil {
+				t.Fatalf("DeleteForUser: %v", err)
+			}
+			// DeleteForUser гасит все ссылки назначения: выпускаем рабочую заново
+			token, _ = issueOneTimeToken(passwordResetPurpose, alice, time.Hour)
+
+			tests := []struct {
+				name    string
+				purpose string
+				token   string
+				wantErr bool
+			}{
+				{"чужое назначение", emailChangeUndoPurpose, token, true},
+				{"действующий", passwordResetPurpose, token, false},
+				{"повторное погашение", passwordResetPurpose, token, true},
+				{"просроченный", passwordResetPurpose, expired, true},
+				{"погашенный DeleteForUser", passwordResetPurpose, revoked, true},
+				{"другое назначение не затронуто", emailChangeUndoPurpose, otherPurpose, false},
+				{"пустой", passwordResetPurpose, "", true},
+				{"неизвестный", passwordResetPurpose, "unknown", true},
+			}
+			for _, tc := range tests {
+				record, err := consumeOneTimeToken(tc.purpose, tc.token)
+				if tc.wantErr {
+					if err != ErrInvalidToken {
+						t.Errorf("%s: ошибка %v, ожидалась %v", tc.name, err, ErrInvalidToken)
+					}
+					continue
+				}
+				if err != nil || record.UserID != "alice-id" || record.Email != "alice@example.com" {
+					t.Errorf("%s: %+v, %v", tc.name, record, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// --- Двухфакторная Аутентификация (TOTP, RFC 6238) ---
+
+const (
+	totpIssuer = "Clone Instagram"
+	totpDigits = 6
+	totpPeriod = 30 // секунд
+	// totpSkew - сколько соседних интервалов принимаем из-за расхождения часов телефона.
+	totpSkew = 1
+	// recoveryCodeCount - сколько одноразовых кодов восстановления выдается пользователю.
+	recoveryCodeCount = 10
+	// loginChallengePurpose - назначение подписанного токена второго шага входа.
+	loginChallengePurpose = "login_2fa"
+	// loginChallengeTTL - сколько есть времени на ввод кода после пароля.
+	loginChallengeTTL = 5 * time.Minute
+)
+
+// base32NoPad - кодировка секретов, которую понимают приложения-аутентификаторы.
+var base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateTOTPSecret создает новый 160-битный секрет в base32.
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32NoPad.EncodeToString(b), nil
+}
+
+// totpCode вычисляет код для номера интервала step (RFC 4226, HMAC-SHA1).
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// validateTOTP проверяет код и возвращает номер совпавшего интервала. Интервалы не новее
+// lastStep отклоняются, чтобы один и тот же код нельзя было использовать дважды.
+func validateTOTP(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	key, err := base32NoPad.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI строит otpauth:// ссылку для приложения-аутентификатора.
+func totpURI(user UserData, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + user.Email)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// normalizeRecoveryCode убирает дефисы и пробелы, чтобы код можно было вводить в любом виде.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// generateRecoveryCodes создает коды восстановления: сами коды показываются пользователю один раз,
+// а в UserData сохраняются только их хеши.
+func generateRecoveryCodes() (codes []string, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(base32NoPad.EncodeToString(b)) // 8 символов
+		code := raw[:4] + "-" + raw[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashToken(normalizeRecoveryCode(code)))
+	}
+	return codes, hashes, nil
+}
+
+// verifySecondFactor проверяет TOTP-код или код восстановления. При успехе возвращает
+// обновленного пользователя (последний интервал TOTP или погашенный код), которого нужно сохранить
+// в той же операции хранилища, что и чтение (см. consumeSecondFactor).
+func verifySecondFactor(user UserData, code string) (UserData, bool) {
+	code = strings.TrimSpace(code)
+	if step, ok := validateTOTP(user.TOTPSecret, code, user.TOTPLastStep, time.Now()); ok {
+		user.TOTPLastStep = step
+		return user, true
+	}
+
+	hash := hashToken(normalizeRecoveryCode(code))
+	for i, stored := range user.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+			// Код восстановления одноразовый
+			user.RecoveryCodes = append(append([]string{}, user.RecoveryCodes[:i]...), user.RecoveryCodes[i+1:]...)
+			log.Printf("🔑 Пользователь %s вошел по коду восстановления (осталось %d)", user.ID, len(user.RecoveryCodes))
+			return user, true
+		}
+	}
+	return user, false
+}
+
+var (
+	// errSecondFactorInvalid возвращается consumeSecondFactor, если код не подошел или уже использован.
+	errSecondFactorInvalid = errors.New("неверный код 2FA")
+	// errTwoFactorChanged возвращается, если настройки 2FA изменил параллельный запрос
+	// между проверкой и сохранением.
+	errTwoFactorChanged = errors.New("Настройки двухфакторной аутентификации изменились, повторите попытку")
+)
+
+// writeTwoFactorChanged отвечает 409 на errTwoFactorChanged.
+func writeTwoFactorChanged(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]string{"message": errTwoFactorChanged.Error(), "status": "error"})
+}
+
+// consumeSecondFactor проверяет код и гасит его (интервал TOTP или код восстановления) одним
+// изменением в хранилище: два параллельных запроса с одним кодом не пройдут оба. email - адрес
+// из токена первого шага: если он с тех пор сменился, код не принимается.
+func consumeSecondFactor(userID, email, code string) (UserData, error) {
+	return userStore.Modify(userID, func(user *UserData) error {
+		if !user.TOTPEnabled || user.Email != email {
+			return errSecondFactorInvalid
+		}
+		updated, ok := verifySecondFactor(*user, code)
+		if !ok {
+			return errSecondFactorInvalid
+		}
+		*user = updated
+		return nil
+	})
+}
+
+// =======================================================================
+// Второй шаг входа
+// =======================================================================
+
+// loginTwoFactorHandler завершает вход кодом из приложения: POST /login/2fa {"challenge": "...", "code": "123456"}
+func loginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Допустим только метод POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	var body struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Неверный формат JSON в теле запроса", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := verifyToken(loginChallengePurpose, body.Challenge)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Время на ввод кода истекло, войдите заново", "status": "error", "restart": "login"})
+		return
+	}
+
+	userData, err := userStore.GetByID(claims.UserID)
+	if err != nil || !userData.TOTPEnabled || userData.Email != claims.Email {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Время на ввод кода истекло, войдите заново", "status": "error", "restart": "login"})
+		return
+	}
+
+	failureKey := "account:" + userData.ID
+	if !checkFailures(w, twoFactorFailures, failureKey) {
+		return
+	}
+
+	updated, err := consumeSecondFactor(userData.ID, claims.Email, body.Code)
+	if err == errSecondFactorInvalid || err == ErrUserNotFound {
+		log.Printf("❌ Неверный код 2FA для %s", userData.ID)
+		recordFailures(r, twoFactorFailures, failureKey)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Неверный код", "status": "error"})
+		return
+	} else if err != nil {
+		log.Printf("❌ Ошибка сохранения состояния 2FA: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	resetFailures(twoFactorFailures, failureKey)
+
+	if updated, err = reactivateAccount(r, updated); err == ErrAccountDeleted {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Аккаунт удален", "status": "error"})
+		return
+	} else if err != nil {
+		log.Printf("❌ Ошибка восстановления аккаунта %s: %v", updated.ID, err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := startSession(w, r, updated.ID); err != nil {
+		log.Printf("❌ Ошибка создания сессии для %s: %v", updated.ID, err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("✅ Успешный вход пользователя %s с 2FA", updated.Username)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":                  "Вход выполнен успешно!",
+		"status":                   "success",
+		"recovery_codes_remaining": len(updated.RecoveryCodes),
+	})
+}
+
+// =======================================================================
+// Управление 2FA (/user/2fa/...)
+// =======================================================================
+
+// twoFactorRequest - тело запросов управления 2FA: пароль для подтверждения личности и/или код.
+type twoFactorRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+// decodeTwoFactorRequest читает тело запроса; пустое тело допустимо (например, в sudo-окне).
+func decodeTwoFactorRequest(r *http.Request) (twoFactorRequest, error) {
+	var body twoFactorRequest
+	if r.ContentLength == 0 {
+		return body, nil
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	return body, err
+}
+
+// twoFactorSetupHandler создает новый (еще не активный) секрет: POST /user/2fa/setup {"password": "..."}
+func twoFactorSetupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Допустим только метод POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Context().Value(userContextKey).(string)
+	body, err := decodeTwoFactorRequest(r)
+	if err != nil {
+		http.Error(w, "Неверный формат JSON в теле запроса", http.StatusBadRequest)
+		return
+	}
+
+	userData, err := userStore.GetByID(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Пользователь не найден", "status": "error"})
+		return
+	}
+	if !reauthenticated(r, userData, body.Password) {
+		writeReauthRequired(w, userData, "Введите текущий пароль")
+		return
+	}
+	if userData.TOTPEnabled {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Двухфакторная аутентификация уже включена", "status": "error"})
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		log.Printf("❌ Ошибка генерации секрета TOTP: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	userData, err = userStore.Modify(userID, func(user *UserData) error {
+		if user.TOTPEnabled {
+			return errTwoFactorChanged
+		}
+		user.TOTPPendingSecret = secret
+		return nil
+	})
+	if err == errTwoFactorChanged {
+		writeTwoFactorChanged(w)
+		return
+	} else if err != nil {
+		log.Printf("❌ Ошибка сохранения секрета TOTP: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message":     "Отсканируйте QR-код и подтвердите кодом из приложения",
+		"secret":      secret,
+		"otpauth_uri": totpURI(userData, secret),
+		"qr_url":      "/user/2fa/qr",
+		"status":      "success",
+	})
+}
+
+// twoFactorQRHandler отдает QR-код (PNG) для секрета, созданного в /user/2fa/setup: GET /user/2fa/qr
+func twoFactorQRHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Допустим только метод GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value(userContextKey).(string)
+	userData, err := userStore.GetByID(userID)
+	if err != nil || userData.TOTPPendingSecret == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Сначала начните настройку 2FA", "status": "error"})
+		return
+	}
+
+	png, err := qrcode.Encode(totpURI(userData, userData.TOTPPendingSecret), qrcode.Medium, 256)
+	if err != nil {
+		log.Printf("❌ Ошибка генерации QR-кода: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	// QR содержит секрет - не кешируем
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(png)
+}
+
+// twoFactorEnableHandler подтверждает секрет кодом и включает 2FA: POST /user/2fa/enable {"code": "123456"}
+func twoFactorEnableHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Допустим только метод POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Context().Value(userContextKey).(string)
+	body, err := decodeTwoFactorRequest(r)
+	if err != nil {
+		http.Error(w, "Неверный формат JSON в теле запроса", http.StatusBadRequest)
+		return
+	}
+
+	userData, err := userStore.GetByID(userID)
+	if err != nil || userData.TOTPPendingSecret == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Сначала начните настройку 2FA", "status": "error"})
+		return
+	}
+
+	// Подбор кода ограничен так же, как на втором шаге входа
+	failureKey := "account:" + userData.ID
+	if !checkFailures(w, twoFactorFailures, failureKey) {
+		return
+	}
+	step, ok := validateTOTP(userData.TOTPPendingSecret, strings.TrimSpace(body.Code), 0, time.Now())
+	if !ok {
+		recordFailures(r, twoFactorFailures, failureKey)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Неверный код", "status": "error"})
+		return
+	}
+	resetFailures(twoFactorFailures, failureKey)
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		log.Printf("❌ Ошибка генерации кодов восстановления: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	// Включается именно проверенный секрет: параллельный /user/2fa/setup мог выдать новый
+	secret := userData.TOTPPendingSecret
+	_, err = userStore.Modify(userID, func(user *UserData) error {
+		if user.TOTPEnabled || user.TOTPPendingSecret != secret {
+			return errTwoFactorChanged
+		}
+		user.TOTPSecret = secret
+		user.TOTPPendingSecret = ""
+		user.TOTPEnabled = true
+		user.TOTPLastStep = step
+		user.RecoveryCodes = hashes
+		return nil
+	})
+	if err == errTwoFactorChanged {
+		writeTwoFactorChanged(w)
+		return
+	} else if err != nil {
+		log.Printf("❌ Ошибка включения 2FA: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🔐 Пользователь %s включил 2FA", userID)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":        "Двухфакторная аутентификация включена. Сохраните коды восстановления - они показываются один раз.",
+		"recovery_codes": codes,
+		"status":         "success",
+	})
+}
+
+// twoFactorDisableHandler выключает 2FA: POST /user/2fa/disable {"password": "...", "code": "123456"}
+// Нужны и пароль (или sudo-окно), и действующий код, чтобы одной украденной куки было недостаточно.
+func twoFactorDisableHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Допустим только метод POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Context().Value(userContextKey).(string)
+	body, err := decodeTwoFactorRequest(r)
+	if err != nil {
+		http.Error(w, "Неверный формат JSON в теле запроса", http.StatusBadRequest)
+		return
+	}
+
+	userData, err := userStore.GetByID(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Пользователь не найден", "status": "error"})
+		return
+	}
+	if !userData.TOTPEnabled {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Двухфакторная аутентификация не включена", "status": "error"})
+		return
+	}
+	failureKey := "account:" + userData.ID
+	if !checkFailures(w, twoFactorFailures, failureKey) {
+		return
+	}
+	if !reauthenticated(r, userData, body.Password) {
+		writeReauthRequired(w, userData, "Введите текущий пароль")
+		return
+	}
+	if _, ok := verifySecondFactor(userData, body.Code); !ok {
+		recordFailures(r, twoFactorFailures, failureKey)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Неверный код", "status": "error"})
+		return
+	}
+	resetFailures(twoFactorFailures, failureKey)
+
+	_, err = userStore.Modify(userID, func(user *UserData) error {
+		if !user.TOTPEnabled {
+			return errTwoFactorChanged
+		}
+		user.TOTPEnabled = false
+		user.TOTPSecret = ""
+		user.TOTPPendingSecret = ""
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = nil
+		return nil
+	})
+	if err == errTwoFactorChanged {
+		writeTwoFactorChanged(w)
+		return
+	} else if err != nil {
+		log.Printf("❌ Ошибка выключения 2FA: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🔓 Пользователь %s выключил 2FA", userID)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Двухфакторная аутентификация выключена", "status": "success"})
+}
+
+// recoveryCodesHandler выпускает новый набор кодов восстановления (старые перестают действовать):
+// POST /user/2fa/recovery-codes {"password": "..."}
+func recoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Допустим только метод POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Context().Value(userContextKey).(string)
+	body, err := decodeTwoFactorRequest(r)
+	if err != nil {
+		http.Error(w, "Неверный формат JSON в теле запроса", http.StatusBadRequest)
+		return
+	}
+
+	userData, err := userStore.GetByID(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Пользователь не найден", "status": "error"})
+		return
+	}
+	if !userData.TOTPEnabled {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Двухфакторная аутентификация не включена", "status": "error"})
+		return
+	}
+	if !reauthenticated(r, userData, body.Password) {
+		writeReauthRequired(w, userData, "Введите текущий пароль")
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		log.Printf("❌ Ошибка генерации кодов восстановления: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	_, err = userStore.Modify(userID, func(user *UserData) error {
+		if !user.TOTPEnabled {
+			return errTwoFactorChanged
+		}
+		user.RecoveryCodes = hashes
+		return nil
+	})
+	if err == errTwoFactorChanged {
+		writeTwoFactorChanged(w)
+		return
+	} else if err != nil {
+		log.Printf("❌ Ошибка сохранения кодов восстановления: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🔑 Пользователь %s перевыпустил коды восстановления", userID)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":        "Новые коды восстановления созданы, старые больше не действуют",
+		"recovery_codes": codes,
+		"status":         "success",
+	})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// codeAt возвращает TOTP-код секрета secret для момента t.
+func codeAt(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+	key, err := base32NoPad.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("секрет: %v", err)
+	}
+	return totpCode(key, at.Unix()/totpPeriod)
+}
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// Тестовые векторы RFC 6238 (приложение B, SHA-1), последние шесть цифр
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tc := range tests {
+		if got := totpCode(key, tc.unix/totpPeriod); got != tc.want {
+			t.Errorf("totpCode(%d) = %s, ожидалось %s", tc.unix, got, tc.want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatalf("generateTOTPSecret: %v", err)
+	}
+	now := time.Unix(1700000000, 0)
+	step := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		lastStep int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{"текущий интервал", secret, codeAt(t, secret, now), 0, step, true},
+		{"секрет в нижнем регистре", strings.ToLower(secret), codeAt(t, secret, now), 0, step, true},
+		{"предыдущий интервал", secret, codeAt(t, secret, now.Add(-totpPeriod*time.Second)), 0, step - 1, true},
+		{"следующий интервал", secret, codeAt(t, secret, now.Add(totpPeriod*time.Second)), 0, step + 1, true},
+		{"вне допуска часов", secret, codeAt(t, secret, now.Add(-2*totpPeriod*time.Second)), 0, 0, false},
+		{"повтор принятого кода", secret, codeAt(t, secret, now), step, 0, false},
+		{"более старый код после нового", secret, codeAt(t, secret, now.Add(-totpPeriod*time.Second)), step, 0, false},
+		{"неверная длина", secret, "12345", 0, 0, false},
+		{"испорченный секрет", "!!!", codeAt(t, secret, now), 0, 0, false},
+	}
+	for _, tc := range tests {
+		gotStep, ok := validateTOTP(tc.secret, tc.code, tc.lastStep, now)
+		if ok != tc.wantOK || gotStep != tc.wantStep {
+			t.Errorf("%s: validateTOTP = %d, %v, ожидалось %d, %v", tc.name, gotStep, ok, tc.wantStep, tc.wantOK)
+		}
+	}
+}
+
+func TestVerifySecondFactorRecoveryCodes(t *testing.T) {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil || len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("generateRecoveryCodes = %d кодов, %v", len(codes), err)
+	}
+	secret, _ := generateTOTPSecret()
+	user := UserData{ID: "alice-id", TOTPEnabled: true, TOTPSecret: secret, RecoveryCodes: hashes}
+
+	tests := []struct {
+		name      string
+		code      string
+		wantOK    bool
+		wantCodes int
+	}{
+		{"код как выдан", codes[0], true, recoveryCodeCount - 1},
+		{"повтор погашенного кода", codes[0], false, recoveryCodeCount - 1},
+		{"без дефиса и в верхнем регистре", strings.ToUpper(strings.ReplaceAll(codes[1], "-", "")), true, recoveryCodeCount - 2},
+		{"с пробелами", " " + strings.ReplaceAll(codes[2], "-", " ") + " ", true, recoveryCodeCount - 3},
+		{"неизвестный код", "aaaa-bbbb", false, recoveryCodeCount - 3},
+	}
+	for _, tc := range tests {
+		updated, ok := verifySecondFactor(user, tc.code)
+		if ok != tc.wantOK || len(updated.RecoveryCodes) != tc.wantCodes {
+			t.Errorf("%s: ok = %v, осталось кодов %d, ожидалось %v и %d", tc.name, ok, len(updated.RecoveryCodes), tc.wantOK, tc.wantCodes)
+		}
+		if ok {
+			user = updated
+		}
+	}
+	if len(hashes) != recoveryCodeCount || hashes[0] == "" {
+		t.Errorf("погашение изменило исходный срез кодов")
+	}
+}
+
+func TestConsumeSecondFactor(t *testing.T) {
+	useMemoryStores()
+	secret, _ := generateTOTPSecret()
+	codes, hashes, _ := generateRecoveryCodes()
+	user := UserData{ID: "alice-id", Email: "alice@example.com", Handle: "alice",
+		TOTPEnabled: true, TOTPSecret: secret, RecoveryCodes: hashes}
+	if err := userStore.Create(user); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := userStore.Create(UserData{ID: "bob-id", Email: "bob@example.com", Handle: "bob"}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	code := codeAt(t, secret, time.Now())
+
+	tests := []struct {
+		name    string
+		userID  string
+		email   string
+		code    string
+		wantErr error
+	}{
+		{"email сменился после первого шага", "alice-id", "old@example.com", code, errSecondFactorInvalid},
+		{"TOTP", "alice-id", "alice@example.com", code, nil},
+		{"повтор того же TOTP", "alice-id", "alice@example.com", code, errSecondFactorInvalid},
+		{"код восстановления", "alice-id", "alice@example.com", codes[0], nil},
+		{"повтор кода восстановления", "alice-id", "alice@example.com", codes[0], errSecondFactorInvalid},
+		{"2FA выключена", "bob-id", "bob@example.com", code, errSecondFactorInvalid},
+		{"нет пользователя", "missing", "alice@example.com", code, ErrUserNotFound},
+	}
+	for _, tc := range tests {
+		if _, err := consumeSecondFactor(tc.userID, tc.email, tc.code); err != tc.wantErr {
+			t.Errorf("%s: ошибка %v, ожидалась %v", tc.name, err, tc.wantErr)
+		}
+	}
+
+	stored, _ := userStore.GetByID("alice-id")
+	if stored.TOTPLastStep == 0 || len(stored.RecoveryCodes) != recoveryCodeCount-1 {
+		t.Errorf("в хранилище TOTPLastStep = %d, кодов %d", stored.TOTPLastStep, len(stored.RecoveryCodes))
+	}
+}
+
+func TestTwoFactorDisableLockout(t *testing.T) {
+	useMemoryStores()
+	secret, _ := generateTOTPSecret()
+	user := UserData{ID: "lockout-id", Email: "lockout@example.com", Handle: "lockout",
+		TOTPEnabled: true, TOTPSecret: secret}
+	if err := userStore.Create(user); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	// Открытое sudo-окно: пароль не нужен, проверяется только код
+	now := time.Now()
+	session := Session{ID: "lockout-session", UserID: user.ID, CreatedAt: now, LastSeen: now,
+		ExpiresAt: now.Add(sessionIdleTTL), SudoUntil: now.Add(sudoWindow)}
+	if err := sessionStore.Create(session); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	t.Cleanup(func() { twoFactorFailures.Reset("account:" + user.ID) })
+
+	disable := func(code string) int {
+		body := strings.NewReader(`{"code": "` + code + `"}`)
+		req := httptest.NewRequest(http.MethodPost, "/user/2fa/disable", body)
+		ctx := context.WithValue(req.Context(), userContextKey, user.ID)
+		req = req.WithContext(context.WithValue(ctx, sessionContextKey, session.ID))
+		rec := httptest.NewRecorder()
+		twoFactorDisableHandler(rec, req)
+		return rec.Code
+	}
+
+	// Неверные коды быстро упираются в паузу, после нее не принимается и верный код
+	locked := false
+	for i := 0; i < 10 && !locked; i++ {
+		locked = disable("000000") == http.StatusTooManyRequests
+	}
+	if !locked {
+		t.Fatalf("подбор кода не ограничен")
+	}
+	if code := disable(codeAt(t, secret, time.Now())); code != http.StatusTooManyRequests {
+		t.Errorf("верный код во время паузы: статус %d, ожидался 429", code)
+	}
+	if stored, _ := userStore.GetByID(user.ID); !stored.TOTPEnabled {
+		t.Errorf("2FA выключена во время паузы")
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	_ "golang.org/x/image/webp"
+)
+
+// --- Загрузка Фотографий Профиля ---
+
+const (
+	// maxImageSide и maxImagePixels ограничивают размеры картинки до декодирования,
+	// чтобы маленький файл не развернулся в гигабайты памяти.
+	maxImageSide   = 10000
+	maxImagePixels = 40_000_000
+	// maxImageFileSize - наибольший размер файла картинки. Обычные формы ограничены
+	// MAX_UPLOAD_SIZE на весь запрос, файлы больше загружаются по частям (/user/uploads).
+	maxImageFileSize = 32 << 20
+	// jpegQuality - качество при перекодировании JPEG.
+	jpegQuality = 90
+	// profilePhotoMaxSide - наибольшая сторона сохраняемого оригинала фото профиля.
+	profilePhotoMaxSide = 2048
+)
+
+// allowedImageTypes - допустимые форматы загрузок: MIME-тип по содержимому -> имя формата в image.Decode.
+var allowedImageTypes = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+}
+
+var (
+	// ErrUnsupportedImage возвращается, если файл не является изображением допустимого формата.
+	ErrUnsupportedImage = errors.New("Допустимы только изображения JPEG, PNG, GIF и WebP")
+	// ErrImageTooLarge возвращается для слишком больших файлов и изображений.
+	ErrImageTooLarge = errors.New("Изображение слишком большое")
+)
+
+// imageRejected сообщает, что загрузку отклонила проверка (ошибку можно показать пользователю).
+func imageRejected(err error) bool {
+	return errors.Is(err, ErrUnsupportedImage) || errors.Is(err, ErrImageTooLarge)
+}
+
+// uploadedImage - декодированная загрузка.
+type uploadedImage struct {
+	Image       image.Image // Как записана в файле, без поворота по EXIF (см. fitted)
+	Orientation int         // Тег Orientation из EXIF
+	Format      string      // Имя формата в image.Decode
+	TakenAt     time.Time   // Время съемки из EXIF (нулевое, если нет или keepCaptureTime выключен)
+}
+
+// fitted уменьшает картинку до maxSide и только затем поворачивает ее по EXIF: поворот
+// копирует все пиксели, и у картинки в десятки мегапикселей это сотни мегабайт памяти.
+func (u uploadedImage) fitted(maxSide int) image.Image {
+	return applyOrientation(fitImage(u.Image, maxSide), u.Orientation)
+}
+
+// decodeUpload проверяет загруженный файл и декодирует его: тип определяется по содержимому
+// и должен совпадать с форматом, который распознал декодер. Из EXIF сохраняется ориентация
+// (применяется в fitted), остальные метаданные отбрасываются.
+func decodeUpload(r io.Reader) (uploadedImage, error) {
+	raw, err := io.ReadAll(io.LimitReader(r, maxImageFileSize+1))
+	if err != nil {
+		return uploadedImage{}, err
+	}
+	if len(raw) > maxImageFileSize {
+		return uploadedImage{}, ErrImageTooLarge
+	}
+
+	format, allowed := allowedImageTypes[http.DetectContentType(raw)]
+	if !allowed {
+		return uploadedImage{}, ErrUnsupportedImage
+	}
+	config, decoded, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil || decoded != format {
+		return uploadedImage{}, ErrUnsupportedImage
+	}
+	if config.Width > maxImageSide || config.Height > maxImageSide || config.Width*config.Height > maxImagePixels {
+		return uploadedImage{}, ErrImageTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return uploadedImage{}, ErrUnsupportedImage
+	}
+
+	exif := readExif(raw, format)
+	upload := uploadedImage{Image: img, Orientation: exif.Orientation, Format: format}
+	if keepCaptureTime {
+		upload.TakenAt = exif.TakenAt
+	}
+	return upload, nil
+}
+
+// encodeImage заново кодирует декодированную картинку, поэтому в результат не попадают
+// посторонние данные (HTML, скрипты, EXIF с геопозицией и моделью камеры). JPEG остается JPEG, остальные форматы
+// сохраняются в PNG. Возвращает данные и расширение.
+func encodeImage(img image.Image, format string) ([]byte, string, error) {
+	var out bytes.Buffer
+	if format == "jpeg" {
+		err := jpeg.Encode(&out, img, &jpeg.Options{Quality: jpegQuality})
+		return out.Bytes(), ".jpg", err
+	}
+	err := png.Encode(&out, img)
+	return out.Bytes(), ".png", err
+}
+
+// profilePhoto - сохраненное фото профиля: перекодированный оригинал и квадратные превью.
+type profilePhoto struct {
+	Path     string
+	Variants map[int]string
+	TakenAt  time.Time
+}
+
+// files возвращает URL всех файлов фото.
+func (p profilePhoto) files() []string {
+	var files []string
+	if p.Path != "" {
+		files = append(files, p.Path)
+	}
+	for _, variant := range p.Variants {
+		files = append(files, variant)
+	}
+	return files
+}
+
+// saveProfilePhoto проверяет и перекодирует загруженное фото, уменьшает его до profilePhotoMaxSide,
+// сохраняет вместе с превью всех размеров из avatarSizes и добавляет ссылки на эти файлы (снимаются releaseMedia).
+// Ошибки проверки распознаются через imageRejected.
+func saveProfilePhoto(file io.Reader) (profilePhoto, error) {
+	upload, err := decodeUpload(file)
+	if err != nil {
+		return profilePhoto{}, err
+	}
+	img := upload.fitted(profilePhotoMaxSide)
+	data, ext, err := encodeImage(img, upload.Format)
+	if err != nil {
+		return profilePhoto{}, err
+	}
+	path, err := storeMedia(data, ext)
+	if err != nil {
+		return profilePhoto{}, err
+	}
+
+	variants, err := saveAvatarVariants(img)
+	if err != nil {
+		releaseMedia(path)
+		return profilePhoto{}, err
+	}
+	return profilePhoto{Path: path, Variants: variants, TakenAt: upload.TakenAt}, nil
+}
+
+// profilePhotoHandler заменяет только фото профиля: POST /user/photo (multipart, поле profile_photo).
+// В отличие от /user/update доступен и API-токенам с правом media:upload.
+func profilePhotoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Допустим только метод POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Context().Value(userContextKey).(string)
+
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_UPLOAD_SIZE)
+	if err := r.ParseMultipartForm(MAX_UPLOAD_SIZE); err != nil {
+		http.Error(w, "Слишком большой запрос", http.StatusBadRequest)
+		return
+	}
+	file, _, err := r.FormFile("profile_photo")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Не передан файл profile_photo", "status": "error"})
+		return
+	}
+	defer file.Close()
+
+	replaceProfilePhoto(w, r, userID, file)
+}
+
+// replaceProfilePhoto сохраняет file новым фото профиля пользователя userID и отвечает клиенту.
+// Общая часть /user/photo и завершения возобновляемой загрузки (finalizeResumableUpload).
+func replaceProfilePhoto(w http.ResponseWriter, r *http.Request, userID string, file io.Reader) {
+	lockUserStorage(userID)
+	defer unlockUserStorage(userID)
+
+	userData, err := userStore.GetByID(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Пользователь не найден", "status": "error"})
+		return
+	}
+
+	photo, err := saveProfilePhoto(file)
+	if imageRejected(err) {
+		writeFieldErrors(w, fieldErrors{"profile_photo": {err.Error()}})
+		return
+	} else if err != nil {
+		log.Printf("❌ Ошибка сохранения фото: %v", err)
+		http.Error(w, "Ошибка при обработке файла", http.StatusInternalServerError)
+		return
+	}
+
+	oldPhotoFiles := userData.photoFiles()
+	var quotaErr *QuotaExceededError
+	if err := checkStorageQuota(userData, oldPhotoFiles, photo.files()); errors.As(err, &quotaErr) {
+		releaseMedia(photo.files()...)
+		writeQuotaExceeded(w, "profile_photo", quotaErr)
+		return
+	} else if err != nil {
+		releaseMedia(photo.files()...)
+		log.Printf("❌ Ошибка проверки квоты: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	userData.setPhoto(photo)
+	if err := userStore.Update(userData); err != nil {
+		releaseMedia(photo.files()...)
+		log.Printf("❌ Ошибка сохранения профиля: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	releaseMedia(oldPhotoFiles...)
+
+	hub.profileUpdate <- userData.ID
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":        "Фото обновлено",
+		"photo_url":      userData.photoURL(requestedAvatarSize(r)),
+		"photo_variants": userData.PhotoVariants,
+		"status":         "success",
+	})
+}
+
+// uploadsHandler раздает загруженные файлы из хранилища: GET /uploads/{name}
+// Картинки отдаются как есть, все остальное (например, HTML из старых загрузок) - только
+// как вложение. Листинг папки не выдается. При BLOB_REDIRECT картинки отдаются редиректом
+// на подписанную ссылку хранилища.
+func uploadsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Допустимы только методы GET и HEAD", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := uploadKey(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if redirectUploads {
+		info, err := blobStore.Stat(key)
+		if errors.Is(err, ErrBlobNotFound) {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			log.Printf("❌ Ошибка чтения файла %s: %v", key, err)
+			http.Error(w, "Ошибка чтения файла", http.StatusInternalServerError)
+			return
+		}
+		if _, isImage := allowedImageTypes[info.ContentType]; isImage {
+			if signed, err := blobStore.SignedURL(key, blobRedirectTTL); err == nil {
+				http.Redirect(w, r, signed, http.StatusFound)
+				return
+			}
+		}
+	}
+
+	body, info, err := blobStore.Get(key)
+	if errors.Is(err, ErrBlobNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("❌ Ошибка чтения файла %s: %v", key, err)
+		http.Error(w, "Ошибка чтения файла", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	contentType := info.ContentType
+	disposition := "inline"
+	if _, allowed := allowedImageTypes[contentType]; !allowed {
+		contentType = "application/octet-stream"
+		disposition = "attachment"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": key}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	if seeker, ok := body.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, key, info.ModTime, seeker)
+		return
+	}
+	// Поток без перемотки (S3): без Range, но с кешированием по времени изменения
+	if !info.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+		if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !info.ModTime.Truncate(time.Second).After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	if info.Size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, body)
+}
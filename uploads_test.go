@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// testPNG возвращает PNG-картинку width x height.
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 13)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("png.Encode: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// testWebP - WebP 1x1 без потерь.
+const testWebP = "UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA=="
+
+func TestDecodeUpload(t *testing.T) {
+	pngData := testPNG(t, 8, 6)
+	var gifData bytes.Buffer
+	palette := color.Palette{color.Black, color.White}
+	if err := gif.Encode(&gifData, image.NewPaletted(image.Rect(0, 0, 4, 4), palette), nil); err != nil {
+		t.Fatalf("gif.Encode: %v", err)
+	}
+	webpData, _ := base64.StdEncoding.DecodeString(testWebP)
+	// PNG, в хвост которого дописан HTML: браузер, угадывающий тип, выполнил бы скрипт
+	polyglot := append(append([]byte{}, pngData...), []byte("<html><script>alert(document.cookie)</script></html>")...)
+	// Заголовок PNG с обрезанными данными
+	truncated := pngData[:40]
+	// Заголовок PNG, заявляющий картинку больше maxImageSide
+	huge := append([]byte{}, pngData[:33]...)
+	copy(huge[16:24], []byte{0, 0, 0x9c, 0x41, 0, 0, 0, 1}) // 40001 x 1
+	binary.BigEndian.PutUint32(huge[29:33], crc32.ChecksumIEEE(huge[12:29]))
+
+	tests := []struct {
+		name       string
+		data       []byte
+		wantErr    error
+		wantFormat string
+		wantExt    string
+	}{
+		{"PNG", pngData, nil, "png", ".png"},
+		{"GIF перекодируется в PNG", gifData.Bytes(), nil, "gif", ".png"},
+		{"WebP перекодируется в PNG", webpData, nil, "webp", ".png"},
+		{"HTML-файл", []byte("<!DOCTYPE html><html><script>alert(1)</script></html>"), ErrUnsupportedImage, "", ""},
+		{"SVG со скриптом", []byte(`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`), ErrUnsupportedImage, "", ""},
+		{"полиглот HTML/PNG", polyglot, nil, "png", ".png"},
+		{"обрезанный PNG", truncated, ErrUnsupportedImage, "", ""},
+		{"слишком большая сторона", huge, ErrImageTooLarge, "", ""},
+		{"пустой файл", nil, ErrUnsupportedImage, "", ""},
+	}
+	for _, tc := range tests {
+		upload, err := decodeUpload(bytes.NewReader(tc.data))
+		if err != tc.wantErr {
+			t.Errorf("%s: ошибка %v, ожидалась %v", tc.name, err, tc.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if upload.Format != tc.wantFormat {
+			t.Errorf("%s: формат %q, ожидался %q", tc.name, upload.Format, tc.wantFormat)
+		}
+		encoded, ext, err := encodeImage(upload.Image, upload.Format)
+		if err != nil || ext != tc.wantExt {
+			t.Errorf("%s: encodeImage = %q, %v, ожидалось %q", tc.name, ext, err, tc.wantExt)
+			continue
+		}
+		if http.DetectContentType(encoded) != "image/png" {
+			t.Errorf("%s: результат определяется как %q", tc.name, http.DetectContentType(encoded))
+		}
+		if bytes.Contains(encoded, []byte("<script")) {
+			t.Errorf("%s: HTML остался в перекодированном файле", tc.name)
+		}
+	}
+}
+
+// photoUploadRequest - POST /user/photo с файлом data, отправленным под именем filename и типом contentType.
+func photoUploadRequest(t *testing.T, userID, filename, contentType string, data []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="profile_photo"; filename="`+filename+`"`)
+	header.Set("Content-Type", contentType)
+	part, err := form.CreatePart(header)
+	if err != nil {
+		t.Fatalf("CreatePart: %v", err)
+	}
+	part.Write(data)
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/user/photo", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req.WithContext(context.WithValue(req.Context(), userContextKey, userID))
+}
+
+func TestProfilePhotoIgnoresClaimedType(t *testing.T) {
+	useMemoryStores()
+	useTestMedia(t, newMemoryMediaStore())
+	userStore.Create(UserData{ID: "alice-id", Email: "alice@example.com", Handle: "alice"})
+
+	tests := []struct {
+		name        string
+		filename    string
+		contentType string
+		data        []byte
+		wantStatus  int
+	}{
+		{"картинка под именем .html", "evil.html", "text/html", testPNG(t, 8, 8), http.StatusOK},
+		{"HTML под именем .png", "photo.png", "image/png", []byte("<html><script>alert(1)</script></html>"), http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		rec := httptest.NewRecorder()
+		profilePhotoHandler(rec, photoUploadRequest(t, "alice-id", tc.filename, tc.contentType, tc.data))
+		if rec.Code != tc.wantStatus {
+			t.Errorf("%s: статус %d, ожидался %d (%s)", tc.name, rec.Code, tc.wantStatus, rec.Body)
+			continue
+		}
+		if tc.wantStatus != http.StatusOK {
+			continue
+		}
+		stored, _ := userStore.GetByID("alice-id")
+		if !strings.HasSuffix(stored.PhotoPath, ".png") || strings.Contains(stored.PhotoPath, "evil") {
+			t.Errorf("%s: фото сохранено как %q", tc.name, stored.PhotoPath)
+		}
+		var resp map[string]interface{}
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if resp["status"] != "success" {
+			t.Errorf("%s: ответ %v", tc.name, resp)
+		}
+	}
+}
+
+func TestUploadsHandlerHeaders(t *testing.T) {
+	useTestMedia(t, newMemoryMediaStore())
+	pngData := testPNG(t, 4, 4)
+	html := []byte("<html><script>alert(1)</script></html>")
+	blobStore.Put("photo.png", bytes.NewReader(pngData), int64(len(pngData)), "image/png")
+	blobStore.Put("legacy.html", bytes.NewReader(html), int64(len(html)), "text/html")
+
+	tests := []struct {
+		name            string
+		method          string
+		path            string
+		wantStatus      int
+		wantType        string
+		wantDisposition string
+	}{
+		{"картинка", http.MethodGet, "/uploads/photo.png", http.StatusOK, "image/png", "inline"},
+		{"HTML из старых загрузок", http.MethodGet, "/uploads/legacy.html", http.StatusOK, "application/octet-stream", "attachment"},
+		{"HEAD", http.MethodHead, "/uploads/photo.png", http.StatusOK, "image/png", "inline"},
+		{"листинг папки", http.MethodGet, "/uploads/", http.StatusNotFound, "", ""},
+		{"выход из папки", http.MethodGet, "/uploads/../main.go", http.StatusNotFound, "", ""},
+		{"вложенный путь", http.MethodGet, "/uploads/sub/photo.png", http.StatusNotFound, "", ""},
+		{"нет файла", http.MethodGet, "/uploads/missing.png", http.StatusNotFound, "", ""},
+		{"запись", http.MethodPost, "/uploads/photo.png", http.StatusMethodNotAllowed, "", ""},
+	}
+	for _, tc := range tests {
+		rec := httptest.NewRecorder()
+		uploadsHandler(rec, httptest.NewRequest(tc.method, tc.path, nil))
+		if rec.Code != tc.wantStatus {
+			t.Errorf("%s: статус %d, ожидался %d", tc.name, rec.Code, tc.wantStatus)
+			continue
+		}
+		if tc.wantStatus != http.StatusOK {
+			continue
+		}
+		header := rec.Header()
+		if header.Get("Content-Type") != tc.wantType || !strings.HasPrefix(header.Get("Content-Disposition"), tc.wantDisposition+";") {
+			t.Errorf("%s: Content-Type %q, Content-Disposition %q", tc.name, header.Get("Content-Type"), header.Get("Content-Disposition"))
+		}
+		if header.Get("X-Content-Type-Options") != "nosniff" || !strings.Contains(header.Get("Content-Security-Policy"), "sandbox") {
+			t.Errorf("%s: нет nosniff или sandbox: %v", tc.name, header)
+		}
+	}
+}
+
+func TestUploadFitted(t *testing.T) {
+	red := color.RGBA{R: 255, A: 255}
+	tests := []struct {
+		name        string
+		img         image.Image
+		orientation int
+		maxSide     int
+		wantW       int
+		wantH       int
+		wantRedAt   image.Point // Где после поворота оказалась левая (красная) полоса
+	}{
+		{"без поворота", stripes(900, 300), 1, 300, 300, 100, image.Pt(10, 50)},
+		{"поворот на 90 после уменьшения", stripes(900, 300), 6, 300, 100, 300, image.Pt(50, 10)},
+		{"поворот на 90 против часовой", stripes(900, 300), 8, 300, 100, 300, image.Pt(50, 290)},
+		{"маленькая картинка не увеличивается", stripes(90, 30), 3, 300, 90, 30, image.Pt(80, 15)},
+	}
+	for _, tc := range tests {
+		got := uploadedImage{Image: tc.img, Orientation: tc.orientation}.fitted(tc.maxSide)
+		bounds := got.Bounds()
+		if bounds.Dx() != tc.wantW || bounds.Dy() != tc.wantH {
+			t.Errorf("%s: размер %dx%d, ожидался %dx%d", tc.name, bounds.Dx(), bounds.Dy(), tc.wantW, tc.wantH)
+			continue
+		}
+		if c := got.At(bounds.Min.X+tc.wantRedAt.X, bounds.Min.Y+tc.wantRedAt.Y); !nearlyEqual(c, red) {
+			t.Errorf("%s: пиксель %v = %v, ожидалась красная полоса", tc.name, tc.wantRedAt, c)
+		}
+	}
+}
+
+func TestSaveProfilePhotoFitsOriginal(t *testing.T) {
+	useTestMedia(t, newMemoryMediaStore())
+
+	photo, err := saveProfilePhoto(bytes.NewReader(testPNG(t, profilePhotoMaxSide*2, 100)))
+	if err != nil {
+		t.Fatalf("saveProfilePhoto: %v", err)
+	}
+	key, _ := uploadKey(photo.Path)
+	body, _, err := blobStore.Get(key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer body.Close()
+	config, err := png.DecodeConfig(body)
+	if err != nil || config.Width != profilePhotoMaxSide || config.Height != 50 {
+		t.Errorf("оригинал %dx%d (%v), ожидался %dx50", config.Width, config.Height, err, profilePhotoMaxSide)
+	}
+}
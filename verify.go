@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// --- Подтверждение Email ---
+
+const (
+	// emailVerifyPurpose - назначение подписанного токена подтверждения email.
+	emailVerifyPurpose = "verify_email"
+	// emailVerifyTTL - срок действия ссылки подтверждения.
+	emailVerifyTTL = 48 * time.Hour
+)
+
+// normalizeEmail приводит адрес к каноническому виду: без пробелов по краям и в нижнем регистре.
+// Так email хранится в профиле и индексе, поэтому Foo@x.com и foo@x.com - один аккаунт.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// validateEmail проверяет, что строка - это голый адрес вида user@host (без имени и переводов строк).
+func validateEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return errors.New("Некорректный email")
+	}
+	return nil
+}
+
+// sendVerificationEmail отправляет пользователю ссылку для подтверждения его текущего email.
+func sendVerificationEmail(user UserData) error {
+	token, err := signToken(emailVerifyPurpose, user.ID, user.Email, emailVerifyTTL)
+	if err != nil {
+		return err
+	}
+	link := fmt.Sprintf("%s/verify-email?token=%s", appBaseURL, url.QueryEscape(token))
+
+	sendMailAsync(MailMessage{
+		To:      user.Email,
+		Subject: "Подтвердите email",
+		Body: fmt.Sprintf("Здравствуйте, %s!\n\n"+
+			"Чтобы подтвердить адрес %s, перейдите по ссылке:\n%s\n\n"+
+			"Ссылка действительна %d часов. Если вы не регистрировались, просто проигнорируйте это письмо.\n",
+			user.Username, user.Email, link, int(emailVerifyTTL.Hours())),
+	})
+	return nil
+}
+
+// =======================================================================
+// Обработчики API подтверждения email
+// =======================================================================
+
+// verifyEmailHandler подтверждает email по токену из письма: GET /verify-email?token=...
+func verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Допустимы только методы GET и POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	claims, err := verifyToken(emailVerifyPurpose, r.FormValue("token"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Ссылка недействительна или устарела", "status": "error"})
+		return
+	}
+
+	userData, err := userStore.GetByID(claims.UserID)
+	// Токен выдан для конкретного адреса: после смены email старая ссылка не подходит
+	if err != nil || userData.Email != claims.Email {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Ссылка недействительна или устарела", "status": "error"})
+		return
+	}
+
+	if !userData.EmailVerified {
+		userData.EmailVerified = true
+		if err := userStore.Update(userData); err != nil {
+			log.Printf("❌ Ошибка сохранения подтверждения email: %v", err)
+			http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("✅ Email %s подтвержден", userData.Email)
+		// Обновляем данные в чате: подтвержденный пользователь может писать сообщения
+		hub.profileUpdate <- userData.ID
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Email подтвержден", "status": "success"})
+}
+
+// resendVerificationHandler повторно отправляет письмо с подтверждением: POST /verify-email/resend
+func resendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Допустим только метод POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Context().Value(userContextKey).(string)
+	userData, err := userStore.GetByID(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Пользователь не найден", "status": "error"})
+		return
+	}
+
+	if userData.EmailVerified {
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Email уже подтвержден", "status": "success"})
+		return
+	}
+
+	if err := sendVerificationEmail(userData); err != nil {
+		log.Printf("❌ Ошибка отправки подтверждения: %v", err)
+		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Письмо с подтверждением отправлено", "status": "success"})
+}